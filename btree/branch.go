@@ -106,10 +106,52 @@ func (b *Branch) Insert(slotId int, key []byte, pageId disk.PageId) error {
 	return nil
 }
 
+func (b *Branch) Remove(slotId int) {
+	b.body.Remove(slotId)
+}
+
+func (b *Branch) SetKeyAt(slotId int, key []byte) error {
+	pair := Pair{Key: key, Value: b.PairAt(slotId).Value}
+	pairBytes := pair.ToBytes()
+	if len(pairBytes) > b.MaxPairSize() {
+		return ErrTooLongData
+	}
+	if err := b.body.Resize(slotId, len(pairBytes)); err != nil {
+		return err
+	}
+	b.body.WriteData(slotId, pairBytes)
+	return nil
+}
+
+func (b *Branch) RightChild() disk.PageId {
+	return b.header.rightChild
+}
+
+func (b *Branch) SetRightChild(rightChild disk.PageId) {
+	b.header.rightChild = rightChild
+}
+
 func (b *Branch) isHalfFull() bool {
 	return 2*b.body.FreeSpace() < b.body.Capacity()
 }
 
+// 子が分割しても、境界キーを分割せずに挿入できるか
+// 境界キーのペアはleafのペアより子のページIDの分だけ大きくなりうる
+func (b *Branch) isSafeForInsert() bool {
+	return b.MaxPairSize()+2*int(unsafe.Sizeof(disk.PageId(0)))+pointerSize <= b.body.FreeSpace()
+}
+
+// 子の併合でペアを1つ失うか、融通で境界キーが縮んでも半分を下回らないか
+func (b *Branch) isSafeForDelete() bool {
+	return 2*(b.body.FreeSpace()+b.MaxPairSize()+pointerSize) < b.body.Capacity()
+}
+
+func (b *Branch) canMergeWith(right *Branch, separator []byte) bool {
+	pair := Pair{Key: separator, Value: disk.PageIdToBytes(b.RightChild())}
+	separatorSize := len(pair.ToBytes()) + pointerSize
+	return b.body.UsedSpace()+right.body.UsedSpace()+separatorSize <= b.body.Capacity()
+}
+
 func (b *Branch) SplitInsert(newBranch *Branch, newKey []byte, newPageId disk.PageId) []byte {
 	newBranch.body.Initialize()
 	for {
@@ -150,3 +192,14 @@ func (b *Branch) Transfer(dest *Branch) {
 	dest.body.WriteData(nextIndex, srcBody)
 	b.body.Remove(0)
 }
+
+func (b *Branch) TransferLast(dest *Branch) {
+	lastIndex := b.NumPairs() - 1
+	srcBody := b.body.ReadData(lastIndex)
+	err := dest.body.Insert(0, len(srcBody))
+	if err != nil {
+		panic(xerrors.Errorf("no space in dest branch: %v", err))
+	}
+	dest.body.WriteData(0, srcBody)
+	b.body.Remove(lastIndex)
+}
@@ -124,4 +124,38 @@ func TestBranch(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("Remove/SetKeyAt", func(t *testing.T) {
+		data := make([]byte, 100)
+		branch := NewBranch(data)
+
+		branch.Initialize(uint64ToBytes(5), disk.PageId(1), disk.PageId(2))
+		if err := branch.Insert(1, uint64ToBytes(8), disk.PageId(3)); err != nil {
+			panic(err)
+		}
+
+		branch.Remove(0)
+		if err := branch.SetKeyAt(0, []byte{0, 0, 0, 0, 0, 0, 0, 7, 0}); err != nil {
+			panic(err)
+		}
+		if err := branch.SetKeyAt(0, make([]byte, 100)); err != ErrTooLongData {
+			t.Fatalf("branch.SetKeyAt() = %v, want ErrTooLongData", err)
+		}
+
+		tests := []struct {
+			key    uint64
+			pageId disk.PageId
+		}{
+			{1, 3},
+			{7, 3},
+			{8, 2},
+			{12, 2},
+		}
+		for _, tt := range tests {
+			actual := branch.SearchChild(uint64ToBytes(tt.key))
+			if actual != tt.pageId {
+				t.Fatalf("branch.SearchChild(%v) = %v, want %v", tt.key, actual, tt.pageId)
+			}
+		}
+	})
 }
@@ -1,6 +1,9 @@
 package btree
 
 import (
+	"runtime"
+	"unsafe"
+
 	"my-relly-go/bsearch"
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
@@ -11,6 +14,7 @@ import (
 
 var (
 	ErrDuplicateKey  = xerrors.New("duplicate key")
+	ErrKeyNotFound   = xerrors.New("key not found")
 	ErrEndOfIterator = xerrors.New("end of iterator")
 )
 
@@ -30,9 +34,12 @@ func (p *Pair) ToBytes() []byte {
 	return buf
 }
 
+// backwardがtrueのモードは、条件に合う最後のペアに位置付ける
+// tupleSlotIdはそのペアの位置を返し、leafに無ければ-1を返す
 type SearchMode interface {
 	childPageId(branch *Branch) disk.PageId
 	tupleSlotId(leaf *Leaf) (int, int)
+	backward() bool
 }
 
 type SearchModeStart struct {
@@ -46,6 +53,10 @@ func (s *SearchModeStart) tupleSlotId(leaf *Leaf) (int, int) {
 	return bsearch.BINARY_SEARCH_RESULT_MISS, 0
 }
 
+func (s *SearchModeStart) backward() bool {
+	return false
+}
+
 type SearchModeKey struct {
 	Key []byte
 }
@@ -58,31 +69,91 @@ func (s *SearchModeKey) tupleSlotId(leaf *Leaf) (int, int) {
 	return leaf.SearchSlotId(s.Key)
 }
 
+func (s *SearchModeKey) backward() bool {
+	return false
+}
+
+// 最後のペアに位置付ける
+type SearchModeEnd struct {
+}
+
+func (s *SearchModeEnd) childPageId(branch *Branch) disk.PageId {
+	return branch.RightChild()
+}
+
+func (s *SearchModeEnd) tupleSlotId(leaf *Leaf) (int, int) {
+	return bsearch.BINARY_SEARCH_RESULT_MISS, leaf.NumPairs() - 1
+}
+
+func (s *SearchModeEnd) backward() bool {
+	return true
+}
+
+// Key以下で最大のキーのペアに位置付ける
+type SearchModeKeyBackward struct {
+	Key []byte
+}
+
+func (s *SearchModeKeyBackward) childPageId(branch *Branch) disk.PageId {
+	return branch.SearchChild(s.Key)
+}
+
+func (s *SearchModeKeyBackward) tupleSlotId(leaf *Leaf) (int, int) {
+	result, slotId := leaf.SearchSlotId(s.Key)
+	if result == bsearch.BINARY_SEARCH_RESULT_HIT {
+		return result, slotId
+	}
+	return result, slotId - 1
+}
+
+func (s *SearchModeKeyBackward) backward() bool {
+	return true
+}
+
+type insertMode int
+
+const (
+	insertModeInsert insertMode = iota
+	insertModeUpdate
+	insertModeUpsert
+)
+
+// 更新はまずleafだけに書き込みラッチを取って試し、分割や併合が必要なら経路上の書き込みラッチをすべて取って降り直す
+// 書き換えるページは、書き換える前にトランザクションでロックする
+// 他のトランザクションがロックしていたら、書き換えを取り消してラッチを手放し、ロックが外れるのを待ってからやり直す
 type BTree struct {
 	MetaPageId disk.PageId
 }
 
 func CreateBTree(bufmgr *buffer.BufferPoolManager) (*BTree, error) {
-	metaBuffer, err := bufmgr.CreatePage()
-	if err != nil {
-		return nil, err
-	}
-	defer bufmgr.FinishUsingPage(metaBuffer)
-	meta := NewMeta(metaBuffer.Page[:])
+	var tree *BTree
+	err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		metaBuffer, err := bufmgr.CreatePage()
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(metaBuffer)
+		meta := NewMeta(metaBuffer.Page[:])
+
+		rootBuffer, err := bufmgr.CreatePage()
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(rootBuffer)
+		root := NewNode(rootBuffer.Page[:])
+		root.InitializeAsLeaf()
 
-	rootBuffer, err := bufmgr.CreatePage()
+		leaf := NewLeaf(root.body)
+		leaf.Initialize()
+
+		meta.header.rootPageId = rootBuffer.PageId
+		tree = NewBTree(metaBuffer.PageId)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer bufmgr.FinishUsingPage(rootBuffer)
-	root := NewNode(rootBuffer.Page[:])
-	root.InitializeAsLeaf()
-
-	leaf := NewLeaf(root.body)
-	leaf.Initialize()
-
-	meta.header.rootPageId = rootBuffer.PageId
-	return NewBTree(metaBuffer.PageId), nil
+	return tree, nil
 }
 
 func NewBTree(metaPageId disk.PageId) *BTree {
@@ -95,6 +166,8 @@ func (t *BTree) ReadMetaAppArea(bufmgr *buffer.BufferPoolManager) ([]byte, error
 		return nil, err
 	}
 	defer bufmgr.FinishUsingPage(metaBuffer)
+	metaBuffer.RLatch()
+	defer metaBuffer.RUnlatch()
 
 	meta := NewMeta(metaBuffer.Page[:])
 	data := make([]byte, *(meta.appAreaLength))
@@ -103,19 +176,27 @@ func (t *BTree) ReadMetaAppArea(bufmgr *buffer.BufferPoolManager) ([]byte, error
 }
 
 func (t *BTree) WriteMetaAppArea(bufmgr *buffer.BufferPoolManager, data []byte) error {
-	metaBuffer, err := t.fetchMetaPage(bufmgr)
-	if err != nil {
-		return err
-	}
-	defer bufmgr.FinishUsingPage(metaBuffer)
+	return retryOnLock(bufmgr, func(bufmgr *buffer.BufferPoolManager) error {
+		metaBuffer, err := t.fetchMetaPage(bufmgr)
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(metaBuffer)
+		metaBuffer.WLatch()
+		defer metaBuffer.WUnlatch()
+		if err := bufmgr.LockPage(metaBuffer.PageId); err != nil {
+			return err
+		}
 
-	meta := NewMeta(metaBuffer.Page[:])
-	if len(meta.appArea) < len(data) {
-		return ErrTooLongData
-	}
-	copy(meta.appArea, data)
-	*(meta.appAreaLength) = uint64(len(data))
-	return nil
+		meta := NewMeta(metaBuffer.Page[:])
+		if len(meta.appArea) < len(data) {
+			return ErrTooLongData
+		}
+		copy(meta.appArea, data)
+		*(meta.appAreaLength) = uint64(len(data))
+		metaBuffer.IsDirty = true
+		return nil
+	})
 }
 
 func (t *BTree) fetchMetaPage(bufmgr *buffer.BufferPoolManager) (*buffer.Buffer, error) {
@@ -126,12 +207,16 @@ func (t *BTree) fetchMetaPage(bufmgr *buffer.BufferPoolManager) (*buffer.Buffer,
 	return metaBuffer, nil
 }
 
+// rootを読み込みラッチを取得した状態で返す
+// metaのラッチを保持したままrootのラッチを取るので、途中でrootが差し替わることはない
 func (t *BTree) fetchRootPage(bufmgr *buffer.BufferPoolManager) (*buffer.Buffer, error) {
 	metaBuffer, err := bufmgr.FetchPage(t.MetaPageId)
 	if err != nil {
 		return nil, err
 	}
 	defer bufmgr.FinishUsingPage(metaBuffer)
+	metaBuffer.RLatch()
+	defer metaBuffer.RUnlatch()
 
 	meta := NewMeta(metaBuffer.Page[:])
 	rootPageId := meta.header.rootPageId
@@ -139,23 +224,27 @@ func (t *BTree) fetchRootPage(bufmgr *buffer.BufferPoolManager) (*buffer.Buffer,
 	if err != nil {
 		return nil, err
 	}
+	rootBuffer.RLatch()
 	return rootBuffer, nil
 }
 
-func (t *BTree) searchInternal(bufmgr *buffer.BufferPoolManager, nodeBuffer *buffer.Buffer, searchMode SearchMode) (*BTreeIter, error) {
+// 読み込みラッチを親から子へ付け替えながら降りていく
+// 見つかったleafは読み込みラッチを取得した状態で返す
+func (t *BTree) searchInternal(bufmgr *buffer.BufferPoolManager, nodeBuffer *buffer.Buffer, searchMode SearchMode) (*buffer.Buffer, error) {
 	node := NewNode(nodeBuffer.Page[:])
 	switch node.header.NodeTypeString() {
 	case NODE_TYPE_LEAF:
-		leaf := NewLeaf(node.body)
-		_, slotId := searchMode.tupleSlotId(leaf)
-		node = nil
-		return &BTreeIter{nodeBuffer, slotId}, nil
+		return nodeBuffer, nil
 	case NODE_TYPE_BRANCH:
 		branch := NewBranch(node.body)
 		childPageId := searchMode.childPageId(branch)
 		node = nil
-		bufmgr.FinishUsingPage(nodeBuffer)
 		childNodePage, err := bufmgr.FetchPage(childPageId)
+		if err == nil {
+			childNodePage.RLatch()
+		}
+		nodeBuffer.RUnlatch()
+		bufmgr.FinishUsingPage(nodeBuffer)
 		if err != nil {
 			return nil, err
 		}
@@ -166,23 +255,196 @@ func (t *BTree) searchInternal(bufmgr *buffer.BufferPoolManager, nodeBuffer *buf
 }
 
 func (t *BTree) Search(bufmgr *buffer.BufferPoolManager, searchMode SearchMode) (*BTreeIter, error) {
-	rootPage, err := t.fetchRootPage(bufmgr)
+	iter := &BTreeIter{tree: t, searchMode: searchMode}
+	if err := iter.research(bufmgr); err != nil {
+		return nil, err
+	}
+	// イテレータはピンだけを保持し、ラッチは読み出すたびに取得する
+	iter.buffer.RUnlatch()
+	return iter, nil
+}
+
+// keyを含むleafを書き込みラッチを取得した状態で返す
+// 親の読み込みラッチを保持したままleafのラッチを取り直すので、その間にleafが分割や併合されることはない
+func (t *BTree) fetchLeafForWrite(bufmgr *buffer.BufferPoolManager, key []byte) (*buffer.Buffer, error) {
+	parentBuffer, err := t.fetchMetaPage(bufmgr)
 	if err != nil {
 		return nil, err
 	}
-	return t.searchInternal(bufmgr, rootPage, searchMode)
+	parentBuffer.RLatch()
+	childPageId := NewMeta(parentBuffer.Page[:]).header.rootPageId
+	for {
+		childBuffer, err := bufmgr.FetchPage(childPageId)
+		if err != nil {
+			parentBuffer.RUnlatch()
+			bufmgr.FinishUsingPage(parentBuffer)
+			return nil, err
+		}
+		childBuffer.RLatch()
+		node := NewNode(childBuffer.Page[:])
+		isLeaf := node.header.NodeTypeString() == NODE_TYPE_LEAF
+		if isLeaf {
+			childBuffer.RUnlatch()
+			childBuffer.WLatch()
+		} else {
+			childPageId = NewBranch(node.body).SearchChild(key)
+		}
+		parentBuffer.RUnlatch()
+		bufmgr.FinishUsingPage(parentBuffer)
+		if isLeaf {
+			return childBuffer, nil
+		}
+		parentBuffer = childBuffer
+	}
+}
+
+// 書き込みラッチを保持したまま降りてきた経路のページ
+// 先頭はmetaで、childIdxは次の段のページがbranchの何番目の子か
+type pathEntry struct {
+	buffer   *buffer.Buffer
+	childIdx int
+}
+
+// トランザクションの中でfを実行する
+// fが他のトランザクションのロックしているページに当たったら、fの書き換えを取り消し、ロックが外れるのを待ってやり直す
+// fはラッチをすべて手放してから返るので、ラッチを保持したまま待つことはない
+func retryOnLock(bufmgr *buffer.BufferPoolManager, f func(bufmgr *buffer.BufferPoolManager) error) error {
+	for {
+		err := bufmgr.Transaction(f)
+		var locked *buffer.PageLockedError
+		if !xerrors.As(err, &locked) {
+			return err
+		}
+		if err := bufmgr.WaitPageLock(locked); err != nil {
+			return err
+		}
+	}
+}
+
+// 分割が伝わる範囲のページを、書き換える前にまとめてロックする
+func lockForInsert(bufmgr *buffer.BufferPoolManager, path []pathEntry, leafBuffer *buffer.Buffer, leaf *Leaf, pair *Pair) error {
+	if err := bufmgr.LockPage(leafBuffer.PageId); err != nil {
+		return err
+	}
+	if leaf.isSafeForInsert(pair) {
+		return nil
+	}
+	// 分割したleafは左隣との間に入れる
+	if prevPageId, err := leaf.PrevPageId(); !xerrors.Is(err, disk.ErrInvalidPageId) {
+		if err := bufmgr.LockPage(prevPageId); err != nil {
+			return err
+		}
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if err := bufmgr.LockPage(path[i].buffer.PageId); err != nil {
+			return err
+		}
+		if NewBranch(NewNode(path[i].buffer.Page[:]).body).isSafeForInsert() {
+			return nil
+		}
+	}
+	// rootが分割されると、metaのrootも書き換える
+	return bufmgr.LockPage(path[0].buffer.PageId)
+}
+
+// 併合や融通が伝わる範囲のページを、書き換える前にまとめてロックする
+// 兄弟の選び方はrebalanceChildに合わせる
+func lockForDelete(bufmgr *buffer.BufferPoolManager, path []pathEntry, leafBuffer *buffer.Buffer, leaf *Leaf, slotId int) error {
+	if err := bufmgr.LockPage(leafBuffer.PageId); err != nil {
+		return err
+	}
+	if len(path) == 1 || leaf.isSafeForDelete(slotId) {
+		return nil
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		parentBuffer := path[i].buffer
+		if err := bufmgr.LockPage(parentBuffer.PageId); err != nil {
+			return err
+		}
+		parent := NewBranch(NewNode(parentBuffer.Page[:]).body)
+		if parent.NumPairs() > 0 {
+			childIdx := path[i].childIdx
+			siblingIdx := childIdx - 1
+			if childIdx == 0 {
+				siblingIdx = 1
+			}
+			if err := bufmgr.LockPage(parent.ChildAt(siblingIdx)); err != nil {
+				return err
+			}
+			// leafを併合すると、左のleafの左隣のリンクも書き換える
+			if i == len(path)-1 {
+				prevPageId, err := leaf.PrevPageId()
+				if siblingIdx < childIdx {
+					prevPageId, err = readPrevPageId(bufmgr, parent.ChildAt(siblingIdx))
+				}
+				if err == nil {
+					if err := bufmgr.LockPage(prevPageId); err != nil {
+						return err
+					}
+				} else if !xerrors.Is(err, disk.ErrInvalidPageId) {
+					return err
+				}
+			}
+		}
+		// rootが子を1つしか持たなくなると、metaのrootも書き換える
+		if i == 1 {
+			if parent.NumPairs() <= 1 {
+				return bufmgr.LockPage(path[0].buffer.PageId)
+			}
+			return nil
+		}
+		if parent.isSafeForDelete() {
+			return nil
+		}
+	}
+	return nil
+}
+
+func readPrevPageId(bufmgr *buffer.BufferPoolManager, leafPageId disk.PageId) (disk.PageId, error) {
+	leafBuffer, err := bufmgr.FetchPage(leafPageId)
+	if err != nil {
+		return disk.INVALID_PAGE_ID, err
+	}
+	defer bufmgr.FinishUsingPage(leafBuffer)
+	leafBuffer.RLatch()
+	defer leafBuffer.RUnlatch()
+	return NewLeaf(NewNode(leafBuffer.Page[:]).body).PrevPageId()
 }
 
-func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.Buffer, key []byte, value []byte) (bool, []byte, disk.PageId, error) {
+// pathはmetaから親までの、書き込みラッチを取得済みのページ
+func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.Buffer, pair *Pair, mode insertMode, path []pathEntry) (bool, []byte, disk.PageId, error) {
 	node := NewNode(buffer.Page[:])
 	switch node.header.NodeTypeString() {
 	case NODE_TYPE_LEAF:
 		leaf := NewLeaf(node.body)
-		result, slotId := leaf.SearchSlotId(key)
+		result, slotId := leaf.SearchSlotId(pair.Key)
+		if err := lockForInsert(bufmgr, path, buffer, leaf, pair); err != nil {
+			return false, nil, disk.INVALID_PAGE_ID, err
+		}
 		if result == bsearch.BINARY_SEARCH_RESULT_HIT {
-			return false, nil, disk.INVALID_PAGE_ID, ErrDuplicateKey
+			if mode == insertModeInsert {
+				return false, nil, disk.INVALID_PAGE_ID, ErrDuplicateKey
+			}
+			// 既存のペアをその場で書き換える
+			oldPair := leaf.PairAt(slotId)
+			err := leaf.UpdatePair(slotId, pair)
+			if err == nil {
+				buffer.IsDirty = true
+				return false, nil, disk.INVALID_PAGE_ID, oldPair.freeValue(bufmgr)
+			}
+			if err == ErrTooLongData {
+				return false, nil, disk.INVALID_PAGE_ID, err
+			}
+			// 入りきらなかった場合は、一旦削除してから挿入し直す
+			leaf.Remove(slotId)
+			buffer.IsDirty = true
+			if err := oldPair.freeValue(bufmgr); err != nil {
+				return false, nil, disk.INVALID_PAGE_ID, err
+			}
+		} else if mode == insertModeUpdate {
+			return false, nil, disk.INVALID_PAGE_ID, ErrKeyNotFound
 		}
-		if err := leaf.Insert(slotId, key, value); err == nil {
+		if err := leaf.InsertPair(slotId, pair); err == nil {
 			buffer.IsDirty = true
 			return false, nil, disk.INVALID_PAGE_ID, nil
 		} else {
@@ -193,8 +455,11 @@ func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.
 				return false, nil, disk.INVALID_PAGE_ID, err
 			}
 			defer bufmgr.FinishUsingPage(newLeafBuffer)
+			newLeafBuffer.WLatch()
+			defer newLeafBuffer.WUnlatch()
 
 			// leaf.prevLeafとleafの間に入れる
+			// 左隣のラッチは右から左の順で取ることになるが、読み込み側は左から右へ待たずに進むのでデッドロックしない
 			prevLeafPageId, err := leaf.PrevPageId()
 			if !xerrors.Is(err, disk.ErrInvalidPageId) {
 				prevLeafBuffer, err := bufmgr.FetchPage(prevLeafPageId)
@@ -202,6 +467,8 @@ func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.
 					return false, nil, disk.INVALID_PAGE_ID, err
 				}
 				defer bufmgr.FinishUsingPage(prevLeafBuffer)
+				prevLeafBuffer.WLatch()
+				defer prevLeafBuffer.WUnlatch()
 
 				node := NewNode(prevLeafBuffer.Page[:])
 				prefLeaf := NewLeaf(node.body)
@@ -216,7 +483,7 @@ func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.
 			newLeafNode.InitializeAsLeaf()
 			newLeaf := NewLeaf(newLeafNode.body)
 			newLeaf.Initialize()
-			overflowKey := leaf.SplitInsert(newLeaf, key, value)
+			overflowKey := leaf.SplitInsertPair(newLeaf, pair)
 			newLeaf.SetNextPageId(buffer.PageId)
 			newLeaf.SetPrevPageId(prevLeafPageId)
 			buffer.IsDirty = true
@@ -225,15 +492,17 @@ func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.
 
 	case NODE_TYPE_BRANCH:
 		branch := NewBranch(node.body)
-		childIdx := branch.SearchChildIdx(key)
+		childIdx := branch.SearchChildIdx(pair.Key)
 		childPageId := branch.ChildAt(childIdx)
 		childNodeBuffer, err := bufmgr.FetchPage(childPageId)
 		if err != nil {
 			return false, nil, disk.INVALID_PAGE_ID, err
 		}
 		defer bufmgr.FinishUsingPage(childNodeBuffer)
+		childNodeBuffer.WLatch()
+		defer childNodeBuffer.WUnlatch()
 
-		overflow, overflowKeyFromChild, overflowChildPageId, err := t.insertInternal(bufmgr, childNodeBuffer, key, value)
+		overflow, overflowKeyFromChild, overflowChildPageId, err := t.insertInternal(bufmgr, childNodeBuffer, pair, mode, append(path, pathEntry{buffer, childIdx}))
 		if err != nil {
 			return false, nil, disk.INVALID_PAGE_ID, err
 		}
@@ -251,6 +520,8 @@ func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.
 					return false, nil, disk.INVALID_PAGE_ID, err
 				}
 				defer bufmgr.FinishUsingPage(newBranchBuffer)
+				newBranchBuffer.WLatch()
+				defer newBranchBuffer.WUnlatch()
 
 				newBranchNode := NewNode(newBranchBuffer.Page[:])
 				newBranchNode.InitializeAsBranch()
@@ -270,11 +541,64 @@ func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.
 }
 
 func (t *BTree) Insert(bufmgr *buffer.BufferPoolManager, key []byte, value []byte) error {
+	return t.insert(bufmgr, key, value, insertModeInsert)
+}
+
+func (t *BTree) Update(bufmgr *buffer.BufferPoolManager, key []byte, value []byte) error {
+	return t.insert(bufmgr, key, value, insertModeUpdate)
+}
+
+func (t *BTree) Upsert(bufmgr *buffer.BufferPoolManager, key []byte, value []byte) error {
+	return t.insert(bufmgr, key, value, insertModeUpsert)
+}
+
+func (t *BTree) insert(bufmgr *buffer.BufferPoolManager, key []byte, value []byte, mode insertMode) error {
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		pair, err := newLeafPair(bufmgr, key, value)
+		if err != nil {
+			return err
+		}
+		return retryOnLock(bufmgr, func(bufmgr *buffer.BufferPoolManager) error {
+			return t.insertTx(bufmgr, pair, mode)
+		})
+	})
+}
+
+// leafに収まらない値はオーバーフローページに移し、leafにはその先頭のページIDだけを置く
+func newLeafPair(bufmgr *buffer.BufferPoolManager, key []byte, value []byte) (*Pair, error) {
+	maxPairSize := NewLeaf(make([]byte, disk.PAGE_BODY_SIZE-int(unsafe.Sizeof(NodeHeader{})))).MaxPairSize()
+	pair := &Pair{Key: key, Value: value}
+	if len(pair.ToBytes()) <= maxPairSize {
+		return pair, nil
+	}
+	pair = &Pair{Key: key, Value: disk.PageIdToBytes(disk.INVALID_PAGE_ID), Overflow: true}
+	if len(pair.ToBytes()) > maxPairSize {
+		return nil, ErrTooLongData
+	}
+	overflowPageId, err := writeOverflow(bufmgr, value)
+	if err != nil {
+		return nil, err
+	}
+	pair.Value = disk.PageIdToBytes(overflowPageId)
+	return pair, nil
+}
+
+// 重複などで失敗した場合、書き込んだオーバーフローページはロールバックで解放される
+func (t *BTree) insertTx(bufmgr *buffer.BufferPoolManager, pair *Pair, mode insertMode) error {
+	// まずはleafだけの書き換えで済むか試す
+	done, err := t.insertOptimistic(bufmgr, pair, mode)
+	if err != nil || done {
+		return err
+	}
+
+	// 分割が必要な場合は、経路上の書き込みラッチをすべて保持したままmetaから降り直す
 	metaBuffer, err := bufmgr.FetchPage(t.MetaPageId)
 	if err != nil {
 		return err
 	}
 	defer bufmgr.FinishUsingPage(metaBuffer)
+	metaBuffer.WLatch()
+	defer metaBuffer.WUnlatch()
 	meta := NewMeta(metaBuffer.Page[:])
 
 	rootPageId := meta.header.rootPageId
@@ -283,8 +607,10 @@ func (t *BTree) Insert(bufmgr *buffer.BufferPoolManager, key []byte, value []byt
 		return err
 	}
 	defer bufmgr.FinishUsingPage(rootBuffer)
+	rootBuffer.WLatch()
+	defer rootBuffer.WUnlatch()
 
-	overflow, key, childPageId, err := t.insertInternal(bufmgr, rootBuffer, key, value)
+	overflow, key, childPageId, err := t.insertInternal(bufmgr, rootBuffer, pair, mode, []pathEntry{{metaBuffer, 0}})
 	if err != nil {
 		return err
 	}
@@ -296,6 +622,8 @@ func (t *BTree) Insert(bufmgr *buffer.BufferPoolManager, key []byte, value []byt
 			return err
 		}
 		defer bufmgr.FinishUsingPage(newRootBuffer)
+		newRootBuffer.WLatch()
+		defer newRootBuffer.WUnlatch()
 
 		node := NewNode(newRootBuffer.Page[:])
 		node.InitializeAsBranch()
@@ -307,43 +635,683 @@ func (t *BTree) Insert(bufmgr *buffer.BufferPoolManager, key []byte, value []byt
 	return nil
 }
 
+func (t *BTree) insertOptimistic(bufmgr *buffer.BufferPoolManager, pair *Pair, mode insertMode) (bool, error) {
+	leafBuffer, err := t.fetchLeafForWrite(bufmgr, pair.Key)
+	if err != nil {
+		return false, err
+	}
+	defer bufmgr.FinishUsingPage(leafBuffer)
+	defer leafBuffer.WUnlatch()
+	if err := bufmgr.LockPage(leafBuffer.PageId); err != nil {
+		return false, err
+	}
+
+	node := NewNode(leafBuffer.Page[:])
+	leaf := NewLeaf(node.body)
+	result, slotId := leaf.SearchSlotId(pair.Key)
+	if result == bsearch.BINARY_SEARCH_RESULT_HIT {
+		if mode == insertModeInsert {
+			return false, ErrDuplicateKey
+		}
+		oldPair := leaf.PairAt(slotId)
+		if err := leaf.UpdatePair(slotId, pair); err != nil {
+			return false, nil
+		}
+		leafBuffer.IsDirty = true
+		return true, oldPair.freeValue(bufmgr)
+	}
+	if mode == insertModeUpdate {
+		return false, ErrKeyNotFound
+	}
+	if !leaf.isSafeForInsert(pair) {
+		return false, nil
+	}
+	if err := leaf.InsertPair(slotId, pair); err != nil {
+		return false, nil
+	}
+	leafBuffer.IsDirty = true
+	return true, nil
+}
+
+// 併合や融通は兄弟や親にも及ぶので、経路上の書き込みラッチはすべて保持したままにする
+// pathはmetaから親までの、書き込みラッチを取得済みのページ
+func (t *BTree) deleteInternal(bufmgr *buffer.BufferPoolManager, buffer *buffer.Buffer, key []byte, path []pathEntry) (bool, error) {
+	node := NewNode(buffer.Page[:])
+	switch node.header.NodeTypeString() {
+	case NODE_TYPE_LEAF:
+		leaf := NewLeaf(node.body)
+		result, slotId := leaf.SearchSlotId(key)
+		if result != bsearch.BINARY_SEARCH_RESULT_HIT {
+			return false, ErrKeyNotFound
+		}
+		if err := lockForDelete(bufmgr, path, buffer, leaf, slotId); err != nil {
+			return false, err
+		}
+		pair := leaf.PairAt(slotId)
+		leaf.Remove(slotId)
+		buffer.IsDirty = true
+		return !leaf.isHalfFull(), pair.freeValue(bufmgr)
+
+	case NODE_TYPE_BRANCH:
+		branch := NewBranch(node.body)
+		childIdx := branch.SearchChildIdx(key)
+		childPageId := branch.ChildAt(childIdx)
+		childNodeBuffer, err := bufmgr.FetchPage(childPageId)
+		if err != nil {
+			return false, err
+		}
+		defer bufmgr.FinishUsingPage(childNodeBuffer)
+		childNodeBuffer.WLatch()
+		defer childNodeBuffer.WUnlatch()
+
+		underflow, err := t.deleteInternal(bufmgr, childNodeBuffer, key, append(path, pathEntry{buffer, childIdx}))
+		if err != nil {
+			return false, err
+		}
+		if !underflow {
+			return false, nil
+		}
+		// 子が半分を下回った場合
+		// 隣の子と併合するか、ペアを融通してもらう
+		if err := t.rebalanceChild(bufmgr, branch, childIdx, childNodeBuffer); err != nil {
+			return false, err
+		}
+		buffer.IsDirty = true
+		return !branch.isHalfFull(), nil
+
+	default:
+		panic("unreachable")
+	}
+}
+
+func (t *BTree) rebalanceChild(bufmgr *buffer.BufferPoolManager, branch *Branch, childIdx int, childBuffer *buffer.Buffer) error {
+	if branch.NumPairs() == 0 {
+		// 兄弟がいないので、親の段で解消してもらう
+		return nil
+	}
+	// branchのペア[leftIdx]が左の子と右の子の境界になる
+	leftIdx := childIdx - 1
+	if childIdx == 0 {
+		leftIdx = 0
+	}
+
+	// 子は書き込みラッチを取得済みなので、兄弟だけ取得する
+	siblingIdx := leftIdx
+	if childIdx == leftIdx {
+		siblingIdx = leftIdx + 1
+	}
+	siblingBuffer, err := bufmgr.FetchPage(branch.ChildAt(siblingIdx))
+	if err != nil {
+		return err
+	}
+	defer bufmgr.FinishUsingPage(siblingBuffer)
+	siblingBuffer.WLatch()
+	defer siblingBuffer.WUnlatch()
+
+	leftBuffer, rightBuffer := siblingBuffer, childBuffer
+	if siblingIdx > childIdx {
+		leftBuffer, rightBuffer = childBuffer, siblingBuffer
+	}
+
+	leftNode := NewNode(leftBuffer.Page[:])
+	rightNode := NewNode(rightBuffer.Page[:])
+	switch leftNode.header.NodeTypeString() {
+	case NODE_TYPE_LEAF:
+		left := NewLeaf(leftNode.body)
+		right := NewLeaf(rightNode.body)
+		if left.canMerge(right) {
+			if err := t.mergeLeaves(bufmgr, left, right, rightBuffer.PageId); err != nil {
+				return err
+			}
+			branch.Remove(leftIdx)
+			if err := bufmgr.DeallocatePage(leftBuffer.PageId); err != nil {
+				return err
+			}
+		} else {
+			redistributeLeaves(branch, leftIdx, left, right)
+		}
+
+	case NODE_TYPE_BRANCH:
+		left := NewBranch(leftNode.body)
+		right := NewBranch(rightNode.body)
+		if left.canMergeWith(right, branch.PairAt(leftIdx).Key) {
+			mergeBranches(left, right, branch.PairAt(leftIdx).Key)
+			branch.Remove(leftIdx)
+			if err := bufmgr.DeallocatePage(leftBuffer.PageId); err != nil {
+				return err
+			}
+		} else {
+			redistributeBranches(branch, leftIdx, left, right)
+		}
+
+	default:
+		panic("unreachable")
+	}
+	leftBuffer.IsDirty = true
+	rightBuffer.IsDirty = true
+	return nil
+}
+
+// 左のleafのペアをすべて右のleafに移し、左のleafをリンクから外す
+func (t *BTree) mergeLeaves(bufmgr *buffer.BufferPoolManager, left *Leaf, right *Leaf, rightPageId disk.PageId) error {
+	for left.NumPairs() > 0 {
+		left.TransferLast(right)
+	}
+
+	prevPageId, err := left.PrevPageId()
+	if !xerrors.Is(err, disk.ErrInvalidPageId) {
+		prevBuffer, err := bufmgr.FetchPage(prevPageId)
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(prevBuffer)
+		prevBuffer.WLatch()
+		defer prevBuffer.WUnlatch()
+
+		node := NewNode(prevBuffer.Page[:])
+		prevLeaf := NewLeaf(node.body)
+		prevLeaf.SetNextPageId(rightPageId)
+		prevBuffer.IsDirty = true
+	}
+	right.SetPrevPageId(prevPageId)
+	return nil
+}
+
+// 少ない方のleafが半分を超えるまで、多い方から1ペアずつ移す
+func redistributeLeaves(parent *Branch, leftIdx int, left *Leaf, right *Leaf) {
+	if left.body.UsedSpace() > right.body.UsedSpace() {
+		for !right.isHalfFull() && left.NumPairs() > 1 {
+			left.TransferLast(right)
+			if left.body.UsedSpace() < right.body.UsedSpace() || parent.SetKeyAt(leftIdx, right.PairAt(0).Key) != nil {
+				right.Transfer(left)
+				break
+			}
+		}
+	} else {
+		for !left.isHalfFull() && right.NumPairs() > 1 {
+			right.Transfer(left)
+			if right.body.UsedSpace() < left.body.UsedSpace() || parent.SetKeyAt(leftIdx, right.PairAt(0).Key) != nil {
+				left.TransferLast(right)
+				break
+			}
+		}
+	}
+}
+
+// 左のbranchを、親の境界キーをはさんで右のbranchの先頭に移す
+func mergeBranches(left *Branch, right *Branch, separator []byte) {
+	if err := right.Insert(0, separator, left.RightChild()); err != nil {
+		panic(xerrors.Errorf("right branch must have space: %v", err))
+	}
+	for left.NumPairs() > 0 {
+		left.TransferLast(right)
+	}
+}
+
+// 親の境界キーを経由して、多い方のbranchから1ペアずつ回転させる
+func redistributeBranches(parent *Branch, leftIdx int, left *Branch, right *Branch) {
+	if left.body.UsedSpace() > right.body.UsedSpace() {
+		for !right.isHalfFull() && left.NumPairs() > 1 && left.body.UsedSpace() > right.body.UsedSpace() {
+			separator := parent.PairAt(leftIdx).Key
+			lastIdx := left.NumPairs() - 1
+			lastPair := left.PairAt(lastIdx)
+			if right.Insert(0, separator, left.RightChild()) != nil {
+				break
+			}
+			if parent.SetKeyAt(leftIdx, lastPair.Key) != nil {
+				right.Remove(0)
+				break
+			}
+			left.SetRightChild(disk.BytesToPageId(lastPair.Value))
+			left.Remove(lastIdx)
+		}
+	} else {
+		for !left.isHalfFull() && right.NumPairs() > 1 && right.body.UsedSpace() > left.body.UsedSpace() {
+			separator := parent.PairAt(leftIdx).Key
+			firstPair := right.PairAt(0)
+			if left.Insert(left.NumPairs(), separator, left.RightChild()) != nil {
+				break
+			}
+			if parent.SetKeyAt(leftIdx, firstPair.Key) != nil {
+				left.Remove(left.NumPairs() - 1)
+				break
+			}
+			left.SetRightChild(disk.BytesToPageId(firstPair.Value))
+			right.Remove(0)
+		}
+	}
+}
+
+func (t *BTree) Delete(bufmgr *buffer.BufferPoolManager, key []byte) error {
+	return retryOnLock(bufmgr, func(bufmgr *buffer.BufferPoolManager) error {
+		return t.deleteTx(bufmgr, key)
+	})
+}
+
+func (t *BTree) deleteTx(bufmgr *buffer.BufferPoolManager, key []byte) error {
+	// まずはleafだけの書き換えで済むか試す
+	done, err := t.deleteOptimistic(bufmgr, key)
+	if err != nil || done {
+		return err
+	}
+
+	metaBuffer, err := bufmgr.FetchPage(t.MetaPageId)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.FinishUsingPage(metaBuffer)
+	metaBuffer.WLatch()
+	defer metaBuffer.WUnlatch()
+	meta := NewMeta(metaBuffer.Page[:])
+
+	rootBuffer, err := bufmgr.FetchPage(meta.header.rootPageId)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.FinishUsingPage(rootBuffer)
+	rootBuffer.WLatch()
+	defer rootBuffer.WUnlatch()
+
+	if _, err := t.deleteInternal(bufmgr, rootBuffer, key, []pathEntry{{metaBuffer, 0}}); err != nil {
+		return err
+	}
+
+	// rootのbranchが子を1つしか持たなくなったら、その子を新しいrootにする
+	node := NewNode(rootBuffer.Page[:])
+	if node.header.NodeTypeString() == NODE_TYPE_BRANCH {
+		branch := NewBranch(node.body)
+		if branch.NumPairs() == 0 {
+			meta.header.rootPageId = branch.RightChild()
+			metaBuffer.IsDirty = true
+			return bufmgr.DeallocatePage(rootBuffer.PageId)
+		}
+	}
+	return nil
+}
+
+// メタページを含む、木のすべてのページを解放する
+// 解放した木はもう使えないので、他から参照されないようにしてから呼ぶこと
+func (t *BTree) Drop(bufmgr *buffer.BufferPoolManager) error {
+	return retryOnLock(bufmgr, func(bufmgr *buffer.BufferPoolManager) error {
+		metaBuffer, err := t.fetchMetaPage(bufmgr)
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(metaBuffer)
+		metaBuffer.WLatch()
+		defer metaBuffer.WUnlatch()
+
+		meta := NewMeta(metaBuffer.Page[:])
+		if err := t.dropInternal(bufmgr, meta.header.rootPageId); err != nil {
+			return err
+		}
+		return bufmgr.DeallocatePage(t.MetaPageId)
+	})
+}
+
+func (t *BTree) dropInternal(bufmgr *buffer.BufferPoolManager, pageId disk.PageId) error {
+	nodeBuffer, err := bufmgr.FetchPage(pageId)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.FinishUsingPage(nodeBuffer)
+
+	nodeBuffer.RLatch()
+	childPageIds := []disk.PageId{}
+	overflowPairs := []*Pair{}
+	node := NewNode(nodeBuffer.Page[:])
+	switch node.header.NodeTypeString() {
+	case NODE_TYPE_LEAF:
+		leaf := NewLeaf(node.body)
+		for i := 0; i < leaf.NumPairs(); i++ {
+			if pair := leaf.PairAt(i); pair.Overflow {
+				overflowPairs = append(overflowPairs, pair)
+			}
+		}
+	case NODE_TYPE_BRANCH:
+		branch := NewBranch(node.body)
+		for i := 0; i <= branch.NumPairs(); i++ {
+			childPageIds = append(childPageIds, branch.ChildAt(i))
+		}
+	}
+	nodeBuffer.RUnlatch()
+
+	for _, pair := range overflowPairs {
+		if err := pair.freeValue(bufmgr); err != nil {
+			return err
+		}
+	}
+	for _, childPageId := range childPageIds {
+		if err := t.dropInternal(bufmgr, childPageId); err != nil {
+			return err
+		}
+	}
+	return bufmgr.DeallocatePage(pageId)
+}
+
+// すべてのキーと値を書き換える
+// 書き換えで長さと順序が変わらないこと。rewriteValueがnilなら値は書き換えない
+// 符号化の形式が変わったデータを移行するときに使う
+func (t *BTree) RewritePairs(bufmgr *buffer.BufferPoolManager, rewriteKey func([]byte) []byte, rewriteValue func([]byte) []byte) error {
+	return retryOnLock(bufmgr, func(bufmgr *buffer.BufferPoolManager) error {
+		metaBuffer, err := t.fetchMetaPage(bufmgr)
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(metaBuffer)
+		metaBuffer.RLatch()
+		rootPageId := NewMeta(metaBuffer.Page[:]).header.rootPageId
+		metaBuffer.RUnlatch()
+
+		return t.rewriteInternal(bufmgr, rootPageId, rewriteKey, rewriteValue)
+	})
+}
+
+func (t *BTree) rewriteInternal(bufmgr *buffer.BufferPoolManager, pageId disk.PageId, rewriteKey func([]byte) []byte, rewriteValue func([]byte) []byte) error {
+	nodeBuffer, err := bufmgr.FetchPage(pageId)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.FinishUsingPage(nodeBuffer)
+
+	nodeBuffer.WLatch()
+	if err := bufmgr.LockPage(nodeBuffer.PageId); err != nil {
+		nodeBuffer.WUnlatch()
+		return err
+	}
+	childPageIds := []disk.PageId{}
+	node := NewNode(nodeBuffer.Page[:])
+	switch node.header.NodeTypeString() {
+	case NODE_TYPE_LEAF:
+		leaf := NewLeaf(node.body)
+		for i := 0; i < leaf.NumPairs(); i++ {
+			pair := leaf.PairAt(i)
+			pair.Key = rewriteKey(pair.Key)
+			if rewriteValue != nil && !pair.Overflow {
+				pair.Value = rewriteValue(pair.Value)
+			}
+			if err := leaf.UpdatePair(i, pair); err != nil {
+				nodeBuffer.WUnlatch()
+				return err
+			}
+		}
+	case NODE_TYPE_BRANCH:
+		branch := NewBranch(node.body)
+		for i := 0; i < branch.NumPairs(); i++ {
+			if err := branch.SetKeyAt(i, rewriteKey(branch.PairAt(i).Key)); err != nil {
+				nodeBuffer.WUnlatch()
+				return err
+			}
+		}
+		for i := 0; i <= branch.NumPairs(); i++ {
+			childPageIds = append(childPageIds, branch.ChildAt(i))
+		}
+	}
+	nodeBuffer.IsDirty = true
+	nodeBuffer.WUnlatch()
+
+	for _, childPageId := range childPageIds {
+		if err := t.rewriteInternal(bufmgr, childPageId, rewriteKey, rewriteValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *BTree) deleteOptimistic(bufmgr *buffer.BufferPoolManager, key []byte) (bool, error) {
+	leafBuffer, err := t.fetchLeafForWrite(bufmgr, key)
+	if err != nil {
+		return false, err
+	}
+	defer bufmgr.FinishUsingPage(leafBuffer)
+	defer leafBuffer.WUnlatch()
+	if err := bufmgr.LockPage(leafBuffer.PageId); err != nil {
+		return false, err
+	}
+
+	node := NewNode(leafBuffer.Page[:])
+	leaf := NewLeaf(node.body)
+	result, slotId := leaf.SearchSlotId(key)
+	if result != bsearch.BINARY_SEARCH_RESULT_HIT {
+		return false, ErrKeyNotFound
+	}
+	// 兄弟のいないleafはrootなので、半分を下回ってもかまわない
+	_, prevErr := leaf.PrevPageId()
+	_, nextErr := leaf.NextPageId()
+	isRoot := xerrors.Is(prevErr, disk.ErrInvalidPageId) && xerrors.Is(nextErr, disk.ErrInvalidPageId)
+	if !isRoot && !leaf.isSafeForDelete(slotId) {
+		return false, nil
+	}
+	pair := leaf.PairAt(slotId)
+	leaf.Remove(slotId)
+	leafBuffer.IsDirty = true
+	return true, pair.freeValue(bufmgr)
+}
+
+// ページのラッチは読み出しの間だけ取得し、呼び出しの合間はピンだけを保持する
+// その間に木が書き換えられてもよいよう、最後に返したキーから次の位置を求め直す
+// Next/Prevは今の位置のペアを返し、後ろ/前のペアへ進む
 type BTreeIter struct {
-	buffer *buffer.Buffer
-	slotId int
+	tree       *BTree
+	searchMode SearchMode
+	buffer     *buffer.Buffer
+	lastKey    []byte
+	// 最後にPrevを呼んだか
+	backward bool
+	// nilでなければ、範囲の外のペアに達したら終わりにする
+	rng *Range
 }
 
-func (it *BTreeIter) Get() ([]byte, []byte, error) {
-	leafNode := NewNode(it.buffer.Page[:])
-	leaf := NewLeaf(leafNode.body)
-	if it.slotId < leaf.NumPairs() {
-		pair := leaf.PairAt(it.slotId)
-		return pair.Key, pair.Value, nil
+func (it *BTreeIter) Get(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
+	pair, err := it.locateInRange(bufmgr)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil, nil, ErrEndOfIterator
+	return pair.Key, pair.Value, nil
 }
 
 func (it *BTreeIter) Next(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
-	key, value, err := it.Get()
+	pair, err := it.locateInRange(bufmgr)
 	if err != nil {
 		return nil, nil, err
 	}
+	it.lastKey = pair.Key
+	it.backward = false
+	return pair.Key, pair.Value, nil
+}
 
-	it.slotId++
-	leafNode := NewNode(it.buffer.Page[:])
-	leaf := NewLeaf(leafNode.body)
-	if it.slotId < leaf.NumPairs() {
-		return key, value, nil
+func (it *BTreeIter) Prev(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
+	pair, err := it.locateInRange(bufmgr)
+	if err != nil {
+		return nil, nil, err
 	}
-	nextPageId, err := leaf.NextPageId()
-	if !xerrors.Is(err, disk.ErrInvalidPageId) {
+	it.lastKey = pair.Key
+	it.backward = true
+	return pair.Key, pair.Value, nil
+}
+
+func (it *BTreeIter) locateInRange(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	pair, err := it.locate(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	if it.rng != nil && !it.rng.Contains(pair.Key) {
+		return nil, ErrEndOfIterator
+	}
+	return pair, nil
+}
+
+// 今の位置のペアを探す
+// 最後に返したキーの後ろか前か（まだ返していなければ検索モード）で、探す向きが決まる
+func (it *BTreeIter) locate(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	backward := it.backward
+	if it.lastKey == nil {
+		backward = it.searchMode.backward()
+	}
+	if backward {
+		return it.locateBackward(bufmgr)
+	}
+	return it.locateForward(bufmgr)
+}
+
+func (it *BTreeIter) locateForward(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	// verified: 今のleafに、根から降りてきたか左隣からラッチを付け替えて来たか
+	verified := false
+	it.buffer.RLatch()
+	for {
+		leafNode := NewNode(it.buffer.Page[:])
+		leaf := NewLeaf(leafNode.body)
+		slotId := it.lowerBound(leaf)
+		// 手前のペアがこのleafに無ければ、分割で左隣に移されたかもしれない
+		_, err := leaf.PrevPageId()
+		if slotId == 0 && !verified && !xerrors.Is(err, disk.ErrInvalidPageId) {
+			it.buffer.RUnlatch()
+			if err := it.research(bufmgr); err != nil {
+				return nil, err
+			}
+			verified = true
+			continue
+		}
+		if slotId < leaf.NumPairs() {
+			// オーバーフローページはleafから外されてもトランザクションが終わるまで解放されないので、
+			// leafのラッチを持っている間に読み込む
+			pair := leaf.PairAt(slotId)
+			err := pair.loadValue(bufmgr)
+			it.buffer.RUnlatch()
+			if err != nil {
+				return nil, err
+			}
+			return pair, nil
+		}
+
+		nextPageId, err := leaf.NextPageId()
+		if xerrors.Is(err, disk.ErrInvalidPageId) {
+			it.buffer.RUnlatch()
+			return nil, ErrEndOfIterator
+		}
+		nextBuffer, err := bufmgr.FetchPage(nextPageId)
+		if err != nil {
+			it.buffer.RUnlatch()
+			return nil, err
+		}
+		if !nextBuffer.TryRLatch() {
+			// 書き込み側は右のleafを持ったまま左のleafのラッチを待つことがあるので、
+			// ここで待つとデッドロックする。一旦手放して根から探し直す
+			it.buffer.RUnlatch()
+			bufmgr.FinishUsingPage(nextBuffer)
+			runtime.Gosched()
+			if err := it.research(bufmgr); err != nil {
+				return nil, err
+			}
+			verified = true
+			continue
+		}
+		it.buffer.RUnlatch()
 		bufmgr.FinishUsingPage(it.buffer)
-		it.buffer, err = bufmgr.FetchPage(nextPageId)
+		it.buffer = nextBuffer
+		verified = true
+	}
+}
+
+// 左隣へもラッチを付け替えながら進む
+// 書き込み側は併合のときに左から右の順にもラッチを取るので、待たずに取れなければ根から探し直す
+func (it *BTreeIter) locateBackward(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	// verified: 今のleafに、根から降りてきたか右隣からラッチを付け替えて来たか
+	verified := false
+	it.buffer.RLatch()
+	for {
+		leafNode := NewNode(it.buffer.Page[:])
+		leaf := NewLeaf(leafNode.body)
+		slotId := it.upperBound(leaf)
+		// 後ろのペアがこのleafに無ければ、融通や併合で右隣に移されたかもしれない
+		_, err := leaf.NextPageId()
+		if slotId == leaf.NumPairs()-1 && !verified && !xerrors.Is(err, disk.ErrInvalidPageId) {
+			it.buffer.RUnlatch()
+			if err := it.research(bufmgr); err != nil {
+				return nil, err
+			}
+			verified = true
+			continue
+		}
+		if slotId >= 0 {
+			pair := leaf.PairAt(slotId)
+			err := pair.loadValue(bufmgr)
+			it.buffer.RUnlatch()
+			if err != nil {
+				return nil, err
+			}
+			return pair, nil
+		}
+
+		prevPageId, err := leaf.PrevPageId()
+		if xerrors.Is(err, disk.ErrInvalidPageId) {
+			it.buffer.RUnlatch()
+			return nil, ErrEndOfIterator
+		}
+		prevBuffer, err := bufmgr.FetchPage(prevPageId)
 		if err != nil {
-			return nil, nil, err
+			it.buffer.RUnlatch()
+			return nil, err
 		}
-		it.slotId = 0
+		if !prevBuffer.TryRLatch() {
+			it.buffer.RUnlatch()
+			bufmgr.FinishUsingPage(prevBuffer)
+			runtime.Gosched()
+			if err := it.research(bufmgr); err != nil {
+				return nil, err
+			}
+			verified = true
+			continue
+		}
+		it.buffer.RUnlatch()
+		bufmgr.FinishUsingPage(it.buffer)
+		it.buffer = prevBuffer
+		verified = true
+	}
+}
+
+// 前に返すべきペアのleaf内での位置。このleafより左にあれば-1
+func (it *BTreeIter) upperBound(leaf *Leaf) int {
+	if it.lastKey == nil {
+		_, slotId := it.searchMode.tupleSlotId(leaf)
+		return slotId
+	}
+	_, slotId := leaf.SearchSlotId(it.lastKey)
+	return slotId - 1
+}
+
+// 次に返すべきペアのleaf内での位置
+func (it *BTreeIter) lowerBound(leaf *Leaf) int {
+	if it.lastKey == nil {
+		_, slotId := it.searchMode.tupleSlotId(leaf)
+		return slotId
+	}
+	result, slotId := leaf.SearchSlotId(it.lastKey)
+	if result == bsearch.BINARY_SEARCH_RESULT_HIT {
+		return slotId + 1
 	}
-	return key, value, nil
+	return slotId
+}
+
+// 根から降り直し、leafを読み込みラッチを取得した状態で保持する
+func (it *BTreeIter) research(bufmgr *buffer.BufferPoolManager) error {
+	searchMode := it.searchMode
+	if it.lastKey != nil {
+		searchMode = &SearchModeKey{it.lastKey}
+	}
+	rootBuffer, err := it.tree.fetchRootPage(bufmgr)
+	if err != nil {
+		return err
+	}
+	leafBuffer, err := it.tree.searchInternal(bufmgr, rootBuffer, searchMode)
+	if err != nil {
+		return err
+	}
+	if it.buffer != nil {
+		bufmgr.FinishUsingPage(it.buffer)
+	}
+	it.buffer = leafBuffer
+	return nil
 }
 
 func (it *BTreeIter) Finish(bufmgr *buffer.BufferPoolManager) {
@@ -5,12 +5,19 @@ import (
 	"encoding/binary"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
 )
 
 // BTreeの中身をlogに出力
@@ -89,20 +96,26 @@ func TestBTree(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		disk, err := disk.NewDiskManager(file)
+		disk, err := disk.CreateDiskManager(file.Name())
 		if err != nil {
 			panic(err)
 		}
 		return file, disk
 	}
 
-	destroyDiskManager := func(file *os.File, _ *disk.DiskManager) {
+	destroyDiskManager := func(file *os.File, diskManager *disk.DiskManager) {
+		if err := diskManager.Close(); err != nil {
+			panic(err)
+		}
 		if err := file.Close(); err != nil {
 			panic(err)
 		}
 		if err := os.Remove(file.Name()); err != nil {
 			panic(err)
 		}
+		if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+			panic(err)
+		}
 	}
 
 	t.Run("Search", func(t *testing.T) {
@@ -140,7 +153,7 @@ func TestBTree(t *testing.T) {
 			}
 			defer iter.Finish(bufmgr)
 
-			_, value, err := iter.Get()
+			_, value, err := iter.Get(bufmgr)
 			if err != nil {
 				panic(err)
 			}
@@ -156,7 +169,7 @@ func TestBTree(t *testing.T) {
 			}
 			defer iter.Finish(bufmgr)
 
-			_, value, err := iter.Get()
+			_, value, err := iter.Get(bufmgr)
 			if err != nil {
 				panic(err)
 			}
@@ -167,6 +180,124 @@ func TestBTree(t *testing.T) {
 		}
 	})
 
+	t.Run("Prev", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+
+		// 偶数のキーを、いくつものleafに分かれるよう登録する
+		const numKeys = 1000
+		for n := 0; n < numKeys; n += 2 {
+			if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), bytes.Repeat([]byte{byte(n)}, 100)); err != nil {
+				panic(err)
+			}
+		}
+		// iterからPrevで読めるキーを、ErrEndOfIteratorまで確かめる
+		checkPrev := func(iter *BTreeIter, from int) {
+			for n := from; n >= 0; n -= 2 {
+				k, v, err := iter.Prev(bufmgr)
+				if err != nil || !bytes.Equal(k, uint64ToBytes(uint64(n))) || v[0] != byte(n) {
+					t.Fatalf("iter.Prev() = %v, %v, want %v", k, err, n)
+				}
+			}
+			if _, _, err := iter.Prev(bufmgr); err != ErrEndOfIterator {
+				t.Fatalf("iter.Prev() = %v, want ErrEndOfIterator", err)
+			}
+		}
+
+		tests := []struct {
+			name       string
+			searchMode SearchMode
+			expect     int // 最初に返るキー（-1なら無し）
+		}{
+			{"End", &SearchModeEnd{}, numKeys - 2},
+			{"KeyBackward: 一致", &SearchModeKeyBackward{uint64ToBytes(500)}, 500},
+			{"KeyBackward: 不一致", &SearchModeKeyBackward{uint64ToBytes(501)}, 500},
+			{"KeyBackward: 最大のキーより後", &SearchModeKeyBackward{uint64ToBytes(numKeys * 2)}, numKeys - 2},
+			{"Key", &SearchModeKey{uint64ToBytes(501)}, 502},
+		}
+		for _, tt := range tests {
+			iter, err := btree.Search(bufmgr, tt.searchMode)
+			if err != nil {
+				panic(err)
+			}
+			if k, _, err := iter.Get(bufmgr); err != nil || !bytes.Equal(k, uint64ToBytes(uint64(tt.expect))) {
+				t.Fatalf("%s: iter.Get() = %v, %v, want %v", tt.name, k, err, tt.expect)
+			}
+			checkPrev(iter, tt.expect)
+			iter.Finish(bufmgr)
+		}
+
+		// 最小のキーより前には何も無い
+		{
+			iter, err := btree.Search(bufmgr, &SearchModeKeyBackward{[]byte{}})
+			if err != nil {
+				panic(err)
+			}
+			if _, _, err := iter.Prev(bufmgr); err != ErrEndOfIterator {
+				t.Fatalf("iter.Prev() = %v, want ErrEndOfIterator", err)
+			}
+			iter.Finish(bufmgr)
+		}
+
+		// NextとPrevは今の位置のペアを返してから、それぞれの向きに進む
+		{
+			iter, err := btree.Search(bufmgr, &SearchModeKey{uint64ToBytes(100)})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+			for _, step := range []struct {
+				prev   bool
+				expect int
+			}{
+				{false, 100}, {false, 102}, {true, 104}, {true, 102}, {true, 100}, {false, 98}, {false, 100},
+			} {
+				next := iter.Next
+				if step.prev {
+					next = iter.Prev
+				}
+				if k, _, err := next(bufmgr); err != nil || !bytes.Equal(k, uint64ToBytes(uint64(step.expect))) {
+					t.Fatalf("iter.Next()/Prev() = %v, %v, want %v", k, err, step.expect)
+				}
+			}
+		}
+
+		// 読み進める間にleafが併合されても、読み飛ばさない
+		{
+			iter, err := btree.Search(bufmgr, &SearchModeEnd{})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+			for n := numKeys - 2; n >= numKeys/2; n -= 2 {
+				if _, _, err := iter.Prev(bufmgr); err != nil {
+					panic(err)
+				}
+			}
+			for n := 0; n < numKeys/2-10; n += 2 {
+				if err := btree.Delete(bufmgr, uint64ToBytes(uint64(n))); err != nil {
+					panic(err)
+				}
+			}
+			for n := numKeys/2 - 2; n >= numKeys/2-10; n -= 2 {
+				if k, _, err := iter.Prev(bufmgr); err != nil || !bytes.Equal(k, uint64ToBytes(uint64(n))) {
+					t.Fatalf("iter.Prev() = %v, %v, want %v", k, err, n)
+				}
+			}
+			if _, _, err := iter.Prev(bufmgr); err != ErrEndOfIterator {
+				t.Fatalf("iter.Prev() = %v, want ErrEndOfIterator", err)
+			}
+		}
+	})
+
 	t.Run("Split", func(t *testing.T) {
 		arrayRepeat := func(value byte, length int) []byte {
 			longData := make([]byte, length)
@@ -251,7 +382,7 @@ func TestBTree(t *testing.T) {
 				}
 				defer iter.Finish(bufmgr)
 
-				k, v, err := iter.Get()
+				k, v, err := iter.Get(bufmgr)
 				if err != nil {
 					panic(err)
 				}
@@ -284,4 +415,892 @@ func TestBTree(t *testing.T) {
 			t.Fatalf("btree.Insert() = %v, want ErrDuplicateKey", err)
 		}
 	})
+
+	t.Run("Delete", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+
+		// 3段のツリーになるよう、長めのキーで登録する
+		makeKey := func(n int) []byte {
+			key := bytes.Repeat([]byte{0xAB}, 100)
+			copy(key, uint64ToBytes(uint64(n)))
+			return key
+		}
+		const numKeys = 1000
+		for _, n := range rand.New(rand.NewSource(1)).Perm(numKeys) {
+			if err := btree.Insert(bufmgr, makeKey(n), bytes.Repeat([]byte{byte(n)}, 100)); err != nil {
+				panic(err)
+			}
+		}
+
+		assertKeys := func(alive map[int]bool) {
+			iter, err := btree.Search(bufmgr, &SearchModeStart{})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+
+			for n := 0; n < numKeys; n++ {
+				if !alive[n] {
+					continue
+				}
+				k, v, err := iter.Next(bufmgr)
+				if err != nil {
+					t.Fatalf("iter.Next() = %v, want key %d", err, n)
+				}
+				if !bytes.Equal(k, makeKey(n)) {
+					t.Fatalf("iter.Next() key = %v, want %v", k[:8], makeKey(n)[:8])
+				}
+				if v[0] != byte(n) {
+					t.Fatalf("iter.Next() value = %v, want %v", v[0], byte(n))
+				}
+			}
+			if _, _, err := iter.Next(bufmgr); err != ErrEndOfIterator {
+				t.Fatalf("iter.Next() = %v, want ErrEndOfIterator", err)
+			}
+		}
+
+		alive := map[int]bool{}
+		for n := 0; n < numKeys; n++ {
+			alive[n] = true
+		}
+
+		// 半分を削除
+		for _, n := range rand.New(rand.NewSource(2)).Perm(numKeys)[:numKeys/2] {
+			if err := btree.Delete(bufmgr, makeKey(n)); err != nil {
+				t.Fatalf("btree.Delete(%d) = %v", n, err)
+			}
+			delete(alive, n)
+		}
+		assertKeys(alive)
+
+		// 削除済みのキーは見つからない
+		for n := 0; n < numKeys; n++ {
+			iter, err := btree.Search(bufmgr, &SearchModeKey{makeKey(n)})
+			if err != nil {
+				panic(err)
+			}
+			k, _, err := iter.Get(bufmgr)
+			iter.Finish(bufmgr)
+			found := err == nil && bytes.Equal(k, makeKey(n))
+			if found != alive[n] {
+				t.Fatalf("btree.Search(%d) found = %v, want %v", n, found, alive[n])
+			}
+		}
+		for n := range rand.New(rand.NewSource(3)).Perm(numKeys) {
+			if alive[n] {
+				continue
+			}
+			if err := btree.Delete(bufmgr, makeKey(n)); err != ErrKeyNotFound {
+				t.Fatalf("btree.Delete(%d) = %v, want ErrKeyNotFound", n, err)
+			}
+		}
+
+		// 残りもすべて削除
+		for n := range alive {
+			if err := btree.Delete(bufmgr, makeKey(n)); err != nil {
+				t.Fatalf("btree.Delete(%d) = %v", n, err)
+			}
+			delete(alive, n)
+		}
+		assertKeys(alive)
+
+		// 空になった後も再び登録できる
+		if err := btree.Insert(bufmgr, makeKey(1), []byte("hello")); err != nil {
+			panic(err)
+		}
+		alive[1] = true
+		if err := btree.Insert(bufmgr, makeKey(1), []byte("hello")); err != ErrDuplicateKey {
+			t.Fatalf("btree.Insert() = %v, want ErrDuplicateKey", err)
+		}
+	})
+
+	t.Run("Delete: ページの再利用", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+
+		const numKeys = 1000
+		insertAll := func() int64 {
+			for _, n := range rand.New(rand.NewSource(1)).Perm(numKeys) {
+				if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), bytes.Repeat([]byte{byte(n)}, 100)); err != nil {
+					panic(err)
+				}
+			}
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+			stat, err := file.Stat()
+			if err != nil {
+				panic(err)
+			}
+			return stat.Size()
+		}
+		size := insertAll()
+
+		// 併合で使われなくなったページは解放され、Flushでファイルが切り詰められる
+		for n := 0; n < numKeys; n++ {
+			if err := btree.Delete(bufmgr, uint64ToBytes(uint64(n))); err != nil {
+				panic(err)
+			}
+		}
+		if err := bufmgr.Flush(); err != nil {
+			panic(err)
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			panic(err)
+		}
+		if stat.Size() >= size {
+			t.Fatalf("file size = %v, want < %v", stat.Size(), size)
+		}
+
+		// 同じだけ登録し直すと、空きページを使い切ってから元の大きさに戻る
+		if size2 := insertAll(); size2 != size {
+			t.Fatalf("file size = %v, want %v", size2, size)
+		}
+		if n := disk.NumFreePages(); n != 0 {
+			t.Fatalf("disk.NumFreePages() = %v, want 0", n)
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		const pageSize = disk.PAGE_SIZE
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		const numKeys = 1000
+		createTree := func() *BTree {
+			btree, err := CreateBTree(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			for n := 0; n < numKeys; n++ {
+				if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), bytes.Repeat([]byte{byte(n)}, 100)); err != nil {
+					panic(err)
+				}
+			}
+			return btree
+		}
+		fileSize := func() int64 {
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+			stat, err := file.Stat()
+			if err != nil {
+				panic(err)
+			}
+			return stat.Size()
+		}
+
+		dropped := createTree()
+		size1 := fileSize()
+		kept := createTree()
+		size2 := fileSize()
+
+		// 後ろに別の木があるので切り詰められず、すべて空きページになる
+		if err := dropped.Drop(bufmgr); err != nil {
+			panic(err)
+		}
+		if size := fileSize(); size != size2 {
+			t.Fatalf("file size = %v, want %v", size, size2)
+		}
+		if n, expect := disk.NumFreePages(), int(size1/pageSize-1); n != expect {
+			t.Fatalf("disk.NumFreePages() = %v, want %v", n, expect)
+		}
+		iter, err := kept.Search(bufmgr, &SearchModeKey{uint64ToBytes(10)})
+		if err != nil {
+			panic(err)
+		}
+		if _, value, err := iter.Next(bufmgr); err != nil || !bytes.Equal(value, bytes.Repeat([]byte{10}, 100)) {
+			t.Fatalf("iter.Next() = %v, %v", value, err)
+		}
+		iter.Finish(bufmgr)
+
+		// 解放したページを使い切るまでファイルは大きくならない
+		createTree()
+		if size := fileSize(); size != size2 {
+			t.Fatalf("file size = %v, want %v", size, size2)
+		}
+		if n := disk.NumFreePages(); n != 0 {
+			t.Fatalf("disk.NumFreePages() = %v, want 0", n)
+		}
+	})
+
+	t.Run("Update/Upsert", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+
+		const numKeys = 100
+		for n := 0; n < numKeys; n++ {
+			if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), []byte("a")); err != nil {
+				panic(err)
+			}
+		}
+
+		// 同じleafに収まる更新と、収まらずに分割が起きる更新
+		for n := 0; n < numKeys; n++ {
+			value := []byte("b")
+			if n%2 == 0 {
+				value = bytes.Repeat([]byte{byte(n)}, 500)
+			}
+			if err := btree.Update(bufmgr, uint64ToBytes(uint64(n)), value); err != nil {
+				t.Fatalf("btree.Update(%d) = %v", n, err)
+			}
+		}
+		if err := btree.Update(bufmgr, uint64ToBytes(numKeys), []byte("c")); err != ErrKeyNotFound {
+			t.Fatalf("btree.Update() = %v, want ErrKeyNotFound", err)
+		}
+		// 値はオーバーフローページに移せるが、キーは移せない
+		if err := btree.Update(bufmgr, make([]byte, 4096), []byte("c")); err != ErrTooLongData {
+			t.Fatalf("btree.Update() = %v, want ErrTooLongData", err)
+		}
+
+		// 既存キーは書き換え、新しいキーは挿入
+		if err := btree.Upsert(bufmgr, uint64ToBytes(1), []byte("d")); err != nil {
+			panic(err)
+		}
+		if err := btree.Upsert(bufmgr, uint64ToBytes(numKeys), []byte("e")); err != nil {
+			panic(err)
+		}
+
+		iter, err := btree.Search(bufmgr, &SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+
+		for n := 0; n <= numKeys; n++ {
+			var expect []byte
+			switch {
+			case n == 1:
+				expect = []byte("d")
+			case n == numKeys:
+				expect = []byte("e")
+			case n%2 == 0:
+				expect = bytes.Repeat([]byte{byte(n)}, 500)
+			default:
+				expect = []byte("b")
+			}
+			k, v, err := iter.Next(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			if !bytes.Equal(k, uint64ToBytes(uint64(n))) {
+				t.Fatalf("iter.Next() key = %v, want %v", k, uint64ToBytes(uint64(n)))
+			}
+			if !bytes.Equal(v, expect) {
+				t.Fatalf("iter.Next() value = %v, want %v", v, expect)
+			}
+		}
+		if _, _, err := iter.Next(bufmgr); err != ErrEndOfIterator {
+			t.Fatalf("iter.Next() = %v, want ErrEndOfIterator", err)
+		}
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		const pageSize = disk.PAGE_SIZE
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		fileSize := func() int64 {
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+			stat, err := file.Stat()
+			if err != nil {
+				panic(err)
+			}
+			return stat.Size()
+		}
+
+		// 偶数のキーには数ページにまたがる値を入れる
+		const numKeys = 20
+		makeValue := func(n int, size int) []byte {
+			value := make([]byte, size)
+			for i := range value {
+				value[i] = byte(n + i)
+			}
+			return value
+		}
+		values := map[int][]byte{}
+		for n := 0; n < numKeys; n++ {
+			value := makeValue(n, 10)
+			if n%2 == 0 {
+				value = makeValue(n, 3*pageSize+n)
+			}
+			if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), value); err != nil {
+				t.Fatalf("btree.Insert(%d) = %v", n, err)
+			}
+			values[n] = value
+		}
+		checkValues := func() {
+			iter, err := btree.Search(bufmgr, &SearchModeStart{})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+			for n := 0; n < numKeys; n++ {
+				expect, ok := values[n]
+				if !ok {
+					continue
+				}
+				key, value, err := iter.Next(bufmgr)
+				if err != nil {
+					t.Fatalf("iter.Next() = %v, want %d", err, n)
+				}
+				if !bytes.Equal(key, uint64ToBytes(uint64(n))) || !bytes.Equal(value, expect) {
+					t.Fatalf("iter.Next() = %v, (%d bytes), want %d", key, len(value), n)
+				}
+			}
+			if _, _, err := iter.Next(bufmgr); !xerrors.Is(err, ErrEndOfIterator) {
+				t.Fatalf("iter.Next() = %v, want ErrEndOfIterator", err)
+			}
+		}
+		checkValues()
+
+		iter, err := btree.Search(bufmgr, &SearchModeKey{uint64ToBytes(4)})
+		if err != nil {
+			panic(err)
+		}
+		if _, value, err := iter.Get(bufmgr); err != nil || !bytes.Equal(value, values[4]) {
+			t.Fatalf("iter.Get() = %d bytes, %v", len(value), err)
+		}
+		iter.Finish(bufmgr)
+
+		// 大きな値と小さな値を入れ替えても、解放したページを使い回すのでファイルは大きくならない
+		size := fileSize()
+		for n := 0; n < numKeys; n++ {
+			value := makeValue(n+1, 3*pageSize+n)
+			if n%2 == 0 {
+				value = makeValue(n+1, 10)
+			}
+			if err := btree.Update(bufmgr, uint64ToBytes(uint64(n)), value); err != nil {
+				t.Fatalf("btree.Update(%d) = %v", n, err)
+			}
+			values[n] = value
+		}
+		checkValues()
+		if s := fileSize(); s != size {
+			t.Fatalf("file size = %v, want %v", s, size)
+		}
+
+		// 削除した値のページも空きページになる
+		numFreePages := disk.NumFreePages()
+		for n := 1; n < numKeys; n += 2 {
+			if err := btree.Delete(bufmgr, uint64ToBytes(uint64(n))); err != nil {
+				panic(err)
+			}
+			delete(values, n)
+		}
+		checkValues()
+		if n := disk.NumFreePages(); n < numFreePages+numKeys/2*4 {
+			t.Fatalf("disk.NumFreePages() = %v, want >= %v", n, numFreePages+numKeys/2*4)
+		}
+
+		// 失敗した挿入で書き込んだページは、ロールバックで解放される
+		numFreePages = disk.NumFreePages()
+		if err := btree.Insert(bufmgr, uint64ToBytes(0), makeValue(0, 3*pageSize)); err != ErrDuplicateKey {
+			t.Fatalf("btree.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if n := disk.NumFreePages(); n != numFreePages {
+			t.Fatalf("disk.NumFreePages() = %v, want %v", n, numFreePages)
+		}
+
+		// Dropでオーバーフローページも解放され、ファイルはヘッダだけになる
+		if err := btree.Drop(bufmgr); err != nil {
+			panic(err)
+		}
+		if size := fileSize(); size != pageSize {
+			t.Fatalf("file size = %v, want %v", size, pageSize)
+		}
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		value := bytes.Repeat([]byte{0xEE}, 500)
+		for n := 0; n < 20; n++ {
+			if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), value); err != nil {
+				panic(err)
+			}
+		}
+		countKeys := func(bufmgr *buffer.BufferPoolManager) int {
+			iter, err := btree.Search(bufmgr, &SearchModeStart{})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+
+			n := 0
+			for {
+				_, _, err := iter.Next(bufmgr)
+				if err == ErrEndOfIterator {
+					return n
+				}
+				if err != nil {
+					panic(err)
+				}
+				n++
+			}
+		}
+
+		// 分割やページの追い出しを伴う更新を取り消す
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		for n := 20; n < 100; n++ {
+			if err := btree.Insert(tx, uint64ToBytes(uint64(n)), value); err != nil {
+				panic(err)
+			}
+		}
+		for n := 0; n < 10; n++ {
+			if err := btree.Delete(tx, uint64ToBytes(uint64(n))); err != nil {
+				panic(err)
+			}
+		}
+		// 書き換えたページはロックしているので、他のトランザクションはロックが外れるまで待たされる
+		bufmgr.SetLockTimeout(10 * time.Millisecond)
+		if err := btree.Insert(bufmgr, uint64ToBytes(100), value); err != buffer.ErrLockTimeout {
+			t.Fatalf("btree.Insert() = %v, want ErrLockTimeout", err)
+		}
+		bufmgr.SetLockTimeout(0)
+		if n := countKeys(tx); n != 90 {
+			t.Fatalf("countKeys() = %v, want 90", n)
+		}
+		if err := tx.Rollback(); err != nil {
+			panic(err)
+		}
+		if n := countKeys(bufmgr); n != 20 {
+			t.Fatalf("countKeys() = %v, want 20", n)
+		}
+		if err := tx.Commit(); err != buffer.ErrNoTransaction {
+			t.Fatalf("tx.Commit() = %v, want ErrNoTransaction", err)
+		}
+
+		// ネストしたトランザクションはセーブポイントとして扱う
+		tx, err = bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		if err := btree.Insert(tx, uint64ToBytes(20), value); err != nil {
+			panic(err)
+		}
+		savepoint, err := tx.Begin()
+		if err != nil {
+			panic(err)
+		}
+		for n := 21; n < 50; n++ {
+			if err := btree.Insert(savepoint, uint64ToBytes(uint64(n)), value); err != nil {
+				panic(err)
+			}
+		}
+		if err := savepoint.Rollback(); err != nil {
+			panic(err)
+		}
+		if err := tx.Commit(); err != nil {
+			panic(err)
+		}
+		if n := countKeys(bufmgr); n != 21 {
+			t.Fatalf("countKeys() = %v, want 21", n)
+		}
+	})
+
+	t.Run("並行アクセス", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(64)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+
+		// 3段のツリーになるよう、長めのキーで登録する
+		makeKey := func(n int) []byte {
+			key := bytes.Repeat([]byte{0xAB}, 100)
+			copy(key, uint64ToBytes(uint64(n)))
+			return key
+		}
+		const numKeys = 1000
+		inserted := make([]int32, numKeys)
+		var deleting int32
+
+		// 1つのゴルーチンが登録してから奇数のキーを削除し、その間に他のゴルーチンが読む
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, n := range rand.New(rand.NewSource(1)).Perm(numKeys) {
+				if err := btree.Insert(bufmgr, makeKey(n), bytes.Repeat([]byte{byte(n)}, 100)); err != nil {
+					panic(err)
+				}
+				atomic.StoreInt32(&inserted[n], 1)
+			}
+			atomic.StoreInt32(&deleting, 1)
+			for n := 1; n < numKeys; n += 2 {
+				if err := btree.Delete(bufmgr, makeKey(n)); err != nil {
+					panic(err)
+				}
+			}
+		}()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				random := rand.New(rand.NewSource(int64(r)))
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					// 登録済みのキーは必ず見つかる
+					n := random.Intn(numKeys/2) * 2
+					if atomic.LoadInt32(&inserted[n]) == 1 {
+						iter, err := btree.Search(bufmgr, &SearchModeKey{makeKey(n)})
+						if err != nil {
+							panic(err)
+						}
+						k, v, err := iter.Get(bufmgr)
+						iter.Finish(bufmgr)
+						if err != nil || !bytes.Equal(k, makeKey(n)) || v[0] != byte(n) {
+							errs <- xerrors.Errorf("iter.Get() = %v, %v, want key %v", k, err, n)
+							return
+						}
+					}
+
+					// 走査ではキーが昇順（奇数番目のゴルーチンは降順）に並び、削除しない偶数のキーは読み飛ばされない
+					deletingAtStart := atomic.LoadInt32(&deleting) == 1
+					var searchMode SearchMode = &SearchModeStart{}
+					order := -1
+					if r%2 == 1 {
+						searchMode = &SearchModeEnd{}
+						order = 1
+					}
+					iter, err := btree.Search(bufmgr, searchMode)
+					if err != nil {
+						panic(err)
+					}
+					next := iter.Next
+					if r%2 == 1 {
+						next = iter.Prev
+					}
+					var prev []byte
+					numEven := 0
+					for {
+						k, _, err := next(bufmgr)
+						if err == ErrEndOfIterator {
+							break
+						}
+						if err != nil {
+							panic(err)
+						}
+						if prev != nil && bytes.Compare(prev, k) != order {
+							errs <- xerrors.Errorf("iter.Next()/Prev() = %v, after %v", k[:8], prev[:8])
+							iter.Finish(bufmgr)
+							return
+						}
+						if binary.BigEndian.Uint64(k)%2 == 0 {
+							numEven++
+						}
+						prev = k
+					}
+					iter.Finish(bufmgr)
+					if deletingAtStart && numEven != numKeys/2 {
+						errs <- xerrors.Errorf("numEven = %v, want %v", numEven, numKeys/2)
+						return
+					}
+				}
+			}(r)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		iter, err := btree.Search(bufmgr, &SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		for n := 0; n < numKeys; n += 2 {
+			k, _, err := iter.Next(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			if !bytes.Equal(k, makeKey(n)) {
+				t.Fatalf("iter.Next() key = %v, want %v", k[:8], n)
+			}
+		}
+		if _, _, err := iter.Next(bufmgr); err != ErrEndOfIterator {
+			t.Fatalf("iter.Next() = %v, want ErrEndOfIterator", err)
+		}
+	})
+
+	t.Run("並行な更新", func(t *testing.T) {
+		file, disk := createDiskManager()
+		defer destroyDiskManager(file, disk)
+
+		pool := buffer.NewBufferPool(64)
+		bufmgr := buffer.NewBufferPoolManager(disk, pool)
+
+		btree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+
+		makeKey := func(n int) []byte {
+			key := bytes.Repeat([]byte{0xCD}, 100)
+			copy(key, uint64ToBytes(uint64(n)))
+			return key
+		}
+		// 各ゴルーチンは自分の担当のキーを、10件ずつのトランザクションで登録してから奇数のキーを削除する
+		// 3つ目ごとのトランザクションは一度ロールバックしてからやり直す
+		const numWriters = 4
+		const numKeys = 2000
+		const batchSize = 10
+		var wg sync.WaitGroup
+		errs := make(chan error, numWriters)
+		for w := 0; w < numWriters; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				random := rand.New(rand.NewSource(int64(w)))
+				keys := []int{}
+				for _, n := range random.Perm(numKeys) {
+					if n%numWriters == w {
+						keys = append(keys, n)
+					}
+				}
+				odd := []int{}
+				for _, n := range keys {
+					if n%2 == 1 {
+						odd = append(odd, n)
+					}
+				}
+				apply := func(tx *buffer.BufferPoolManager, n int, insert bool) error {
+					if insert {
+						return btree.Insert(tx, makeKey(n), bytes.Repeat([]byte{byte(n)}, 100))
+					}
+					return btree.Delete(tx, makeKey(n))
+				}
+				run := func(ns []int, insert bool) error {
+					for i := 0; i < len(ns); i += batchSize {
+						batch := ns[i:]
+						if len(batch) > batchSize {
+							batch = batch[:batchSize]
+						}
+						for attempt := 0; ; attempt++ {
+							tx, err := bufmgr.Begin()
+							if err != nil {
+								return err
+							}
+							for _, n := range batch {
+								if err = apply(tx, n, insert); err != nil {
+									break
+								}
+							}
+							// デッドロックで失敗したトランザクションは、相手が先に進めるよう少し待ってからやり直す
+							if err == buffer.ErrDeadlock {
+								if err := tx.Rollback(); err != nil {
+									return err
+								}
+								time.Sleep(time.Duration(random.Intn(1000)) * time.Microsecond)
+								continue
+							}
+							if err != nil {
+								tx.Rollback()
+								return err
+							}
+							if i/batchSize%3 == 0 && attempt == 0 {
+								if err := tx.Rollback(); err != nil {
+									return err
+								}
+								continue
+							}
+							if err := tx.Commit(); err != nil {
+								return err
+							}
+							break
+						}
+					}
+					return nil
+				}
+				if err := run(keys, true); err != nil {
+					errs <- err
+					return
+				}
+				if err := run(odd, false); err != nil {
+					errs <- err
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		// 偶数のキーだけが昇順に残る
+		iter, err := btree.Search(bufmgr, &SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		for n := 0; n < numKeys; n += 2 {
+			k, v, err := iter.Next(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			if !bytes.Equal(k, makeKey(n)) || v[0] != byte(n) {
+				t.Fatalf("iter.Next() key = %v, want %v", k[:8], n)
+			}
+		}
+		if _, _, err := iter.Next(bufmgr); err != ErrEndOfIterator {
+			t.Fatalf("iter.Next() = %v, want ErrEndOfIterator", err)
+		}
+		for n := 0; n < numKeys; n++ {
+			iter, err := btree.Search(bufmgr, &SearchModeKey{makeKey(n)})
+			if err != nil {
+				panic(err)
+			}
+			k, _, err := iter.Get(bufmgr)
+			iter.Finish(bufmgr)
+			if found := err == nil && bytes.Equal(k, makeKey(n)); found != (n%2 == 0) {
+				t.Fatalf("found key %v = %v", n, found)
+			}
+		}
+	})
+
+	t.Run("WAL: クラッシュリカバリ", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "TestBTree")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
+		heapFilePath := filepath.Join(dir, "test.rly")
+
+		value := bytes.Repeat([]byte{0xEE}, 500)
+		openTree := func(mode disk.OpenMode) (*buffer.BufferPoolManager, *BTree) {
+			diskManager, err := disk.OpenDiskManagerWithMode(heapFilePath, mode)
+			if err != nil {
+				panic(err)
+			}
+			pool := buffer.NewBufferPool(5)
+			return buffer.NewBufferPoolManager(diskManager, pool), NewBTree(disk.PageId(0))
+		}
+		countKeys := func(bufmgr *buffer.BufferPoolManager, btree *BTree) int {
+			iter, err := btree.Search(bufmgr, &SearchModeStart{})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+
+			n := 0
+			for {
+				k, _, err := iter.Next(bufmgr)
+				if err == ErrEndOfIterator {
+					return n
+				}
+				if err != nil {
+					panic(err)
+				}
+				if !bytes.Equal(k, uint64ToBytes(uint64(n))) {
+					t.Fatalf("iter.Next() key = %v, want %v", k, uint64ToBytes(uint64(n)))
+				}
+				n++
+			}
+		}
+
+		{
+			bufmgr, _ := openTree(disk.OPEN_MODE_CREATE)
+			btree, err := CreateBTree(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			for n := 0; n < 20; n++ {
+				if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), value); err != nil {
+					panic(err)
+				}
+			}
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+
+			// コミットしたがページは書き出していない更新
+			for n := 20; n < 40; n++ {
+				if err := btree.Insert(bufmgr, uint64ToBytes(uint64(n)), value); err != nil {
+					panic(err)
+				}
+			}
+
+			// 分割が起き、ページが追い出されている途中でクラッシュ
+			tx, err := bufmgr.Begin()
+			if err != nil {
+				panic(err)
+			}
+			for n := 40; n < 100; n++ {
+				if err := btree.Insert(tx, uint64ToBytes(uint64(n)), value); err != nil {
+					panic(err)
+				}
+			}
+		}
+
+		bufmgr, btree := openTree(disk.OPEN_MODE_READ_WRITE)
+		if n := countKeys(bufmgr, btree); n != 40 {
+			t.Fatalf("countKeys() = %v, want 40", n)
+		}
+		if err := btree.Insert(bufmgr, uint64ToBytes(40), value); err != nil {
+			panic(err)
+		}
+	})
 }
@@ -0,0 +1,266 @@
+package btree
+
+import (
+	"bytes"
+	"unsafe"
+
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrTreeNotEmpty      = xerrors.New("tree is not empty")
+	ErrUnsortedKeys      = xerrors.New("keys are not sorted")
+	ErrInvalidFillFactor = xerrors.New("invalid fill factor")
+)
+
+// ページのどこまでペアを詰めるか
+// 残りは、後から挿入したときにすぐ分割が起きないよう空けておく
+const DEFAULT_FILL_FACTOR = 0.9
+
+// BulkLoadに渡す、キーの昇順にペアを返すイテレータ
+// 終わりに達したらErrEndOfIteratorを返す。BTreeIterもこれを満たす
+type Iterator interface {
+	Next(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error)
+}
+
+// キーと値のスライスを先頭から順に返すイテレータ
+type SliceIterator struct {
+	keys   [][]byte
+	values [][]byte
+	next   int
+}
+
+func NewSliceIterator(keys [][]byte, values [][]byte) *SliceIterator {
+	if len(keys) != len(values) {
+		panic("keys and values must have the same length")
+	}
+	return &SliceIterator{keys, values, 0}
+}
+
+func (it *SliceIterator) Next(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
+	if it.next >= len(it.keys) {
+		return nil, nil, ErrEndOfIterator
+	}
+	it.next++
+	return it.keys[it.next-1], it.values[it.next-1], nil
+}
+
+// 下の段のノードの、最小のキーとページID
+type bulkLoadChild struct {
+	key    []byte
+	pageId disk.PageId
+}
+
+func (t *BTree) BulkLoad(bufmgr *buffer.BufferPoolManager, iter Iterator) error {
+	return t.BulkLoadWithFillFactor(bufmgr, iter, DEFAULT_FILL_FACTOR)
+}
+
+// 空の木に、キーの昇順に並んだペアをleafから順に詰めていき、その上にbranchを積み上げる
+// 1件ずつ挿入するより速く、各ページはfillFactorの割合まで埋まる
+func (t *BTree) BulkLoadWithFillFactor(bufmgr *buffer.BufferPoolManager, iter Iterator, fillFactor float64) error {
+	if fillFactor <= 0 || 1 < fillFactor {
+		return ErrInvalidFillFactor
+	}
+	// ロックはiterを読み始める前に取るので、ロックが外れるのを待ってやり直してもペアを読み飛ばさない
+	return retryOnLock(bufmgr, func(bufmgr *buffer.BufferPoolManager) error {
+		metaBuffer, err := t.fetchMetaPage(bufmgr)
+		if err != nil {
+			return err
+		}
+		defer bufmgr.FinishUsingPage(metaBuffer)
+		metaBuffer.WLatch()
+		defer metaBuffer.WUnlatch()
+		if err := bufmgr.LockPage(metaBuffer.PageId); err != nil {
+			return err
+		}
+		meta := NewMeta(metaBuffer.Page[:])
+
+		oldRootPageId := meta.header.rootPageId
+		empty, err := isEmptyLeaf(bufmgr, oldRootPageId)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrTreeNotEmpty
+		}
+		if err := bufmgr.LockPage(oldRootPageId); err != nil {
+			return err
+		}
+
+		children, err := bulkLoadLeaves(bufmgr, iter, fillFactor)
+		if err != nil {
+			return err
+		}
+		for len(children) > 1 {
+			children, err = bulkLoadBranches(bufmgr, children, fillFactor)
+			if err != nil {
+				return err
+			}
+		}
+		meta.header.rootPageId = children[0].pageId
+		metaBuffer.IsDirty = true
+		return bufmgr.DeallocatePage(oldRootPageId)
+	})
+}
+
+func isEmptyLeaf(bufmgr *buffer.BufferPoolManager, pageId disk.PageId) (bool, error) {
+	nodeBuffer, err := bufmgr.FetchPage(pageId)
+	if err != nil {
+		return false, err
+	}
+	defer bufmgr.FinishUsingPage(nodeBuffer)
+	nodeBuffer.RLatch()
+	defer nodeBuffer.RUnlatch()
+
+	node := NewNode(nodeBuffer.Page[:])
+	return node.header.NodeTypeString() == NODE_TYPE_LEAF && NewLeaf(node.body).NumPairs() == 0, nil
+}
+
+// ペアを加えてもfillFactorを超えないか。空のノードには必ず1つは入れる
+func fitsFillFactor(body *Slotted, size int, fillFactor float64) bool {
+	if body.NumSlots() == 0 {
+		return true
+	}
+	size += pointerSize
+	return size <= body.FreeSpace() && body.UsedSpace()+size <= int(fillFactor*float64(body.Capacity()))
+}
+
+// leafを左から順に作ってつなぎ、それぞれの最小のキーとページIDを返す
+// 入力が空でも、空のleafを1つ作る
+func bulkLoadLeaves(bufmgr *buffer.BufferPoolManager, iter Iterator, fillFactor float64) ([]bulkLoadChild, error) {
+	children := []bulkLoadChild{}
+	var leafBuffer *buffer.Buffer
+	var leaf *Leaf
+	defer func() {
+		if leafBuffer != nil {
+			bufmgr.FinishUsingPage(leafBuffer)
+		}
+	}()
+	addLeaf := func(key []byte) error {
+		newLeafBuffer, err := bufmgr.CreatePage()
+		if err != nil {
+			return err
+		}
+		node := NewNode(newLeafBuffer.Page[:])
+		node.InitializeAsLeaf()
+		newLeaf := NewLeaf(node.body)
+		newLeaf.Initialize()
+		if leafBuffer != nil {
+			leaf.SetNextPageId(newLeafBuffer.PageId)
+			newLeaf.SetPrevPageId(leafBuffer.PageId)
+			bufmgr.FinishUsingPage(leafBuffer)
+		}
+		leafBuffer, leaf = newLeafBuffer, newLeaf
+		children = append(children, bulkLoadChild{key, newLeafBuffer.PageId})
+		return nil
+	}
+
+	var prevKey []byte
+	for {
+		key, value, err := iter.Next(bufmgr)
+		if xerrors.Is(err, ErrEndOfIterator) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if leafBuffer != nil {
+			if c := bytes.Compare(prevKey, key); c == 0 {
+				return nil, ErrDuplicateKey
+			} else if c > 0 {
+				return nil, ErrUnsortedKeys
+			}
+		}
+		// イテレータがバッファを使い回してもよいよう、控えるキーはコピーしておく
+		prevKey = append(prevKey[:0], key...)
+
+		pair, err := newLeafPair(bufmgr, key, value)
+		if err != nil {
+			return nil, err
+		}
+		if leafBuffer == nil || !fitsFillFactor(leaf.body, len(pair.ToBytes()), fillFactor) {
+			if err := addLeaf(append([]byte{}, key...)); err != nil {
+				return nil, err
+			}
+		}
+		if err := leaf.InsertPair(leaf.NumPairs(), pair); err != nil {
+			return nil, err
+		}
+		leafBuffer.IsDirty = true
+	}
+	if leafBuffer == nil {
+		if err := addLeaf(nil); err != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+// 子を順にbranchへ分けて、1つ上の段を作る
+// branchには子が2つ以上必要なので、最後のbranchの子が1つだけになったら前のbranchと調整する
+func bulkLoadBranches(bufmgr *buffer.BufferPoolManager, children []bulkLoadChild, fillFactor float64) ([]bulkLoadChild, error) {
+	capacity := NewBranch(make([]byte, disk.PAGE_BODY_SIZE-int(unsafe.Sizeof(NodeHeader{})))).body.Capacity()
+	limit := int(fillFactor * float64(capacity))
+	// 子jを入れると、そのキーと左隣の子のページIDのペアが増える
+	pairSize := func(j int) int {
+		pair := Pair{Key: children[j].key, Value: disk.PageIdToBytes(children[j-1].pageId)}
+		return len(pair.ToBytes()) + pointerSize
+	}
+	groupSize := func(start int, end int) int {
+		size := 0
+		for j := start + 1; j < end; j++ {
+			size += pairSize(j)
+		}
+		return size
+	}
+
+	// 各branchの最初の子の位置。最初の子のキーは1つ上の段の境界キーになる
+	starts := []int{0}
+	used := 0
+	for j := 1; j < len(children); j++ {
+		size := pairSize(j)
+		if j-starts[len(starts)-1] >= 2 && used+size > limit {
+			starts = append(starts, j)
+			used = 0
+			continue
+		}
+		used += size
+	}
+	if last := len(starts) - 1; last > 0 && starts[last] == len(children)-1 {
+		if groupSize(starts[last-1], len(children)) <= capacity {
+			starts = starts[:last]
+		} else {
+			starts[last]--
+		}
+	}
+
+	parents := []bulkLoadChild{}
+	for i, start := range starts {
+		end := len(children)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		branchBuffer, err := bufmgr.CreatePage()
+		if err != nil {
+			return nil, err
+		}
+		node := NewNode(branchBuffer.Page[:])
+		node.InitializeAsBranch()
+		branch := NewBranch(node.body)
+		branch.body.Initialize()
+		for j := start + 1; j < end; j++ {
+			if err := branch.Insert(branch.NumPairs(), children[j].key, children[j-1].pageId); err != nil {
+				bufmgr.FinishUsingPage(branchBuffer)
+				return nil, err
+			}
+		}
+		branch.SetRightChild(children[end-1].pageId)
+		branchBuffer.IsDirty = true
+		bufmgr.FinishUsingPage(branchBuffer)
+		parents = append(parents, bulkLoadChild{children[start].key, branchBuffer.PageId})
+	}
+	return parents, nil
+}
@@ -0,0 +1,259 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+func TestBulkLoad(t *testing.T) {
+	uint64ToBytes := func(n uint64) []byte {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, n)
+		return buf[:]
+	}
+
+	createBufferPoolManager := func() (*buffer.BufferPoolManager, func() int64, func()) {
+		file, err := ioutil.TempFile("", "TestBulkLoad")
+		if err != nil {
+			panic(err)
+		}
+		diskManager, err := disk.CreateDiskManager(file.Name())
+		if err != nil {
+			panic(err)
+		}
+		bufmgr := buffer.NewBufferPoolManager(diskManager, buffer.NewBufferPool(10))
+		fileSize := func() int64 {
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+			stat, err := file.Stat()
+			if err != nil {
+				panic(err)
+			}
+			return stat.Size()
+		}
+		cleanup := func() {
+			if err := diskManager.Close(); err != nil {
+				panic(err)
+			}
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(file.Name()); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+				panic(err)
+			}
+		}
+		return bufmgr, fileSize, cleanup
+	}
+
+	makePairs := func(from int, to int, step int, valueSize int) ([][]byte, [][]byte) {
+		keys, values := [][]byte{}, [][]byte{}
+		for n := from; n < to; n += step {
+			keys = append(keys, uint64ToBytes(uint64(n)))
+			values = append(values, bytes.Repeat([]byte{byte(n)}, valueSize))
+		}
+		return keys, values
+	}
+
+	checkPairs := func(bufmgr *buffer.BufferPoolManager, tree *BTree, keys [][]byte, values [][]byte) {
+		iter, err := tree.Search(bufmgr, &SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		for i := range keys {
+			key, value, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("iter.Next() = %v, want %v", err, keys[i])
+			}
+			if !bytes.Equal(key, keys[i]) || !bytes.Equal(value, values[i]) {
+				t.Fatalf("iter.Next() = %v, (%d bytes), want %v", key, len(value), keys[i])
+			}
+		}
+		if _, _, err := iter.Next(bufmgr); !xerrors.Is(err, ErrEndOfIterator) {
+			t.Fatalf("iter.Next() = %v, want ErrEndOfIterator", err)
+		}
+	}
+
+	t.Run("正常系", func(t *testing.T) {
+		const numKeys = 5000
+		keys, values := makePairs(0, 2*numKeys, 2, 20)
+
+		// 1件ずつ挿入した場合のファイルサイズ
+		insertedSize := func() int64 {
+			bufmgr, fileSize, cleanup := createBufferPoolManager()
+			defer cleanup()
+			tree, err := CreateBTree(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			for i := range keys {
+				if err := tree.Insert(bufmgr, keys[i], values[i]); err != nil {
+					panic(err)
+				}
+			}
+			return fileSize()
+		}()
+
+		prevSize := int64(0)
+		for _, fillFactor := range []float64{0.5, DEFAULT_FILL_FACTOR, 1.0} {
+			func() {
+				bufmgr, fileSize, cleanup := createBufferPoolManager()
+				defer cleanup()
+				tree, err := CreateBTree(bufmgr)
+				if err != nil {
+					panic(err)
+				}
+				if err := tree.BulkLoadWithFillFactor(bufmgr, NewSliceIterator(keys, values), fillFactor); err != nil {
+					t.Fatalf("tree.BulkLoadWithFillFactor(%v) = %v", fillFactor, err)
+				}
+				checkPairs(bufmgr, tree, keys, values)
+
+				// 詰める割合が大きいほどページは少なくて済む
+				size := fileSize()
+				if prevSize != 0 && size >= prevSize {
+					t.Fatalf("fillFactor %v: file size = %v, want < %v", fillFactor, size, prevSize)
+				}
+				if fillFactor == 1.0 && size >= insertedSize {
+					t.Fatalf("file size = %v, want < %v", size, insertedSize)
+				}
+				prevSize = size
+
+				// 作った木にも、普通に挿入や削除ができる
+				newKeys, newValues := makePairs(1, 2*numKeys, 2, 20)
+				for i := range newKeys {
+					if err := tree.Insert(bufmgr, newKeys[i], newValues[i]); err != nil {
+						t.Fatalf("tree.Insert(%v) = %v", newKeys[i], err)
+					}
+				}
+				for i := range keys {
+					if err := tree.Delete(bufmgr, keys[i]); err != nil {
+						t.Fatalf("tree.Delete(%v) = %v", keys[i], err)
+					}
+				}
+				checkPairs(bufmgr, tree, newKeys, newValues)
+			}()
+		}
+	})
+
+	t.Run("長いキー", func(t *testing.T) {
+		// branchが何段にもなり、各段の最後のbranchの子の数も様々になる
+		for _, numKeys := range []int{1000, 1001, 1002, 1003} {
+			bufmgr, _, cleanup := createBufferPoolManager()
+			tree, err := CreateBTree(bufmgr)
+			if err != nil {
+				panic(err)
+			}
+			keys, values := makePairs(0, numKeys, 1, 1)
+			for i := range keys {
+				keys[i] = append(keys[i], bytes.Repeat([]byte{'k'}, 500)...)
+			}
+			if err := tree.BulkLoadWithFillFactor(bufmgr, NewSliceIterator(keys, values), 0.5); err != nil {
+				t.Fatalf("tree.BulkLoadWithFillFactor() = %v", err)
+			}
+			checkPairs(bufmgr, tree, keys, values)
+			for i := range keys {
+				iter, err := tree.Search(bufmgr, &SearchModeKey{keys[i]})
+				if err != nil {
+					panic(err)
+				}
+				if key, _, err := iter.Get(bufmgr); err != nil || !bytes.Equal(key, keys[i]) {
+					t.Fatalf("iter.Get() = %v, %v, want %v", key[:8], err, keys[i][:8])
+				}
+				iter.Finish(bufmgr)
+			}
+			cleanup()
+		}
+	})
+
+	t.Run("オーバーフローと空の入力", func(t *testing.T) {
+		bufmgr, _, cleanup := createBufferPoolManager()
+		defer cleanup()
+
+		tree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		keys, values := makePairs(0, 10, 1, 2*disk.PAGE_SIZE)
+		if err := tree.BulkLoad(bufmgr, NewSliceIterator(keys, values)); err != nil {
+			t.Fatalf("tree.BulkLoad() = %v", err)
+		}
+		checkPairs(bufmgr, tree, keys, values)
+
+		empty, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if err := empty.BulkLoad(bufmgr, NewSliceIterator(nil, nil)); err != nil {
+			t.Fatalf("tree.BulkLoad() = %v", err)
+		}
+		checkPairs(bufmgr, empty, nil, nil)
+
+		// 別の木のイテレータから読み込んでもよい
+		copied, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		iter, err := tree.Search(bufmgr, &SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		if err := copied.BulkLoad(bufmgr, iter); err != nil {
+			t.Fatalf("tree.BulkLoad() = %v", err)
+		}
+		checkPairs(bufmgr, copied, keys, values)
+	})
+
+	t.Run("異常系", func(t *testing.T) {
+		bufmgr, _, cleanup := createBufferPoolManager()
+		defer cleanup()
+
+		tree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		keys, values := makePairs(0, 1000, 1, 20)
+		unsortedKeys := append([][]byte{}, keys...)
+		unsortedKeys[500], unsortedKeys[501] = unsortedKeys[501], unsortedKeys[500]
+		duplicateKeys := append([][]byte{}, keys...)
+		duplicateKeys[501] = duplicateKeys[500]
+
+		tests := []struct {
+			keys       [][]byte
+			fillFactor float64
+			err        error
+		}{
+			{unsortedKeys, DEFAULT_FILL_FACTOR, ErrUnsortedKeys},
+			{duplicateKeys, DEFAULT_FILL_FACTOR, ErrDuplicateKey},
+			{keys, 0, ErrInvalidFillFactor},
+			{keys, 1.5, ErrInvalidFillFactor},
+		}
+		for _, tt := range tests {
+			if err := tree.BulkLoadWithFillFactor(bufmgr, NewSliceIterator(tt.keys, values), tt.fillFactor); err != tt.err {
+				t.Fatalf("tree.BulkLoadWithFillFactor() = %v, want %v", err, tt.err)
+			}
+			// 失敗しても木は空のまま
+			checkPairs(bufmgr, tree, nil, nil)
+		}
+
+		if err := tree.BulkLoad(bufmgr, NewSliceIterator(keys, values)); err != nil {
+			t.Fatalf("tree.BulkLoad() = %v", err)
+		}
+		if err := tree.BulkLoad(bufmgr, NewSliceIterator(keys, values)); err != ErrTreeNotEmpty {
+			t.Fatalf("tree.BulkLoad() = %v, want ErrTreeNotEmpty", err)
+		}
+		checkPairs(bufmgr, tree, keys, values)
+	})
+}
@@ -86,7 +86,10 @@ func (l *Leaf) SetNextPageId(nextPageId disk.PageId) {
 }
 
 func (l *Leaf) Insert(slotId int, key []byte, value []byte) error {
-	pair := Pair{Key: key, Value: value}
+	return l.InsertPair(slotId, &Pair{Key: key, Value: value})
+}
+
+func (l *Leaf) InsertPair(slotId int, pair *Pair) error {
 	pairBytes := pair.ToBytes()
 	if len(pairBytes) > l.MaxPairSize() {
 		return ErrTooLongData
@@ -99,28 +102,65 @@ func (l *Leaf) Insert(slotId int, key []byte, value []byte) error {
 	return nil
 }
 
+func (l *Leaf) Update(slotId int, key []byte, value []byte) error {
+	return l.UpdatePair(slotId, &Pair{Key: key, Value: value})
+}
+
+func (l *Leaf) UpdatePair(slotId int, pair *Pair) error {
+	pairBytes := pair.ToBytes()
+	if len(pairBytes) > l.MaxPairSize() {
+		return ErrTooLongData
+	}
+	err := l.body.Resize(slotId, len(pairBytes))
+	if err != nil {
+		return err
+	}
+	l.body.WriteData(slotId, pairBytes)
+	return nil
+}
+
+func (l *Leaf) Remove(slotId int) {
+	l.body.Remove(slotId)
+}
+
 func (l *Leaf) isHalfFull() bool {
 	return 2*l.body.FreeSpace() < l.body.Capacity()
 }
 
+// 分割せずにペアを格納できるか
+func (l *Leaf) isSafeForInsert(pair *Pair) bool {
+	pairSize := len(pair.ToBytes())
+	return pairSize <= l.MaxPairSize() && pairSize+pointerSize <= l.body.FreeSpace()
+}
+
+// ペアを削除しても半分を下回らないか
+func (l *Leaf) isSafeForDelete(slotId int) bool {
+	pairSize := len(l.body.ReadData(slotId))
+	return 2*(l.body.FreeSpace()+pairSize+pointerSize) < l.body.Capacity()
+}
+
 func (l *Leaf) SplitInsert(newLeaf *Leaf, newKey []byte, newValue []byte) []byte {
+	return l.SplitInsertPair(newLeaf, &Pair{Key: newKey, Value: newValue})
+}
+
+func (l *Leaf) SplitInsertPair(newLeaf *Leaf, newPair *Pair) []byte {
 	newLeaf.Initialize()
 	for {
 		if newLeaf.isHalfFull() {
-			result, index := l.SearchSlotId(newKey)
+			result, index := l.SearchSlotId(newPair.Key)
 			if result == bsearch.BINARY_SEARCH_RESULT_HIT {
 				panic("key must be unique")
 			}
-			err := l.Insert(index, newKey, newValue)
+			err := l.InsertPair(index, newPair)
 			if err != nil {
 				panic(xerrors.Errorf("old leaf must have space: %v", err))
 			}
 			break
 		}
-		if bytes.Compare(l.PairAt(0).Key, newKey) < 0 {
+		if bytes.Compare(l.PairAt(0).Key, newPair.Key) < 0 {
 			l.Transfer(newLeaf)
 		} else {
-			err := newLeaf.Insert(newLeaf.NumPairs(), newKey, newValue)
+			err := newLeaf.InsertPair(newLeaf.NumPairs(), newPair)
 			if err != nil {
 				panic(xerrors.Errorf("new leaf must have space: %v", err))
 			}
@@ -143,3 +183,18 @@ func (l *Leaf) Transfer(dest *Leaf) {
 	dest.body.WriteData(nextIndex, srcBody)
 	l.body.Remove(0)
 }
+
+func (l *Leaf) TransferLast(dest *Leaf) {
+	lastIndex := l.NumPairs() - 1
+	srcBody := l.body.ReadData(lastIndex)
+	err := dest.body.Insert(0, len(srcBody))
+	if err != nil {
+		panic(err)
+	}
+	dest.body.WriteData(0, srcBody)
+	l.body.Remove(lastIndex)
+}
+
+func (l *Leaf) canMerge(other *Leaf) bool {
+	return l.body.UsedSpace()+other.body.UsedSpace() <= l.body.Capacity()
+}
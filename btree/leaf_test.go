@@ -138,4 +138,26 @@ func TestLeaf(t *testing.T) {
 			{"zzzzzzzz", "hello"},
 		})
 	})
+
+	t.Run("Update", func(t *testing.T) {
+		pageData := make([]byte, 88)
+		leafPage := NewLeaf(pageData)
+		leafPage.Initialize()
+
+		insert(leafPage, []byte("deadbeef"), []byte("world"), 0) // 4 + 13 + 6 = 23 bytes
+		insert(leafPage, []byte("facebook"), []byte("!"), 1)     // 4 + 9 + 6 = 19 bytes
+
+		if err := leafPage.Update(1, []byte("facebook"), []byte("hello")); err != nil {
+			t.Fatalf("leafPage.Update(): %v", err)
+		}
+		if err := leafPage.Update(0, []byte("deadbeef"), []byte("w")); err != nil {
+			t.Fatalf("leafPage.Update(): %v", err)
+		}
+		pairAtTest(leafPage, 0, []byte("deadbeef"), []byte("w"))
+		pairAtTest(leafPage, 1, []byte("facebook"), []byte("hello"))
+
+		if err := leafPage.Update(0, []byte("deadbeef"), make([]byte, 30)); err != ErrTooLongData {
+			t.Fatalf("leafPage.Update() = %v, want ErrTooLongData", err)
+		}
+	})
 }
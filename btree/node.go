@@ -6,6 +6,7 @@ import (
 
 const NODE_TYPE_LEAF string = "LEAF    "
 const NODE_TYPE_BRANCH string = "BRANCH  "
+const NODE_TYPE_OVERFLOW string = "OVERFLOW"
 
 type NodeHeader struct {
 	nodeType [8]byte
@@ -39,3 +40,7 @@ func (n *Node) InitializeAsLeaf() {
 func (n *Node) InitializeAsBranch() {
 	copy(n.header.nodeType[:], []byte(NODE_TYPE_BRANCH))
 }
+
+func (n *Node) InitializeAsOverflow() {
+	copy(n.header.nodeType[:], []byte(NODE_TYPE_OVERFLOW))
+}
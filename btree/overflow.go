@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"unsafe"
+
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrBrokenOverflow = xerrors.New("broken overflow page")
+)
+
+type OverflowHeader struct {
+	nextPageId disk.PageId
+	dataLength uint64
+}
+
+// leafに収まらない値を、ページの連結リストに分けて格納する
+type Overflow struct {
+	header *OverflowHeader
+	body   []byte
+}
+
+func NewOverflow(bytes []byte) *Overflow {
+	overflow := Overflow{}
+	headerSize := int(unsafe.Sizeof(*overflow.header))
+	if headerSize+1 > len(bytes) {
+		panic("overflow header must be aligned")
+	}
+
+	overflow.header = (*OverflowHeader)(unsafe.Pointer(&bytes[0]))
+	overflow.body = bytes[headerSize:]
+	return &overflow
+}
+
+func (o *Overflow) NextPageId() (disk.PageId, error) {
+	pageId, err := o.header.nextPageId.Valid()
+	if err != nil {
+		return disk.INVALID_PAGE_ID, err
+	}
+	return pageId, nil
+}
+
+func (o *Overflow) Data() []byte {
+	return o.body[:o.header.dataLength]
+}
+
+// 書き込めた長さを返す
+func (o *Overflow) Initialize(data []byte, nextPageId disk.PageId) int {
+	n := copy(o.body, data)
+	o.header.dataLength = uint64(n)
+	o.header.nextPageId = nextPageId
+	return n
+}
+
+func overflowCapacity() int {
+	return disk.PAGE_BODY_SIZE - int(unsafe.Sizeof(NodeHeader{})) - int(unsafe.Sizeof(OverflowHeader{}))
+}
+
+// 値をオーバーフローページに書き込み、先頭のページIDを返す
+// 前のページに次のページIDを書くので、後ろのページから作っていく
+func writeOverflow(bufmgr *buffer.BufferPoolManager, value []byte) (disk.PageId, error) {
+	capacity := overflowCapacity()
+	numPages := (len(value) + capacity - 1) / capacity
+	nextPageId := disk.INVALID_PAGE_ID
+	for i := numPages - 1; i >= 0; i-- {
+		overflowBuffer, err := bufmgr.CreatePage()
+		if err != nil {
+			return disk.INVALID_PAGE_ID, err
+		}
+		node := NewNode(overflowBuffer.Page[:])
+		node.InitializeAsOverflow()
+		NewOverflow(node.body).Initialize(value[i*capacity:], nextPageId)
+		overflowBuffer.IsDirty = true
+		nextPageId = overflowBuffer.PageId
+		bufmgr.FinishUsingPage(overflowBuffer)
+	}
+	return nextPageId, nil
+}
+
+// オーバーフローページは書き換えられることがないので、ラッチは取らない
+// 解放はleafから外したトランザクションの終了まで遅れるので、leafの読み込みラッチを持ったまま呼ぶこと
+func readOverflow(bufmgr *buffer.BufferPoolManager, pageId disk.PageId) ([]byte, error) {
+	value := []byte{}
+	for pageId != disk.INVALID_PAGE_ID {
+		overflowBuffer, err := bufmgr.FetchPage(pageId)
+		if err != nil {
+			return nil, err
+		}
+		node := NewNode(overflowBuffer.Page[:])
+		if node.header.NodeTypeString() != NODE_TYPE_OVERFLOW {
+			bufmgr.FinishUsingPage(overflowBuffer)
+			return nil, ErrBrokenOverflow
+		}
+		overflow := NewOverflow(node.body)
+		value = append(value, overflow.Data()...)
+		pageId = overflow.header.nextPageId
+		bufmgr.FinishUsingPage(overflowBuffer)
+	}
+	return value, nil
+}
+
+func freeOverflow(bufmgr *buffer.BufferPoolManager, pageId disk.PageId) error {
+	for pageId != disk.INVALID_PAGE_ID {
+		overflowBuffer, err := bufmgr.FetchPage(pageId)
+		if err != nil {
+			return err
+		}
+		node := NewNode(overflowBuffer.Page[:])
+		if node.header.NodeTypeString() != NODE_TYPE_OVERFLOW {
+			bufmgr.FinishUsingPage(overflowBuffer)
+			return ErrBrokenOverflow
+		}
+		nextPageId := NewOverflow(node.body).header.nextPageId
+		bufmgr.FinishUsingPage(overflowBuffer)
+		if err := bufmgr.DeallocatePage(pageId); err != nil {
+			return err
+		}
+		pageId = nextPageId
+	}
+	return nil
+}
+
+// 値がオーバーフローページにあれば読み込んで置き換える
+func (p *Pair) loadValue(bufmgr *buffer.BufferPoolManager) error {
+	if !p.Overflow {
+		return nil
+	}
+	value, err := readOverflow(bufmgr, disk.BytesToPageId(p.Value))
+	if err != nil {
+		return err
+	}
+	p.Value = value
+	p.Overflow = false
+	return nil
+}
+
+// 値がオーバーフローページにあれば解放する
+func (p *Pair) freeValue(bufmgr *buffer.BufferPoolManager) error {
+	if !p.Overflow {
+		return nil
+	}
+	return freeOverflow(bufmgr, disk.BytesToPageId(p.Value))
+}
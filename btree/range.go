@@ -0,0 +1,118 @@
+package btree
+
+import (
+	"bytes"
+
+	"my-relly-go/buffer"
+)
+
+// 範囲の端
+// キーの先頭がKeyと一致するペアは、Keyと等しいとみなす
+// memcmpableで符号化したタプルなら、先頭のいくつかの要素だけでも端にできる
+type Bound struct {
+	Key       []byte
+	Inclusive bool
+}
+
+// 端がnilなら、その向きには制限しない
+type Range struct {
+	Lower *Bound
+	Upper *Bound
+}
+
+// キーの先頭をboundと比べる
+func compareBound(key []byte, bound []byte) int {
+	if len(key) > len(bound) {
+		key = key[:len(bound)]
+	}
+	return bytes.Compare(key, bound)
+}
+
+func (r *Range) aboveLower(key []byte) bool {
+	if r.Lower == nil {
+		return true
+	}
+	c := compareBound(key, r.Lower.Key)
+	return c > 0 || (c == 0 && r.Lower.Inclusive)
+}
+
+func (r *Range) belowUpper(key []byte) bool {
+	if r.Upper == nil {
+		return true
+	}
+	c := compareBound(key, r.Upper.Key)
+	return c < 0 || (c == 0 && r.Upper.Inclusive)
+}
+
+func (r *Range) Contains(key []byte) bool {
+	return r.aboveLower(key) && r.belowUpper(key)
+}
+
+// keyで始まるどのキーよりも大きい、最小のキー。無ければnil
+// 前方一致で検索する範囲の上限に使う
+func PrefixSuccessor(key []byte) []byte {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] != 0xFF {
+			succ := append([]byte{}, key[:i+1]...)
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
+
+// 範囲の始まり（backwardなら終わり）に位置付けたイテレータを返す
+// 範囲の外に出たら、Next/PrevはErrEndOfIteratorを返す
+func (t *BTree) SearchRange(bufmgr *buffer.BufferPoolManager, r *Range, backward bool) (*BTreeIter, error) {
+	var searchMode SearchMode
+	if !backward {
+		searchMode = &SearchModeStart{}
+		if r.Lower != nil {
+			searchMode = &SearchModeKey{r.Lower.Key}
+			// 端と等しいキーを飛ばす
+			if succ := PrefixSuccessor(r.Lower.Key); !r.Lower.Inclusive && succ != nil {
+				searchMode = &SearchModeKey{succ}
+			}
+		}
+	} else {
+		searchMode = &SearchModeEnd{}
+		if r.Upper != nil {
+			searchMode = &SearchModeKeyBackward{r.Upper.Key}
+			// 端と等しいキーを含める。0xFFだけの端なら、それより後ろのキーは無い
+			if r.Upper.Inclusive {
+				if succ := PrefixSuccessor(r.Upper.Key); succ != nil {
+					searchMode = &SearchModeKeyBackward{succ}
+				} else {
+					searchMode = &SearchModeEnd{}
+				}
+			}
+		}
+	}
+	iter, err := t.Search(bufmgr, searchMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// 探索した位置には、範囲の始まりより手前のキーが残り得るので読み飛ばす
+	started := r.aboveLower
+	if backward {
+		started = r.belowUpper
+	}
+	for {
+		pair, err := iter.locate(bufmgr)
+		if err == ErrEndOfIterator {
+			break
+		}
+		if err != nil {
+			iter.Finish(bufmgr)
+			return nil, err
+		}
+		if started(pair.Key) {
+			break
+		}
+		iter.lastKey = pair.Key
+		iter.backward = backward
+	}
+	iter.rng = r
+	return iter, nil
+}
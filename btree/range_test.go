@@ -0,0 +1,158 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+)
+
+func TestRange(t *testing.T) {
+	uint64ToBytes := func(n uint64) []byte {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, n)
+		return buf[:]
+	}
+
+	file, err := ioutil.TempFile("", "TestRange")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+	defer os.Remove(disk.WalFilePath(file.Name()))
+	defer file.Close()
+	diskManager, err := disk.CreateDiskManager(file.Name())
+	if err != nil {
+		panic(err)
+	}
+	defer diskManager.Close()
+	bufmgr := buffer.NewBufferPoolManager(diskManager, buffer.NewBufferPool(10))
+
+	readAll := func(tree *BTree, r *Range, backward bool) []string {
+		iter, err := tree.SearchRange(bufmgr, r, backward)
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		next := iter.Next
+		if backward {
+			next = iter.Prev
+		}
+		keys := []string{}
+		for {
+			key, _, err := next(bufmgr)
+			if err == ErrEndOfIterator {
+				return keys
+			}
+			if err != nil {
+				panic(err)
+			}
+			keys = append(keys, string(key))
+		}
+	}
+
+	t.Run("端の扱い", func(t *testing.T) {
+		tree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		for _, key := range []string{"a", "ab", "abc", "b", "ba", "c", "\xff", "\xff\xff"} {
+			if err := tree.Insert(bufmgr, []byte(key), []byte(key)); err != nil {
+				panic(err)
+			}
+		}
+		bound := func(key string, inclusive bool) *Bound {
+			return &Bound{[]byte(key), inclusive}
+		}
+
+		tests := []struct {
+			name   string
+			r      *Range
+			expect []string
+		}{
+			{"制限なし", &Range{}, []string{"a", "ab", "abc", "b", "ba", "c", "\xff", "\xff\xff"}},
+			{"以上、以下", &Range{bound("ab", true), bound("b", true)}, []string{"ab", "abc", "b", "ba"}},
+			{"より大きい、より小さい", &Range{bound("ab", false), bound("c", false)}, []string{"b", "ba"}},
+			{"先頭が一致するキーは等しい", &Range{bound("a", false), nil}, []string{"b", "ba", "c", "\xff", "\xff\xff"}},
+			{"下限だけ", &Range{bound("ba", true), nil}, []string{"ba", "c", "\xff", "\xff\xff"}},
+			{"上限だけ", &Range{nil, bound("a", true)}, []string{"a", "ab", "abc"}},
+			{"上限より小さい", &Range{nil, bound("b", false)}, []string{"a", "ab", "abc"}},
+			{"0xFFの端", &Range{bound("\xff", false), nil}, []string{}},
+			{"0xFFの端を含む", &Range{bound("c", false), bound("\xff", true)}, []string{"\xff", "\xff\xff"}},
+			{"空の範囲", &Range{bound("b", true), bound("ab", true)}, []string{}},
+			{"該当なし", &Range{bound("bb", true), bound("bc", true)}, []string{}},
+		}
+		for _, tt := range tests {
+			if got := readAll(tree, tt.r, false); !reflect.DeepEqual(got, tt.expect) {
+				t.Fatalf("%s: SearchRange() = %q, want %q", tt.name, got, tt.expect)
+			}
+			// 逆順でも同じペアを返す
+			reversed := []string{}
+			for i := len(tt.expect) - 1; i >= 0; i-- {
+				reversed = append(reversed, tt.expect[i])
+			}
+			if got := readAll(tree, tt.r, true); !reflect.DeepEqual(got, reversed) {
+				t.Fatalf("%s: SearchRange(backward) = %q, want %q", tt.name, got, reversed)
+			}
+		}
+
+		// Getは範囲の外ならErrEndOfIteratorを返す
+		iter, err := tree.SearchRange(bufmgr, &Range{bound("ab", false), bound("b", false)}, false)
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		if _, _, err := iter.Get(bufmgr); err != ErrEndOfIterator {
+			t.Fatalf("iter.Get() = %v, want ErrEndOfIterator", err)
+		}
+	})
+
+	t.Run("複数のleaf", func(t *testing.T) {
+		tree, err := CreateBTree(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		const numKeys = 2000
+		for n := uint64(0); n < numKeys; n++ {
+			if err := tree.Insert(bufmgr, uint64ToBytes(n), make([]byte, 100)); err != nil {
+				panic(err)
+			}
+		}
+		r := &Range{&Bound{uint64ToBytes(500), false}, &Bound{uint64ToBytes(1500), true}}
+		for _, backward := range []bool{false, true} {
+			keys := readAll(tree, r, backward)
+			if len(keys) != 1000 {
+				t.Fatalf("len(keys) = %v, want 1000", len(keys))
+			}
+			first, last := uint64(501), uint64(1500)
+			if backward {
+				first, last = last, first
+			}
+			if keys[0] != string(uint64ToBytes(first)) || keys[len(keys)-1] != string(uint64ToBytes(last)) {
+				t.Fatalf("keys = %v...%v, want %v...%v", []byte(keys[0]), []byte(keys[len(keys)-1]), first, last)
+			}
+		}
+	})
+
+	t.Run("前方一致の上限", func(t *testing.T) {
+		tests := []struct {
+			key    []byte
+			expect []byte
+		}{
+			{[]byte("ab"), []byte("ac")},
+			{[]byte("a\xff"), []byte("b")},
+			{[]byte("\xff\xff"), nil},
+			{[]byte{}, nil},
+		}
+		for _, tt := range tests {
+			if got := PrefixSuccessor(tt.key); !bytes.Equal(got, tt.expect) || (got == nil) != (tt.expect == nil) {
+				t.Fatalf("PrefixSuccessor(%q) = %q, want %q", tt.key, got, tt.expect)
+			}
+		}
+	})
+}
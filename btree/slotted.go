@@ -54,6 +54,10 @@ func (s *Slotted) FreeSpace() int {
 	return int(s.header.freeSpaceOffset) - s.pointersSize()
 }
 
+func (s *Slotted) UsedSpace() int {
+	return s.Capacity() - s.FreeSpace()
+}
+
 func (s *Slotted) pointersSize() int {
 	return int(pointerSize * s.NumSlots())
 }
@@ -0,0 +1,278 @@
+package btree
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"sort"
+
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+	"my-relly-go/memcmpable"
+)
+
+// 並べ替えでメモリに置くペアの大きさの上限（バイト）
+const DEFAULT_SORT_MEMORY_LIMIT = 4 * 1024 * 1024
+
+// 一度にマージするrunの数の上限
+// マージ中はrunごとにバッファプールのページを1つ使い続ける
+const DEFAULT_SORT_FAN_IN = 4
+
+// runを置くバッファプールで、マージ中のrunのページの他に使うページの数
+const SORT_BUFFER_POOL_SIZE = 32
+
+// ペアをキーの昇順に並べ替える
+// メモリに置いたペアがメモリの上限を超えたら、並べ替えてrunとして一時的なB+Treeに書き出し、最後にすべてのrunをマージする
+// runはデータベースとは別の一時ファイルに置くので、トランザクションやWALを使わず、読み込み専用のデータベースでも並べ替えられる
+// runがfanInより多ければ、fanIn個ずつマージして新しいrunにすることを繰り返す
+// キーが等しいペアは加えた順に返す
+type Sorter struct {
+	memoryLimit int
+	fanIn       int
+	seq         uint64
+	pairs       []sortPair
+	size        int
+	// runは一時ファイルのtmpに置き、最初に書き出すときに一時ファイルを作る
+	tmpDisk  *disk.DiskManager
+	tmp      *buffer.BufferPoolManager
+	runs     []*BTree
+	runIters []*BTreeIter
+	merger   *mergeIterator
+}
+
+// memoryLimitとfanInは0ならデフォルトの値を使う
+func NewSorter(memoryLimit int, fanIn int) *Sorter {
+	if memoryLimit <= 0 {
+		memoryLimit = DEFAULT_SORT_MEMORY_LIMIT
+	}
+	if fanIn <= 0 {
+		fanIn = DEFAULT_SORT_FAN_IN
+	}
+	return &Sorter{memoryLimit: memoryLimit, fanIn: fanIn}
+}
+
+// Sortを呼ぶ前に、並べ替えるペアを1つずつ加える
+// runのキーはmemcmpableで符号化して通し番号を付け、キーが等しいペアも別のキーにする
+func (s *Sorter) Add(key []byte, value []byte) error {
+	runKey := memcmpable.Encode(key, make([]byte, 0, memcmpable.EncodedSize(len(key))+8))
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, s.seq)
+	s.seq++
+	runKey = append(runKey, seq...)
+	s.pairs = append(s.pairs, sortPair{runKey, value})
+	s.size += len(runKey) + len(value)
+	if s.size <= s.memoryLimit {
+		return nil
+	}
+	if err := s.spill(); err != nil {
+		return err
+	}
+	s.pairs = nil
+	s.size = 0
+	return nil
+}
+
+// 加えたペアをキーの順に返せるようにする
+// runがfanIn個以下になるまでマージし、最後のrunはメモリに置いたままマージする
+func (s *Sorter) Sort() error {
+	for len(s.runs) > s.fanIn {
+		if err := s.mergeRuns(s.fanIn); err != nil {
+			return err
+		}
+	}
+
+	iters, err := s.openRuns(s.runs)
+	if err != nil {
+		return err
+	}
+	s.runIters = iters
+	sources := []Iterator{}
+	for _, iter := range iters {
+		sources = append(sources, iter)
+	}
+	sources = append(sources, sortPairs(s.pairs))
+	s.pairs = nil
+	s.merger, err = newMergeIterator(s.tmp, sources)
+	return err
+}
+
+// Sortの後に、ペアをキーの昇順に返す
+// runは一時ファイルから読むので、bufmgrは使わない
+func (s *Sorter) Next(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
+	runKey, value, err := s.merger.Next(s.tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, key := memcmpable.Decode(runKey, []byte{})
+	return key, value, nil
+}
+
+// 書き出したrunの数
+func (s *Sorter) NumRuns() int {
+	return len(s.runs)
+}
+
+// 一時ファイルごとrunを捨てる
+// 一時ファイルは作ったときに削除してあるので、閉じるのに失敗しても残らない
+func (s *Sorter) Finish() {
+	for _, iter := range s.runIters {
+		iter.Finish(s.tmp)
+	}
+	s.runIters = nil
+	s.runs = nil
+	s.pairs = nil
+	s.merger = nil
+	if s.tmpDisk != nil {
+		s.tmpDisk.Close()
+		s.tmpDisk = nil
+		s.tmp = nil
+	}
+}
+
+type sortPair struct {
+	key   []byte
+	value []byte
+}
+
+func sortPairs(pairs []sortPair) *SliceIterator {
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].key, pairs[j].key) < 0
+	})
+	keys := make([][]byte, len(pairs))
+	values := make([][]byte, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.key
+		values[i] = pair.value
+	}
+	return NewSliceIterator(keys, values)
+}
+
+// 並べ替えたrunをB+Treeに書き出す
+func (s *Sorter) spill() error {
+	if s.tmp == nil {
+		tmpDisk, err := disk.CreateTempDiskManager()
+		if err != nil {
+			return err
+		}
+		s.tmpDisk = tmpDisk
+		s.tmp = buffer.NewTempBufferPoolManager(tmpDisk, buffer.NewBufferPool(s.fanIn+SORT_BUFFER_POOL_SIZE))
+	}
+	run, err := CreateBTree(s.tmp)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	return run.BulkLoad(s.tmp, sortPairs(s.pairs))
+}
+
+// 先頭のn個のrunをマージして、1つのrunにする
+func (s *Sorter) mergeRuns(n int) error {
+	bufmgr := s.tmp
+	run, err := CreateBTree(bufmgr)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	inputs := s.runs[:n]
+
+	iters, err := s.openRuns(inputs)
+	if err != nil {
+		return err
+	}
+	sources := []Iterator{}
+	for _, iter := range iters {
+		sources = append(sources, iter)
+	}
+	merger, err := newMergeIterator(bufmgr, sources)
+	if err == nil {
+		err = run.BulkLoad(bufmgr, merger)
+	}
+	for _, iter := range iters {
+		iter.Finish(bufmgr)
+	}
+	if err != nil {
+		return err
+	}
+
+	// マージしたrunのページは、次に書き出すrunで再利用する
+	for _, input := range inputs {
+		input.Drop(bufmgr)
+	}
+	s.runs = s.runs[n:]
+	return nil
+}
+
+func (s *Sorter) openRuns(runs []*BTree) ([]*BTreeIter, error) {
+	iters := []*BTreeIter{}
+	for _, run := range runs {
+		iter, err := run.Search(s.tmp, &SearchModeStart{})
+		if err != nil {
+			for _, iter := range iters {
+				iter.Finish(s.tmp)
+			}
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	return iters, nil
+}
+
+// キーの昇順に並んだ複数のイテレータから、キーの昇順にペアを返す
+type mergeIterator struct {
+	sources   []Iterator
+	mergeHeap mergeHeap
+}
+
+// 各イテレータの先頭のペアをヒープに入れる
+func newMergeIterator(bufmgr *buffer.BufferPoolManager, sources []Iterator) (*mergeIterator, error) {
+	it := &mergeIterator{sources: sources}
+	for i := range sources {
+		if err := it.pushNext(bufmgr, i); err != nil {
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+func (it *mergeIterator) pushNext(bufmgr *buffer.BufferPoolManager, source int) error {
+	key, value, err := it.sources[source].Next(bufmgr)
+	if err == ErrEndOfIterator {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(&it.mergeHeap, mergeItem{key, value, source})
+	return nil
+}
+
+func (it *mergeIterator) Next(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
+	if it.mergeHeap.Len() == 0 {
+		return nil, nil, ErrEndOfIterator
+	}
+	item := heap.Pop(&it.mergeHeap).(mergeItem)
+	if err := it.pushNext(bufmgr, item.source); err != nil {
+		return nil, nil, err
+	}
+	return item.key, item.value, nil
+}
+
+type mergeItem struct {
+	key    []byte
+	value  []byte
+	source int
+}
+
+// キーが最小のペアを先頭に置くヒープ
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
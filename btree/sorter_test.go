@@ -0,0 +1,81 @@
+package btree
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSorter(t *testing.T) {
+	t.Run("メモリに収まる", func(t *testing.T) {
+		sorter := NewSorter(0, 0)
+		defer sorter.Finish()
+		for _, key := range []string{"b", "", "a", "ab"} {
+			if err := sorter.Add([]byte(key), []byte("v"+key)); err != nil {
+				panic(err)
+			}
+		}
+		if err := sorter.Sort(); err != nil {
+			panic(err)
+		}
+		if n := sorter.NumRuns(); n != 0 {
+			t.Fatalf("sorter.NumRuns() = %v, want 0", n)
+		}
+		keys := []string{}
+		for {
+			key, value, err := sorter.Next(nil)
+			if err == ErrEndOfIterator {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			if string(value) != "v"+string(key) {
+				t.Fatalf("sorter.Next() = %q, %q", key, value)
+			}
+			keys = append(keys, string(key))
+		}
+		if expect := []string{"", "a", "ab", "b"}; !reflect.DeepEqual(keys, expect) {
+			t.Fatalf("keys = %q, want %q", keys, expect)
+		}
+	})
+
+	t.Run("runの書き出しとマージ", func(t *testing.T) {
+		const numPairs = 1000
+		sorter := NewSorter(256, 2)
+		defer sorter.Finish()
+		for i := 0; i < numPairs; i++ {
+			key := []byte(fmt.Sprintf("key%d", i*7919%100))
+			if err := sorter.Add(key, []byte(fmt.Sprintf("%04d", i))); err != nil {
+				panic(err)
+			}
+		}
+		if err := sorter.Sort(); err != nil {
+			panic(err)
+		}
+		if n := sorter.NumRuns(); n == 0 || 2 < n {
+			t.Fatalf("sorter.NumRuns() = %v", n)
+		}
+
+		// キーが等しいペアは加えた順に並ぶ
+		var prevKey, prevValue string
+		n := 0
+		for {
+			key, value, err := sorter.Next(nil)
+			if err == ErrEndOfIterator {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			if string(key) < prevKey || (string(key) == prevKey && string(value) <= prevValue) {
+				t.Fatalf("sorter.Next() = %q, %q after %q, %q", key, value, prevKey, prevValue)
+			}
+			prevKey, prevValue = string(key), string(value)
+			n++
+		}
+		if n != numPairs {
+			t.Fatalf("sorted %v pairs, want %v", n, numPairs)
+		}
+	})
+}
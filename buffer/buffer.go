@@ -2,6 +2,7 @@ package buffer
 
 import (
 	"my-relly-go/disk"
+	"sync"
 
 	"golang.org/x/xerrors"
 )
@@ -15,17 +16,49 @@ type BufferId int
 
 type Buffer struct {
 	PageId  disk.PageId
-	Page    [disk.PAGE_SIZE]byte
+	PageLSN disk.LSN
+	Page    [disk.PAGE_BODY_SIZE]byte
 	IsDirty bool
+	latch   *latch
+}
+
+// ページの内容を読む間は読み込みラッチ、書き換える間は書き込みラッチを取得する
+// ラッチはFetchPage/CreatePageで貸し出されている間だけ取得できる
+func (b *Buffer) RLatch() {
+	b.latch.rLock()
+}
+
+func (b *Buffer) TryRLatch() bool {
+	return b.latch.tryRLock()
+}
+
+func (b *Buffer) RUnlatch() {
+	b.latch.rUnlock()
+}
+
+func (b *Buffer) WLatch() {
+	b.latch.lock()
+}
+
+func (b *Buffer) TryWLatch() bool {
+	return b.latch.tryLock()
+}
+
+func (b *Buffer) WUnlatch() {
+	b.latch.unlock()
 }
 
 type Frame struct {
 	usageCount int
 	refCount   int
 	buffer     Buffer
+	// ピンが外れたらページを解放する
+	deallocated bool
 }
 
 type BufferPool struct {
+	// ページテーブル、クロックの針、フレームのカウンタ、トランザクションの状態を保護する
+	mutex        sync.Mutex
 	buffers      []Frame
 	nextVictimId BufferId
 }
@@ -35,6 +68,7 @@ func NewBufferPool(poolSize int) *BufferPool {
 	bufferPool.buffers = make([]Frame, poolSize)
 	for i := range bufferPool.buffers {
 		bufferPool.buffers[i].buffer.PageId = disk.INVALID_PAGE_ID
+		bufferPool.buffers[i].buffer.latch = newLatch()
 	}
 	return &bufferPool
 }
@@ -77,6 +111,12 @@ type BufferPoolManager struct {
 	diskManager *disk.DiskManager
 	pool        *BufferPool
 	pageTable   map[disk.PageId]BufferId
+	txnManager  *txnManager
+	txn         *Txn
+	nested      bool
+	savepoint   savepoint
+	// 一時的なページだけを置くので、トランザクションを使わない
+	temporary bool
 }
 
 func NewBufferPoolManager(diskManager *disk.DiskManager, pool *BufferPool) *BufferPoolManager {
@@ -84,11 +124,39 @@ func NewBufferPoolManager(diskManager *disk.DiskManager, pool *BufferPool) *Buff
 		diskManager,
 		pool,
 		map[disk.PageId]BufferId{},
+		newTxnManager(),
+		nil,
+		false,
+		savepoint{},
+		false,
 	}
 }
 
+// 並べ替えの途中結果など、クラッシュしたら捨てるページを置くBufferPoolManagerを作る
+// Transactionはトランザクションを始めずにfを実行するので、更新をログに書かず、取り消すこともない
+func NewTempBufferPoolManager(diskManager *disk.DiskManager, pool *BufferPool) *BufferPoolManager {
+	m := NewBufferPoolManager(diskManager, pool)
+	m.temporary = true
+	return m
+}
+
+func (m *BufferPoolManager) DiskManager() *disk.DiskManager {
+	return m.diskManager
+}
+
 func (m *BufferPoolManager) FetchPage(pageId disk.PageId) (*Buffer, error) {
+	buffer, err := m.fetchPage(pageId)
+	if err != nil {
+		return nil, err
+	}
+	m.pinForTxn(buffer)
+	return buffer, nil
+}
+
+func (m *BufferPoolManager) fetchPage(pageId disk.PageId) (*Buffer, error) {
 	//fmt.Println("pageId:", pageId)
+	m.pool.mutex.Lock()
+	defer m.pool.mutex.Unlock()
 
 	if bufferId, ok := m.pageTable[pageId]; ok {
 		frame := &m.pool.buffers[bufferId]
@@ -105,14 +173,14 @@ func (m *BufferPoolManager) FetchPage(pageId disk.PageId) (*Buffer, error) {
 
 	buffer := &frame.buffer
 	if evictPageId != disk.INVALID_PAGE_ID && buffer.IsDirty {
-		err = m.diskManager.WritePageData(evictPageId, buffer.Page[:])
+		err = m.writePage(buffer)
 		if err != nil {
 			return nil, err
 		}
 	}
 	buffer.PageId = pageId
 	buffer.IsDirty = false
-	err = m.diskManager.ReadPageData(pageId, buffer.Page[:])
+	err = m.readPage(buffer)
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +195,18 @@ func (m *BufferPoolManager) FetchPage(pageId disk.PageId) (*Buffer, error) {
 }
 
 func (m *BufferPoolManager) CreatePage() (*Buffer, error) {
+	buffer, err := m.createPage()
+	if err != nil {
+		return nil, err
+	}
+	m.pinNewPageForTxn(buffer)
+	return buffer, nil
+}
+
+func (m *BufferPoolManager) createPage() (*Buffer, error) {
+	m.pool.mutex.Lock()
+	defer m.pool.mutex.Unlock()
+
 	bufferId, err := m.pool.evict()
 	if err != nil {
 		return nil, err
@@ -136,14 +216,24 @@ func (m *BufferPoolManager) CreatePage() (*Buffer, error) {
 
 	buffer := &frame.buffer
 	if evictPageId != disk.INVALID_PAGE_ID && buffer.IsDirty {
-		err = m.diskManager.WritePageData(evictPageId, buffer.Page[:])
+		err = m.writePage(buffer)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	pageId := m.diskManager.AllocatePage()
-	*buffer = Buffer{PageId: pageId, IsDirty: true}
+	pageId, err := m.diskManager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	if m.txn != nil {
+		m.txn.allocatedPageIds = append(m.txn.allocatedPageIds, pageId)
+		// 確保したページは、コミットするまで他のトランザクションから書き換えられない
+		if err := m.txnManager.tryLock(m.txn, pageId, false); err != nil {
+			return nil, err
+		}
+	}
+	*buffer = Buffer{PageId: pageId, IsDirty: true, latch: buffer.latch}
 	frame.usageCount = 1
 	frame.refCount = 1
 
@@ -155,6 +245,10 @@ func (m *BufferPoolManager) CreatePage() (*Buffer, error) {
 }
 
 func (m *BufferPoolManager) FinishUsingPage(buffer *Buffer) {
+	m.unpinForTxn(buffer)
+	m.pool.mutex.Lock()
+	defer m.pool.mutex.Unlock()
+
 	bufferId, ok := m.pageTable[buffer.PageId]
 	if !ok {
 		panic("Not exist in page table")
@@ -165,18 +259,114 @@ func (m *BufferPoolManager) FinishUsingPage(buffer *Buffer) {
 		panic("Can't release any more")
 	}
 	frame.refCount--
+	if frame.refCount == 0 && frame.deallocated {
+		pageId := buffer.PageId
+		m.discardFrame(bufferId)
+		// 解放に失敗しても空きページにならないだけなので、エラーは無視する
+		m.diskManager.DeallocatePage(pageId)
+	}
+}
+
+// どこからも参照されなくなったページを解放する
+// トランザクション中はページをロックし、コミット（またはアボート）されるまで遅らせる
+func (m *BufferPoolManager) DeallocatePage(pageId disk.PageId) error {
+	if m.txn != nil {
+		if err := m.txnManager.tryLock(m.txn, pageId, false); err != nil {
+			return err
+		}
+		m.pool.mutex.Lock()
+		defer m.pool.mutex.Unlock()
+		m.txn.freedPageIds = append(m.txn.freedPageIds, pageId)
+		return nil
+	}
+	return m.deallocatePage(pageId)
+}
+
+// 他のゴルーチンがピンしている間は、使い終わるまで遅らせる
+func (m *BufferPoolManager) deallocatePage(pageId disk.PageId) error {
+	m.pool.mutex.Lock()
+	defer m.pool.mutex.Unlock()
+
+	if bufferId, ok := m.pageTable[pageId]; ok {
+		frame := &m.pool.buffers[bufferId]
+		if frame.refCount > 0 {
+			frame.deallocated = true
+			return nil
+		}
+		m.discardFrame(bufferId)
+	}
+	return m.diskManager.DeallocatePage(pageId)
 }
 
+// 書き出さずにページテーブルから外す
+func (m *BufferPoolManager) discardFrame(bufferId BufferId) {
+	frame := &m.pool.buffers[bufferId]
+	delete(m.pageTable, frame.buffer.PageId)
+	frame.buffer.PageId = disk.INVALID_PAGE_ID
+	frame.buffer.IsDirty = false
+	frame.usageCount = 0
+	frame.deallocated = false
+}
+
+// 他のゴルーチンがページを書き換えていないときに呼ぶこと
 func (m *BufferPoolManager) Flush() error {
-	for pageId, bufferId := range m.pageTable {
+	if m.txn != nil {
+		m.logAllChanges(m.txn)
+	}
+	m.pool.mutex.Lock()
+	defer m.pool.mutex.Unlock()
+
+	for _, bufferId := range m.pageTable {
 		frame := &m.pool.buffers[bufferId]
-		page := &frame.buffer.Page
-		err := m.diskManager.WritePageData(pageId, page[:])
+		if !frame.buffer.IsDirty {
+			continue
+		}
+		err := m.writePage(&frame.buffer)
 		if err != nil {
 			return err
 		}
 		frame.buffer.IsDirty = false
 	}
+	if err := m.diskManager.SyncFreeList(); err != nil {
+		return err
+	}
 	m.diskManager.Sync()
+
+	// 実行中のトランザクションがなければチェックポイントとしてWALを空にする
+	if m.txnManager.active > 0 {
+		return nil
+	}
+	if logManager := m.diskManager.LogManager(); logManager != nil {
+		if err := logManager.Truncate(); err != nil {
+			return err
+		}
+	}
+	// WALが空になったので、末尾の空きページを切り詰めてもREDOで書き戻されない
+	if m.diskManager.Mode() != disk.OPEN_MODE_READ_ONLY {
+		return m.diskManager.TruncateFreePages()
+	}
 	return nil
 }
+
+func (m *BufferPoolManager) readPage(buffer *Buffer) error {
+	page := make([]byte, disk.PAGE_SIZE)
+	if err := m.diskManager.ReadPageData(buffer.PageId, page); err != nil {
+		return err
+	}
+	buffer.PageLSN = disk.ReadPageLSN(page)
+	copy(buffer.Page[:], page[disk.PAGE_HEADER_SIZE:])
+	return nil
+}
+
+func (m *BufferPoolManager) writePage(buffer *Buffer) error {
+	if logManager := m.diskManager.LogManager(); logManager != nil {
+		// ページを書き出す前に、そのページの更新ログを永続化する
+		if err := logManager.Flush(buffer.PageLSN); err != nil {
+			return err
+		}
+	}
+	page := make([]byte, disk.PAGE_SIZE)
+	disk.WritePageLSN(page, buffer.PageLSN)
+	copy(page[disk.PAGE_HEADER_SIZE:], buffer.Page[:])
+	return m.diskManager.WritePageData(buffer.PageId, page)
+}
@@ -2,18 +2,23 @@ package buffer
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
 )
 
 func TestBuffer(t *testing.T) {
 	// 書き込むデータを準備
-	hello := make([]byte, disk.PAGE_SIZE)
+	hello := make([]byte, disk.PAGE_BODY_SIZE)
 	copy(hello, []byte("hello"))
-	world := make([]byte, disk.PAGE_SIZE)
+	world := make([]byte, disk.PAGE_BODY_SIZE)
 	copy(world, []byte("world"))
 
 	// ディスクマネージャ作成用
@@ -22,7 +27,7 @@ func TestBuffer(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		diskManager, err := disk.NewDiskManager(file)
+		diskManager, err := disk.CreateDiskManager(file.Name())
 		if err != nil {
 			panic(err)
 		}
@@ -30,13 +35,19 @@ func TestBuffer(t *testing.T) {
 	}
 
 	// ディスクマネージャ破棄用
-	destroyDiskManager := func(file *os.File, _ *disk.DiskManager) {
+	destroyDiskManager := func(file *os.File, diskManager *disk.DiskManager) {
+		if err := diskManager.Close(); err != nil {
+			panic(err)
+		}
 		if err := file.Close(); err != nil {
 			panic(err)
 		}
 		if err := os.Remove(file.Name()); err != nil {
 			panic(err)
 		}
+		if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+			panic(err)
+		}
 	}
 
 	t.Run("正常系", func(t *testing.T) {
@@ -181,4 +192,520 @@ func TestBuffer(t *testing.T) {
 			}
 		}
 	})
+	t.Run("並行アクセス", func(t *testing.T) {
+		tempFile, diskManager := createDiskManager()
+		defer destroyDiskManager(tempFile, diskManager)
+
+		// ページ数よりバッファを少なくして、追い出しも並行して起こす
+		pool := NewBufferPool(8)
+		bufmgr := NewBufferPoolManager(diskManager, pool)
+
+		const numPages = 16
+		pageIds := []disk.PageId{}
+		for i := 0; i < numPages; i++ {
+			buffer, err := bufmgr.CreatePage()
+			if err != nil {
+				panic(err)
+			}
+			pageIds = append(pageIds, buffer.PageId)
+			bufmgr.FinishUsingPage(buffer)
+		}
+
+		// 各ゴルーチンがカウンタを加算し、他のゴルーチンは読み込みラッチで読む
+		const numWorkers = 4
+		const numLoops = 200
+		var wg sync.WaitGroup
+		for w := 0; w < numWorkers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < numLoops; i++ {
+					pageId := pageIds[(w+i)%numPages]
+					for {
+						buffer, err := bufmgr.FetchPage(pageId)
+						if err == ErrNoFreeBuffer {
+							continue
+						}
+						if err != nil {
+							panic(err)
+						}
+						if i%2 == 0 {
+							buffer.WLatch()
+							n := binary.BigEndian.Uint64(buffer.Page[:8])
+							binary.BigEndian.PutUint64(buffer.Page[:8], n+1)
+							buffer.IsDirty = true
+							buffer.WUnlatch()
+						} else {
+							buffer.RLatch()
+							_ = binary.BigEndian.Uint64(buffer.Page[:8])
+							buffer.RUnlatch()
+						}
+						bufmgr.FinishUsingPage(buffer)
+						break
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		total := uint64(0)
+		for _, pageId := range pageIds {
+			buffer, err := bufmgr.FetchPage(pageId)
+			if err != nil {
+				panic(err)
+			}
+			total += binary.BigEndian.Uint64(buffer.Page[:8])
+			bufmgr.FinishUsingPage(buffer)
+		}
+		if expect := uint64(numWorkers * numLoops / 2); total != expect {
+			t.Fatalf("total = %v, want %v", total, expect)
+		}
+	})
+
+	t.Run("ラッチ", func(t *testing.T) {
+		tempFile, diskManager := createDiskManager()
+		defer destroyDiskManager(tempFile, diskManager)
+
+		pool := NewBufferPool(1)
+		bufmgr := NewBufferPoolManager(diskManager, pool)
+
+		buffer, err := bufmgr.CreatePage()
+		if err != nil {
+			panic(err)
+		}
+		defer bufmgr.FinishUsingPage(buffer)
+
+		buffer.RLatch()
+		if !buffer.TryRLatch() {
+			t.Fatal("buffer.TryRLatch() = false, want true")
+		}
+		if buffer.TryWLatch() {
+			t.Fatal("buffer.TryWLatch() = true, want false")
+		}
+		buffer.RUnlatch()
+		buffer.RUnlatch()
+		if !buffer.TryWLatch() {
+			t.Fatal("buffer.TryWLatch() = false, want true")
+		}
+		if buffer.TryRLatch() {
+			t.Fatal("buffer.TryRLatch() = true, want false")
+		}
+		buffer.WUnlatch()
+	})
+
+	t.Run("Transaction_ページのロック", func(t *testing.T) {
+		tempFile, diskManager := createDiskManager()
+		defer destroyDiskManager(tempFile, diskManager)
+
+		pool := NewBufferPool(4)
+		bufmgr := NewBufferPoolManager(diskManager, pool)
+		pageIds := []disk.PageId{}
+		for i := 0; i < 2; i++ {
+			buffer, err := bufmgr.CreatePage()
+			if err != nil {
+				panic(err)
+			}
+			pageIds = append(pageIds, buffer.PageId)
+			bufmgr.FinishUsingPage(buffer)
+		}
+		lockPage := func(tx *BufferPoolManager, pageId disk.PageId, data []byte) error {
+			buffer, err := tx.FetchPage(pageId)
+			if err != nil {
+				panic(err)
+			}
+			defer tx.FinishUsingPage(buffer)
+			buffer.WLatch()
+			defer buffer.WUnlatch()
+			if err := tx.LockPage(buffer.PageId); err != nil {
+				return err
+			}
+			copy(buffer.Page[:], data)
+			buffer.IsDirty = true
+			return nil
+		}
+		// ロックできなければ、取れるようになるまで待つ
+		waitPage := func(tx *BufferPoolManager, pageId disk.PageId) error {
+			var locked *PageLockedError
+			if err := tx.LockPage(pageId); !xerrors.As(err, &locked) {
+				return err
+			}
+			return tx.WaitPageLock(locked)
+		}
+		readPage := func(pageId disk.PageId) []byte {
+			buffer, err := bufmgr.FetchPage(pageId)
+			if err != nil {
+				panic(err)
+			}
+			defer bufmgr.FinishUsingPage(buffer)
+			return append([]byte{}, buffer.Page[:]...)
+		}
+
+		// 別々のページなら、複数のトランザクションが同時に書き換えられる
+		tx1, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		tx2, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		if err := lockPage(tx1, pageIds[0], hello); err != nil {
+			panic(err)
+		}
+		if err := lockPage(tx2, pageIds[1], world); err != nil {
+			panic(err)
+		}
+
+		// 他のトランザクションがロックしているページは、待たずに失敗する
+		var locked *PageLockedError
+		if err := lockPage(tx2, pageIds[0], world); !xerrors.As(err, &locked) || locked.PageId != pageIds[0] {
+			t.Fatalf("tx2.LockPage() = %v, want PageLockedError", err)
+		}
+
+		// ロールバックは、他のトランザクションが書き換えたページを巻き込まない
+		if err := tx2.Rollback(); err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(readPage(pageIds[0]), hello) {
+			t.Fatal("rollback undid another transaction")
+		}
+		if bytes.Equal(readPage(pageIds[1]), world) {
+			t.Fatal("rollback did not undo the transaction")
+		}
+
+		// WaitPageLockは、ロックしているトランザクションが終わるまで待つ
+		tx2, err = bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		done := make(chan error)
+		go func() {
+			done <- waitPage(tx2, pageIds[0])
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("tx2.WaitPageLock() = %v while another transaction holds the lock", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err := tx1.Commit(); err != nil {
+			panic(err)
+		}
+		if err := <-done; err != nil {
+			panic(err)
+		}
+		if err := lockPage(tx2, pageIds[0], world); err != nil {
+			panic(err)
+		}
+
+		// 待つ時間に上限を設定すると、上限を過ぎたら諦める
+		tx3, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		bufmgr.SetLockTimeout(10 * time.Millisecond)
+		if err := waitPage(tx3, pageIds[0]); err != ErrLockTimeout {
+			t.Fatalf("tx3.WaitPageLock() = %v, want ErrLockTimeout", err)
+		}
+		bufmgr.SetLockTimeout(0)
+
+		// 互いのロックを待つとデッドロックになるので、後から待った方が失敗する
+		if err := lockPage(tx3, pageIds[1], hello); err != nil {
+			panic(err)
+		}
+		go func() {
+			done <- waitPage(tx2, pageIds[1])
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if err := waitPage(tx3, pageIds[0]); err != ErrDeadlock {
+			t.Fatalf("tx3.WaitPageLock() = %v, want ErrDeadlock", err)
+		}
+		if err := tx3.Rollback(); err != nil {
+			panic(err)
+		}
+		if err := <-done; err != nil {
+			panic(err)
+		}
+		if err := tx2.Commit(); err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(readPage(pageIds[0]), world) {
+			t.Fatal("committed write was lost")
+		}
+
+		// 共有ロックは複数のトランザクションが取れるが、排他ロックとは両立しない
+		tx1, err = bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		tx2, err = bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		for _, tx := range []*BufferPoolManager{tx1, tx2} {
+			if err := tx.LockPageShared(pageIds[0]); err != nil {
+				t.Fatalf("LockPageShared() = %v", err)
+			}
+		}
+		if err := tx1.LockPage(pageIds[0]); !xerrors.As(err, &locked) {
+			t.Fatalf("tx1.LockPage() = %v, want PageLockedError", err)
+		}
+		go func() {
+			done <- tx1.WaitPageLock(locked)
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("tx1.WaitPageLock() = %v while another transaction holds a shared lock", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err := tx2.Commit(); err != nil {
+			panic(err)
+		}
+		if err := <-done; err != nil {
+			panic(err)
+		}
+		if err := tx1.LockPage(pageIds[0]); err != nil {
+			t.Fatalf("tx1.LockPage() = %v", err)
+		}
+		if err := tx1.Commit(); err != nil {
+			panic(err)
+		}
+	})
+	t.Run("Transaction_他のピン", func(t *testing.T) {
+		tempFile, diskManager := createDiskManager()
+		defer destroyDiskManager(tempFile, diskManager)
+
+		pool := NewBufferPool(2)
+		bufmgr := NewBufferPoolManager(diskManager, pool)
+		buffer, err := bufmgr.CreatePage()
+		if err != nil {
+			panic(err)
+		}
+		pageId := buffer.PageId
+		bufmgr.FinishUsingPage(buffer)
+
+		// トランザクションの外でピンしたページへの書き込みは、トランザクションのログに入らない
+		buffer, err = bufmgr.FetchPage(pageId)
+		if err != nil {
+			panic(err)
+		}
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		buffer.WLatch()
+		copy(buffer.Page[:], hello)
+		buffer.IsDirty = true
+		buffer.WUnlatch()
+		bufmgr.FinishUsingPage(buffer)
+		if err := tx.Rollback(); err != nil {
+			panic(err)
+		}
+
+		buffer, err = bufmgr.FetchPage(pageId)
+		if err != nil {
+			panic(err)
+		}
+		defer bufmgr.FinishUsingPage(buffer)
+		if !bytes.Equal(hello, buffer.Page[:]) {
+			t.Fatal("write outside the transaction was rolled back")
+		}
+	})
+	t.Run("DeallocatePage", func(t *testing.T) {
+		tempFile, diskManager := createDiskManager()
+		defer destroyDiskManager(tempFile, diskManager)
+
+		pool := NewBufferPool(4)
+		bufmgr := NewBufferPoolManager(diskManager, pool)
+
+		createPages := func(bufmgr *BufferPoolManager, n int) []disk.PageId {
+			pageIds := make([]disk.PageId, n)
+			for i := range pageIds {
+				buffer, err := bufmgr.CreatePage()
+				if err != nil {
+					panic(err)
+				}
+				pageIds[i] = buffer.PageId
+				bufmgr.FinishUsingPage(buffer)
+			}
+			return pageIds
+		}
+		pageIds := createPages(bufmgr, 3)
+		if err := bufmgr.Flush(); err != nil {
+			panic(err)
+		}
+
+		// トランザクション中の解放はコミットまで遅れる
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		if err := tx.DeallocatePage(pageIds[0]); err != nil {
+			panic(err)
+		}
+		if n := diskManager.NumFreePages(); n != 0 {
+			t.Fatalf("diskManager.NumFreePages() = %v, want 0", n)
+		}
+		if err := tx.Commit(); err != nil {
+			panic(err)
+		}
+		if n := diskManager.NumFreePages(); n != 1 {
+			t.Fatalf("diskManager.NumFreePages() = %v, want 1", n)
+		}
+
+		// ロールバックすると、解放は取り消され、確保したページが解放される
+		tx, err = bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		if err := tx.DeallocatePage(pageIds[1]); err != nil {
+			panic(err)
+		}
+		created := createPages(tx, 2)
+		if created[0] != pageIds[0] {
+			t.Fatalf("tx.CreatePage() = %v, want %v", created[0], pageIds[0])
+		}
+		if err := tx.Rollback(); err != nil {
+			panic(err)
+		}
+		if n := diskManager.NumFreePages(); n != 2 {
+			t.Fatalf("diskManager.NumFreePages() = %v, want 2", n)
+		}
+
+		// ピンされている間は解放されない
+		buffer, err := bufmgr.FetchPage(pageIds[1])
+		if err != nil {
+			panic(err)
+		}
+		if err := bufmgr.DeallocatePage(pageIds[1]); err != nil {
+			panic(err)
+		}
+		if n := diskManager.NumFreePages(); n != 2 {
+			t.Fatalf("diskManager.NumFreePages() = %v, want 2", n)
+		}
+		bufmgr.FinishUsingPage(buffer)
+		if n := diskManager.NumFreePages(); n != 3 {
+			t.Fatalf("diskManager.NumFreePages() = %v, want 3", n)
+		}
+
+		// 末尾の空きページはFlushで切り詰められる
+		if err := bufmgr.Flush(); err != nil {
+			panic(err)
+		}
+		if n := diskManager.NumFreePages(); n != 2 {
+			t.Fatalf("diskManager.NumFreePages() = %v, want 2", n)
+		}
+		stat, err := tempFile.Stat()
+		if err != nil {
+			panic(err)
+		}
+		if size := stat.Size(); size != 4*disk.PAGE_SIZE {
+			t.Fatalf("stat.Size() = %v, want %v", size, 4*disk.PAGE_SIZE)
+		}
+	})
+
+	t.Run("CreatePage_再利用したページのリカバリ", func(t *testing.T) {
+		tempFile, err := ioutil.TempFile("", "TestBuffer")
+		if err != nil {
+			panic(err)
+		}
+		heapFilePath := tempFile.Name()
+		tempFile.Close()
+		defer os.Remove(heapFilePath)
+		defer os.Remove(disk.WalFilePath(heapFilePath))
+
+		diskManager, err := disk.OpenDiskManagerWithMode(heapFilePath, disk.OPEN_MODE_CREATE)
+		if err != nil {
+			panic(err)
+		}
+		bufmgr := NewBufferPoolManager(diskManager, NewBufferPool(4))
+		pageIds := []disk.PageId{}
+		for i := 0; i < 2; i++ {
+			buffer, err := bufmgr.CreatePage()
+			if err != nil {
+				panic(err)
+			}
+			pageIds = append(pageIds, buffer.PageId)
+			bufmgr.FinishUsingPage(buffer)
+		}
+		if err := bufmgr.Flush(); err != nil {
+			panic(err)
+		}
+		// ディスク上には空きページの次へのリンクが残る
+		if err := bufmgr.DeallocatePage(pageIds[0]); err != nil {
+			panic(err)
+		}
+
+		// 再利用したページへの更新をコミットし、書き出す前にクラッシュする
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		buffer, err := tx.CreatePage()
+		if err != nil {
+			panic(err)
+		}
+		if buffer.PageId != pageIds[0] {
+			t.Fatalf("tx.CreatePage() = %v, want %v", buffer.PageId, pageIds[0])
+		}
+		copy(buffer.Page[100:], []byte("hello"))
+		tx.FinishUsingPage(buffer)
+		if err := tx.Commit(); err != nil {
+			panic(err)
+		}
+
+		diskManager2, err := disk.OpenDiskManagerWithMode(heapFilePath, disk.OPEN_MODE_READ_WRITE)
+		if err != nil {
+			panic(err)
+		}
+		defer diskManager2.Close()
+		page := make([]byte, disk.PAGE_SIZE)
+		if err := diskManager2.ReadPageData(pageIds[0], page); err != nil {
+			panic(err)
+		}
+		expect := make([]byte, disk.PAGE_BODY_SIZE)
+		copy(expect[100:], []byte("hello"))
+		if !bytes.Equal(page[disk.PAGE_HEADER_SIZE:], expect) {
+			t.Fatalf("page = %v..., want %v...", page[disk.PAGE_HEADER_SIZE:disk.PAGE_HEADER_SIZE+16], expect[:16])
+		}
+	})
+
+	t.Run("Transaction_一時的なページ", func(t *testing.T) {
+		diskManager, err := disk.CreateTempDiskManager()
+		if err != nil {
+			panic(err)
+		}
+		defer diskManager.Close()
+
+		pool := NewBufferPool(2)
+		bufmgr := NewTempBufferPoolManager(diskManager, pool)
+		var pageId disk.PageId
+
+		// トランザクションを始めないので、エラーを返しても取り消されない
+		errTest := xerrors.New("test")
+		err = bufmgr.Transaction(func(tx *BufferPoolManager) error {
+			if tx.InTransaction() {
+				t.Fatal("tx.InTransaction() = true, want false")
+			}
+			buffer, err := tx.CreatePage()
+			if err != nil {
+				panic(err)
+			}
+			defer tx.FinishUsingPage(buffer)
+			pageId = buffer.PageId
+			copy(buffer.Page[:], hello)
+			return errTest
+		})
+		if err != errTest {
+			t.Fatalf("bufmgr.Transaction() = %v, want errTest", err)
+		}
+
+		buffer, err := bufmgr.FetchPage(pageId)
+		if err != nil {
+			panic(err)
+		}
+		defer bufmgr.FinishUsingPage(buffer)
+		if !bytes.Equal(hello, buffer.Page[:]) {
+			t.Fatal("write to the temporary page was rolled back")
+		}
+	})
 }
@@ -0,0 +1,78 @@
+package buffer
+
+import "sync"
+
+// ページ単位の読み書きラッチ
+// 取得できなければすぐに諦めるTry系の操作も提供する
+type latch struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	readers int
+	writer  bool
+}
+
+func newLatch() *latch {
+	l := &latch{}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+func (l *latch) rLock() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.writer {
+		l.cond.Wait()
+	}
+	l.readers++
+}
+
+func (l *latch) tryRLock() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.writer {
+		return false
+	}
+	l.readers++
+	return true
+}
+
+func (l *latch) rUnlock() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.readers == 0 {
+		panic("Not read latched")
+	}
+	l.readers--
+	if l.readers == 0 {
+		l.cond.Broadcast()
+	}
+}
+
+func (l *latch) lock() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.writer || l.readers > 0 {
+		l.cond.Wait()
+	}
+	l.writer = true
+}
+
+func (l *latch) tryLock() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.writer || l.readers > 0 {
+		return false
+	}
+	l.writer = true
+	return true
+}
+
+func (l *latch) unlock() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.writer {
+		panic("Not write latched")
+	}
+	l.writer = false
+	l.cond.Broadcast()
+}
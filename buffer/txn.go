@@ -0,0 +1,487 @@
+package buffer
+
+import (
+	"fmt"
+	"my-relly-go/disk"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrNoTransaction = xerrors.New("no transaction")
+	ErrLockTimeout   = xerrors.New("lock wait timeout")
+	ErrDeadlock      = xerrors.New("deadlock detected")
+)
+
+// 他のトランザクションがロックしているページをロックしようとした
+type PageLockedError struct {
+	PageId disk.PageId
+	shared bool
+}
+
+func (e *PageLockedError) Error() string {
+	return fmt.Sprintf("page %d is locked by another transaction", e.PageId)
+}
+
+type Txn struct {
+	id disk.TxnId
+	// このトランザクションでピンしているページのピンの数と、書き換えるためにロックしているページの最後にログを取った時点の内容
+	// トランザクションを実行しているゴルーチンからしか触らない
+	pins      map[*Buffer]int
+	snapshots map[*Buffer][]byte
+	// ロールバック用の更新ログ
+	undoLog []*disk.LogRecord
+	// トランザクション中に確保したページと、終了時に解放するページ
+	allocatedPageIds []disk.PageId
+	freedPageIds     []disk.PageId
+	// ロックしているページと、書き換えるための排他ロックか。終了するまで外さない
+	locks map[disk.PageId]bool
+	// ロックが外れるのを待っている相手のトランザクション。txnManagerのmutexで保護する
+	waitingFor *Txn
+	// 終了したら閉じる
+	done chan struct{}
+}
+
+// ロールバックで戻す位置
+type savepoint struct {
+	undoLog   int
+	allocated int
+	freed     int
+}
+
+// 書き換えたページは、トランザクションが終わるまで他のトランザクションに書き換えさせない
+// 更新ログはページの差分なので、ページごとに書き換えるトランザクションが1つなら、他の更新を巻き込まずに取り消せる
+type txnManager struct {
+	// ロック表を保護する
+	mutex sync.Mutex
+	locks map[disk.PageId]*pageLock
+	// ロックが外れるのを待つ時間の上限。0なら待ち続ける
+	lockTimeout time.Duration
+	nextTxnId   disk.TxnId
+	// 実行中のトランザクションの数
+	active int
+}
+
+type pageLock struct {
+	// 排他ロックしているトランザクション
+	owner   *Txn
+	sharers map[*Txn]bool
+}
+
+// txnがロックを取るのを妨げているトランザクションを1つ返す
+func (l *pageLock) blocker(txn *Txn, shared bool) *Txn {
+	if l.owner != nil && l.owner != txn {
+		return l.owner
+	}
+	if !shared {
+		for sharer := range l.sharers {
+			if sharer != txn {
+				return sharer
+			}
+		}
+	}
+	return nil
+}
+
+func newTxnManager() *txnManager {
+	return &txnManager{locks: map[disk.PageId]*pageLock{}, nextTxnId: 1}
+}
+
+// トランザクションに紐付いたBufferPoolManagerを返す
+// トランザクション中に呼ばれた場合は、そのトランザクションに参加する
+func (m *BufferPoolManager) Begin() (*BufferPoolManager, error) {
+	if m.txn != nil {
+		return m.beginNested(), nil
+	}
+	return m.begin(), nil
+}
+
+// WaitPageLockがロックを待つ時間の上限を設定する
+// 上限を過ぎたらErrLockTimeoutを返す。0なら待ち続ける
+// トランザクションを始める前に設定しておくこと
+func (m *BufferPoolManager) SetLockTimeout(timeout time.Duration) {
+	m.txnManager.lockTimeout = timeout
+}
+
+// トランザクションでページを書き換える前に呼び、コミットかロールバックまでページを排他ロックする
+// 他のトランザクションがロックしていれば、待たずに*PageLockedErrorを返す
+// ラッチを保持したまま待つとデッドロックしかねないので、ラッチをすべて手放してからWaitPageLockで待つこと
+func (m *BufferPoolManager) LockPage(pageId disk.PageId) error {
+	txn := m.txn
+	if txn == nil {
+		return nil
+	}
+	if err := m.txnManager.tryLock(txn, pageId, false); err != nil {
+		return err
+	}
+	// ロックする前にピンしていたページは、ここから差分を取る
+	for buffer := range txn.pins {
+		if _, ok := txn.snapshots[buffer]; !ok && buffer.PageId == pageId {
+			snapshot := make([]byte, len(buffer.Page))
+			copy(snapshot, buffer.Page[:])
+			txn.snapshots[buffer] = snapshot
+		}
+	}
+	return nil
+}
+
+// コミットかロールバックまで、他のトランザクションにページを排他ロックさせない
+// 排他ロックされていれば、待たずに*PageLockedErrorを返す
+func (m *BufferPoolManager) LockPageShared(pageId disk.PageId) error {
+	if m.txn == nil {
+		return nil
+	}
+	return m.txnManager.tryLock(m.txn, pageId, true)
+}
+
+// LockPageやLockPageSharedが失敗したロックを取れるようになるまで待つ
+// 待っている相手をたどって自分に戻ればErrDeadlock、上限を過ぎたらErrLockTimeoutを返す
+func (m *BufferPoolManager) WaitPageLock(locked *PageLockedError) error {
+	txn := m.txn
+	tm := m.txnManager
+	tm.mutex.Lock()
+	var blocker *Txn
+	if lock, ok := tm.locks[locked.PageId]; ok {
+		blocker = lock.blocker(txn, locked.shared)
+	}
+	if blocker == nil {
+		tm.mutex.Unlock()
+		return nil
+	}
+	if txn != nil {
+		for t := blocker; t != nil; t = t.waitingFor {
+			if t == txn {
+				tm.mutex.Unlock()
+				return ErrDeadlock
+			}
+		}
+		txn.waitingFor = blocker
+		defer func() {
+			tm.mutex.Lock()
+			txn.waitingFor = nil
+			tm.mutex.Unlock()
+		}()
+	}
+	tm.mutex.Unlock()
+
+	if tm.lockTimeout <= 0 {
+		<-blocker.done
+		return nil
+	}
+	timer := time.NewTimer(tm.lockTimeout)
+	defer timer.Stop()
+	select {
+	case <-blocker.done:
+		return nil
+	case <-timer.C:
+		return ErrLockTimeout
+	}
+}
+
+func (m *txnManager) tryLock(txn *Txn, pageId disk.PageId, shared bool) error {
+	if exclusive, ok := txn.locks[pageId]; ok && (exclusive || shared) {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lock, ok := m.locks[pageId]
+	if !ok {
+		lock = &pageLock{sharers: map[*Txn]bool{}}
+		m.locks[pageId] = lock
+	}
+	if lock.blocker(txn, shared) != nil {
+		return &PageLockedError{pageId, shared}
+	}
+	if shared {
+		lock.sharers[txn] = true
+	} else {
+		lock.owner = txn
+		delete(lock.sharers, txn)
+	}
+	txn.locks[pageId] = !shared
+	return nil
+}
+
+func (m *txnManager) unlockAll(txn *Txn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for pageId := range txn.locks {
+		lock := m.locks[pageId]
+		if lock.owner == txn {
+			lock.owner = nil
+		}
+		delete(lock.sharers, txn)
+		if lock.owner == nil && len(lock.sharers) == 0 {
+			delete(m.locks, pageId)
+		}
+	}
+	txn.locks = nil
+	close(txn.done)
+}
+
+// ネストしたトランザクションはセーブポイントとして扱う
+func (m *BufferPoolManager) beginNested() *BufferPoolManager {
+	m.logAllChanges(m.txn)
+	tx := *m
+	tx.nested = true
+	tx.savepoint = savepoint{
+		undoLog:   len(m.txn.undoLog),
+		allocated: len(m.txn.allocatedPageIds),
+		freed:     len(m.txn.freedPageIds),
+	}
+	return &tx
+}
+
+func (m *BufferPoolManager) begin() *BufferPoolManager {
+	m.pool.mutex.Lock()
+	txn := &Txn{
+		id:        m.txnManager.nextTxnId,
+		pins:      map[*Buffer]int{},
+		snapshots: map[*Buffer][]byte{},
+		locks:     map[disk.PageId]bool{},
+		done:      make(chan struct{}),
+	}
+	m.txnManager.nextTxnId++
+	m.txnManager.active++
+	m.pool.mutex.Unlock()
+	m.appendLog(&disk.LogRecord{Type: disk.LOG_RECORD_BEGIN, TxnId: txn.id})
+
+	tx := *m
+	tx.txn = txn
+	tx.nested = false
+	tx.savepoint = savepoint{}
+	return &tx
+}
+
+func (m *BufferPoolManager) Commit() error {
+	if m.txn == nil {
+		return ErrNoTransaction
+	}
+	txn := m.txn
+	m.txn = nil
+	if m.nested {
+		return nil
+	}
+
+	return m.finish(txn, disk.LOG_RECORD_COMMIT)
+}
+
+// トランザクション（ネストしている場合はセーブポイント）以降の更新を取り消す
+func (m *BufferPoolManager) Rollback() error {
+	if m.txn == nil {
+		return ErrNoTransaction
+	}
+	txn := m.txn
+
+	m.logAllChanges(txn)
+	var err error
+	for i := len(txn.undoLog) - 1; i >= m.savepoint.undoLog && err == nil; i-- {
+		err = m.undo(txn, txn.undoLog[i])
+	}
+	m.txn = nil
+
+	txn.undoLog = txn.undoLog[:m.savepoint.undoLog]
+	// 取り消した後に確保したページは使われなくなり、解放したページは使われ続ける
+	m.pool.mutex.Lock()
+	txn.freedPageIds = append(txn.freedPageIds[:m.savepoint.freed], txn.allocatedPageIds[m.savepoint.allocated:]...)
+	txn.allocatedPageIds = txn.allocatedPageIds[:m.savepoint.allocated]
+	m.pool.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if m.nested {
+		return nil
+	}
+	return m.finish(txn, disk.LOG_RECORD_ABORT)
+}
+
+// 更新を取り消し、取り消したことをCLRとしてログに書く
+// リカバリはCLRと対になる更新を取り消さないので、ロールバックの途中でクラッシュしても二重に取り消さない
+func (m *BufferPoolManager) undo(txn *Txn, record *disk.LogRecord) error {
+	buffer, err := m.FetchPage(record.PageId)
+	if err != nil {
+		return err
+	}
+	defer m.FinishUsingPage(buffer)
+	buffer.WLatch()
+	defer buffer.WUnlatch()
+
+	offset := int(record.Offset) - disk.PAGE_HEADER_SIZE
+	copy(buffer.Page[offset:], record.Before)
+	clr := &disk.LogRecord{
+		Type:   disk.LOG_RECORD_CLR,
+		TxnId:  txn.id,
+		PageId: record.PageId,
+		Offset: record.Offset,
+		Before: record.After,
+		After:  record.Before,
+	}
+	if lsn := m.appendLog(clr); lsn != disk.INVALID_LSN {
+		buffer.PageLSN = lsn
+	}
+	buffer.IsDirty = true
+	// 取り消しを差分として改めてログに書かないよう、スナップショットにも反映しておく
+	copy(txn.snapshots[buffer][offset:], record.Before)
+	return nil
+}
+
+func (m *BufferPoolManager) finish(txn *Txn, recordType disk.LogRecordType) error {
+	m.logAllChanges(txn)
+	lsn := m.appendLog(&disk.LogRecord{Type: recordType, TxnId: txn.id})
+	m.pool.mutex.Lock()
+	m.txnManager.active--
+	m.pool.mutex.Unlock()
+
+	if logManager := m.diskManager.LogManager(); logManager != nil {
+		// 確保したページへの更新がREDOされるとき、ファイル上の空きページリストに残っていないようにする
+		err := m.diskManager.SyncFreeList()
+		if err == nil {
+			err = logManager.Flush(lsn)
+		}
+		if err != nil {
+			m.txnManager.unlockAll(txn)
+			return err
+		}
+	}
+	// 解放するページもロックしているので、他のトランザクションが確保し直せるのはロックを外した後になる
+	m.txnManager.unlockAll(txn)
+	// リカバリで取り消されることがなくなってから、ページを解放する
+	for _, pageId := range txn.freedPageIds {
+		if err := m.deallocatePage(pageId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *BufferPoolManager) InTransaction() bool {
+	return m.txn != nil
+}
+
+// トランザクションが、終わるまで他のトランザクションを待たせるロックを持っているか
+func (m *BufferPoolManager) HoldsLocks() bool {
+	return m.txn != nil && len(m.txn.locks) > 0
+}
+
+// トランザクション内でfを実行し、エラーが返ればロールバックする
+func (m *BufferPoolManager) Transaction(f func(tx *BufferPoolManager) error) error {
+	if m.temporary {
+		return f(m)
+	}
+	var tx *BufferPoolManager
+	if m.txn != nil {
+		tx = m.beginNested()
+	} else {
+		tx = m.begin()
+	}
+	if err := f(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *BufferPoolManager) appendLog(record *disk.LogRecord) disk.LSN {
+	logManager := m.diskManager.LogManager()
+	if logManager == nil {
+		return disk.INVALID_LSN
+	}
+	return logManager.Append(record)
+}
+
+// トランザクションでロックしているページは、ピンした時点の内容を控えておく
+// ロックしていないページは、他のトランザクションが書き換えるかもしれないので控えない
+func (m *BufferPoolManager) pinForTxn(buffer *Buffer) {
+	txn := m.txn
+	if txn == nil {
+		return
+	}
+	txn.pins[buffer]++
+	if _, ok := txn.snapshots[buffer]; ok || !txn.locks[buffer.PageId] {
+		return
+	}
+	buffer.RLatch()
+	snapshot := make([]byte, len(buffer.Page))
+	copy(snapshot, buffer.Page[:])
+	buffer.RUnlatch()
+	txn.snapshots[buffer] = snapshot
+}
+
+// 再利用したページにはディスク上に古い内容が残っているので、最初の更新ではページ全体をログに書く
+func (m *BufferPoolManager) pinNewPageForTxn(buffer *Buffer) {
+	txn := m.txn
+	if txn == nil {
+		return
+	}
+	txn.pins[buffer]++
+	txn.snapshots[buffer] = nil
+}
+
+// トランザクションの最後のピンを外すときに、それまでの更新をログに書く
+// ログに書き終わるまでピンを外さないので、その間にページが追い出されることはない
+func (m *BufferPoolManager) unpinForTxn(buffer *Buffer) {
+	txn := m.txn
+	if txn == nil || txn.pins[buffer] == 0 {
+		return
+	}
+	txn.pins[buffer]--
+	if txn.pins[buffer] > 0 {
+		return
+	}
+	delete(txn.pins, buffer)
+	if snapshot, ok := txn.snapshots[buffer]; ok {
+		m.logChanges(txn, buffer, snapshot)
+		delete(txn.snapshots, buffer)
+	}
+}
+
+func (m *BufferPoolManager) logAllChanges(txn *Txn) {
+	for buffer, snapshot := range txn.snapshots {
+		m.logChanges(txn, buffer, snapshot)
+	}
+}
+
+// スナップショットとの差分を1つの更新ログとして記録する
+// スナップショットがnilなら、0で埋めたページからの更新としてページ全体を記録する
+// 差分を取る間は読み込みラッチを取り、ページが書き換えられないようにする
+func (m *BufferPoolManager) logChanges(txn *Txn, buffer *Buffer, snapshot []byte) {
+	buffer.RLatch()
+	defer buffer.RUnlatch()
+
+	page := buffer.Page[:]
+	start, end := 0, len(page)
+	if snapshot == nil {
+		snapshot = make([]byte, len(page))
+		txn.snapshots[buffer] = snapshot
+	} else {
+		for start < len(page) && page[start] == snapshot[start] {
+			start++
+		}
+		if start == len(page) {
+			return
+		}
+		for page[end-1] == snapshot[end-1] {
+			end--
+		}
+	}
+
+	record := &disk.LogRecord{
+		Type:   disk.LOG_RECORD_UPDATE,
+		TxnId:  txn.id,
+		PageId: buffer.PageId,
+		Offset: uint16(disk.PAGE_HEADER_SIZE + start),
+		Before: append([]byte{}, snapshot[start:end]...),
+		After:  append([]byte{}, page[start:end]...),
+	}
+	if lsn := m.appendLog(record); lsn != disk.INVALID_LSN {
+		buffer.PageLSN = lsn
+	}
+	txn.undoLog = append(txn.undoLog, record)
+	buffer.IsDirty = true
+	copy(snapshot[start:end], page[start:end])
+}
@@ -1,9 +1,12 @@
 package disk
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io/ioutil"
 	"math"
 	"os"
+	"sync"
 
 	"golang.org/x/xerrors"
 )
@@ -11,7 +14,9 @@ import (
 type PageId uint64
 
 var (
-	ErrInvalidPageId = xerrors.New("invalid page id")
+	ErrInvalidPageId   = xerrors.New("invalid page id")
+	ErrInvalidHeapFile = xerrors.New("invalid heap file")
+	ErrReadOnly        = xerrors.New("heap file is opened read-only")
 )
 
 func BytesToPageId(b []byte) PageId {
@@ -39,70 +44,296 @@ func (p *PageId) ToUint64() uint64 {
 	return uint64(*p)
 }
 
+// 先頭のページはファイルヘッダとして使い、ページIDがNのページは(N+1)*PAGE_SIZEの位置に置く
+var heapMagic = []byte("RLYGOHEP")
+
+const (
+	HEAP_FILE_VERSION_INITIAL   = 1
+	HEAP_FILE_VERSION_FREE_LIST = 2
+	HEAP_FILE_VERSION_NULL      = 3
+	HEAP_FILE_VERSION           = HEAP_FILE_VERSION_NULL
+	// バージョン2まではNULLのない形式でタプルを符号化している
+	// カタログを開くときに今の形式に書き換えて、バージョンを上げる
+	HEAP_FILE_VERSION_OLDEST = HEAP_FILE_VERSION_INITIAL
+)
+
+// magic(8) + version(4) + pageSize(4) + 空きページリストの先頭(8)
+const heapHeaderSize = 24
+
+type OpenMode int
+
+const (
+	OPEN_MODE_READ_ONLY OpenMode = iota
+	OPEN_MODE_READ_WRITE
+	// 新しいファイルを作る（既存のファイルとWALは捨てる）
+	OPEN_MODE_CREATE
+)
+
 type DiskManager struct {
 	heapFile   *os.File
+	mode       OpenMode
+	mutex      sync.Mutex
 	nextPageId PageId
+	version    uint32
+	// 空きページのIDを昇順に並べたもの
+	freePageIds []PageId
+	// freePageIdsの変更のうち、まだファイルに書き出していないもの
+	// 新しく空きページになったページ、次の空きページが変わったページ（INVALID_PAGE_IDはヘッダ）、リストから外したページ
+	newFreePageIds  map[PageId]bool
+	relinkedPageIds map[PageId]bool
+	unlinkedPageIds map[PageId]bool
+	logManager      *LogManager
+	// クラッシュしたら捨てる一時ファイルなので、永続化しない
+	temporary bool
 }
 
+// 開いたファイルのヘッダを検証する
 func NewDiskManager(heapFile *os.File) (*DiskManager, error) {
+	return newDiskManager(heapFile, OPEN_MODE_READ_WRITE)
+}
+
+func newDiskManager(heapFile *os.File, mode OpenMode) (*DiskManager, error) {
+	if mode == OPEN_MODE_CREATE {
+		if err := writeHeapHeader(heapFile); err != nil {
+			return nil, err
+		}
+	}
+
 	stat, err := heapFile.Stat()
 	if err != nil {
 		return nil, err
 	}
-
 	heapFileSize := stat.Size()
-	nextPageId := PageId(heapFileSize / PAGE_SIZE)
-	return &DiskManager{heapFile, nextPageId}, nil
+	freeListHead, version, err := readHeapHeader(heapFile, heapFileSize)
+	if err != nil {
+		return nil, err
+	}
+	nextPageId := PageId(heapFileSize/PAGE_SIZE - 1)
+	m := &DiskManager{heapFile: heapFile, mode: mode, nextPageId: nextPageId, version: version}
+	m.resetFreeListChanges()
+	if err := m.loadFreeList(freeListHead); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func writeHeapHeader(heapFile *os.File) error {
+	header := make([]byte, PAGE_SIZE)
+	encodeHeapHeader(header, HEAP_FILE_VERSION, INVALID_PAGE_ID)
+	if _, err := heapFile.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return heapFile.Sync()
+}
+
+func encodeHeapHeader(header []byte, version uint32, freeListHead PageId) {
+	copy(header, heapMagic)
+	binary.LittleEndian.PutUint32(header[len(heapMagic):], version)
+	binary.LittleEndian.PutUint32(header[len(heapMagic)+4:], PAGE_SIZE)
+	binary.LittleEndian.PutUint64(header[len(heapMagic)+8:], uint64(freeListHead))
+}
+
+// ヘッダを検証して、空きページリストの先頭とバージョンを返す
+func readHeapHeader(heapFile *os.File, heapFileSize int64) (PageId, uint32, error) {
+	header := make([]byte, heapHeaderSize)
+	if heapFileSize < heapHeaderSize {
+		return INVALID_PAGE_ID, 0, xerrors.Errorf("%s: not a heap file (%d bytes): %w", heapFile.Name(), heapFileSize, ErrInvalidHeapFile)
+	}
+	if _, err := heapFile.ReadAt(header, 0); err != nil {
+		return INVALID_PAGE_ID, 0, err
+	}
+	if !bytes.Equal(header[:len(heapMagic)], heapMagic) {
+		return INVALID_PAGE_ID, 0, xerrors.Errorf("%s: bad magic number: %w", heapFile.Name(), ErrInvalidHeapFile)
+	}
+	version := binary.LittleEndian.Uint32(header[len(heapMagic):])
+	if version < HEAP_FILE_VERSION_OLDEST || HEAP_FILE_VERSION < version {
+		return INVALID_PAGE_ID, 0, xerrors.Errorf("%s: unsupported format version %d: %w", heapFile.Name(), version, ErrInvalidHeapFile)
+	}
+	if pageSize := binary.LittleEndian.Uint32(header[len(heapMagic)+4:]); pageSize != PAGE_SIZE {
+		return INVALID_PAGE_ID, 0, xerrors.Errorf("%s: page size %d, want %d: %w", heapFile.Name(), pageSize, PAGE_SIZE, ErrInvalidHeapFile)
+	}
+	if heapFileSize < PAGE_SIZE || heapFileSize%PAGE_SIZE != 0 {
+		return INVALID_PAGE_ID, 0, xerrors.Errorf("%s: truncated (%d bytes is not a multiple of page size): %w", heapFile.Name(), heapFileSize, ErrInvalidHeapFile)
+	}
+	// バージョン1には空きページリストがない
+	if version < HEAP_FILE_VERSION_FREE_LIST {
+		return INVALID_PAGE_ID, version, nil
+	}
+	return BytesToPageId(header[len(heapMagic)+8:]), version, nil
+}
+
+func openHeapFile(heapFilePath string, mode OpenMode) (*os.File, error) {
+	switch mode {
+	case OPEN_MODE_READ_ONLY:
+		return os.Open(heapFilePath)
+	case OPEN_MODE_READ_WRITE:
+		return os.OpenFile(heapFilePath, os.O_RDWR, 0)
+	case OPEN_MODE_CREATE:
+		// 前のファイルのWALが残っていると、次に開いたときに誤って適用されてしまう
+		if err := os.Remove(WalFilePath(heapFilePath)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return os.OpenFile(heapFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	default:
+		return nil, xerrors.Errorf("invalid open mode: %d", mode)
+	}
+}
+
+func CreateDiskManager(heapFilePath string) (*DiskManager, error) {
+	return OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_CREATE)
 }
 
 func OpenDiskManager(heapFilePath string) (*DiskManager, error) {
-	heapFile, err := os.Open(heapFilePath)
+	return OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_READ_WRITE)
+}
+
+// 書き込みできるモードではWALを使い、残っていればリカバリする
+// 読み込み専用ではページを書き換えられないので、WALは使わず、リカバリが必要なら開けない
+func OpenDiskManagerWithMode(heapFilePath string, mode OpenMode) (*DiskManager, error) {
+	if stat, err := os.Stat(WalFilePath(heapFilePath)); mode == OPEN_MODE_READ_ONLY && err == nil && stat.Size() > walHeaderSize {
+		return nil, xerrors.Errorf("%s: needs recovery from WAL: %w", heapFilePath, ErrReadOnly)
+	}
+
+	heapFile, err := openHeapFile(heapFilePath, mode)
 	if err != nil {
 		return nil, err
 	}
-	diskManager, err := NewDiskManager(heapFile)
+	diskManager, err := newDiskManager(heapFile, mode)
 	if err != nil {
+		heapFile.Close()
+		return nil, err
+	}
+	if mode == OPEN_MODE_READ_ONLY {
+		return diskManager, nil
+	}
+
+	_, err = os.Stat(WalFilePath(heapFilePath))
+	walMissing := os.IsNotExist(err)
+	logManager, err := OpenLogManager(WalFilePath(heapFilePath))
+	if err != nil {
+		heapFile.Close()
+		return nil, err
+	}
+	diskManager.logManager = logManager
+	// WALを作り直した場合は、ページに残っているLSNより後から振り直す
+	// そうしないと、新しい更新がページLSNより古いとみなされてREDOされない
+	if walMissing && mode != OPEN_MODE_CREATE {
+		if err := diskManager.resetLSN(); err != nil {
+			diskManager.Close()
+			return nil, err
+		}
+	}
+	if err := diskManager.recover(); err != nil {
+		diskManager.Close()
 		return nil, err
 	}
 	return diskManager, nil
 }
 
-func (m *DiskManager) ReadPageData(pageId PageId, data []byte) error {
-	var err error
-
-	offset := int64(PAGE_SIZE * pageId)
-	_, err = m.heapFile.Seek(offset, 0)
+// 並べ替えなどで一時的にページを置くファイルを作る
+// WALは使わず、作ってすぐに削除するので、閉じれば（クラッシュしても）ファイルは残らない
+func CreateTempDiskManager() (*DiskManager, error) {
+	heapFile, err := ioutil.TempFile("", "relly-temp")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := os.Remove(heapFile.Name()); err != nil {
+		heapFile.Close()
+		return nil, err
+	}
+	diskManager, err := newDiskManager(heapFile, OPEN_MODE_CREATE)
+	if err != nil {
+		heapFile.Close()
+		return nil, err
+	}
+	diskManager.temporary = true
+	return diskManager, nil
+}
+
+func (m *DiskManager) Version() uint32 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.version
+}
+
+// ヘッダのバージョンを今のバージョンに上げる
+// 古いバージョンの形式で書かれたデータを、すべて今の形式に書き換えてから呼ぶこと
+func (m *DiskManager) UpgradeVersion() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.mode == OPEN_MODE_READ_ONLY {
+		return ErrReadOnly
 	}
-	_, err = m.heapFile.Read(data)
+	m.version = HEAP_FILE_VERSION
+	m.relinkedPageIds[INVALID_PAGE_ID] = true
+	return m.syncFreeList()
+}
+
+func (m *DiskManager) LogManager() *LogManager {
+	return m.logManager
+}
+
+func (m *DiskManager) Mode() OpenMode {
+	return m.mode
+}
+
+func pageOffset(pageId PageId) int64 {
+	return int64(PAGE_SIZE) * int64(pageId+1)
+}
+
+// 複数のゴルーチンから同時に呼べるよう、シークせずに読み書きする
+func (m *DiskManager) ReadPageData(pageId PageId, data []byte) error {
+	offset := pageOffset(pageId)
+	_, err := m.heapFile.ReadAt(data, offset)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// 空きページリストから外したページは、ファイル上のリストから外してから書き出す
 func (m *DiskManager) WritePageData(pageId PageId, data []byte) error {
-	var err error
+	m.mutex.Lock()
+	if m.unlinkedPageIds[pageId] {
+		if err := m.syncFreeList(); err != nil {
+			m.mutex.Unlock()
+			return err
+		}
+	}
+	m.mutex.Unlock()
+	return m.writePageData(pageId, data)
+}
 
-	offset := int64(PAGE_SIZE * pageId)
-	_, err = m.heapFile.Seek(offset, 0)
-	if err != nil {
-		return err
+func (m *DiskManager) writePageData(pageId PageId, data []byte) error {
+	if m.mode == OPEN_MODE_READ_ONLY {
+		return ErrReadOnly
 	}
-	_, err = m.heapFile.Write(data)
+	offset := pageOffset(pageId)
+	_, err := m.heapFile.WriteAt(data, offset)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *DiskManager) AllocatePage() PageId {
-	pageId := m.nextPageId
-	m.nextPageId++
-	return pageId
-}
-
 func (m *DiskManager) Sync() error {
+	if m.temporary {
+		return nil
+	}
 	return m.heapFile.Sync()
 }
+
+func (m *DiskManager) Close() error {
+	if m.mode != OPEN_MODE_READ_ONLY {
+		if err := m.SyncFreeList(); err != nil {
+			return err
+		}
+	}
+	if m.logManager != nil {
+		if err := m.logManager.Close(); err != nil {
+			return err
+		}
+	}
+	return m.heapFile.Close()
+}
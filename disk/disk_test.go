@@ -2,68 +2,454 @@ package disk
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"golang.org/x/xerrors"
 )
 
 func TestDisk(t *testing.T) {
-	var err error
+	createHeapFilePath := func() (string, func()) {
+		dir, err := ioutil.TempDir("", "TestDisk")
+		if err != nil {
+			panic(err)
+		}
+		return filepath.Join(dir, "test.rly"), func() {
+			if err := os.RemoveAll(dir); err != nil {
+				panic(err)
+			}
+		}
+	}
 
-	file, err := ioutil.TempFile("", "TestDisk")
-	if err != nil {
-		panic(err)
+	allocatePage := func(disk *DiskManager) PageId {
+		pageId, err := disk.AllocatePage()
+		if err != nil {
+			panic(err)
+		}
+		return pageId
 	}
-	defer func() {
-		/*
-			if derr := file.Close(); err != nil {
-				panic(derr)
+
+	t.Run("正常系", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFilePath()
+		defer cleanup()
+
+		disk, err := CreateDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+
+		hello := make([]byte, PAGE_SIZE)
+		copy(hello, []byte("hello"))
+		helloPageId := allocatePage(disk)
+		err = disk.WritePageData(helloPageId, hello)
+		if err != nil {
+			panic(err)
+		}
+
+		world := make([]byte, PAGE_SIZE)
+		copy(world, []byte("world"))
+		worldPageId := allocatePage(disk)
+		err = disk.WritePageData(worldPageId, world)
+		if err != nil {
+			panic(err)
+		}
+
+		err = disk.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		disk2, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		defer disk2.Close()
+
+		buf := make([]byte, PAGE_SIZE)
+		disk2.ReadPageData(helloPageId, buf)
+		if !bytes.Equal(hello, buf) {
+			t.Fatal("bytes.Equal(hello, buf)")
+		}
+		disk2.ReadPageData(worldPageId, buf)
+		if !bytes.Equal(world, buf) {
+			t.Fatal("bytes.Equal(world, buf)")
+		}
+		if pageId := allocatePage(disk2); pageId != worldPageId+1 {
+			t.Fatalf("disk2.AllocatePage() = %v, want %v", pageId, worldPageId+1)
+		}
+	})
+
+	t.Run("読み込み専用", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFilePath()
+		defer cleanup()
+
+		disk, err := CreateDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		hello := make([]byte, PAGE_SIZE)
+		copy(hello, []byte("hello"))
+		helloPageId := allocatePage(disk)
+		if err := disk.WritePageData(helloPageId, hello); err != nil {
+			panic(err)
+		}
+		if err := disk.Close(); err != nil {
+			panic(err)
+		}
+
+		disk2, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_READ_ONLY)
+		if err != nil {
+			panic(err)
+		}
+		defer disk2.Close()
+		buf := make([]byte, PAGE_SIZE)
+		if err := disk2.ReadPageData(helloPageId, buf); err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(hello, buf) {
+			t.Fatal("bytes.Equal(hello, buf)")
+		}
+		if err := disk2.WritePageData(helloPageId, buf); err != ErrReadOnly {
+			t.Fatalf("disk2.WritePageData() = %v, want ErrReadOnly", err)
+		}
+		// 読み込み専用ではWALを使わない
+		if disk2.LogManager() != nil {
+			t.Fatal("disk2.LogManager() != nil")
+		}
+
+		// リカバリが必要なWALが残っていれば、読み込み専用では開けない
+		logManager, err := OpenLogManager(WalFilePath(heapFilePath))
+		if err != nil {
+			panic(err)
+		}
+		logManager.Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 1})
+		if err := logManager.Close(); err != nil {
+			panic(err)
+		}
+		if _, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_READ_ONLY); !xerrors.Is(err, ErrReadOnly) {
+			t.Fatalf("OpenDiskManagerWithMode() = %v, want ErrReadOnly", err)
+		}
+	})
+
+	t.Run("不正なファイル", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFilePath()
+		defer cleanup()
+
+		if _, err := OpenDiskManager(heapFilePath); !os.IsNotExist(err) {
+			t.Fatalf("OpenDiskManager() = %v, want not exist", err)
+		}
+
+		disk, err := CreateDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		if err := disk.WritePageData(allocatePage(disk), make([]byte, PAGE_SIZE)); err != nil {
+			panic(err)
+		}
+		if err := disk.Close(); err != nil {
+			panic(err)
+		}
+		header, err := ioutil.ReadFile(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+
+		testCases := []struct {
+			name    string
+			content []byte
+		}{
+			{"空", []byte{}},
+			{"別のファイル", append([]byte("#!/bin/sh\n"), make([]byte, PAGE_SIZE)...)},
+			{"ページの途中で切れている", header[:PAGE_SIZE+100]},
+			{"ヘッダの途中で切れている", header[:100]},
+			{"バージョン違い", append(append(append([]byte{}, header[:8]...), 99, 0, 0, 0), header[12:]...)},
+			{"バージョン0", append(append(append([]byte{}, header[:8]...), 0, 0, 0, 0), header[12:]...)},
+			{"ページサイズ違い", append(append(append([]byte{}, header[:12]...), 0, 0x20, 0, 0), header[16:]...)},
+		}
+		for _, tc := range testCases {
+			if err := ioutil.WriteFile(heapFilePath, tc.content, 0644); err != nil {
+				panic(err)
+			}
+			_, err := OpenDiskManager(heapFilePath)
+			if !xerrors.Is(err, ErrInvalidHeapFile) {
+				t.Fatalf("%s: OpenDiskManager() = %v, want ErrInvalidHeapFile", tc.name, err)
 			}
-		*/
-		file.Close()
-		if derr := os.Remove(file.Name()); derr != nil {
-			panic(derr)
 		}
-	}()
+	})
+	t.Run("空きページ", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFilePath()
+		defer cleanup()
 
-	disk, err := NewDiskManager(file)
-	if err != nil {
-		panic(err)
-	}
+		disk, err := CreateDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		page := make([]byte, PAGE_SIZE)
+		for i := 0; i < 5; i++ {
+			if err := disk.WritePageData(allocatePage(disk), page); err != nil {
+				panic(err)
+			}
+		}
+		for _, pageId := range []PageId{3, 1} {
+			if err := disk.DeallocatePage(pageId); err != nil {
+				panic(err)
+			}
+		}
+		if err := disk.DeallocatePage(PageId(1)); err != ErrPageAlreadyFree {
+			t.Fatalf("disk.DeallocatePage() = %v, want ErrPageAlreadyFree", err)
+		}
+		if err := disk.DeallocatePage(PageId(5)); err != ErrInvalidPageId {
+			t.Fatalf("disk.DeallocatePage() = %v, want ErrInvalidPageId", err)
+		}
+		if err := disk.Close(); err != nil {
+			panic(err)
+		}
 
-	hello := make([]byte, PAGE_SIZE)
-	copy(hello, []byte("hello"))
-	helloPageId := disk.AllocatePage()
-	err = disk.WritePageData(helloPageId, hello)
-	if err != nil {
-		panic(err)
-	}
+		// 空きページのリストは永続化され、IDの小さい順に再利用される
+		disk2, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		if n := disk2.NumFreePages(); n != 2 {
+			t.Fatalf("disk2.NumFreePages() = %v, want 2", n)
+		}
+		for _, expect := range []PageId{1, 3, 5} {
+			pageId := allocatePage(disk2)
+			if pageId != expect {
+				t.Fatalf("disk2.AllocatePage() = %v, want %v", pageId, expect)
+			}
+			if err := disk2.WritePageData(pageId, page); err != nil {
+				panic(err)
+			}
+		}
 
-	world := make([]byte, PAGE_SIZE)
-	copy(world, []byte("world"))
-	worldPageId := disk.AllocatePage()
-	err = disk.WritePageData(worldPageId, world)
-	if err != nil {
-		panic(err)
-	}
+		// 末尾に連続する空きページだけが切り詰められる
+		for _, pageId := range []PageId{5, 2, 4} {
+			if err := disk2.DeallocatePage(pageId); err != nil {
+				panic(err)
+			}
+		}
+		if err := disk2.TruncateFreePages(); err != nil {
+			panic(err)
+		}
+		if err := disk2.Close(); err != nil {
+			panic(err)
+		}
+		stat, err := os.Stat(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		if size := stat.Size(); size != 5*PAGE_SIZE {
+			t.Fatalf("stat.Size() = %v, want %v", size, 5*PAGE_SIZE)
+		}
 
-	err = file.Close()
-	if err != nil {
-		panic(err)
-	}
+		disk3, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		defer disk3.Close()
+		if n := disk3.NumFreePages(); n != 1 {
+			t.Fatalf("disk3.NumFreePages() = %v, want 1", n)
+		}
+		for _, expect := range []PageId{2, 4} {
+			if pageId := allocatePage(disk3); pageId != expect {
+				t.Fatalf("disk3.AllocatePage() = %v, want %v", pageId, expect)
+			}
+		}
+	})
 
-	disk2, err := OpenDiskManager(file.Name())
-	if err != nil {
-		panic(err)
-	}
+	t.Run("空きページ: まとめて永続化", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFilePath()
+		defer cleanup()
 
-	buf := make([]byte, PAGE_SIZE)
-	disk2.ReadPageData(helloPageId, buf)
-	if !bytes.Equal(hello, buf) {
-		t.Fatal("bytes.Equal(hello, buf)")
-	}
-	disk2.ReadPageData(worldPageId, buf)
-	if !bytes.Equal(world, buf) {
-		t.Fatal("bytes.Equal(world, buf)")
-	}
+		disk, err := CreateDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		defer disk.Close()
+		page := make([]byte, PAGE_SIZE)
+		for i := 0; i < 5; i++ {
+			if err := disk.WritePageData(allocatePage(disk), page); err != nil {
+				panic(err)
+			}
+		}
+		// 閉じずに開き直して、クラッシュした後のファイルの空きページを数える
+		numFreePagesOnFile := func() int {
+			disk2, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_READ_ONLY)
+			if err != nil {
+				panic(err)
+			}
+			defer disk2.Close()
+			return disk2.NumFreePages()
+		}
+
+		// 解放したページは、SyncFreeListを呼ぶまでファイル上のリストに加わらない
+		for _, pageId := range []PageId{3, 1} {
+			if err := disk.DeallocatePage(pageId); err != nil {
+				panic(err)
+			}
+		}
+		if n := numFreePagesOnFile(); n != 0 {
+			t.Fatalf("numFreePagesOnFile() = %v, want 0", n)
+		}
+		if err := disk.SyncFreeList(); err != nil {
+			panic(err)
+		}
+		if n := numFreePagesOnFile(); n != 2 {
+			t.Fatalf("numFreePagesOnFile() = %v, want 2", n)
+		}
+
+		// 確保したページは、書き出す前にファイル上のリストから外す
+		pageId := allocatePage(disk)
+		if n := numFreePagesOnFile(); n != 2 {
+			t.Fatalf("numFreePagesOnFile() = %v, want 2", n)
+		}
+		if err := disk.WritePageData(pageId, page); err != nil {
+			panic(err)
+		}
+		if n := numFreePagesOnFile(); n != 1 {
+			t.Fatalf("numFreePagesOnFile() = %v, want 1", n)
+		}
+
+		// 永続化する前に解放し直したページは、リストにつなぎ直すだけで済む
+		pageId = allocatePage(disk)
+		if err := disk.DeallocatePage(pageId); err != nil {
+			panic(err)
+		}
+		if err := disk.DeallocatePage(PageId(0)); err != nil {
+			panic(err)
+		}
+		if err := disk.SyncFreeList(); err != nil {
+			panic(err)
+		}
+		if n := numFreePagesOnFile(); n != 2 {
+			t.Fatalf("numFreePagesOnFile() = %v, want 2", n)
+		}
+		for _, expect := range []PageId{0, 3} {
+			if pageId := allocatePage(disk); pageId != expect {
+				t.Fatalf("disk.AllocatePage() = %v, want %v", pageId, expect)
+			}
+		}
+	})
+
+	t.Run("古いバージョン", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFilePath()
+		defer cleanup()
+
+		disk, err := CreateDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := disk.WritePageData(allocatePage(disk), make([]byte, PAGE_SIZE)); err != nil {
+				panic(err)
+			}
+		}
+		if err := disk.Close(); err != nil {
+			panic(err)
+		}
+		// バージョン1のヘッダには空きページリストがないので、先頭のIDがあっても無視される
+		file, err := os.OpenFile(heapFilePath, os.O_RDWR, 0)
+		if err != nil {
+			panic(err)
+		}
+		version := make([]byte, 4)
+		binary.LittleEndian.PutUint32(version, HEAP_FILE_VERSION_INITIAL)
+		if _, err := file.WriteAt(version, int64(len(heapMagic))); err != nil {
+			panic(err)
+		}
+		if _, err := file.WriteAt(PageIdToBytes(PageId(1)), int64(len(heapMagic)+8)); err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+
+		disk2, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			t.Fatalf("OpenDiskManager() = %v", err)
+		}
+		if version := disk2.Version(); version != HEAP_FILE_VERSION_INITIAL {
+			t.Fatalf("disk2.Version() = %v, want %v", version, HEAP_FILE_VERSION_INITIAL)
+		}
+		if n := disk2.NumFreePages(); n != 0 {
+			t.Fatalf("disk2.NumFreePages() = %v, want 0", n)
+		}
+		// ページを解放すると、空きページリストを持つバージョンまで上がる
+		if err := disk2.DeallocatePage(PageId(1)); err != nil {
+			panic(err)
+		}
+		if err := disk2.Close(); err != nil {
+			panic(err)
+		}
+		disk3, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		if version := disk3.Version(); version != HEAP_FILE_VERSION_FREE_LIST {
+			t.Fatalf("disk3.Version() = %v, want %v", version, HEAP_FILE_VERSION_FREE_LIST)
+		}
+		if n := disk3.NumFreePages(); n != 1 {
+			t.Fatalf("disk3.NumFreePages() = %v, want 1", n)
+		}
+		if err := disk3.UpgradeVersion(); err != nil {
+			panic(err)
+		}
+		if err := disk3.Close(); err != nil {
+			panic(err)
+		}
+
+		disk4, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_READ_ONLY)
+		if err != nil {
+			panic(err)
+		}
+		defer disk4.Close()
+		if version := disk4.Version(); version != HEAP_FILE_VERSION {
+			t.Fatalf("disk4.Version() = %v, want %v", version, HEAP_FILE_VERSION)
+		}
+		if n := disk4.NumFreePages(); n != 1 {
+			t.Fatalf("disk4.NumFreePages() = %v, want 1", n)
+		}
+		if err := disk4.UpgradeVersion(); err != ErrReadOnly {
+			t.Fatalf("disk4.UpgradeVersion() = %v, want ErrReadOnly", err)
+		}
+	})
+
+	t.Run("一時ファイル", func(t *testing.T) {
+		disk, err := CreateTempDiskManager()
+		if err != nil {
+			panic(err)
+		}
+		defer disk.Close()
+
+		// WALを使わない
+		if disk.LogManager() != nil {
+			t.Fatal("disk.LogManager() != nil")
+		}
+
+		hello := make([]byte, PAGE_SIZE)
+		copy(hello, []byte("hello"))
+		helloPageId := allocatePage(disk)
+		if err := disk.WritePageData(helloPageId, hello); err != nil {
+			panic(err)
+		}
+		buf := make([]byte, PAGE_SIZE)
+		if err := disk.ReadPageData(helloPageId, buf); err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(hello, buf) {
+			t.Fatal("ReadPageData() != hello")
+		}
+
+		// 解放したページは再利用される
+		if err := disk.DeallocatePage(helloPageId); err != nil {
+			panic(err)
+		}
+		if pageId := allocatePage(disk); pageId != helloPageId {
+			t.Fatalf("disk.AllocatePage() = %v, want %v", pageId, helloPageId)
+		}
+	})
 }
@@ -0,0 +1,230 @@
+package disk
+
+import (
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrPageAlreadyFree = xerrors.New("page is already free")
+)
+
+// 空きページはヘッダを先頭に、ページID順の連結リストとしてファイル上に持つ
+// 空きページの中身はページLSNと次の空きページのIDだけ
+const freePageNextOffset = PAGE_HEADER_SIZE
+
+func (m *DiskManager) loadFreeList(head PageId) error {
+	page := make([]byte, PAGE_SIZE)
+	for pageId := head; pageId != INVALID_PAGE_ID; {
+		n := len(m.freePageIds)
+		if pageId >= m.nextPageId || (n > 0 && pageId <= m.freePageIds[n-1]) {
+			return xerrors.Errorf("%s: broken free page list at page %d: %w", m.heapFile.Name(), pageId, ErrInvalidHeapFile)
+		}
+		if err := m.ReadPageData(pageId, page); err != nil {
+			return err
+		}
+		m.freePageIds = append(m.freePageIds, pageId)
+		pageId = BytesToPageId(page[freePageNextOffset:])
+	}
+	return nil
+}
+
+// 空きページがあれば、IDの小さいものから再利用する
+// リストから外したことは、そのページを書き出すかSyncFreeListを呼ぶまでファイルに反映しない
+func (m *DiskManager) AllocatePage() (PageId, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.mode == OPEN_MODE_READ_ONLY {
+		return INVALID_PAGE_ID, ErrReadOnly
+	}
+	if len(m.freePageIds) == 0 {
+		pageId := m.nextPageId
+		m.nextPageId++
+		return pageId, nil
+	}
+
+	pageId := m.freePageIds[0]
+	m.freePageIds = m.freePageIds[1:]
+	m.relinkedPageIds[INVALID_PAGE_ID] = true
+	if m.newFreePageIds[pageId] {
+		delete(m.newFreePageIds, pageId)
+	} else {
+		m.unlinkedPageIds[pageId] = true
+	}
+	delete(m.relinkedPageIds, pageId)
+	return pageId, nil
+}
+
+// どこからも参照されなくなったページを空きページにする
+// バッファプールに残っている内容は、呼び出し側で捨てておくこと
+// SyncFreeListを呼ぶまでファイルに反映しないので、その前にクラッシュしても、ページが空きページにならないだけで済む
+func (m *DiskManager) DeallocatePage(pageId PageId) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.mode == OPEN_MODE_READ_ONLY {
+		return ErrReadOnly
+	}
+	if pageId >= m.nextPageId {
+		return ErrInvalidPageId
+	}
+	i := sort.Search(len(m.freePageIds), func(i int) bool { return m.freePageIds[i] >= pageId })
+	if i < len(m.freePageIds) && m.freePageIds[i] == pageId {
+		return ErrPageAlreadyFree
+	}
+
+	m.freePageIds = append(m.freePageIds, INVALID_PAGE_ID)
+	copy(m.freePageIds[i+1:], m.freePageIds[i:])
+	m.freePageIds[i] = pageId
+	if m.unlinkedPageIds[pageId] {
+		// ファイル上のリストにはまだ残っているので、つなぎ直すだけでよい
+		delete(m.unlinkedPageIds, pageId)
+		m.relinkedPageIds[pageId] = true
+	} else {
+		m.newFreePageIds[pageId] = true
+	}
+	m.relinkedPageIds[m.freePageIdAt(i-1)] = true
+	return nil
+}
+
+// メモリ上で変更した空きページリストを、ファイルに書き出して永続化する
+// 確保したページを書き出す前と、トランザクションのコミットやバッファプールのFlushで呼ばれる
+func (m *DiskManager) SyncFreeList() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.syncFreeList()
+}
+
+// 新しい空きページを先に永続化してから、前の空きページ（またはヘッダ）からつなぐ
+// つなぎ替えの途中でクラッシュしても、リストが中身のないページを指すことはない
+func (m *DiskManager) syncFreeList() error {
+	if len(m.newFreePageIds) == 0 && len(m.relinkedPageIds) == 0 && len(m.unlinkedPageIds) == 0 {
+		return nil
+	}
+	if m.mode == OPEN_MODE_READ_ONLY {
+		return ErrReadOnly
+	}
+	if len(m.newFreePageIds) > 0 {
+		for i, pageId := range m.freePageIds {
+			if m.newFreePageIds[pageId] {
+				if err := m.linkFreePage(i, m.freePageIdAt(i+1)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := m.Sync(); err != nil {
+			return err
+		}
+	}
+	for i, pageId := range m.freePageIds {
+		if m.relinkedPageIds[pageId] && !m.newFreePageIds[pageId] {
+			if err := m.linkFreePage(i, m.freePageIdAt(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if m.relinkedPageIds[INVALID_PAGE_ID] {
+		if err := m.linkFreePage(-1, m.freePageIdAt(0)); err != nil {
+			return err
+		}
+	}
+	if err := m.Sync(); err != nil {
+		return err
+	}
+	m.resetFreeListChanges()
+	return nil
+}
+
+func (m *DiskManager) resetFreeListChanges() {
+	m.newFreePageIds = map[PageId]bool{}
+	m.relinkedPageIds = map[PageId]bool{}
+	m.unlinkedPageIds = map[PageId]bool{}
+}
+
+// ファイル末尾に連続している空きページを切り詰める
+// WALに切り詰めるページへの更新が残っていないときに呼ぶこと
+func (m *DiskManager) TruncateFreePages() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i := len(m.freePageIds)
+	nextPageId := m.nextPageId
+	for i > 0 && m.freePageIds[i-1] == nextPageId-1 {
+		i--
+		nextPageId--
+	}
+	if i == len(m.freePageIds) {
+		return nil
+	}
+	if m.mode == OPEN_MODE_READ_ONLY {
+		return ErrReadOnly
+	}
+
+	// 切り詰めたページをリストが指したままにならないよう、先につなぎ替えを永続化する
+	m.freePageIds = m.freePageIds[:i]
+	m.relinkedPageIds[m.freePageIdAt(i-1)] = true
+	if err := m.syncFreeList(); err != nil {
+		return err
+	}
+	if err := m.heapFile.Truncate(pageOffset(nextPageId)); err != nil {
+		return err
+	}
+	if err := m.Sync(); err != nil {
+		return err
+	}
+	m.nextPageId = nextPageId
+	return nil
+}
+
+func (m *DiskManager) NumFreePages() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.freePageIds)
+}
+
+func (m *DiskManager) freePageIdAt(i int) PageId {
+	if 0 <= i && i < len(m.freePageIds) {
+		return m.freePageIds[i]
+	}
+	return INVALID_PAGE_ID
+}
+
+// それまでのLSNを付けて書き出し、REDOで古い更新ログが適用されないようにする
+// 永続化は呼び出し側で行う
+func (m *DiskManager) writeFreePage(pageId PageId, page []byte) error {
+	if m.logManager != nil {
+		WritePageLSN(page, m.logManager.lastLSN())
+	}
+	return m.writePageData(pageId, page)
+}
+
+// i番目の空きページ（-1ならヘッダ）の次をnextにする
+// 永続化は呼び出し側で行う
+// タプルの形式に関わるので、ヘッダのバージョンは空きページリストを持つバージョンまでしか上げない
+func (m *DiskManager) linkFreePage(i int, next PageId) error {
+	if i < 0 {
+		if m.version < HEAP_FILE_VERSION_FREE_LIST {
+			m.version = HEAP_FILE_VERSION_FREE_LIST
+		}
+		header := make([]byte, heapHeaderSize)
+		encodeHeapHeader(header, m.version, next)
+		_, err := m.heapFile.WriteAt(header, 0)
+		return err
+	}
+	page := make([]byte, PAGE_SIZE)
+	copy(page[freePageNextOffset:], PageIdToBytes(next))
+	return m.writeFreePage(m.freePageIds[i], page)
+}
+
+// リカバリで空きページの中身が書き換わっているかもしれないので、リスト全体を書き直す
+func (m *DiskManager) rewriteFreeList() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, pageId := range m.freePageIds {
+		m.relinkedPageIds[pageId] = true
+	}
+	m.relinkedPageIds[INVALID_PAGE_ID] = true
+	return m.syncFreeList()
+}
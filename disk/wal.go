@@ -0,0 +1,409 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+type LSN uint64
+type TxnId uint64
+
+const INVALID_LSN = LSN(0)
+
+// ページ先頭にはページLSNを置く
+const PAGE_HEADER_SIZE = 8
+const PAGE_BODY_SIZE = PAGE_SIZE - PAGE_HEADER_SIZE
+
+const WAL_FILE_SUFFIX = ".wal"
+
+var (
+	ErrInvalidWalFile = xerrors.New("invalid WAL file")
+)
+
+func ReadPageLSN(page []byte) LSN {
+	return LSN(binary.LittleEndian.Uint64(page[:PAGE_HEADER_SIZE]))
+}
+
+func WritePageLSN(page []byte, lsn LSN) {
+	binary.LittleEndian.PutUint64(page[:PAGE_HEADER_SIZE], uint64(lsn))
+}
+
+func WalFilePath(heapFilePath string) string {
+	return heapFilePath + WAL_FILE_SUFFIX
+}
+
+type LogRecordType uint8
+
+const (
+	LOG_RECORD_BEGIN LogRecordType = iota + 1
+	LOG_RECORD_UPDATE
+	LOG_RECORD_COMMIT
+	LOG_RECORD_ABORT
+	// 更新を取り消したことを表す補償ログ（CLR）。REDOはするが、それ自体は取り消さない
+	LOG_RECORD_CLR
+)
+
+type LogRecord struct {
+	LSN    LSN
+	Type   LogRecordType
+	TxnId  TxnId
+	PageId PageId
+	Offset uint16
+	Before []byte
+	After  []byte
+}
+
+// LSN(8) + Type(1) + TxnId(8) + PageId(8) + Offset(2) + Length(2)
+const logRecordHeaderSize = 29
+
+// length(4) + crc32(4)
+const logRecordFrameSize = 8
+
+func (r *LogRecord) encode(dst []byte) []byte {
+	payload := make([]byte, logRecordHeaderSize, logRecordHeaderSize+len(r.Before)+len(r.After))
+	binary.LittleEndian.PutUint64(payload[0:], uint64(r.LSN))
+	payload[8] = byte(r.Type)
+	binary.LittleEndian.PutUint64(payload[9:], uint64(r.TxnId))
+	binary.LittleEndian.PutUint64(payload[17:], uint64(r.PageId))
+	binary.LittleEndian.PutUint16(payload[25:], r.Offset)
+	binary.LittleEndian.PutUint16(payload[27:], uint16(len(r.After)))
+	payload = append(payload, r.Before...)
+	payload = append(payload, r.After...)
+
+	frame := make([]byte, logRecordFrameSize)
+	binary.LittleEndian.PutUint32(frame[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	dst = append(dst, frame...)
+	return append(dst, payload...)
+}
+
+// 壊れたレコード（書きかけの末尾など）はnilを返す
+func decodeLogRecord(src []byte) (*LogRecord, []byte) {
+	if len(src) < logRecordFrameSize {
+		return nil, src
+	}
+	length := int(binary.LittleEndian.Uint32(src[0:]))
+	checksum := binary.LittleEndian.Uint32(src[4:])
+	if length < logRecordHeaderSize || len(src) < logRecordFrameSize+length {
+		return nil, src
+	}
+	payload := src[logRecordFrameSize : logRecordFrameSize+length]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, src
+	}
+	dataLen := int(binary.LittleEndian.Uint16(payload[27:]))
+	if logRecordHeaderSize+2*dataLen != length {
+		return nil, src
+	}
+
+	record := &LogRecord{
+		LSN:    LSN(binary.LittleEndian.Uint64(payload[0:])),
+		Type:   LogRecordType(payload[8]),
+		TxnId:  TxnId(binary.LittleEndian.Uint64(payload[9:])),
+		PageId: PageId(binary.LittleEndian.Uint64(payload[17:])),
+		Offset: binary.LittleEndian.Uint16(payload[25:]),
+	}
+	data := payload[logRecordHeaderSize:]
+	record.Before = append([]byte{}, data[:dataLen]...)
+	record.After = append([]byte{}, data[dataLen:]...)
+	return record, src[logRecordFrameSize+length:]
+}
+
+var walMagic = []byte("RLYGOWAL")
+
+// magic(8) + 先頭のLSN(8)
+const walHeaderSize = 16
+
+type LogManager struct {
+	mutex      sync.Mutex
+	logFile    *os.File
+	buf        []byte
+	fileSize   int64
+	nextLSN    LSN
+	flushedLSN LSN
+}
+
+func OpenLogManager(logFilePath string) (*LogManager, error) {
+	logFile, err := os.OpenFile(logFilePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &LogManager{logFile: logFile}
+
+	data, err := ioutil.ReadAll(logFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		if err := m.reset(LSN(1)); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if len(data) < walHeaderSize || !bytes.Equal(data[:len(walMagic)], walMagic) {
+		return nil, ErrInvalidWalFile
+	}
+
+	// 正しく書けているレコードの末尾まで読み進める
+	m.nextLSN = LSN(binary.LittleEndian.Uint64(data[len(walMagic):]))
+	rest := data[walHeaderSize:]
+	for {
+		var record *LogRecord
+		record, rest = decodeLogRecord(rest)
+		if record == nil {
+			break
+		}
+		if record.LSN >= m.nextLSN {
+			m.nextLSN = record.LSN + 1
+		}
+	}
+	m.fileSize = int64(len(data) - len(rest))
+	m.flushedLSN = m.nextLSN - 1
+	if err := logFile.Truncate(m.fileSize); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *LogManager) Append(record *LogRecord) LSN {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record.LSN = m.nextLSN
+	m.nextLSN++
+	m.buf = record.encode(m.buf)
+	return record.LSN
+}
+
+// lsnまでのレコードをファイルに書き出して永続化する
+func (m *LogManager) Flush(lsn LSN) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.flush(lsn)
+}
+
+func (m *LogManager) flush(lsn LSN) error {
+	if lsn <= m.flushedLSN || len(m.buf) == 0 {
+		return nil
+	}
+	if _, err := m.logFile.WriteAt(m.buf, m.fileSize); err != nil {
+		return err
+	}
+	if err := m.logFile.Sync(); err != nil {
+		return err
+	}
+	m.fileSize += int64(len(m.buf))
+	m.buf = m.buf[:0]
+	m.flushedLSN = m.nextLSN - 1
+	return nil
+}
+
+func (m *LogManager) ReadRecords() ([]*LogRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.flush(m.nextLSN); err != nil {
+		return nil, err
+	}
+	data := make([]byte, m.fileSize)
+	if _, err := m.logFile.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+
+	records := []*LogRecord{}
+	rest := data[walHeaderSize:]
+	for {
+		var record *LogRecord
+		record, rest = decodeLogRecord(rest)
+		if record == nil {
+			break
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (m *LogManager) lastLSN() LSN {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.nextLSN - 1
+}
+
+// すべてのページがディスクに書き出された後に、ログを空にする
+// LSNは引き続き単調増加させる
+func (m *LogManager) Truncate() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.flush(m.nextLSN); err != nil {
+		return err
+	}
+	return m.reset(m.nextLSN)
+}
+
+func (m *LogManager) reset(startLSN LSN) error {
+	header := make([]byte, walHeaderSize)
+	copy(header, walMagic)
+	binary.LittleEndian.PutUint64(header[len(walMagic):], uint64(startLSN))
+	if err := m.logFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := m.logFile.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := m.logFile.Sync(); err != nil {
+		return err
+	}
+	m.buf = m.buf[:0]
+	m.fileSize = walHeaderSize
+	m.nextLSN = startLSN
+	m.flushedLSN = startLSN - 1
+	return nil
+}
+
+func (m *LogManager) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.flush(m.nextLSN); err != nil {
+		return err
+	}
+	return m.logFile.Close()
+}
+
+// REDO: ページLSNより新しい更新とCLRをすべて適用する
+// UNDO: COMMIT/ABORTされていないトランザクションの更新を逆順に取り消す
+// 取り消すたびにCLRを書いてページLSNを進め、最後にABORTを書く
+func (m *DiskManager) recover() error {
+	records, err := m.logManager.ReadRecords()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	losers := map[TxnId]bool{}
+	for _, record := range records {
+		switch record.Type {
+		case LOG_RECORD_BEGIN:
+			losers[record.TxnId] = true
+		case LOG_RECORD_COMMIT, LOG_RECORD_ABORT:
+			delete(losers, record.TxnId)
+		case LOG_RECORD_UPDATE, LOG_RECORD_CLR:
+			if err := m.redo(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	// CLRは直前の更新から逆順に対応するので、後ろから数えて対応する更新を飛ばす
+	// （ロールバックやリカバリの途中でクラッシュした場合に、二重に取り消さない）
+	compensated := map[TxnId]int{}
+	clrs := []*LogRecord{}
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if !losers[record.TxnId] {
+			continue
+		}
+		switch record.Type {
+		case LOG_RECORD_CLR:
+			compensated[record.TxnId]++
+		case LOG_RECORD_UPDATE:
+			if compensated[record.TxnId] > 0 {
+				compensated[record.TxnId]--
+				continue
+			}
+			clr := &LogRecord{
+				Type:   LOG_RECORD_CLR,
+				TxnId:  record.TxnId,
+				PageId: record.PageId,
+				Offset: record.Offset,
+				Before: record.After,
+				After:  record.Before,
+			}
+			m.logManager.Append(clr)
+			clrs = append(clrs, clr)
+		}
+	}
+	for txnId := range losers {
+		m.logManager.Append(&LogRecord{Type: LOG_RECORD_ABORT, TxnId: txnId})
+	}
+	// ページを書き換える前にCLRを永続化しておく
+	if err := m.logManager.Flush(m.logManager.lastLSN()); err != nil {
+		return err
+	}
+	for _, clr := range clrs {
+		if err := m.redo(clr); err != nil {
+			return err
+		}
+	}
+
+	if err := m.Sync(); err != nil {
+		return err
+	}
+	if err := m.rewriteFreeList(); err != nil {
+		return err
+	}
+	return m.logManager.Truncate()
+}
+
+func (m *DiskManager) resetLSN() error {
+	maxLSN := INVALID_LSN
+	page := make([]byte, PAGE_SIZE)
+	for pageId := PageId(0); pageId < m.nextPageId; pageId++ {
+		if err := m.ReadPageData(pageId, page); err != nil {
+			return err
+		}
+		if lsn := ReadPageLSN(page); lsn > maxLSN {
+			maxLSN = lsn
+		}
+	}
+	if maxLSN < m.logManager.lastLSN() {
+		return nil
+	}
+	m.logManager.mutex.Lock()
+	defer m.logManager.mutex.Unlock()
+	return m.logManager.reset(maxLSN + 1)
+}
+
+// ページLSNより新しければ、更新後の内容を書き込んでページLSNを進める
+func (m *DiskManager) redo(record *LogRecord) error {
+	page := make([]byte, PAGE_SIZE)
+	if err := m.readPageForRecovery(record.PageId, page); err != nil {
+		return err
+	}
+	if ReadPageLSN(page) >= record.LSN {
+		return nil
+	}
+	copy(page[record.Offset:], record.After)
+	WritePageLSN(page, record.LSN)
+	return m.writePageForRecovery(record.PageId, page)
+}
+
+func (m *DiskManager) readPageForRecovery(pageId PageId, page []byte) error {
+	if pageId >= m.nextPageId {
+		// 書き出される前にクラッシュしたページ
+		for i := range page {
+			page[i] = 0
+		}
+		return nil
+	}
+	return m.ReadPageData(pageId, page)
+}
+
+func (m *DiskManager) writePageForRecovery(pageId PageId, page []byte) error {
+	if err := m.WritePageData(pageId, page); err != nil {
+		return err
+	}
+	if pageId >= m.nextPageId {
+		m.nextPageId = pageId + 1
+	}
+	return nil
+}
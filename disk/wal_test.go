@@ -0,0 +1,236 @@
+package disk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWal(t *testing.T) {
+	createHeapFile := func() (string, func()) {
+		dir, err := ioutil.TempDir("", "TestWal")
+		if err != nil {
+			panic(err)
+		}
+		return filepath.Join(dir, "test.rly"), func() {
+			if err := os.RemoveAll(dir); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	t.Run("LogManager", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		logManager, err := OpenLogManager(WalFilePath(heapFilePath))
+		if err != nil {
+			panic(err)
+		}
+		lsn1 := logManager.Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 1})
+		lsn2 := logManager.Append(&LogRecord{
+			Type:   LOG_RECORD_UPDATE,
+			TxnId:  1,
+			PageId: PageId(3),
+			Offset: 100,
+			Before: []byte("hello"),
+			After:  []byte("world"),
+		})
+		if lsn1 >= lsn2 {
+			t.Fatalf("logManager.Append() = %v, %v, want increasing", lsn1, lsn2)
+		}
+		if err := logManager.Flush(lsn2); err != nil {
+			panic(err)
+		}
+		// フラッシュしていないレコードはクラッシュで失われる
+		logManager.Append(&LogRecord{Type: LOG_RECORD_COMMIT, TxnId: 1})
+
+		logManager2, err := OpenLogManager(WalFilePath(heapFilePath))
+		if err != nil {
+			panic(err)
+		}
+		records, err := logManager2.ReadRecords()
+		if err != nil {
+			panic(err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("len(records) = %v, want 2", len(records))
+		}
+		record := records[1]
+		if record.LSN != lsn2 || record.Type != LOG_RECORD_UPDATE || record.PageId != 3 || record.Offset != 100 {
+			t.Fatalf("records[1] = %+v", record)
+		}
+		if !bytes.Equal(record.Before, []byte("hello")) || !bytes.Equal(record.After, []byte("world")) {
+			t.Fatalf("records[1] = %+v", record)
+		}
+
+		// 空にした後もLSNは増え続ける
+		if err := logManager2.Truncate(); err != nil {
+			panic(err)
+		}
+		if lsn := logManager2.Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 2}); lsn <= lsn2 {
+			t.Fatalf("logManager.Append() = %v, want > %v", lsn, lsn2)
+		}
+	})
+
+	t.Run("壊れたWAL", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		if err := ioutil.WriteFile(WalFilePath(heapFilePath), []byte("this is not a WAL file"), 0644); err != nil {
+			panic(err)
+		}
+		if _, err := OpenLogManager(WalFilePath(heapFilePath)); err != ErrInvalidWalFile {
+			t.Fatalf("OpenLogManager() = %v, want ErrInvalidWalFile", err)
+		}
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		disk, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_CREATE)
+		if err != nil {
+			panic(err)
+		}
+		page := make([]byte, PAGE_SIZE)
+		pageId, err := disk.AllocatePage()
+		if err != nil {
+			panic(err)
+		}
+		copy(page[PAGE_HEADER_SIZE:], []byte("aaaa"))
+		if err := disk.WritePageData(pageId, page); err != nil {
+			panic(err)
+		}
+
+		// コミット済みのトランザクション1と、コミットされていないトランザクション2
+		logManager := disk.LogManager()
+		logManager.Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 1})
+		logManager.Append(&LogRecord{Type: LOG_RECORD_UPDATE, TxnId: 1, PageId: pageId, Offset: PAGE_HEADER_SIZE, Before: []byte("aa"), After: []byte("bb")})
+		logManager.Append(&LogRecord{Type: LOG_RECORD_COMMIT, TxnId: 1})
+		logManager.Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 2})
+		lsn := logManager.Append(&LogRecord{Type: LOG_RECORD_UPDATE, TxnId: 2, PageId: pageId, Offset: PAGE_HEADER_SIZE + 2, Before: []byte("aa"), After: []byte("cc")})
+		if err := logManager.Flush(lsn); err != nil {
+			panic(err)
+		}
+
+		// トランザクション2の更新までページに書き出された状態でクラッシュ
+		copy(page[PAGE_HEADER_SIZE:], []byte("bbcc"))
+		WritePageLSN(page, lsn)
+		if err := disk.WritePageData(pageId, page); err != nil {
+			panic(err)
+		}
+
+		disk2, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		defer disk2.Close()
+		if err := disk2.ReadPageData(pageId, page); err != nil {
+			panic(err)
+		}
+		expect := []byte("bbaa")
+		if actual := page[PAGE_HEADER_SIZE : PAGE_HEADER_SIZE+4]; !bytes.Equal(actual, expect) {
+			t.Fatalf("page = %s, want %s", actual, expect)
+		}
+		// 取り消しはCLRとして書かれ、ページLSNが進んでいる
+		if pageLSN := ReadPageLSN(page); pageLSN <= lsn {
+			t.Fatalf("ReadPageLSN() = %v, want > %v", pageLSN, lsn)
+		}
+
+		// リカバリ後はWALが空になっている
+		stat, err := os.Stat(WalFilePath(heapFilePath))
+		if err != nil {
+			panic(err)
+		}
+		if stat.Size() != walHeaderSize {
+			t.Fatalf("WAL size = %v, want %v", stat.Size(), walHeaderSize)
+		}
+	})
+	t.Run("WALがない", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		disk, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_CREATE)
+		if err != nil {
+			panic(err)
+		}
+		page := make([]byte, PAGE_SIZE)
+		pageId, err := disk.AllocatePage()
+		if err != nil {
+			panic(err)
+		}
+		WritePageLSN(page, LSN(100))
+		if err := disk.WritePageData(pageId, page); err != nil {
+			panic(err)
+		}
+		if err := disk.Close(); err != nil {
+			panic(err)
+		}
+		if err := os.Remove(WalFilePath(heapFilePath)); err != nil {
+			panic(err)
+		}
+
+		// 作り直したWALのLSNは、ページに残っているLSNより後から振られる
+		disk2, err := OpenDiskManager(heapFilePath)
+		if err != nil {
+			panic(err)
+		}
+		defer disk2.Close()
+		if lsn := disk2.LogManager().Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 1}); lsn <= LSN(100) {
+			t.Fatalf("LogManager().Append() = %v, want > 100", lsn)
+		}
+	})
+	t.Run("Recovery: 解放したページ", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		disk, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_CREATE)
+		if err != nil {
+			panic(err)
+		}
+		page := make([]byte, PAGE_SIZE)
+		pageIds := make([]PageId, 2)
+		for i := range pageIds {
+			if pageIds[i], err = disk.AllocatePage(); err != nil {
+				panic(err)
+			}
+			if err := disk.WritePageData(pageIds[i], page); err != nil {
+				panic(err)
+			}
+		}
+
+		// 空きページのリンクと重なる位置への更新がコミットされた後に、ページを解放する
+		logManager := disk.LogManager()
+		logManager.Append(&LogRecord{Type: LOG_RECORD_BEGIN, TxnId: 1})
+		logManager.Append(&LogRecord{Type: LOG_RECORD_UPDATE, TxnId: 1, PageId: pageIds[0], Offset: PAGE_HEADER_SIZE, Before: make([]byte, 8), After: []byte("xxxxxxxx")})
+		lsn := logManager.Append(&LogRecord{Type: LOG_RECORD_COMMIT, TxnId: 1})
+		if err := logManager.Flush(lsn); err != nil {
+			panic(err)
+		}
+		for _, pageId := range pageIds {
+			if err := disk.DeallocatePage(pageId); err != nil {
+				panic(err)
+			}
+		}
+		if err := disk.SyncFreeList(); err != nil {
+			panic(err)
+		}
+
+		disk2, err := OpenDiskManagerWithMode(heapFilePath, OPEN_MODE_READ_WRITE)
+		if err != nil {
+			panic(err)
+		}
+		defer disk2.Close()
+		if n := disk2.NumFreePages(); n != 2 {
+			t.Fatalf("disk2.NumFreePages() = %v, want 2", n)
+		}
+		for _, pageId := range pageIds {
+			if actual, err := disk2.AllocatePage(); err != nil || actual != pageId {
+				t.Fatalf("disk2.AllocatePage() = %v, %v, want %v", actual, err, pageId)
+			}
+		}
+	})
+}
@@ -4,25 +4,19 @@ import (
 	"my-relly-go/btree"
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
-	"os"
 )
 
 func BTreeCreate() {
-	file, err := os.Create("test.btr")
+	disk, err := disk.CreateDiskManager("test.btr")
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
-		if err := file.Close(); err != nil {
+		if err := disk.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
-	disk, err := disk.NewDiskManager(file)
-	if err != nil {
-		panic(err)
-	}
-
 	pool := buffer.NewBufferPool(10)
 	bufmgr := buffer.NewBufferPoolManager(disk, pool)
 
@@ -8,7 +8,7 @@ import (
 )
 
 func BTreeLargeQuery() {
-	diskManager, err := disk.OpenDiskManager("large.btr")
+	diskManager, err := disk.OpenDiskManagerWithMode("large.btr", disk.OPEN_MODE_READ_ONLY)
 	if err != nil {
 		panic(err)
 	}
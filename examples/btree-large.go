@@ -1,50 +1,71 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/binary"
 	"fmt"
 	"my-relly-go/btree"
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
-	"os"
+	"sort"
 )
 
 const NUM_PAIRS uint32 = 1_000_000
 
 func BTreeLarge() {
-	file, err := os.Create("large.btr")
+	disk, err := disk.CreateDiskManager("large.btr")
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
-		if err := file.Close(); err != nil {
+		if err := disk.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
-	disk, err := disk.NewDiskManager(file)
-	if err != nil {
-		panic(err)
-	}
-
 	pool := buffer.NewBufferPool(100)
 	bufmgr := buffer.NewBufferPoolManager(disk, pool)
 
-	btree, err := btree.CreateBTree(bufmgr)
-	if err != nil {
-		panic(err)
-	}
-
+	// キーの順に並べてから、下の段から一度に作る
+	keys := make([][]byte, 0, NUM_PAIRS)
+	values := make([][]byte, 0, NUM_PAIRS)
 	var i uint32
 	for i = 1; i <= NUM_PAIRS; i++ {
 		pkey := make([]byte, 4)
 		binary.BigEndian.PutUint32(pkey, uint32(i))
 		hash := md5.Sum(pkey)
-		if err := btree.Insert(bufmgr, hash[:], pkey[:]); err != nil {
-			panic(err)
-		}
+		keys = append(keys, hash[:])
+		values = append(values, pkey[:])
+	}
+	sort.Sort(&pairsByKey{keys, values})
+	iter := btree.NewSliceIterator(keys, values)
+
+	btree, err := btree.CreateBTree(bufmgr)
+	if err != nil {
+		panic(err)
+	}
+	if err := btree.BulkLoad(bufmgr, iter); err != nil {
+		panic(err)
 	}
 	bufmgr.Flush()
 	fmt.Println("Ok")
 }
+
+type pairsByKey struct {
+	keys   [][]byte
+	values [][]byte
+}
+
+func (p *pairsByKey) Len() int {
+	return len(p.keys)
+}
+
+func (p *pairsByKey) Less(i, j int) bool {
+	return bytes.Compare(p.keys[i], p.keys[j]) < 0
+}
+
+func (p *pairsByKey) Swap(i, j int) {
+	p.keys[i], p.keys[j] = p.keys[j], p.keys[i]
+	p.values[i], p.values[j] = p.values[j], p.values[i]
+}
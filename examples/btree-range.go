@@ -8,7 +8,7 @@ import (
 )
 
 func BTreeRange() {
-	diskManager, err := disk.OpenDiskManager("test.btr")
+	diskManager, err := disk.OpenDiskManagerWithMode("test.btr", disk.OPEN_MODE_READ_ONLY)
 	if err != nil {
 		panic(err)
 	}
@@ -5,25 +5,19 @@ import (
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
 	"my-relly-go/table"
-	"os"
 )
 
 func SimpleTableCreate() {
-	file, err := os.Create("simple.rly")
+	diskManager, err := disk.CreateDiskManager("simple.rly")
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
-		if err := file.Close(); err != nil {
+		if err := diskManager.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
-	diskManager, err := disk.NewDiskManager(file)
-	if err != nil {
-		panic(err)
-	}
-
 	pool := buffer.NewBufferPool(10)
 	bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
@@ -8,7 +8,7 @@ import (
 )
 
 func SimpleTableRange() {
-	diskManager, err := disk.OpenDiskManager("simple.rly")
+	diskManager, err := disk.OpenDiskManagerWithMode("simple.rly", disk.OPEN_MODE_READ_ONLY)
 	if err != nil {
 		panic(err)
 	}
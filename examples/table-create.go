@@ -5,30 +5,30 @@ import (
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
 	"my-relly-go/table"
-	"os"
 )
 
 func TableCreate() {
-	file, err := os.Create("table.rly")
+	diskManager, err := disk.CreateDiskManager("table.rly")
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
-		if err := file.Close(); err != nil {
+		if err := diskManager.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
-	diskManager, err := disk.NewDiskManager(file)
-	if err != nil {
-		panic(err)
-	}
-
 	pool := buffer.NewBufferPool(10)
 	bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
+	catalog, err := table.CreateCatalog(bufmgr)
+	if err != nil {
+		panic(err)
+	}
 	tbl := table.Table{
+		Name:        "users",
 		MetaPageId:  disk.INVALID_PAGE_ID,
+		NumCols:     3,
 		NumKeyElems: 1,
 		UniqueIndices: []table.UniqueIndex{
 			{
@@ -37,7 +37,7 @@ func TableCreate() {
 			},
 		},
 	}
-	if err := tbl.Create(bufmgr); err != nil {
+	if err := catalog.CreateTable(bufmgr, &tbl); err != nil {
 		panic(err)
 	}
 	fmt.Println(tbl)
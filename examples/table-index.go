@@ -5,19 +5,29 @@ import (
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
 	"my-relly-go/query"
+	"my-relly-go/table"
 )
 
 func TableIndex() {
-	diskManager, err := disk.OpenDiskManager("table_large.rly")
+	diskManager, err := disk.OpenDiskManagerWithMode("table_large.rly", disk.OPEN_MODE_READ_ONLY)
 	if err != nil {
 		panic(err)
 	}
 	pool := buffer.NewBufferPool(10)
 	bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
+	catalog, err := table.OpenCatalog(bufmgr)
+	if err != nil {
+		panic(err)
+	}
+	tbl, err := catalog.OpenTable(bufmgr, "users")
+	if err != nil {
+		panic(err)
+	}
+
 	plan := query.IndexScan{
-		TableMetaPageId: disk.PageId(0),
-		IndexMetaPageId: disk.PageId(2),
+		TableMetaPageId: tbl.MetaPageId,
+		IndexMetaPageId: tbl.UniqueIndices[0].MetaPageId,
 		SearchMode:      &query.TupleSearchModeKey{Key: [][]byte{[]byte("Smith")}},
 		WhileCond: func(skey query.Tuple) bool {
 			return bytes.Equal(skey[0], []byte("Smith"))
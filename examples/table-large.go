@@ -8,32 +8,32 @@ import (
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
 	"my-relly-go/table"
-	"os"
 )
 
 const NUM_ROWS int = 10_000_000
 
 func TableLarge() {
-	file, err := os.Create("table_large.rly")
+	diskManager, err := disk.CreateDiskManager("table_large.rly")
 	if err != nil {
 		panic(err)
 	}
 	defer func() {
-		if err := file.Close(); err != nil {
+		if err := diskManager.Close(); err != nil {
 			panic(err)
 		}
 	}()
 
-	diskManager, err := disk.NewDiskManager(file)
-	if err != nil {
-		panic(err)
-	}
-
 	pool := buffer.NewBufferPool(1_000_000)
 	bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
+	catalog, err := table.CreateCatalog(bufmgr)
+	if err != nil {
+		panic(err)
+	}
 	tbl := table.Table{
+		Name:        "users",
 		MetaPageId:  disk.INVALID_PAGE_ID,
+		NumCols:     3,
 		NumKeyElems: 1,
 		UniqueIndices: []table.UniqueIndex{
 			{
@@ -42,11 +42,12 @@ func TableLarge() {
 			},
 		},
 	}
-	if err := tbl.Create(bufmgr); err != nil {
+	if err := catalog.CreateTable(bufmgr, &tbl); err != nil {
 		panic(err)
 	}
 	fmt.Println(tbl)
 
+	// まとめて読み込み、プライマリキーとインデックスの木を下の段から一度に作る
 	rows := [][][]byte{
 		{[]byte("z"), []byte("Alice"), []byte("Smith")},
 		{[]byte("x"), []byte("Bob"), []byte("Johnson")},
@@ -54,11 +55,6 @@ func TableLarge() {
 		{[]byte("w"), []byte("Dave"), []byte("Miller")},
 		{[]byte("v"), []byte("Eve"), []byte("Brown")},
 	}
-	for _, row := range rows {
-		if err := tbl.Insert(bufmgr, row); err != nil {
-			panic(err)
-		}
-	}
 
 	var i int
 	for i = 0; i <= NUM_ROWS; i++ {
@@ -66,13 +62,14 @@ func TableLarge() {
 		binary.BigEndian.PutUint32(pkey, uint32(i))
 		md5Hash := md5.Sum(pkey)
 		sha1Hash := sha1.Sum(pkey)
-		if err := tbl.Insert(bufmgr, [][]byte{
+		rows = append(rows, [][]byte{
 			pkey[:],
 			md5Hash[:],
 			sha1Hash[:],
-		}); err != nil {
-			panic(err)
-		}
+		})
+	}
+	if err := tbl.Import(bufmgr, rows); err != nil {
+		panic(err)
 	}
 
 	bufmgr.Flush()
@@ -2,6 +2,13 @@ package memcmpable
 
 const ESCAPE_LENGTH int = 9
 
+// 各ブロックの最後のバイト
+// NULLはすべて0のブロックにして、空のバイト列を含むすべての値より前に並べる
+const (
+	NULL_MARKER         byte = 0
+	CONTINUATION_MARKER byte = byte(ESCAPE_LENGTH) + 1
+)
+
 func min(x, y int) int {
 	if x < y {
 		return x
@@ -10,9 +17,13 @@ func min(x, y int) int {
 }
 
 func EncodedSize(length int) int {
+	if length == 0 {
+		return ESCAPE_LENGTH
+	}
 	return (length + (ESCAPE_LENGTH - 1)) / (ESCAPE_LENGTH - 1) * ESCAPE_LENGTH
 }
 
+// 最後のブロックには、そのブロックに入っている長さ+1を付ける
 func Encode(src []byte, dst []byte) []byte {
 	for {
 		copyLen := min(ESCAPE_LENGTH-1, len(src))
@@ -23,23 +34,45 @@ func Encode(src []byte, dst []byte) []byte {
 			if padSize > 0 {
 				dst = append(dst, make([]byte, padSize)...)
 			}
-			dst = append(dst, byte(copyLen))
+			dst = append(dst, byte(copyLen)+1)
 			break
 		}
-		dst = append(dst, byte(ESCAPE_LENGTH))
+		dst = append(dst, CONTINUATION_MARKER)
 	}
 	return dst
 }
 
+func EncodeNull(dst []byte) []byte {
+	return append(dst, make([]byte, ESCAPE_LENGTH)...)
+}
+
+func IsNull(src []byte) bool {
+	return src[ESCAPE_LENGTH-1] == NULL_MARKER
+}
+
+// NULLの場合はdstに追加せずnilを返す
 func Decode(src []byte, dst []byte) ([]byte, []byte) {
+	if IsNull(src) {
+		return src[ESCAPE_LENGTH:], nil
+	}
 	for {
 		extra := src[ESCAPE_LENGTH-1]
-		length := min(ESCAPE_LENGTH-1, int(extra))
+		length := min(ESCAPE_LENGTH-1, int(extra)-1)
 		dst = append(dst, src[:length]...)
 		src = src[ESCAPE_LENGTH:]
-		if extra < byte(ESCAPE_LENGTH) {
+		if extra != CONTINUATION_MARKER {
 			break
 		}
 	}
 	return src, dst
 }
+
+// NULLを加える前の形式では、最後のブロックに長さをそのまま、続きがあるブロックにESCAPE_LENGTHを付けていた
+// 各ブロックの最後のバイトに1を足すと今の形式になる。長さも順序も変わらない
+func MigrateLegacy(src []byte) []byte {
+	dst := append([]byte{}, src...)
+	for i := ESCAPE_LENGTH - 1; i < len(dst); i += ESCAPE_LENGTH {
+		dst[i]++
+	}
+	return dst
+}
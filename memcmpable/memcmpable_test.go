@@ -28,4 +28,26 @@ func TestMemCmpAble(t *testing.T) {
 	if !bytes.Equal(org2, dec2) {
 		t.Fatalf("Decode() = %v, want %v", dec2, org2)
 	}
+
+	// NULLは空のバイト列を含むすべての値より前に並び、デコードするとnilになる
+	null := EncodeNull(nil)
+	for _, v := range [][]byte{{}, {0}, {0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte("a")} {
+		enc := Encode(v, nil)
+		if bytes.Compare(null, enc) >= 0 {
+			t.Fatalf("EncodeNull() >= Encode(%v)", v)
+		}
+		if len(enc) != EncodedSize(len(v)) {
+			t.Fatalf("len(Encode(%v)) = %v, want %v", v, len(enc), EncodedSize(len(v)))
+		}
+		rest, dec := Decode(append(enc, null...), []byte{})
+		if dec == nil || !bytes.Equal(dec, v) {
+			t.Fatalf("Decode() = %v, want %v", dec, v)
+		}
+		if rest, dec = Decode(rest, []byte{}); dec != nil || len(rest) != 0 {
+			t.Fatalf("Decode() = %v, %v, want nil", rest, dec)
+		}
+	}
+	if a, b := Encode([]byte("abc"), nil), Encode([]byte("abc\x00"), nil); bytes.Compare(a, b) >= 0 {
+		t.Fatal("Encode(abc) >= Encode(abc\\x00)")
+	}
 }
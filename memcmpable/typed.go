@@ -0,0 +1,70 @@
+package memcmpable
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// 固定長の型は、バイト列のまま比較したときに値の大小と同じ順になるように符号化する
+// 可変長のバイト列と同じようにEncodeでタプルに詰められる
+const (
+	INT64_SIZE   = 8
+	UINT64_SIZE  = 8
+	FLOAT64_SIZE = 8
+	BOOL_SIZE    = 1
+)
+
+func EncodeUint64(v uint64) []byte {
+	buf := make([]byte, UINT64_SIZE)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+
+func DecodeUint64(buf []byte) uint64 {
+	return binary.BigEndian.Uint64(buf)
+}
+
+// 符号ビットを反転させると、負の数が正の数より前に並ぶ
+func EncodeInt64(v int64) []byte {
+	return EncodeUint64(uint64(v) ^ (1 << 63))
+}
+
+func DecodeInt64(buf []byte) int64 {
+	return int64(DecodeUint64(buf) ^ (1 << 63))
+}
+
+// 正の数は符号ビットだけを、負の数は全ビットを反転させる
+// -0は0と同じものとして扱う
+func EncodeFloat64(v float64) []byte {
+	if v == 0 {
+		v = 0
+	}
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return EncodeUint64(bits)
+}
+
+func DecodeFloat64(buf []byte) float64 {
+	bits := DecodeUint64(buf)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func EncodeBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func DecodeBool(buf []byte) bool {
+	return buf[0] != 0
+}
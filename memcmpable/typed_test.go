@@ -0,0 +1,72 @@
+package memcmpable
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestTyped(t *testing.T) {
+	t.Run("int64", func(t *testing.T) {
+		values := []int64{math.MinInt64, -1000, -1, 0, 1, 9, 10, math.MaxInt64}
+		for i, v := range values {
+			enc := EncodeInt64(v)
+			if dec := DecodeInt64(enc); dec != v {
+				t.Fatalf("DecodeInt64() = %v, want %v", dec, v)
+			}
+			if i > 0 && bytes.Compare(EncodeInt64(values[i-1]), enc) >= 0 {
+				t.Fatalf("EncodeInt64(%v) >= EncodeInt64(%v)", values[i-1], v)
+			}
+		}
+	})
+
+	t.Run("uint64", func(t *testing.T) {
+		values := []uint64{0, 1, 9, 10, 256, math.MaxUint64}
+		for i, v := range values {
+			enc := EncodeUint64(v)
+			if dec := DecodeUint64(enc); dec != v {
+				t.Fatalf("DecodeUint64() = %v, want %v", dec, v)
+			}
+			if i > 0 && bytes.Compare(EncodeUint64(values[i-1]), enc) >= 0 {
+				t.Fatalf("EncodeUint64(%v) >= EncodeUint64(%v)", values[i-1], v)
+			}
+		}
+	})
+
+	t.Run("float64", func(t *testing.T) {
+		values := []float64{math.Inf(-1), -math.MaxFloat64, -10, -9.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 0.1, 9.5, 10, math.MaxFloat64, math.Inf(1)}
+		for i, v := range values {
+			enc := EncodeFloat64(v)
+			if dec := DecodeFloat64(enc); dec != v {
+				t.Fatalf("DecodeFloat64() = %v, want %v", dec, v)
+			}
+			if i > 0 && bytes.Compare(EncodeFloat64(values[i-1]), enc) >= 0 {
+				t.Fatalf("EncodeFloat64(%v) >= EncodeFloat64(%v)", values[i-1], v)
+			}
+		}
+		if !bytes.Equal(EncodeFloat64(math.Copysign(0, -1)), EncodeFloat64(0)) {
+			t.Fatal("EncodeFloat64(-0) != EncodeFloat64(0)")
+		}
+	})
+
+	t.Run("bool", func(t *testing.T) {
+		for _, v := range []bool{false, true} {
+			if dec := DecodeBool(EncodeBool(v)); dec != v {
+				t.Fatalf("DecodeBool() = %v, want %v", dec, v)
+			}
+		}
+		if bytes.Compare(EncodeBool(false), EncodeBool(true)) >= 0 {
+			t.Fatal("EncodeBool(false) >= EncodeBool(true)")
+		}
+	})
+
+	t.Run("タプルに詰めても順序が変わらない", func(t *testing.T) {
+		a := Encode(EncodeInt64(-1), nil)
+		a = Encode([]byte("b"), a)
+		b := Encode(EncodeInt64(2), nil)
+		b = Encode([]byte("a"), b)
+		if bytes.Compare(a, b) >= 0 {
+			t.Fatal("(-1, b) >= (2, a)")
+		}
+	})
+}
@@ -8,7 +8,9 @@ import (
 	"my-relly-go/disk"
 	"my-relly-go/table"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/thoas/go-funk"
 	"golang.org/x/xerrors"
@@ -22,36 +24,125 @@ const (
 	OP_GT  Op = "$gt"
 	OP_GTE Op = "$gte"
 	OP_NE  Op = "$ne"
+
+	// 右辺はtrueだけ
+	OP_IS_NULL     Op = "$isNull"
+	OP_IS_NOT_NULL Op = "$isNotNull"
+
+	// 右辺は値の配列
+	OP_IN  Op = "$in"
+	OP_NIN Op = "$nin"
+
+	// 文字列とバイト列のカラムだけ。右辺は文字列
+	// $likeは%が0文字以上、_が1文字に一致し、\でエスケープする
+	OP_PREFIX Op = "$prefix"
+	OP_LIKE   Op = "$like"
+	OP_REGEX  Op = "$regex"
+
+	// カラムの代わりに書き、右辺は検索条件の配列（$notは検索条件）
+	OP_AND Op = "$and"
+	OP_OR  Op = "$or"
+	OP_NOT Op = "$not"
 )
 
 func (o Op) valid() bool {
-	return o == OP_GT || o == OP_GTE || o == OP_LT || o == OP_LTE || o == OP_NE
+	return o == OP_GT || o == OP_GTE || o == OP_LT || o == OP_LTE || o == OP_NE || o == OP_IS_NULL || o == OP_IS_NOT_NULL || o == OP_IN || o == OP_NIN ||
+		o == OP_PREFIX || o == OP_LIKE || o == OP_REGEX
+}
+
+func (o Op) logical() bool {
+	return o == OP_AND || o == OP_OR || o == OP_NOT
 }
 
 var (
 	ErrJsonParse        = xerrors.New("JSON parse error")
 	ErrInvalidCondition = xerrors.New("Invalid condition")
+	ErrInvalidField     = xerrors.New("Invalid field")
+	ErrInvalidSort      = xerrors.New("Invalid sort")
 	errCannotMakeConds  = xerrors.New("Cannot make conds")
 )
 
 type Parser struct {
-	meta *table.Meta
+	tbl *table.Table
 }
 
-func NewParser(bufmgr *buffer.BufferPoolManager) (*Parser, error) {
-	tree := btree.NewBTree(disk.PageId(0))
-	buf, err := tree.ReadMetaAppArea(bufmgr)
+// カタログからテーブルを探して、そのテーブルに対するパーサを返す
+func NewParser(bufmgr *buffer.BufferPoolManager, tableName string) (*Parser, error) {
+	catalog, err := table.OpenCatalog(bufmgr)
 	if err != nil {
 		return nil, err
 	}
-	meta := table.NewMetaFromBytes(buf)
-	return &Parser{meta: meta}, nil
+	tbl, err := catalog.OpenTable(bufmgr, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return NewTableParser(tbl), nil
+}
+
+func NewTableParser(tbl *table.Table) *Parser {
+	return &Parser{tbl: tbl}
 }
 
 func (p *Parser) Parse(query string) (PlanNode, error) {
-	// JSONデコード
+	where, err := decodeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// テーブルにfieldsというカラムが無ければ、結果に含めるカラムの指定とみなす
+	// ["カラム", {"カラム": "結果のカラム名"}, ...]
+	var project *Project
+	if fields, ok := where["fields"]; ok && funk.IndexOf(p.tbl.ColNames, "fields") < 0 {
+		delete(where, "fields")
+		var err error
+		project, err = p.parseFields(fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// sortも同じく、並べ替えの指定とみなす
+	// ["カラム", {"カラム": "asc" | "desc"}, ...]
+	var sortKeys []SortKey
+	if sortSpec, ok := where["sort"]; ok && funk.IndexOf(p.tbl.ColNames, "sort") < 0 {
+		delete(where, "sort")
+		var err error
+		sortKeys, err = p.parseSort(sortSpec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	where = p.revertColName(where)
+	return p.buildPlan(query, where, project, sortKeys)
+}
+
+// UPDATEやDELETEで書き換えるレコードを探すプランを返す
+// 見つけたレコードをそのまま書き換えるので、fieldsとsortは指定できない
+func (p *Parser) ParseCondition(query string) (PlanNode, error) {
+	where, err := decodeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"fields", "sort"} {
+		if _, ok := where[key]; ok && funk.IndexOf(p.tbl.ColNames, key) < 0 {
+			return nil, ErrInvalidCondition
+		}
+	}
+	where = p.revertColName(where)
+	return p.buildPlan(query, where, nil, nil)
+}
+
+// JSONデコード
+// 数値はカラムの型に合わせて変換するので、json.Numberのまま受け取る
+func decodeQuery(query string) (map[string]interface{}, error) {
 	var decodeData interface{}
-	if err := json.Unmarshal([]byte(query), &decodeData); err != nil {
+	decoder := json.NewDecoder(strings.NewReader(query))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decodeData); err != nil {
+		return nil, ErrJsonParse
+	}
+	if decoder.More() {
 		return nil, ErrJsonParse
 	}
 
@@ -59,7 +150,105 @@ func (p *Parser) Parse(query string) (PlanNode, error) {
 	if !ok {
 		return nil, ErrInvalidCondition
 	}
-	where = p.revertColName(where)
+	return where, nil
+}
+
+// カラム名かカラム番号から、カラム番号を返す
+func (p *Parser) colIndex(colStr string) (int, bool) {
+	if col := funk.IndexOf(p.tbl.ColNames, colStr); col >= 0 {
+		return col, true
+	}
+	col, err := strconv.Atoi(colStr)
+	if err != nil || col < 0 || p.tbl.NumCols <= col {
+		return 0, false
+	}
+	return col, true
+}
+
+func (p *Parser) parseSort(sortSpec interface{}) ([]SortKey, error) {
+	items, ok := sortSpec.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, ErrInvalidSort
+	}
+	sortKeys := []SortKey{}
+	for _, item := range items {
+		var colStr string
+		desc := false
+		switch v := item.(type) {
+		case string:
+			colStr = v
+		case map[string]interface{}:
+			if len(v) != 1 {
+				return nil, ErrInvalidSort
+			}
+			for k, order := range v {
+				colStr = k
+				switch order {
+				case "asc":
+				case "desc":
+					desc = true
+				default:
+					return nil, ErrInvalidSort
+				}
+			}
+		default:
+			return nil, ErrInvalidSort
+		}
+
+		col, ok := p.colIndex(colStr)
+		if !ok {
+			return nil, ErrInvalidSort
+		}
+		sortKeys = append(sortKeys, SortKey{Col: col, Desc: desc})
+	}
+	return sortKeys, nil
+}
+
+func (p *Parser) parseFields(fields interface{}) (*Project, error) {
+	items, ok := fields.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, ErrInvalidField
+	}
+	project := &Project{}
+	for _, item := range items {
+		var colStr, name string
+		switch v := item.(type) {
+		case string:
+			colStr = v
+		case map[string]interface{}:
+			if len(v) != 1 {
+				return nil, ErrInvalidField
+			}
+			for k, alias := range v {
+				colStr = k
+				if name, ok = alias.(string); !ok {
+					return nil, ErrInvalidField
+				}
+			}
+		default:
+			return nil, ErrInvalidField
+		}
+
+		col, ok := p.colIndex(colStr)
+		if !ok {
+			return nil, ErrInvalidField
+		}
+		if name == "" {
+			name = colStr
+			if col < len(p.tbl.ColNames) {
+				name = p.tbl.ColNames[col]
+			}
+		}
+		project.Columns = append(project.Columns, col)
+		project.Names = append(project.Names, name)
+	}
+	return project, nil
+}
+
+// カラム番号をキーにした検索条件から、Scanノードとその上のFilterノードを構築する
+// sortKeysを指定するとその上にSortノード（キーの順に走査すれば並ぶ場合は置かない）を置き、projectを指定すると、そのカラムだけを返すProjectノードを一番手前に置く
+func (p *Parser) buildPlan(query string, where map[string]interface{}, project *Project, sortKeys []SortKey) (PlanNode, error) {
+	where = flattenAnd(where)
 
 	// Scanノードを構築
 	scan, where, err := p.buildScanNode(query, where)
@@ -67,6 +256,23 @@ func (p *Parser) Parse(query string) (PlanNode, error) {
 		return nil, err
 	}
 
+	// キーの順に走査すれば並んでいるなら、並べ替えない
+	if len(sortKeys) > 0 && p.useKeyOrder(scan, sortKeys) {
+		sortKeys = nil
+	}
+
+	// 必要なカラムがすべてインデックスにあれば、テーブルを読まずに済ませる
+	if project != nil {
+		needed := whereColumns(where, map[int]bool{})
+		for _, col := range project.Columns {
+			needed[col] = true
+		}
+		for _, sortKey := range sortKeys {
+			needed[sortKey.Col] = true
+		}
+		scan = p.useIndexOnlyScan(scan, needed)
+	}
+
 	// Filterノードを構築
 	nodes := []PlanNode{scan}
 	nodes, err = p.buildFilters(query, where, nodes)
@@ -74,15 +280,169 @@ func (p *Parser) Parse(query string) (PlanNode, error) {
 		return nil, err
 	}
 
+	if len(sortKeys) > 0 {
+		nodes = append(nodes, &Sort{
+			InnerPlan: nodes[len(nodes)-1],
+			Keys:      sortKeys,
+		})
+	}
+	if project != nil {
+		project.InnerPlan = nodes[len(nodes)-1]
+		return project, nil
+	}
+
 	// 一番手前のノードを返す
 	return nodes[len(nodes)-1], nil
 }
 
+// 検索条件で使うカラム
+func whereColumns(where map[string]interface{}, cols map[int]bool) map[int]bool {
+	for key, value := range where {
+		if Op(key).logical() {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				whereColumns(v, cols)
+			case []interface{}:
+				for _, item := range v {
+					if itemWhere, ok := item.(map[string]interface{}); ok {
+						whereColumns(itemWhere, cols)
+					}
+				}
+			}
+			continue
+		}
+		if col, err := strconv.Atoi(key); err == nil {
+			cols[col] = true
+		}
+	}
+	return cols
+}
+
+// neededのカラムがすべてプライマリキーかインデックスのキーなら、IndexScanをIndexOnlyScanに置き換える
+func (p *Parser) useIndexOnlyScan(scan PlanNode, needed map[int]bool) PlanNode {
+	switch s := scan.(type) {
+	case *IndexScan:
+		skey := p.indexSKey(s.IndexMetaPageId)
+		for col := range needed {
+			if col >= p.tbl.NumKeyElems && funk.IndexOfInt(skey, col) < 0 {
+				return scan
+			}
+		}
+		return &IndexOnlyScan{
+			IndexMetaPageId: s.IndexMetaPageId,
+			SearchMode:      s.SearchMode,
+			Range:           s.Range,
+			WhileCond:       s.WhileCond,
+			Backward:        s.Backward,
+			SKey:            skey,
+			NumCols:         p.tbl.NumCols,
+		}
+
+	case *Union:
+		innerPlans := []PlanNode{}
+		for _, innerPlan := range s.InnerPlans {
+			innerPlans = append(innerPlans, p.useIndexOnlyScan(innerPlan, needed))
+		}
+		return &Union{InnerPlans: innerPlans}
+	}
+	return scan
+}
+
+// インデックスのキーにするカラム
+func (p *Parser) indexSKey(indexMetaPageId disk.PageId) []int {
+	for _, uniqueIndex := range p.tbl.UniqueIndices {
+		if uniqueIndex.MetaPageId == indexMetaPageId {
+			return uniqueIndex.SKey
+		}
+	}
+	for _, secondaryIndex := range p.tbl.SecondaryIndices {
+		if secondaryIndex.MetaPageId == indexMetaPageId {
+			return secondaryIndex.SKey
+		}
+	}
+	return nil
+}
+
+// 並べ替えのキーが、走査するB+Treeのキーの先頭のカラムと同じ並びで、向きがそろっていれば
+// キーの順（降順なら逆順）に走査するようにして、trueを返す
+func (p *Parser) useKeyOrder(scan PlanNode, sortKeys []SortKey) bool {
+	var keyCols []int
+	var searchMode *TupleSearchMode
+	var rng *Range
+	var backward *bool
+	switch s := scan.(type) {
+	case *SeqScan:
+		for col := 0; col < p.tbl.NumKeyElems; col++ {
+			keyCols = append(keyCols, col)
+		}
+		searchMode, rng, backward = &s.SearchMode, s.Range, &s.Backward
+	case *IndexScan:
+		keyCols = p.indexSKey(s.IndexMetaPageId)
+		searchMode, rng, backward = &s.SearchMode, s.Range, &s.Backward
+	default:
+		return false
+	}
+
+	if len(sortKeys) > len(keyCols) {
+		return false
+	}
+	desc := sortKeys[0].Desc
+	for i, sortKey := range sortKeys {
+		if sortKey.Col != keyCols[i] || sortKey.Desc != desc {
+			return false
+		}
+	}
+
+	if rng != nil {
+		*backward = desc
+		return true
+	}
+	switch (*searchMode).(type) {
+	case *TupleSearchModeStart:
+		if desc {
+			*searchMode = &TupleSearchModeEnd{}
+			*backward = true
+		}
+		return true
+	case *TupleSearchModeKey:
+		// キーのすべてのカラムの完全一致検索なので、並べ替えのキーは等しい
+		return true
+	}
+	return false
+}
+
+// 検索条件の値をカラムの型で符号化する
+// NULLとの比較は$isNull/$isNotNullを使う
+func (p *Parser) encodeValue(col int, value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, ErrInvalidCondition
+	}
+	buf, err := table.EncodeValue(p.tbl.ColType(col), value)
+	if err != nil {
+		return nil, ErrInvalidCondition
+	}
+	return buf, nil
+}
+
 func (p *Parser) revertColName(where map[string]interface{}) map[string]interface{} {
 	for colStr, cond := range where {
+		// $and/$or/$notの中の検索条件も書き換える
+		if Op(colStr).logical() {
+			switch v := cond.(type) {
+			case map[string]interface{}:
+				p.revertColName(v)
+			case []interface{}:
+				for _, item := range v {
+					if itemWhere, ok := item.(map[string]interface{}); ok {
+						p.revertColName(itemWhere)
+					}
+				}
+			}
+			continue
+		}
 		r := regexp.MustCompile(`^\d+$`)
 		if !r.MatchString(colStr) {
-			if col := funk.IndexOf(p.meta.ColNames, colStr); col >= 0 {
+			if col := funk.IndexOf(p.tbl.ColNames, colStr); col >= 0 {
 				delete(where, colStr)
 				where[strconv.Itoa(col)] = cond
 			}
@@ -91,12 +451,44 @@ func (p *Parser) revertColName(where map[string]interface{}) map[string]interfac
 	return where
 }
 
+// $andの中のカラムの条件を、同じカラムの条件が無ければ外に出して、Scanノードの構築に使えるようにする
+func flattenAnd(where map[string]interface{}) map[string]interface{} {
+	items, ok := where[string(OP_AND)].([]interface{})
+	if !ok {
+		return where
+	}
+	rest := []interface{}{}
+	for _, item := range items {
+		itemWhere, ok := item.(map[string]interface{})
+		if !ok {
+			rest = append(rest, item)
+			continue
+		}
+		itemWhere = flattenAnd(itemWhere)
+		for key, cond := range itemWhere {
+			if _, ok := where[key]; !ok && !Op(key).logical() {
+				where[key] = cond
+				delete(itemWhere, key)
+			}
+		}
+		if len(itemWhere) > 0 {
+			rest = append(rest, itemWhere)
+		}
+	}
+	if len(rest) == 0 {
+		delete(where, string(OP_AND))
+	} else {
+		where[string(OP_AND)] = rest
+	}
+	return where
+}
+
 func (p *Parser) buildScanNode(query string, where map[string]interface{}) (PlanNode, map[string]interface{}, error) {
 	var scan PlanNode = nil
 	var err error
 
 	// プライマリキーに対する検索条件をもとにScanノードを構築
-	if p.meta.NumKeyElems == 1 {
+	if p.tbl.NumKeyElems == 1 {
 		// プライマリキーが単一キーの場合
 		scan, where, err = p.buildSinglePKeyScanNode(query, where)
 	} else {
@@ -111,14 +503,24 @@ func (p *Parser) buildScanNode(query string, where map[string]interface{}) (Plan
 	}
 
 	// セカンダリキーに対する検索条件をもとにScanノードを構築
-	uniqueIndices := p.meta.GetUniqueIndices()
-	for indexNo, uniqueIndex := range uniqueIndices {
-		if len(uniqueIndex) == 1 {
+	// ユニークインデックスを優先し、次に重複を許すインデックスを使う
+	indexMetaPageIds := []disk.PageId{}
+	indices := [][]int{}
+	for _, uniqueIndex := range p.tbl.UniqueIndices {
+		indexMetaPageIds = append(indexMetaPageIds, uniqueIndex.MetaPageId)
+		indices = append(indices, uniqueIndex.SKey)
+	}
+	for _, secondaryIndex := range p.tbl.SecondaryIndices {
+		indexMetaPageIds = append(indexMetaPageIds, secondaryIndex.MetaPageId)
+		indices = append(indices, secondaryIndex.SKey)
+	}
+	for i, index := range indices {
+		if len(index) == 1 {
 			// セカンダリキーが単一キーの場合
-			scan, where, err = p.buildSingleSKeyScanNode(query, where, indexNo, uniqueIndex)
+			scan, where, err = p.buildSingleSKeyScanNode(query, where, indexMetaPageIds[i], index)
 		} else {
 			// セカンダリキーが複合キーの場合
-			scan, where, err = p.buildCompositeSKeyScanNode(query, where, indexNo, uniqueIndex)
+			scan, where, err = p.buildCompositeSKeyScanNode(query, where, indexMetaPageIds[i], index)
 		}
 		if err != nil {
 			return nil, nil, err
@@ -130,7 +532,7 @@ func (p *Parser) buildScanNode(query string, where map[string]interface{}) (Plan
 
 	// ここまでScanノードが決まらなかったら、先頭からのSeqScanを使う
 	scan = &SeqScan{
-		TableMetaPageId: disk.PageId(0),
+		TableMetaPageId: p.tbl.MetaPageId,
 		SearchMode:      &TupleSearchModeStart{},
 		WhileCond: func(Tuple) bool {
 			return true
@@ -148,31 +550,46 @@ func (p *Parser) buildSinglePKeyScanNode(query string, where map[string]interfac
 		return nil, where, nil
 	}
 	switch v := where[pkeyStr].(type) {
-	case string: // 完全一致検索
-		tupleSearchMode, whileCond, err := p.makeEqualCondWithSingleKey(v)
-		if err != nil {
-			return nil, nil, err
+	case map[string]interface{}: // 演算子による検索
+		if _, ok := v[string(OP_IN)]; ok {
+			var err error
+			scan, err = p.makeInScanNode(0, v, func(searchValue []byte) PlanNode {
+				tupleSearchMode, whileCond := p.makeEqualCondWithSingleKey(searchValue)
+				return &SeqScan{
+					TableMetaPageId: p.tbl.MetaPageId,
+					SearchMode:      tupleSearchMode,
+					WhileCond:       whileCond,
+				}
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			rng, err := p.makeRangeWithSingleKey(0, v)
+			if err != nil {
+				return nil, nil, err
+			}
+			scan = &SeqScan{
+				TableMetaPageId: p.tbl.MetaPageId,
+				Range:           rng,
+			}
 		}
-		scan = &SeqScan{
-			TableMetaPageId: disk.PageId(0),
-			SearchMode:      tupleSearchMode,
-			WhileCond:       whileCond,
+		if len(v) == 0 {
+			delete(where, pkeyStr)
 		}
-		delete(where, pkeyStr)
 
-	case map[string]interface{}: // 演算子による検索
-		tupleSearchMode, whileCond, err := p.makeRangeCondWithSingleKey(v)
+	default: // 完全一致検索
+		searchValue, err := p.encodeValue(0, v)
 		if err != nil {
 			return nil, nil, err
 		}
+		tupleSearchMode, whileCond := p.makeEqualCondWithSingleKey(searchValue)
 		scan = &SeqScan{
-			TableMetaPageId: disk.PageId(0),
+			TableMetaPageId: p.tbl.MetaPageId,
 			SearchMode:      tupleSearchMode,
 			WhileCond:       whileCond,
 		}
-
-	default:
-		return nil, nil, ErrInvalidCondition
+		delete(where, pkeyStr)
 	}
 	return scan, where, nil
 }
@@ -181,7 +598,7 @@ func (p *Parser) buildCompositePKeyScanNode(query string, where map[string]inter
 	var scan PlanNode = nil
 
 	// プライマリキーの対象カラムすべてで完全一致検索がされているか
-	numKeyElems := int(p.meta.NumKeyElems)
+	numKeyElems := p.tbl.NumKeyElems
 	index := make([]int, numKeyElems)
 	for pkey := 0; pkey < numKeyElems; pkey++ {
 		index[pkey] = pkey
@@ -195,7 +612,7 @@ func (p *Parser) buildCompositePKeyScanNode(query string, where map[string]inter
 	}
 
 	scan = &SeqScan{
-		TableMetaPageId: disk.PageId(0),
+		TableMetaPageId: p.tbl.MetaPageId,
 		SearchMode:      tupleSearchMode,
 		WhileCond:       whileCond,
 	}
@@ -206,54 +623,70 @@ func (p *Parser) buildCompositePKeyScanNode(query string, where map[string]inter
 	return scan, where, nil
 }
 
-func (p *Parser) buildSingleSKeyScanNode(query string, where map[string]interface{}, indexNo int, uniqueIndex []int) (PlanNode, map[string]interface{}, error) {
+func (p *Parser) buildSingleSKeyScanNode(query string, where map[string]interface{}, indexMetaPageId disk.PageId, index []int) (PlanNode, map[string]interface{}, error) {
 	var scan PlanNode = nil
 
 	// セカンダリキーの検索条件が指定されているか
-	skey := int(uniqueIndex[0])
+	skey := int(index[0])
 	skeyStr := strconv.Itoa(skey)
 	if _, ok := where[skeyStr]; !ok {
 		return nil, where, nil
 	}
 
 	switch v := where[skeyStr].(type) {
-	case string: // 完全一致検索
-		tupleSearchMode, whileCond, err := p.makeEqualCondWithSingleKey(v)
-		if err != nil {
-			return nil, nil, err
+	case map[string]interface{}: // 演算子による検索
+		if _, ok := v[string(OP_IN)]; ok {
+			var err error
+			scan, err = p.makeInScanNode(skey, v, func(searchValue []byte) PlanNode {
+				tupleSearchMode, whileCond := p.makeEqualCondWithSingleKey(searchValue)
+				return &IndexScan{
+					TableMetaPageId: p.tbl.MetaPageId,
+					IndexMetaPageId: indexMetaPageId,
+					SearchMode:      tupleSearchMode,
+					WhileCond:       whileCond,
+				}
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			rng, err := p.makeRangeWithSingleKey(skey, v)
+			if err != nil {
+				return nil, nil, err
+			}
+			scan = &IndexScan{
+				TableMetaPageId: p.tbl.MetaPageId,
+				IndexMetaPageId: indexMetaPageId,
+				Range:           rng,
+			}
 		}
-		scan = &IndexScan{
-			TableMetaPageId: disk.PageId(0),
-			IndexMetaPageId: disk.PageId((indexNo + 1) * 2),
-			SearchMode:      tupleSearchMode,
-			WhileCond:       whileCond,
+		if len(v) == 0 {
+			delete(where, skeyStr)
 		}
-		delete(where, skeyStr)
 
-	case map[string]interface{}: // 演算子による検索
-		tupleSearchMode, whileCond, err := p.makeRangeCondWithSingleKey(v)
+	default: // 完全一致検索
+		searchValue, err := p.encodeValue(skey, v)
 		if err != nil {
 			return nil, nil, err
 		}
+		tupleSearchMode, whileCond := p.makeEqualCondWithSingleKey(searchValue)
 		scan = &IndexScan{
-			TableMetaPageId: disk.PageId(0),
-			IndexMetaPageId: disk.PageId((indexNo + 1) * 2),
+			TableMetaPageId: p.tbl.MetaPageId,
+			IndexMetaPageId: indexMetaPageId,
 			SearchMode:      tupleSearchMode,
 			WhileCond:       whileCond,
 		}
-
-	default:
-		return nil, nil, ErrInvalidCondition
+		delete(where, skeyStr)
 	}
 
 	return scan, where, nil
 }
 
-func (p *Parser) buildCompositeSKeyScanNode(query string, where map[string]interface{}, indexNo int, uniqueIndex []int) (PlanNode, map[string]interface{}, error) {
+func (p *Parser) buildCompositeSKeyScanNode(query string, where map[string]interface{}, indexMetaPageId disk.PageId, index []int) (PlanNode, map[string]interface{}, error) {
 	var scan PlanNode = nil
 
 	// セカンダリキーの対象カラムすべてで完全一致検索がされているか
-	tupleSearchMode, whileCond, err := p.makeCondWithCompositeKey(uniqueIndex, where)
+	tupleSearchMode, whileCond, err := p.makeCondWithCompositeKey(index, where)
 	if err != nil {
 		if err == errCannotMakeConds {
 			return nil, where, nil
@@ -262,12 +695,12 @@ func (p *Parser) buildCompositeSKeyScanNode(query string, where map[string]inter
 	}
 
 	scan = &IndexScan{
-		TableMetaPageId: disk.PageId(0),
-		IndexMetaPageId: disk.PageId((indexNo + 1) * 2),
+		TableMetaPageId: p.tbl.MetaPageId,
+		IndexMetaPageId: indexMetaPageId,
 		SearchMode:      tupleSearchMode,
 		WhileCond:       whileCond,
 	}
-	for _, skey := range uniqueIndex {
+	for _, skey := range index {
 		skeyStr := strconv.Itoa(int(skey))
 		delete(where, skeyStr)
 	}
@@ -275,132 +708,355 @@ func (p *Parser) buildCompositeSKeyScanNode(query string, where map[string]inter
 }
 
 func (p *Parser) buildFilters(query string, where map[string]interface{}, nodes []PlanNode) ([]PlanNode, error) {
+	cond, err := p.compileWhere(where)
+	if err != nil {
+		return nil, err
+	}
+	if cond == nil {
+		return nodes, nil
+	}
+
+	// Filterを追加
+	nodes = append(nodes, &Filter{
+		Cond:      cond,
+		InnerPlan: nodes[len(nodes)-1],
+	})
+	return nodes, nil
+}
+
+// 検索条件を、レコードが条件に合うかを判定する関数にする
+// 条件が1つも無ければnilを返す
+func (p *Parser) compileWhere(where map[string]interface{}) (WhileCondFunc, error) {
 	whileCondFuncs := []WhileCondFunc{}
 	for key, value := range where {
-		col, err := strconv.Atoi(key)
-		if err != nil {
-			return nil, ErrInvalidCondition
-		}
-		// カラム存在チェック
-		if col < 0 || int(p.meta.NumCols) <= col {
-			return nil, ErrInvalidCondition
-		}
+		switch op := Op(key); op {
+		case OP_AND, OP_OR:
+			items, ok := value.([]interface{})
+			if !ok || len(items) == 0 {
+				return nil, ErrInvalidCondition
+			}
+			funcs := []WhileCondFunc{}
+			for _, item := range items {
+				f, err := p.compileSubWhere(item)
+				if err != nil {
+					return nil, err
+				}
+				funcs = append(funcs, f)
+			}
+			if op == OP_AND {
+				whileCondFuncs = append(whileCondFuncs, allOf(funcs))
+			} else {
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					for _, f := range funcs {
+						if (f)(record) {
+							return true
+						}
+					}
+					return false
+				})
+			}
 
-		switch v := value.(type) {
-		case string: // 完全一致検索
+		case OP_NOT:
+			// 条件に合わないレコードに一致する。NULLとの比較は偽なので、NULLのレコードにも一致する
+			f, err := p.compileSubWhere(value)
+			if err != nil {
+				return nil, err
+			}
 			whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
-				return bytes.Equal(record[col], []byte(v))
+				return !(f)(record)
 			})
 
-		case map[string]interface{}: // 演算子による検索
-			for opStr, right := range v {
-				r, ok := right.(string)
-				if !ok {
+		default:
+			funcs, err := p.compileColumnCond(key, value)
+			if err != nil {
+				return nil, err
+			}
+			whileCondFuncs = append(whileCondFuncs, funcs...)
+		}
+	}
+	if len(whileCondFuncs) == 0 {
+		return nil, nil
+	}
+	return allOf(whileCondFuncs), nil
+}
+
+// $and/$or/$notの中の検索条件。空の条件はすべてのレコードに一致する
+func (p *Parser) compileSubWhere(value interface{}) (WhileCondFunc, error) {
+	where, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidCondition
+	}
+	f, err := p.compileWhere(where)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		f = func(Tuple) bool {
+			return true
+		}
+	}
+	return f, nil
+}
+
+func allOf(funcs []WhileCondFunc) WhileCondFunc {
+	return func(record Tuple) bool {
+		for _, f := range funcs {
+			if !(f)(record) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (p *Parser) compileColumnCond(key string, value interface{}) ([]WhileCondFunc, error) {
+	whileCondFuncs := []WhileCondFunc{}
+	col, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, ErrInvalidCondition
+	}
+	// カラム存在チェック
+	if col < 0 || p.tbl.NumCols <= col {
+		return nil, ErrInvalidCondition
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}: // 演算子による検索
+		for opStr, right := range v {
+			op := Op(opStr)
+			if op == OP_IS_NULL || op == OP_IS_NOT_NULL {
+				if right != true {
 					return nil, ErrInvalidCondition
 				}
-
-				op := Op(opStr)
-				switch op {
-				case OP_LT:
-					whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
-						return bytes.Compare(record[col], []byte(r)) < 0
-					})
-				case OP_LTE:
-					whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
-						return bytes.Compare(record[col], []byte(r)) <= 0
-					})
-				case OP_GT:
-					whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
-						return bytes.Compare(record[col], []byte(r)) > 0
-					})
-				case OP_GTE:
-					whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
-						return bytes.Compare(record[col], []byte(r)) >= 0
-					})
-				case OP_NE:
+				isNull := op == OP_IS_NULL
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return (record[col] == nil) == isNull
+				})
+				continue
+			}
+			if op == OP_PREFIX || op == OP_LIKE || op == OP_REGEX {
+				// NULLには一致しない
+				pattern, err := p.patternValue(col, right)
+				if err != nil {
+					return nil, err
+				}
+				if op == OP_PREFIX {
 					whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
-						return !bytes.Equal(record[col], []byte(r))
+						return record[col] != nil && bytes.HasPrefix(record[col], []byte(pattern))
 					})
-				default:
+					continue
+				}
+				var re *regexp.Regexp
+				if op == OP_LIKE {
+					re, _, _ = likeToRegexp(pattern)
+				} else if re, err = regexp.Compile(pattern); err != nil {
 					return nil, ErrInvalidCondition
 				}
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return record[col] != nil && re.Match(record[col])
+				})
+				continue
+			}
+			if op == OP_IN || op == OP_NIN {
+				values, err := p.encodeValues(col, right)
+				if err != nil {
+					return nil, err
+				}
+				set := map[string]struct{}{}
+				for _, value := range values {
+					set[string(value)] = struct{}{}
+				}
+				in := op == OP_IN
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					_, ok := set[string(record[col])]
+					return record[col] != nil && ok == in
+				})
+				continue
 			}
 
-		default:
-			return nil, ErrInvalidCondition
+			// NULLとの比較は常に偽になる
+			r, err := p.encodeValue(col, right)
+			if err != nil {
+				return nil, err
+			}
+			switch op {
+			case OP_LT:
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return record[col] != nil && bytes.Compare(record[col], r) < 0
+				})
+			case OP_LTE:
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return record[col] != nil && bytes.Compare(record[col], r) <= 0
+				})
+			case OP_GT:
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return record[col] != nil && bytes.Compare(record[col], r) > 0
+				})
+			case OP_GTE:
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return record[col] != nil && bytes.Compare(record[col], r) >= 0
+				})
+			case OP_NE:
+				whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+					return record[col] != nil && !bytes.Equal(record[col], r)
+				})
+			default:
+				return nil, ErrInvalidCondition
+			}
 		}
+
+	default: // 完全一致検索
+		searchValue, err := p.encodeValue(col, v)
+		if err != nil {
+			return nil, err
+		}
+		whileCondFuncs = append(whileCondFuncs, func(record Tuple) bool {
+			return record[col] != nil && bytes.Equal(record[col], searchValue)
+		})
 	}
-	if len(whileCondFuncs) == 0 {
-		return nodes, nil
+	return whileCondFuncs, nil
+}
+
+func (p *Parser) makeEqualCondWithSingleKey(searchValue []byte) (TupleSearchMode, WhileCondFunc) {
+	tupleSearchMode := &TupleSearchModeKey{Key: [][]byte{searchValue}}
+	whileCond := func(tuple Tuple) bool {
+		return tuple[0] != nil && bytes.Equal(tuple[0], searchValue)
 	}
+	return tupleSearchMode, whileCond
+}
 
-	// Filterを追加
-	nodes = append(nodes, &Filter{
-		Cond: func(record Tuple) bool {
-			for _, f := range whileCondFuncs {
-				if !(f)(record) {
-					return false
-				}
-			}
-			return true
-		},
-		InnerPlan: nodes[len(nodes)-1],
+// $inの値ごとに完全一致検索するScanノードを作り、Unionでつなげる
+// 値はキーの順に並べて重複を除くので、結果もキーの順に並ぶ
+// $inはexprsから取り除き、残りの演算子はFilterで判定する
+func (p *Parser) makeInScanNode(col int, exprs map[string]interface{}, newScan func(searchValue []byte) PlanNode) (PlanNode, error) {
+	values, err := p.encodeValues(col, exprs[string(OP_IN)])
+	if err != nil {
+		return nil, err
+	}
+	delete(exprs, string(OP_IN))
+
+	sort.Slice(values, func(i, j int) bool {
+		return bytes.Compare(values[i], values[j]) < 0
 	})
-	return nodes, nil
+	scans := []PlanNode{}
+	for i, value := range values {
+		if i > 0 && bytes.Equal(values[i-1], value) {
+			continue
+		}
+		scans = append(scans, newScan(value))
+	}
+	return &Union{InnerPlans: scans}, nil
 }
 
-func (p *Parser) makeEqualCondWithSingleKey(searchValue string) (TupleSearchMode, WhileCondFunc, error) {
-	tupleSearchMode := &TupleSearchModeKey{Key: [][]byte{[]byte(searchValue)}}
-	whileCond := func(tuple Tuple) bool {
-		return bytes.Equal(tuple[0], []byte(searchValue))
+// $in/$ninの右辺の値をすべて符号化する
+func (p *Parser) encodeValues(col int, right interface{}) ([][]byte, error) {
+	items, ok := right.([]interface{})
+	if !ok {
+		return nil, ErrInvalidCondition
 	}
-	return tupleSearchMode, whileCond, nil
+	values := [][]byte{}
+	for _, item := range items {
+		value, err := p.encodeValue(col, item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
 }
 
-func (p *Parser) makeRangeCondWithSingleKey(exprs map[string]interface{}) (TupleSearchMode, WhileCondFunc, error) {
-	var searchKeyBegin []byte = nil
-	var searchKeyEnd []byte = nil
+// 範囲の演算子から、最も狭い範囲を作る
+// $prefixと、$likeの先頭の%や_を含まない部分も範囲にする
+// 範囲で判定できた演算子はexprsから取り除き、残りはFilterで判定する
+func (p *Parser) makeRangeWithSingleKey(col int, exprs map[string]interface{}) (*Range, error) {
+	var lower *Bound = nil
+	var upper *Bound = nil
 
 	for opStr, right := range exprs {
 		op := Op(opStr)
 		if !op.valid() {
-			return nil, nil, ErrInvalidCondition
+			return nil, ErrInvalidCondition
 		}
 
-		switch r := right.(type) {
-		case string:
+		switch op {
+		case OP_GT, OP_GTE, OP_LT, OP_LTE:
+			r, err := p.encodeValue(col, right)
+			if err != nil {
+				return nil, err
+			}
+			bound := &Bound{Key: [][]byte{r}, Inclusive: op == OP_GTE || op == OP_LTE}
 			if op == OP_GT || op == OP_GTE {
-				if searchKeyBegin == nil || bytes.Compare(searchKeyBegin, []byte(r)) > 0 {
-					searchKeyBegin = []byte(r)
-				}
-			} else if op == OP_LT || op == OP_LTE {
-				if searchKeyEnd == nil || bytes.Compare(searchKeyEnd, []byte(r)) < 0 {
-					searchKeyEnd = []byte(r)
+				lower = tighterLower(lower, bound)
+			} else {
+				upper = tighterUpper(upper, bound)
+			}
+			delete(exprs, opStr)
+
+		case OP_PREFIX, OP_LIKE:
+			pattern, err := p.patternValue(col, right)
+			if err != nil {
+				return nil, err
+			}
+			prefix, exact := pattern, true
+			if op == OP_LIKE {
+				// 「先頭の部分%」の形なら範囲だけで判定できる
+				_, prefix, exact = likeToRegexp(pattern)
+				if prefix == "" {
+					continue
 				}
 			}
-		default:
-			return nil, nil, ErrInvalidCondition
+
+			// prefixで始まる値は、prefix以上で、prefixの最後のバイトを1つ増やした値より小さい
+			lower = tighterLower(lower, &Bound{Key: [][]byte{[]byte(prefix)}, Inclusive: true})
+			if succ := btree.PrefixSuccessor([]byte(prefix)); succ != nil {
+				upper = tighterUpper(upper, &Bound{Key: [][]byte{succ}, Inclusive: false})
+			}
+			if exact {
+				delete(exprs, opStr)
+			}
 		}
 	}
 
-	var tupleSearchMode TupleSearchMode = nil
-	if searchKeyBegin == nil {
-		tupleSearchMode = &TupleSearchModeStart{}
-	} else {
-		tupleSearchMode = &TupleSearchModeKey{Key: [][]byte{searchKeyBegin}}
+	// NULLはインデックスの先頭に並ぶが、どの比較でも偽になるので範囲に含めない
+	if lower == nil && upper != nil {
+		lower = &Bound{Key: [][]byte{nil}, Inclusive: false}
 	}
+	return &Range{Lower: lower, Upper: upper}, nil
+}
 
-	var whileCond WhileCondFunc = nil
-	if searchKeyEnd == nil {
-		whileCond = func(tuple Tuple) bool {
-			return true
-		}
-	} else {
-		whileCond = func(tuple Tuple) bool {
-			return bytes.Compare(tuple[0], searchKeyEnd) <= 0
-		}
+// 大きいほうの下限を使い、同じ値なら含まないほうを使う
+func tighterLower(lower *Bound, bound *Bound) *Bound {
+	if lower == nil {
+		return bound
 	}
-	return tupleSearchMode, whileCond, nil
+	if c := bytes.Compare(bound.Key[0], lower.Key[0]); c > 0 || (c == 0 && !bound.Inclusive) {
+		return bound
+	}
+	return lower
+}
+
+// 小さいほうの上限を使い、同じ値なら含まないほうを使う
+func tighterUpper(upper *Bound, bound *Bound) *Bound {
+	if upper == nil {
+		return bound
+	}
+	if c := bytes.Compare(bound.Key[0], upper.Key[0]); c < 0 || (c == 0 && !bound.Inclusive) {
+		return bound
+	}
+	return upper
+}
+
+// $prefix/$like/$regexの右辺
+func (p *Parser) patternValue(col int, right interface{}) (string, error) {
+	colType := p.tbl.ColType(col)
+	if colType != table.COL_TYPE_STRING && colType != table.COL_TYPE_BYTES {
+		return "", ErrInvalidCondition
+	}
+	pattern, ok := right.(string)
+	if !ok {
+		return "", ErrInvalidCondition
+	}
+	return pattern, nil
 }
 
 func (p *Parser) makeCondWithCompositeKey(index []int, where map[string]interface{}) (TupleSearchMode, WhileCondFunc, error) {
@@ -414,12 +1070,16 @@ func (p *Parser) makeCondWithCompositeKey(index []int, where map[string]interfac
 			break
 		}
 
-		if v, ok := where[skeyStr].(string); ok {
-			searchKeys = append(searchKeys, []byte(v))
+		if _, ok := where[skeyStr].(map[string]interface{}); !ok {
+			v, err := p.encodeValue(skey, where[skeyStr])
+			if err != nil {
+				return nil, nil, err
+			}
+			searchKeys = append(searchKeys, v)
 			{
 				ii := i
 				whileCondFuncs = append(whileCondFuncs, func(skeyTuple Tuple) bool {
-					return bytes.Equal(skeyTuple[ii], []byte(v))
+					return skeyTuple[ii] != nil && bytes.Equal(skeyTuple[ii], v)
 				})
 			}
 		}
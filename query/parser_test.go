@@ -2,9 +2,15 @@ package query
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
+	"my-relly-go/memcmpable"
+	"my-relly-go/table"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -20,14 +26,14 @@ type QueryErrorTestCase struct {
 }
 
 func openDb(fileName string) (*buffer.BufferPoolManager, *Parser) {
-	diskManager, err := disk.OpenDiskManager(fileName)
+	diskManager, err := disk.OpenDiskManagerWithMode(fileName, disk.OPEN_MODE_READ_ONLY)
 	if err != nil {
 		panic(err)
 	}
 	pool := buffer.NewBufferPool(10)
 	bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
-	parser, err := NewParser(bufmgr)
+	parser, err := NewParser(bufmgr, "students")
 	if err != nil {
 		panic(err)
 	}
@@ -139,32 +145,32 @@ func TestParserSingleKey(t *testing.T) {
 		tests := []*QueryTestCase{
 			{
 				`{"id1": {"$gte": "0010", "$lte": "0013"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{[]byte("0010"), []byte("0011"), []byte("0012"), []byte("0013")},
 			},
 			{
 				`{"id1": {"$gt": "0010", "$lt": "0013"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{[]byte("0011"), []byte("0012")},
 			},
 			{
 				`{"id1": {"$lte": "0003"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{[]byte("0000"), []byte("0001"), []byte("0002"), []byte("0003")},
 			},
 			{
 				`{"id1": {"$lt": "0003"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{[]byte("0000"), []byte("0001"), []byte("0002")},
 			},
 			{
 				`{"id1": {"$gte": "0956"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{[]byte("0956"), []byte("0957"), []byte("0958"), []byte("0959")},
 			},
 			{
 				`{"id1": {"$gt": "0956"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{[]byte("0957"), []byte("0958"), []byte("0959")},
 			},
 			{
@@ -174,14 +180,25 @@ func TestParserSingleKey(t *testing.T) {
 			},
 			{
 				`{"id1": {"$lt": "0000"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{},
 			},
 			{
 				`{"id1": {"$gt": "0959"}}`,
-				[]string{"Filter", "SeqScan"},
+				[]string{"SeqScan"},
 				[][]byte{},
 			},
+			// 複数の条件があれば、最も狭い範囲になる
+			{
+				`{"id1": {"$gte": "0005", "$gt": "0010", "$lt": "0020", "$lte": "0013"}}`,
+				[]string{"SeqScan"},
+				[][]byte{[]byte("0011"), []byte("0012"), []byte("0013")},
+			},
+			{
+				`{"id1": {"$gte": "0010", "$gt": "0010", "$lte": "0012", "$lt": "0012"}}`,
+				[]string{"SeqScan"},
+				[][]byte{[]byte("0011")},
+			},
 		}
 		queryTest(t, bufmgr, parser, tests)
 	})
@@ -212,36 +229,201 @@ func TestParserSingleKey(t *testing.T) {
 		queryTest(t, bufmgr, parser, tests)
 	})
 
+	t.Run("$inによる複数のキーの検索", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			// キーの順に並べ、重複を除いてから1件ずつ検索する
+			{
+				`{"id1": {"$in": ["0013", "0010", "aaaa", "0013"]}}`,
+				[]string{"Union", "SeqScan", "SeqScan", "SeqScan"},
+				[][]byte{[]byte("0010"), []byte("0013")},
+			},
+			{
+				`{"id1": {"$in": ["0010", "0011", "0012"], "$ne": "0011"}}`,
+				[]string{"Filter", "Union", "SeqScan", "SeqScan", "SeqScan"},
+				[][]byte{[]byte("0010"), []byte("0012")},
+			},
+			{
+				`{"id1": {"$in": []}}`,
+				[]string{"Union"},
+				[][]byte{},
+			},
+			{
+				`{"email": {"$in": ["0020@example.com", "0005@example.com"]}}`,
+				[]string{"Union", "IndexScan", "IndexScan"},
+				[][]byte{[]byte("0005"), []byte("0020")},
+			},
+			{
+				`{"email": {"$in": ["0020@example.com", "0005@example.com"]}, "id1": {"$gte": "0010"}}`,
+				[]string{"Filter", "SeqScan"},
+				[][]byte{[]byte("0020")},
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("前方一致、パターン検索", func(t *testing.T) {
+		pkeys := func(from int, to int) [][]byte {
+			ret := [][]byte{}
+			for i := from; i < to; i++ {
+				ret = append(ret, []byte(fmt.Sprintf("%04d", i)))
+			}
+			return ret
+		}
+		tests := []*QueryTestCase{
+			{
+				`{"id1": {"$prefix": "001"}}`,
+				[]string{"SeqScan"},
+				pkeys(10, 20),
+			},
+			{
+				`{"id1": {"$prefix": "00", "$lt": "0003"}}`,
+				[]string{"SeqScan"},
+				pkeys(0, 3),
+			},
+			// 符号化したブロックの境目をまたぐ
+			{
+				`{"email": {"$prefix": "0010@exam"}}`,
+				[]string{"IndexScan"},
+				pkeys(10, 11),
+			},
+			{
+				`{"email": {"$prefix": "0010@example.com."}}`,
+				[]string{"IndexScan"},
+				[][]byte{},
+			},
+			{
+				`{"email": {"$like": "002%"}}`,
+				[]string{"IndexScan"},
+				pkeys(20, 30),
+			},
+			{
+				`{"email": {"$like": "001_@%"}}`,
+				[]string{"Filter", "IndexScan"},
+				pkeys(10, 20),
+			},
+			{
+				`{"email": {"$like": "0005@example.com"}}`,
+				[]string{"Filter", "IndexScan"},
+				pkeys(5, 6),
+			},
+			{
+				`{"name": {"$like": "%Taro010102"}}`,
+				[]string{"Filter", "SeqScan"},
+				pkeys(1, 2),
+			},
+			{
+				`{"name": {"$regex": "^YamadaTaro0101(0[1-3])$"}}`,
+				[]string{"Filter", "SeqScan"},
+				pkeys(0, 3),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("カラムの選択", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			// インデックスとプライマリキーだけで足りればテーブルを読まない
+			{
+				`{"email": "0010@example.com", "fields": ["id1", "email"]}`,
+				[]string{"Project", "IndexOnlyScan"},
+				[][]byte{[]byte("0010")},
+			},
+			{
+				`{"email": {"$gte": "0010@example.com", "$lt": "0012@example.com"}, "fields": [{"email": "mail"}]}`,
+				[]string{"Project", "IndexOnlyScan"},
+				[][]byte{[]byte("0010@example.com"), []byte("0011@example.com")},
+			},
+			{
+				`{"email": {"$prefix": "000", "$ne": "0001@example.com"}, "fields": ["id1"]}`,
+				[]string{"Project", "Filter", "IndexOnlyScan"},
+				[][]byte{[]byte("0000"), []byte("0002"), []byte("0003"), []byte("0004"), []byte("0005"), []byte("0006"), []byte("0007"), []byte("0008"), []byte("0009")},
+			},
+			{
+				`{"email": {"$in": ["0020@example.com", "0005@example.com"]}, "fields": ["0"]}`,
+				[]string{"Project", "Union", "IndexOnlyScan", "IndexOnlyScan"},
+				[][]byte{[]byte("0005"), []byte("0020")},
+			},
+			{
+				`{"email": "0010@example.com", "fields": ["name", "id1"]}`,
+				[]string{"Project", "IndexScan"},
+				[][]byte{[]byte("YamadaTaro010111")},
+			},
+			{
+				`{"email": "0010@example.com", "id2": "1", "fields": ["id1"]}`,
+				[]string{"Project", "Filter", "IndexScan"},
+				[][]byte{},
+			},
+			{
+				`{"id1": {"$lt": "0002"}, "fields": ["id2", "id1"]}`,
+				[]string{"Project", "SeqScan"},
+				[][]byte{[]byte("0"), []byte("1")},
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+
+		// 指定した順にカラムを並べる
+		plan, err := parser.Parse(`{"email": "0010@example.com", "fields": ["email", {"id1": "id"}]}`)
+		if err != nil {
+			panic(err)
+		}
+		if names := plan.(*Project).Names; !reflect.DeepEqual(names, []string{"email", "id"}) {
+			t.Fatalf("names = %v, want [email id]", names)
+		}
+		exec, err := plan.Start(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		defer exec.Finish(bufmgr)
+		record, err := exec.Next(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if want := (Tuple{[]byte("0010@example.com"), []byte("0010")}); !reflect.DeepEqual(record, want) {
+			t.Fatalf("record = %q, want %q", record, want)
+		}
+
+		errorTests := []*QueryErrorTestCase{
+			{`{"fields": []}`, ErrInvalidField},
+			{`{"fields": "id1"}`, ErrInvalidField},
+			{`{"fields": [1]}`, ErrInvalidField},
+			{`{"fields": ["nothing"]}`, ErrInvalidField},
+			{`{"fields": ["7"]}`, ErrInvalidField},
+			{`{"fields": [{"id1": 1}]}`, ErrInvalidField},
+			{`{"fields": [{"id1": "a", "id2": "b"}]}`, ErrInvalidField},
+		}
+		queryErrorTest(t, bufmgr, parser, errorTests)
+	})
+
 	t.Run("単一セカンダリキー、範囲検索", func(t *testing.T) {
 		tests := []*QueryTestCase{
 			{
 				`{"email": {"$gte": "0010@example.com", "$lte": "0013@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{[]byte("0010"), []byte("0011"), []byte("0012"), []byte("0013")},
 			},
 			{
 				`{"email": {"$gt": "0010@example.com", "$lt": "0013@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{[]byte("0011"), []byte("0012")},
 			},
 			{
 				`{"email": {"$lte": "0003@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{[]byte("0000"), []byte("0001"), []byte("0002"), []byte("0003")},
 			},
 			{
 				`{"email": {"$lt": "0003@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{[]byte("0000"), []byte("0001"), []byte("0002")},
 			},
 			{
 				`{"email": {"$gte": "0956@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{[]byte("0956"), []byte("0957"), []byte("0958"), []byte("0959")},
 			},
 			{
 				`{"email": {"$gt": "0956@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{[]byte("0957"), []byte("0958"), []byte("0959")},
 			},
 			{
@@ -251,12 +433,12 @@ func TestParserSingleKey(t *testing.T) {
 			},
 			{
 				`{"email": {"$lt": "0000@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{},
 			},
 			{
 				`{"email": {"$gt": "0959@example.com"}}`,
-				[]string{"Filter", "IndexScan"},
+				[]string{"IndexScan"},
 				[][]byte{},
 			},
 		}
@@ -385,6 +567,416 @@ func TestParserNotKey(t *testing.T) {
 	})
 }
 
+// 一時ファイルにテーブルを作成する
+func createTempTable(tbl *table.Table) (*buffer.BufferPoolManager, func()) {
+	file, err := ioutil.TempFile("", "TestParser")
+	if err != nil {
+		panic(err)
+	}
+	diskManager, err := disk.CreateDiskManager(file.Name())
+	if err != nil {
+		panic(err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskManager, buffer.NewBufferPool(10))
+	if err := tbl.Create(bufmgr); err != nil {
+		panic(err)
+	}
+	return bufmgr, func() {
+		if err := diskManager.Close(); err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+		if err := os.Remove(file.Name()); err != nil {
+			panic(err)
+		}
+		if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestParserTypedColumns(t *testing.T) {
+	tbl := &table.Table{
+		NumCols:     4,
+		NumKeyElems: 1,
+		ColNames:    []string{"id", "name", "score", "passed"},
+		ColTypes:    []table.ColType{table.COL_TYPE_INT64, table.COL_TYPE_STRING, table.COL_TYPE_FLOAT64, table.COL_TYPE_BOOL},
+		UniqueIndices: []table.UniqueIndex{
+			{SKey: []int{2}}, // score
+		},
+	}
+	bufmgr, cleanup := createTempTable(tbl)
+	defer cleanup()
+	for i := -3; i <= 12; i++ {
+		record, err := tbl.EncodeRecord([]interface{}{i, fmt.Sprintf("student%d", i), float64(i) * 1.5, i%2 == 0})
+		if err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(bufmgr, record); err != nil {
+			panic(err)
+		}
+	}
+	parser := NewTableParser(tbl)
+	ids := func(ids ...int64) [][]byte {
+		pkeys := [][]byte{}
+		for _, id := range ids {
+			pkeys = append(pkeys, memcmpable.EncodeInt64(id))
+		}
+		return pkeys
+	}
+
+	t.Run("数値の完全一致検索", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			{
+				`{"id": 10}`,
+				[]string{"SeqScan"},
+				ids(10),
+			},
+			{
+				`{"id": -3}`,
+				[]string{"SeqScan"},
+				ids(-3),
+			},
+			{
+				`{"score": 4.5}`,
+				[]string{"IndexScan"},
+				ids(3),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("数値の範囲検索", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			// バイト列の比較では"10" < "9"になるが、数値の順に並ぶ
+			{
+				`{"id": {"$gte": -1, "$lt": 10}}`,
+				[]string{"SeqScan"},
+				ids(-1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9),
+			},
+			{
+				`{"id": {"$gt": 8}}`,
+				[]string{"SeqScan"},
+				ids(9, 10, 11, 12),
+			},
+			{
+				`{"score": {"$gt": -3, "$lte": 1.5}}`,
+				[]string{"IndexScan"},
+				ids(-1, 0, 1),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("キーでないカラム", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			{
+				`{"passed": true, "id": {"$lte": 4}}`,
+				[]string{"Filter", "SeqScan"},
+				ids(-2, 0, 2, 4),
+			},
+			{
+				`{"name": "student11"}`,
+				[]string{"Filter", "SeqScan"},
+				ids(11),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("型が合わない", func(t *testing.T) {
+		tests := []*QueryErrorTestCase{
+			{`{"id": "10"}`, ErrInvalidCondition},
+			{`{"id": 1.5}`, ErrInvalidCondition},
+			{`{"id": {"$lt": "10"}}`, ErrInvalidCondition},
+			{`{"score": {"$gte": true}}`, ErrInvalidCondition},
+			{`{"passed": 1}`, ErrInvalidCondition},
+			{`{"id": 1} {"id": 2}`, ErrJsonParse},
+		}
+		queryErrorTest(t, bufmgr, parser, tests)
+	})
+}
+
+func TestParserNull(t *testing.T) {
+	tbl := &table.Table{
+		NumCols:     3,
+		NumKeyElems: 1,
+		ColNames:    []string{"id", "email", "age"},
+		ColTypes:    []table.ColType{table.COL_TYPE_STRING, table.COL_TYPE_STRING, table.COL_TYPE_INT64},
+		Nullable:    []bool{false, true, true},
+		UniqueIndices: []table.UniqueIndex{
+			{SKey: []int{1}}, // email
+		},
+	}
+	bufmgr, cleanup := createTempTable(tbl)
+	defer cleanup()
+	for _, values := range [][]interface{}{
+		{"a", "a@example.com", 20},
+		{"b", nil, 30},
+		{"c", "", nil},
+		{"d", nil, nil},
+		{"e", "e@example.com", 15},
+	} {
+		record, err := tbl.EncodeRecord(values)
+		if err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(bufmgr, record); err != nil {
+			panic(err)
+		}
+	}
+	parser := NewTableParser(tbl)
+	ids := func(ids ...string) [][]byte {
+		pkeys := [][]byte{}
+		for _, id := range ids {
+			pkeys = append(pkeys, []byte(id))
+		}
+		return pkeys
+	}
+
+	t.Run("IS NULL/IS NOT NULL", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			{
+				`{"email": {"$isNull": true}}`,
+				[]string{"Filter", "IndexScan"},
+				ids("b", "d"),
+			},
+			{
+				`{"email": {"$isNotNull": true}}`,
+				[]string{"Filter", "IndexScan"},
+				ids("c", "a", "e"),
+			},
+			{
+				`{"age": {"$isNull": true}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("c", "d"),
+			},
+			{
+				`{"age": {"$isNotNull": true}, "id": {"$gte": "b"}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("b", "e"),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("NULLとの比較", func(t *testing.T) {
+		// NULLは空文字列とも一致せず、どの比較でも偽になる
+		tests := []*QueryTestCase{
+			{
+				`{"email": ""}`,
+				[]string{"IndexScan"},
+				ids("c"),
+			},
+			{
+				`{"email": {"$lt": "b"}}`,
+				[]string{"IndexScan"},
+				ids("c", "a"),
+			},
+			{
+				`{"age": {"$ne": 20}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("b", "e"),
+			},
+			{
+				`{"age": {"$lt": 100}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("a", "b", "e"),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("論理演算子", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			{
+				`{"$or": [{"age": {"$gte": 30}}, {"email": {"$isNull": true}}]}`,
+				[]string{"Filter", "SeqScan"},
+				ids("b", "d"),
+			},
+			// $andの中のカラムの条件はScanノードに使われる
+			{
+				`{"$and": [{"id": {"$gt": "a"}}, {"$or": [{"age": 30}, {"age": 15}]}]}`,
+				[]string{"Filter", "SeqScan"},
+				ids("b", "e"),
+			},
+			{
+				`{"$and": [{"email": {"$gte": "a"}}, {"email": {"$lt": "e"}}]}`,
+				[]string{"Filter", "IndexScan"},
+				ids("a"),
+			},
+			// NULLとの比較は偽なので、$notではNULLのレコードも一致する
+			{
+				`{"$not": {"age": {"$gte": 20}}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("c", "d", "e"),
+			},
+			{
+				`{"age": {"$in": [15, 30, 40]}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("b", "e"),
+			},
+			{
+				`{"age": {"$nin": [15, 30]}}`,
+				[]string{"Filter", "SeqScan"},
+				ids("a"),
+			},
+			{
+				`{"email": {"$in": ["", "e@example.com"]}}`,
+				[]string{"Union", "IndexScan", "IndexScan"},
+				ids("c", "e"),
+			},
+			// NULLを含むキーにはプライマリキーが付いている
+			{
+				`{"email": {"$isNull": true}, "fields": ["id", "email"]}`,
+				[]string{"Project", "Filter", "IndexOnlyScan"},
+				ids("b", "d"),
+			},
+			// 空の前方一致はNULL以外のすべての値に一致する
+			{
+				`{"email": {"$prefix": ""}}`,
+				[]string{"IndexScan"},
+				ids("c", "a", "e"),
+			},
+			{
+				`{"email": {"$regex": "^$|^e"}}`,
+				[]string{"Filter", "IndexScan"},
+				ids("c", "e"),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("異常系", func(t *testing.T) {
+		tests := []*QueryErrorTestCase{
+			{`{"email": null}`, ErrInvalidCondition},
+			{`{"age": {"$in": [20, null]}}`, ErrInvalidCondition},
+			{`{"age": {"$nin": 20}}`, ErrInvalidCondition},
+			{`{"age": {"$prefix": "2"}}`, ErrInvalidCondition},
+			{`{"email": {"$like": 1}}`, ErrInvalidCondition},
+			{`{"email": {"$regex": "("}}`, ErrInvalidCondition},
+			{`{"$or": []}`, ErrInvalidCondition},
+			{`{"$or": {"age": 20}}`, ErrInvalidCondition},
+			{`{"$and": [1]}`, ErrInvalidCondition},
+			{`{"$not": [{"age": 20}]}`, ErrInvalidCondition},
+			{`{"$or": [{"nothing": 20}]}`, ErrInvalidCondition},
+			{`{"email": {"$ne": null}}`, ErrInvalidCondition},
+			{`{"email": {"$isNull": false}}`, ErrInvalidCondition},
+			{`{"age": {"$isNotNull": 1}}`, ErrInvalidCondition},
+		}
+		queryErrorTest(t, bufmgr, parser, tests)
+	})
+}
+
+func TestParserSecondaryIndex(t *testing.T) {
+	tbl := &table.Table{
+		NumCols:     4,
+		NumKeyElems: 1,
+		ColNames:    []string{"id", "last_name", "status", "age"},
+		ColTypes:    []table.ColType{table.COL_TYPE_STRING, table.COL_TYPE_STRING, table.COL_TYPE_STRING, table.COL_TYPE_INT64},
+		SecondaryIndices: []table.SecondaryIndex{
+			{SKey: []int{1}},    // last_name
+			{SKey: []int{2, 3}}, // status, age
+		},
+	}
+	bufmgr, cleanup := createTempTable(tbl)
+	defer cleanup()
+	for _, values := range [][]interface{}{
+		{"01", "Smith", "active", 20},
+		{"02", "Jones", "active", 30},
+		{"03", "Smith", "inactive", 20},
+		{"04", "Brown", "active", 20},
+		{"05", "Smith", "active", 20},
+		{"06", "Jones", "inactive", 40},
+	} {
+		record, err := tbl.EncodeRecord(values)
+		if err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(bufmgr, record); err != nil {
+			panic(err)
+		}
+	}
+	parser := NewTableParser(tbl)
+	ids := func(ids ...string) [][]byte {
+		pkeys := [][]byte{}
+		for _, id := range ids {
+			pkeys = append(pkeys, []byte(id))
+		}
+		return pkeys
+	}
+
+	t.Run("単一セカンダリキー", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			// 一致する行がすべて、プライマリキーの順に返る
+			{
+				`{"last_name": "Smith"}`,
+				[]string{"IndexScan"},
+				ids("01", "03", "05"),
+			},
+			{
+				`{"last_name": "Smith", "status": "active"}`,
+				[]string{"Filter", "IndexScan"},
+				ids("01", "05"),
+			},
+			{
+				`{"last_name": "Taylor"}`,
+				[]string{"IndexScan"},
+				ids(),
+			},
+			{
+				`{"last_name": {"$gte": "Jones", "$lt": "Smith"}}`,
+				[]string{"IndexScan"},
+				ids("02", "06"),
+			},
+			{
+				`{"last_name": {"$in": ["Smith", "Brown"]}}`,
+				[]string{"Union", "IndexScan", "IndexScan"},
+				ids("04", "01", "03", "05"),
+			},
+			{
+				`{"last_name": {"$prefix": "Sm"}}`,
+				[]string{"IndexScan"},
+				ids("01", "03", "05"),
+			},
+			{
+				`{"last_name": {"$prefix": "Sm"}, "fields": ["id", "last_name"]}`,
+				[]string{"Project", "IndexOnlyScan"},
+				ids("01", "03", "05"),
+			},
+			{
+				`{"last_name": {"$like": "%o%"}}`,
+				[]string{"Filter", "IndexScan"},
+				ids("04", "02", "06"),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+
+	t.Run("複合セカンダリキー", func(t *testing.T) {
+		tests := []*QueryTestCase{
+			{
+				`{"status": "active", "age": 20}`,
+				[]string{"IndexScan"},
+				ids("01", "04", "05"),
+			},
+			{
+				`{"status": "inactive", "age": 40}`,
+				[]string{"IndexScan"},
+				ids("06"),
+			},
+			{
+				`{"status": "active", "age": 20, "fields": ["id", "age", "status"]}`,
+				[]string{"Project", "IndexOnlyScan"},
+				ids("01", "04", "05"),
+			},
+		}
+		queryTest(t, bufmgr, parser, tests)
+	})
+}
+
 func TestParserError(t *testing.T) {
 	bufmgr, parser := openDb("../query_test1.rly")
 	tests := []*QueryErrorTestCase{
@@ -455,4 +1047,21 @@ func TestParserError(t *testing.T) {
 		},
 	}
 	queryErrorTest(t, bufmgr, parser, tests)
+
+	// UPDATEとDELETEの条件には、結果のカラムや並べ替えを指定できない
+	for _, query := range []string{
+		`{"id1": "0010", "fields": ["id2"]}`,
+		`{"id1": {"$lt": "0002"}, "sort": [{"id1": "desc"}]}`,
+	} {
+		if _, err := parser.ParseCondition(query); err != ErrInvalidCondition {
+			t.Fatalf("parser.ParseCondition(%s) = %v, want ErrInvalidCondition", query, err)
+		}
+	}
+	plan, err := parser.ParseCondition(`{"id1": "0010"}`)
+	if err != nil {
+		panic(err)
+	}
+	if explain := plan.Explain(); !reflect.DeepEqual(explain, []string{"SeqScan"}) {
+		t.Fatalf("plan.Explain() = %v, want [SeqScan]", explain)
+	}
 }
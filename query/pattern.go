@@ -0,0 +1,40 @@
+package query
+
+import (
+	"regexp"
+	"strings"
+)
+
+// LIKEのパターンを正規表現にする
+// 最初の%か_より前の部分と、パターンが「その部分%」の形かも返す
+func likeToRegexp(pattern string) (*regexp.Regexp, string, bool) {
+	var re strings.Builder
+	var prefix strings.Builder
+	numWildcards := 0
+	endsWithPercent := false
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		endsWithPercent = false
+		switch {
+		case c == '\\' && i+1 < len(runes):
+			i++
+			c = runes[i]
+		case c == '%':
+			numWildcards++
+			endsWithPercent = true
+			re.WriteString(`.*`)
+			continue
+		case c == '_':
+			numWildcards++
+			re.WriteString(`.`)
+			continue
+		}
+		re.WriteString(regexp.QuoteMeta(string(c)))
+		if numWildcards == 0 {
+			prefix.WriteRune(c)
+		}
+	}
+	prefixOnly := numWildcards == 1 && endsWithPercent
+	return regexp.MustCompile(`(?s)^` + re.String() + `$`), prefix.String(), prefixOnly
+}
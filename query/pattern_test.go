@@ -0,0 +1,43 @@
+package query
+
+import (
+	"testing"
+)
+
+func TestPattern(t *testing.T) {
+	t.Run("LIKE", func(t *testing.T) {
+		tests := []struct {
+			pattern    string
+			prefix     string
+			prefixOnly bool
+			match      []string
+			notMatch   []string
+		}{
+			{"abc", "abc", false, []string{"abc"}, []string{"abcd", "ab"}},
+			{"abc%", "abc", true, []string{"abc", "abcd", "abc\nd"}, []string{"ab", "xabc"}},
+			{"a_c", "a", false, []string{"abc", "aあc"}, []string{"ac", "abbc"}},
+			{"%b%", "", false, []string{"b", "abc"}, []string{"ac"}},
+			{"a%c", "a", false, []string{"ac", "abbc"}, []string{"acb"}},
+			{"a.*", "a.*", false, []string{"a.*"}, []string{"abc"}},
+			{"100\\%%", "100%", true, []string{"100%", "100%OK"}, []string{"1000"}},
+			{"a\\_%", "a_", true, []string{"a_b"}, []string{"ab"}},
+			{"a%%", "a", false, []string{"a", "ab"}, []string{"b"}},
+		}
+		for _, tt := range tests {
+			re, prefix, prefixOnly := likeToRegexp(tt.pattern)
+			if prefix != tt.prefix || prefixOnly != tt.prefixOnly {
+				t.Fatalf("likeToRegexp(%q) = %q, %v, want %q, %v", tt.pattern, prefix, prefixOnly, tt.prefix, tt.prefixOnly)
+			}
+			for _, s := range tt.match {
+				if !re.MatchString(s) {
+					t.Fatalf("%q should match %q", tt.pattern, s)
+				}
+			}
+			for _, s := range tt.notMatch {
+				if re.MatchString(s) {
+					t.Fatalf("%q should not match %q", tt.pattern, s)
+				}
+			}
+		}
+	})
+}
@@ -35,6 +35,46 @@ func (ts *TupleSearchModeKey) encode() btree.SearchMode {
 	return &btree.SearchModeKey{Key: table.EncodeTuple(ts.Key)}
 }
 
+// 最後のタプルから逆順に走査する
+type TupleSearchModeEnd struct {
+}
+
+func (ts *TupleSearchModeEnd) encode() btree.SearchMode {
+	return &btree.SearchModeEnd{}
+}
+
+// Key以下で最大のタプルから逆順に走査する
+type TupleSearchModeKeyBackward struct {
+	Key [][]byte
+}
+
+func (ts *TupleSearchModeKeyBackward) encode() btree.SearchMode {
+	return &btree.SearchModeKeyBackward{Key: table.EncodeTuple(ts.Key)}
+}
+
+// 範囲の端。タプルの先頭のいくつかの要素だけを指定してもよい
+type Bound struct {
+	Key       [][]byte
+	Inclusive bool
+}
+
+func (b *Bound) encode() *btree.Bound {
+	if b == nil {
+		return nil
+	}
+	return &btree.Bound{Key: table.EncodeTuple(b.Key), Inclusive: b.Inclusive}
+}
+
+// 端がnilなら、その向きには制限しない
+type Range struct {
+	Lower *Bound
+	Upper *Bound
+}
+
+func (r *Range) encode() *btree.Range {
+	return &btree.Range{Lower: r.Lower.encode(), Upper: r.Upper.encode()}
+}
+
 type Executor interface {
 	Next(bufmgr *buffer.BufferPoolManager) (Tuple, error)
 	Finish(bufmgr *buffer.BufferPoolManager)
@@ -45,35 +85,67 @@ type PlanNode interface {
 	Explain() []string
 }
 
+// Rangeを指定したら、SearchModeの代わりにRangeの中だけを走査する
+func search(bufmgr *buffer.BufferPoolManager, tree *btree.BTree, searchMode TupleSearchMode, rng *Range, backward bool) (*btree.BTreeIter, error) {
+	if rng != nil {
+		return tree.SearchRange(bufmgr, rng.encode(), backward)
+	}
+	return tree.Search(bufmgr, searchMode.encode())
+}
+
+// Backwardなら、キーの降順にPrevで読み進める
+func nextPair(bufmgr *buffer.BufferPoolManager, iter *btree.BTreeIter, backward bool) ([]byte, []byte, error) {
+	if backward {
+		return iter.Prev(bufmgr)
+	}
+	return iter.Next(bufmgr)
+}
+
+// WhileCondを省略したら、最後まで読み進める
+func checkWhileCond(whileCond WhileCondFunc, key Tuple) bool {
+	return whileCond == nil || whileCond(key)
+}
+
+func explainScan(name string, backward bool) []string {
+	if backward {
+		return []string{name + " (backward)"}
+	}
+	return []string{name}
+}
+
 type SeqScan struct {
 	TableMetaPageId disk.PageId
 	SearchMode      TupleSearchMode
+	Range           *Range
 	WhileCond       WhileCondFunc
+	Backward        bool
 }
 
 func (s *SeqScan) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
 	tree := btree.NewBTree(s.TableMetaPageId)
-	tableIter, err := tree.Search(bufmgr, s.SearchMode.encode())
+	tableIter, err := search(bufmgr, tree, s.SearchMode, s.Range, s.Backward)
 	if err != nil {
 		return nil, err
 	}
 	return &ExecSeqScan{
 		tableIter,
 		s.WhileCond,
+		s.Backward,
 	}, nil
 }
 
 func (s *SeqScan) Explain() []string {
-	return []string{"SeqScan"}
+	return explainScan("SeqScan", s.Backward)
 }
 
 type ExecSeqScan struct {
 	tableIter *btree.BTreeIter
 	whileCond WhileCondFunc
+	backward  bool
 }
 
 func (es *ExecSeqScan) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
-	pkeyBytes, tupleBytes, err := es.tableIter.Next(bufmgr)
+	pkeyBytes, tupleBytes, err := nextPair(bufmgr, es.tableIter, es.backward)
 	if err != nil {
 		if err == btree.ErrEndOfIterator {
 			return nil, ErrEndOfIterator
@@ -82,7 +154,7 @@ func (es *ExecSeqScan) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
 	}
 	pkey := [][]byte{}
 	pkey = table.DecodeTuple(pkeyBytes, pkey)
-	if !(es.whileCond)(pkey) {
+	if !checkWhileCond(es.whileCond, pkey) {
 		return nil, ErrEndOfIterator
 	}
 	tuple := pkey
@@ -144,17 +216,77 @@ func (ef *ExecFilter) Finish(bufmgr *buffer.BufferPoolManager) {
 	ef.innerIter.Finish(bufmgr)
 }
 
+// 子のプランの結果を順につなげる
+type Union struct {
+	InnerPlans []PlanNode
+}
+
+func (u *Union) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
+	return &ExecUnion{
+		innerPlans: u.InnerPlans,
+	}, nil
+}
+
+func (u *Union) Explain() (ret []string) {
+	ret = []string{"Union"}
+	for _, innerPlan := range u.InnerPlans {
+		ret = append(ret, innerPlan.Explain()...)
+	}
+	return
+}
+
+type ExecUnion struct {
+	innerPlans []PlanNode
+	innerIter  Executor
+}
+
+func (eu *ExecUnion) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
+	for {
+		// 子のプランは1つずつ開始する
+		if eu.innerIter == nil {
+			if len(eu.innerPlans) == 0 {
+				return nil, ErrEndOfIterator
+			}
+			innerIter, err := eu.innerPlans[0].Start(bufmgr)
+			if err != nil {
+				return nil, err
+			}
+			eu.innerPlans = eu.innerPlans[1:]
+			eu.innerIter = innerIter
+		}
+		tuple, err := eu.innerIter.Next(bufmgr)
+		if err == ErrEndOfIterator || err == btree.ErrEndOfIterator {
+			eu.innerIter.Finish(bufmgr)
+			eu.innerIter = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return tuple, nil
+	}
+}
+
+func (eu *ExecUnion) Finish(bufmgr *buffer.BufferPoolManager) {
+	if eu.innerIter != nil {
+		eu.innerIter.Finish(bufmgr)
+		eu.innerIter = nil
+	}
+}
+
 type IndexScan struct {
 	TableMetaPageId disk.PageId
 	IndexMetaPageId disk.PageId
 	SearchMode      TupleSearchMode
+	Range           *Range
 	WhileCond       WhileCondFunc
+	Backward        bool
 }
 
 func (s *IndexScan) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
 	tableTree := btree.NewBTree(s.TableMetaPageId)
 	indexTree := btree.NewBTree(s.IndexMetaPageId)
-	indexIter, err := indexTree.Search(bufmgr, s.SearchMode.encode())
+	indexIter, err := search(bufmgr, indexTree, s.SearchMode, s.Range, s.Backward)
 	if err != nil {
 		return nil, err
 	}
@@ -162,22 +294,24 @@ func (s *IndexScan) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
 		tableTree,
 		indexIter,
 		s.WhileCond,
+		s.Backward,
 	}, nil
 }
 
 func (s *IndexScan) Explain() []string {
-	return []string{"IndexScan"}
+	return explainScan("IndexScan", s.Backward)
 }
 
 type ExecIndexScan struct {
 	tableTree *btree.BTree
 	indexIter *btree.BTreeIter
 	whileCond WhileCondFunc
+	backward  bool
 }
 
 func (es *ExecIndexScan) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
 	// セカンダリインデックスの検索を進める
-	skeyBytes, pkeyBytes, err := es.indexIter.Next(bufmgr)
+	skeyBytes, pkeyBytes, err := nextPair(bufmgr, es.indexIter, es.backward)
 	if err != nil {
 		if err == btree.ErrEndOfIterator {
 			return nil, ErrEndOfIterator
@@ -186,7 +320,7 @@ func (es *ExecIndexScan) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
 	}
 	skey := [][]byte{}
 	skey = table.DecodeTuple(skeyBytes, skey)
-	if !(es.whileCond)(skey) {
+	if !checkWhileCond(es.whileCond, skey) {
 		return nil, ErrEndOfIterator
 	}
 
@@ -211,35 +345,48 @@ func (es *ExecIndexScan) Finish(bufmgr *buffer.BufferPoolManager) {
 	es.indexIter.Finish(bufmgr)
 }
 
+// インデックスだけを読み、テーブルは読まない
+// SKeyを指定しなければ、プライマリキーだけを返す
+// SKeyを指定すると、NumCols個のカラムを持つレコードにプライマリキーとセカンダリキーを並べて返す。それ以外のカラムはnilになる
 type IndexOnlyScan struct {
 	IndexMetaPageId disk.PageId
 	SearchMode      TupleSearchMode
+	Range           *Range
 	WhileCond       WhileCondFunc
+	Backward        bool
+	SKey            []int
+	NumCols         int
 }
 
 func (s *IndexOnlyScan) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
 	indexTree := btree.NewBTree(s.IndexMetaPageId)
-	indexIter, err := indexTree.Search(bufmgr, s.SearchMode.encode())
+	indexIter, err := search(bufmgr, indexTree, s.SearchMode, s.Range, s.Backward)
 	if err != nil {
 		return nil, err
 	}
 	return &ExecIndexOnlyScan{
 		indexIter,
 		s.WhileCond,
+		s.Backward,
+		s.SKey,
+		s.NumCols,
 	}, nil
 }
 
 func (s *IndexOnlyScan) Explain() []string {
-	return []string{"IndexOnlyScan"}
+	return explainScan("IndexOnlyScan", s.Backward)
 }
 
 type ExecIndexOnlyScan struct {
 	indexIter *btree.BTreeIter
 	whileCond WhileCondFunc
+	backward  bool
+	skey      []int
+	numCols   int
 }
 
 func (es *ExecIndexOnlyScan) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
-	skeyBytes, pkeyBytes, err := es.indexIter.Next(bufmgr)
+	skeyBytes, pkeyBytes, err := nextPair(bufmgr, es.indexIter, es.backward)
 	if err != nil {
 		if err == btree.ErrEndOfIterator {
 			return nil, ErrEndOfIterator
@@ -248,15 +395,71 @@ func (es *ExecIndexOnlyScan) Next(bufmgr *buffer.BufferPoolManager) (Tuple, erro
 	}
 	skey := [][]byte{}
 	skey = table.DecodeTuple(skeyBytes, skey)
-	if !(es.whileCond)(skey) {
+	if !checkWhileCond(es.whileCond, skey) {
 		return nil, ErrEndOfIterator
 	}
 
 	tuple := [][]byte{}
 	tuple = table.DecodeTuple(pkeyBytes, tuple)
-	return tuple, nil
+	if len(es.skey) == 0 {
+		return tuple, nil
+	}
+
+	// プライマリキーは先頭のカラムに並ぶ
+	record := make(Tuple, es.numCols)
+	copy(record, tuple)
+	for i, col := range es.skey {
+		record[col] = skey[i]
+	}
+	return record, nil
 }
 
 func (es *ExecIndexOnlyScan) Finish(bufmgr *buffer.BufferPoolManager) {
 	es.indexIter.Finish(bufmgr)
 }
+
+// 子のプランのレコードから、Columnsのカラムだけを順に並べて返す
+// Namesは結果のカラム名
+type Project struct {
+	InnerPlan PlanNode
+	Columns   []int
+	Names     []string
+}
+
+func (p *Project) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
+	innerIter, err := p.InnerPlan.Start(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecProject{
+		innerIter,
+		p.Columns,
+	}, nil
+}
+
+func (p *Project) Explain() (ret []string) {
+	ret = []string{"Project"}
+	ret = append(ret, p.InnerPlan.Explain()...)
+	return
+}
+
+type ExecProject struct {
+	innerIter Executor
+	columns   []int
+}
+
+func (ep *ExecProject) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
+	tuple, err := ep.innerIter.Next(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	projected := make(Tuple, len(ep.columns))
+	for i, col := range ep.columns {
+		projected[i] = tuple[col]
+	}
+	return projected, nil
+}
+
+func (ep *ExecProject) Finish(bufmgr *buffer.BufferPoolManager) {
+	ep.innerIter.Finish(bufmgr)
+}
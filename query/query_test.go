@@ -1,6 +1,7 @@
 package query
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
@@ -8,6 +9,7 @@ import (
 	"my-relly-go/disk"
 	"my-relly-go/table"
 	"os"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -32,25 +34,25 @@ func createTestTable() {
 			}
 		}
 
-		file, err := os.Create(fileName)
+		diskManager, err := disk.CreateDiskManager(fileName)
 		if err != nil {
 			panic(err)
 		}
 		defer func() {
-			if err := file.Close(); err != nil {
+			if err := diskManager.Close(); err != nil {
 				panic(err)
 			}
 		}()
 
-		diskManager, err := disk.NewDiskManager(file)
-		if err != nil {
-			panic(err)
-		}
-
 		pool := buffer.NewBufferPool(100)
 		bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
+		catalog, err := table.CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
 		tbl := table.Table{
+			Name:        "students",
 			MetaPageId:  disk.INVALID_PAGE_ID,
 			NumCols:     7,
 			NumKeyElems: numKeyElems,
@@ -74,7 +76,7 @@ func createTestTable() {
 				},
 			},
 		}
-		if err := tbl.Create(bufmgr); err != nil {
+		if err := catalog.CreateTable(bufmgr, &tbl); err != nil {
 			panic(err)
 		}
 		fmt.Println(tbl)
@@ -104,3 +106,106 @@ func createTestTable() {
 	create(1)
 	create(2)
 }
+
+func TestScanBackward(t *testing.T) {
+	bufmgr, parser := openDb("../query_test1.rly")
+	tbl := parser.tbl
+	pkeys := func(from int, to int) [][]byte {
+		ret := [][]byte{}
+		for i := from; i >= to; i-- {
+			ret = append(ret, []byte(fmt.Sprintf("%04d", i)))
+		}
+		return ret
+	}
+	whileTrue := func(Tuple) bool {
+		return true
+	}
+
+	tests := []struct {
+		name        string
+		plan        PlanNode
+		limit       int
+		wantExplain string
+		wantPKeys   [][]byte
+	}{
+		{
+			"末尾から",
+			&SeqScan{TableMetaPageId: tbl.MetaPageId, SearchMode: &TupleSearchModeEnd{}, WhileCond: whileTrue, Backward: true},
+			3, "SeqScan (backward)", pkeys(959, 957),
+		},
+		{
+			"キー以下から",
+			&SeqScan{
+				TableMetaPageId: tbl.MetaPageId,
+				SearchMode:      &TupleSearchModeKeyBackward{Key: [][]byte{[]byte("0500")}},
+				WhileCond: func(pkey Tuple) bool {
+					return bytes.Compare(pkey[0], []byte("0495")) >= 0
+				},
+				Backward: true,
+			},
+			0, "SeqScan (backward)", pkeys(500, 495),
+		},
+		{
+			"範囲を逆順に",
+			&SeqScan{
+				TableMetaPageId: tbl.MetaPageId,
+				Range: &Range{
+					Lower: &Bound{Key: [][]byte{[]byte("0495")}, Inclusive: false},
+					Upper: &Bound{Key: [][]byte{[]byte("0500")}, Inclusive: true},
+				},
+				Backward: true,
+			},
+			0, "SeqScan (backward)", pkeys(500, 496),
+		},
+		{
+			"存在しないキー以下から",
+			&SeqScan{TableMetaPageId: tbl.MetaPageId, SearchMode: &TupleSearchModeKeyBackward{Key: [][]byte{[]byte("0500a")}}, WhileCond: whileTrue, Backward: true},
+			2, "SeqScan (backward)", pkeys(500, 499),
+		},
+		{
+			"先頭より前",
+			&SeqScan{TableMetaPageId: tbl.MetaPageId, SearchMode: &TupleSearchModeKeyBackward{Key: [][]byte{[]byte("")}}, WhileCond: whileTrue, Backward: true},
+			0, "SeqScan (backward)", pkeys(-1, 0),
+		},
+		{
+			"インデックスを逆順に",
+			&IndexScan{
+				TableMetaPageId: tbl.MetaPageId,
+				IndexMetaPageId: tbl.UniqueIndices[0].MetaPageId,
+				SearchMode:      &TupleSearchModeKeyBackward{Key: [][]byte{[]byte("0100@example.com")}},
+				WhileCond:       whileTrue,
+				Backward:        true,
+			},
+			4, "IndexScan (backward)", pkeys(100, 97),
+		},
+		{
+			"インデックスだけを逆順に",
+			&IndexOnlyScan{IndexMetaPageId: tbl.UniqueIndices[1].MetaPageId, SearchMode: &TupleSearchModeEnd{}, WhileCond: whileTrue, Backward: true},
+			2, "IndexOnlyScan (backward)", pkeys(959, 958),
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.plan.Explain(); len(got) != 1 || got[0] != tt.wantExplain {
+			t.Fatalf("%s: explain = %v, want %v", tt.name, got, tt.wantExplain)
+		}
+		exec, err := tt.plan.Start(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		got := [][]byte{}
+		for tt.limit == 0 || len(got) < tt.limit {
+			record, err := exec.Next(bufmgr)
+			if err == ErrEndOfIterator {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			got = append(got, record[0])
+		}
+		exec.Finish(bufmgr)
+		if !reflect.DeepEqual(got, tt.wantPKeys) {
+			t.Fatalf("%s = %q, want %q", tt.name, got, tt.wantPKeys)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package query
+
+import (
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/table"
+)
+
+// 並べ替えに使うカラム
+type SortKey struct {
+	Col  int
+	Desc bool
+}
+
+// 並べ替えでメモリに置くレコードの大きさの上限（バイト）
+const DEFAULT_SORT_MEMORY_LIMIT = btree.DEFAULT_SORT_MEMORY_LIMIT
+
+// 一度にマージするrunの数の上限
+const DEFAULT_SORT_FAN_IN = btree.DEFAULT_SORT_FAN_IN
+
+// 子のプランのレコードをKeysの順に並べ替える
+// NULLは昇順なら先頭、降順なら末尾に並び、Keysが等しいレコードは子のプランの順のまま並ぶ
+// btree.Sorterで並べ替えるので、メモリに置いたレコードがMemoryLimitを超えたらrunとして一時ファイルに書き出し、FanIn個ずつマージする
+// MemoryLimitとFanInは0ならデフォルトの値を使う
+type Sort struct {
+	InnerPlan   PlanNode
+	Keys        []SortKey
+	MemoryLimit int
+	FanIn       int
+}
+
+func (s *Sort) Start(bufmgr *buffer.BufferPoolManager) (Executor, error) {
+	innerIter, err := s.InnerPlan.Start(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	defer innerIter.Finish(bufmgr)
+
+	es := &ExecSort{btree.NewSorter(s.MemoryLimit, s.FanIn)}
+	for {
+		tuple, err := innerIter.Next(bufmgr)
+		if err == ErrEndOfIterator || err == btree.ErrEndOfIterator {
+			break
+		}
+		if err != nil {
+			es.Finish(bufmgr)
+			return nil, err
+		}
+		if err := es.sorter.Add(s.encodeKey(tuple), table.EncodeTuple(tuple)); err != nil {
+			es.Finish(bufmgr)
+			return nil, err
+		}
+	}
+	if err := es.sorter.Sort(); err != nil {
+		es.Finish(bufmgr)
+		return nil, err
+	}
+	return es, nil
+}
+
+func (s *Sort) Explain() (ret []string) {
+	ret = []string{"Sort"}
+	ret = append(ret, s.InnerPlan.Explain()...)
+	return
+}
+
+// 並べ替えのキーを、bytes.Compareで比べられるバイト列にする
+// カラムごとにmemcmpableで符号化し、降順なら反転する
+// btree.Sorterはキーが等しいペアを加えた順に返すので、キーが等しいレコードは元の順に並ぶ
+func (s *Sort) encodeKey(tuple Tuple) []byte {
+	key := []byte{}
+	for _, sortKey := range s.Keys {
+		elem := table.EncodeTuple([][]byte{tuple[sortKey.Col]})
+		if sortKey.Desc {
+			for i := range elem {
+				elem[i] = ^elem[i]
+			}
+		}
+		key = append(key, elem...)
+	}
+	return key
+}
+
+type ExecSort struct {
+	sorter *btree.Sorter
+}
+
+func (es *ExecSort) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
+	_, value, err := es.sorter.Next(bufmgr)
+	if err == btree.ErrEndOfIterator {
+		return nil, ErrEndOfIterator
+	}
+	if err != nil {
+		return nil, err
+	}
+	tuple := [][]byte{}
+	tuple = table.DecodeTuple(value, tuple)
+	return tuple, nil
+}
+
+func (es *ExecSort) Finish(bufmgr *buffer.BufferPoolManager) {
+	es.sorter.Finish()
+}
@@ -0,0 +1,219 @@
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"my-relly-go/buffer"
+	"my-relly-go/memcmpable"
+	"my-relly-go/table"
+)
+
+func TestSort(t *testing.T) {
+	tbl := &table.Table{
+		NumCols:     3,
+		NumKeyElems: 1,
+		ColNames:    []string{"id", "name", "score"},
+		ColTypes:    []table.ColType{table.COL_TYPE_STRING, table.COL_TYPE_STRING, table.COL_TYPE_INT64},
+		Nullable:    []bool{false, true, true},
+	}
+	bufmgr, cleanup := createTempTable(tbl)
+	defer cleanup()
+
+	// 並べ替えた結果の先頭のカラムを返す
+	sortIds := func(bufmgr *buffer.BufferPoolManager, plan PlanNode) []string {
+		exec, err := plan.Start(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		defer exec.Finish(bufmgr)
+		ids := []string{}
+		for {
+			record, err := exec.Next(bufmgr)
+			if err == ErrEndOfIterator {
+				return ids
+			}
+			if err != nil {
+				panic(err)
+			}
+			ids = append(ids, string(record[0]))
+		}
+	}
+	seqScan := &SeqScan{
+		TableMetaPageId: tbl.MetaPageId,
+		SearchMode:      &TupleSearchModeStart{},
+	}
+
+	t.Run("メモリ内", func(t *testing.T) {
+		for _, values := range [][]interface{}{
+			{"a", "Smith", 80},
+			{"b", "Jones", nil},
+			{"c", nil, 90},
+			{"d", "Brown", 80},
+			{"e", "Jones", -70},
+		} {
+			record, err := tbl.EncodeRecord(values)
+			if err != nil {
+				panic(err)
+			}
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+
+		tests := []struct {
+			name   string
+			keys   []SortKey
+			expect []string
+		}{
+			// 負の数も正しく並び、NULLは先頭に並ぶ
+			{"昇順", []SortKey{{Col: 2}}, []string{"b", "e", "a", "d", "c"}},
+			{"降順", []SortKey{{Col: 2, Desc: true}}, []string{"c", "a", "d", "e", "b"}},
+			{"複数のカラム", []SortKey{{Col: 2, Desc: true}, {Col: 1}}, []string{"c", "d", "a", "e", "b"}},
+			{"文字列の降順", []SortKey{{Col: 1, Desc: true}}, []string{"a", "b", "e", "d", "c"}},
+		}
+		for _, tt := range tests {
+			got := sortIds(bufmgr, &Sort{InnerPlan: seqScan, Keys: tt.keys})
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Fatalf("%s: %v, want %v", tt.name, got, tt.expect)
+			}
+		}
+
+		plan, err := NewTableParser(tbl).Parse(`{"id": {"$gt": "a"}, "sort": ["name", {"score": "desc"}], "fields": ["id"]}`)
+		if err != nil {
+			panic(err)
+		}
+		if got := plan.Explain(); !reflect.DeepEqual(got, []string{"Project", "Sort", "SeqScan"}) {
+			t.Fatalf("explain = %v", got)
+		}
+		stmt, err := ParseSql("SELECT id FROM t WHERE score IS NOT NULL ORDER BY score, name DESC")
+		if err != nil {
+			panic(err)
+		}
+		plan, err = stmt.(*SelectStmt).Plan(tbl)
+		if err != nil {
+			panic(err)
+		}
+		if got := plan.Explain(); !reflect.DeepEqual(got, []string{"Project", "Sort", "Filter", "SeqScan"}) {
+			t.Fatalf("explain = %v", got)
+		}
+		got := sortIds(bufmgr, plan.(*Project).InnerPlan.(*Sort))
+		if want := []string{"e", "a", "d", "c"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("ORDER BY = %v, want %v", got, want)
+		}
+
+		errorTests := []*QueryErrorTestCase{
+			{`{"sort": []}`, ErrInvalidSort},
+			{`{"sort": "id"}`, ErrInvalidSort},
+			{`{"sort": ["nothing"]}`, ErrInvalidSort},
+			{`{"sort": [{"id": "up"}]}`, ErrInvalidSort},
+		}
+		queryErrorTest(t, bufmgr, NewTableParser(tbl), errorTests)
+
+		for _, id := range []string{"a", "b", "c", "d", "e"} {
+			if err := tbl.Delete(bufmgr, [][]byte{[]byte(id)}); err != nil {
+				panic(err)
+			}
+		}
+	})
+
+	t.Run("runの書き出しとマージ", func(t *testing.T) {
+		const numRecords = 1000
+		for i := 0; i < numRecords; i++ {
+			// スコアが同じレコードはidの順に並ぶ
+			record := [][]byte{
+				[]byte(fmt.Sprintf("%04d", i)),
+				[]byte(fmt.Sprintf("name%d", i)),
+				memcmpable.EncodeInt64(int64(i * 7919 % 100)),
+			}
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		expect := []string{}
+		for score := 99; score >= 0; score-- {
+			for i := 0; i < numRecords; i++ {
+				if i*7919%100 == score {
+					expect = append(expect, fmt.Sprintf("%04d", i))
+				}
+			}
+		}
+
+		plan := &Sort{
+			InnerPlan:   seqScan,
+			Keys:        []SortKey{{Col: 2, Desc: true}},
+			MemoryLimit: 1024,
+			FanIn:       3,
+		}
+		exec, err := plan.Start(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		// FanIn個以下になるまでマージしてある
+		if n := exec.(*ExecSort).sorter.NumRuns(); n == 0 || plan.FanIn < n {
+			t.Fatalf("len(runs) = %v", n)
+		}
+		exec.Finish(bufmgr)
+
+		// runはデータベースに書き出さないので、他のトランザクションが実行中でも待たずに並べ替えられる
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		bufmgr.SetLockTimeout(10 * time.Millisecond)
+		defer bufmgr.SetLockTimeout(0)
+		for i := 0; i < 2; i++ {
+			if got := sortIds(bufmgr, plan); !reflect.DeepEqual(got, expect) {
+				t.Fatalf("sorted %v records, want %v records in order", len(got), len(expect))
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			panic(err)
+		}
+	})
+
+	t.Run("キーの順", func(t *testing.T) {
+		// 前のテストで登録した、idが0000から0999のレコードを使う
+		ids := func(from, to int) []string {
+			ret := []string{}
+			for i := from; i != to; {
+				ret = append(ret, fmt.Sprintf("%04d", i))
+				if from < to {
+					i++
+				} else {
+					i--
+				}
+			}
+			return ret
+		}
+		tests := []struct {
+			sql     string
+			explain []string
+			expect  []string
+		}{
+			{"SELECT id FROM t ORDER BY id", []string{"Project", "SeqScan"}, ids(0, 1000)},
+			{"SELECT id FROM t ORDER BY id DESC", []string{"Project", "SeqScan (backward)"}, ids(999, -1)},
+			{"SELECT id FROM t WHERE id >= '0990' ORDER BY id DESC", []string{"Project", "SeqScan (backward)"}, ids(999, 989)},
+			{"SELECT id FROM t WHERE id = '0123' ORDER BY id DESC", []string{"Project", "SeqScan"}, ids(123, 124)},
+			{"SELECT id FROM t WHERE id < '0003' ORDER BY id DESC, score", []string{"Project", "Sort", "SeqScan"}, ids(2, -1)},
+		}
+		for _, tt := range tests {
+			stmt, err := ParseSql(tt.sql)
+			if err != nil {
+				panic(err)
+			}
+			plan, err := stmt.(*SelectStmt).Plan(tbl)
+			if err != nil {
+				panic(err)
+			}
+			if got := plan.Explain(); !reflect.DeepEqual(got, tt.explain) {
+				t.Fatalf("%s: explain = %v, want %v", tt.sql, got, tt.explain)
+			}
+			if got := sortIds(bufmgr, plan); !reflect.DeepEqual(got, tt.expect) {
+				t.Fatalf("%s: %v records, want %v records in order", tt.sql, len(got), len(tt.expect))
+			}
+		}
+	})
+}
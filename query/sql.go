@@ -0,0 +1,966 @@
+package query
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"my-relly-go/disk"
+	"my-relly-go/table"
+
+	"github.com/thoas/go-funk"
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrSqlSyntax     = xerrors.New("SQL syntax error")
+	ErrUnknownColumn = xerrors.New("Unknown column")
+)
+
+// SQLの文
+// どの文も1つのテーブルを対象にする
+type Statement interface {
+	TableName() string
+}
+
+// SELECT {* | カラム [AS 名前], ...} FROM テーブル [WHERE 条件] [ORDER BY カラム [ASC | DESC], ...]
+// *ならColumnsはnil。Namesは結果のカラム名
+type SelectStmt struct {
+	Table   string
+	Columns []string
+	Names   []string
+	OrderBy []OrderByItem
+	where   map[string]interface{}
+}
+
+type OrderByItem struct {
+	Column string
+	Desc   bool
+}
+
+// INSERT INTO テーブル [(カラム, ...)] VALUES (値, ...), ...
+// カラムを省略したら、すべてのカラムの値を定義の順に並べる
+type InsertStmt struct {
+	Table   string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// UPDATE テーブル SET カラム = 値, ... [WHERE 条件]
+type UpdateStmt struct {
+	Table   string
+	Columns []string
+	Values  []interface{}
+	where   map[string]interface{}
+}
+
+// DELETE FROM テーブル [WHERE 条件]
+type DeleteStmt struct {
+	Table string
+	where map[string]interface{}
+}
+
+// CREATE TABLE テーブル (カラム 型 [NOT NULL] [PRIMARY KEY], ..., [PRIMARY KEY (カラム, ...)])
+// プライマリキーは先頭から並んだカラムでなければならない
+type CreateTableStmt struct {
+	Table *table.Table
+}
+
+// CREATE [UNIQUE] INDEX [インデックス] ON テーブル (カラム, ...)
+type CreateIndexStmt struct {
+	Table   string
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+func (s *SelectStmt) TableName() string      { return s.Table }
+func (s *InsertStmt) TableName() string      { return s.Table }
+func (s *UpdateStmt) TableName() string      { return s.Table }
+func (s *DeleteStmt) TableName() string      { return s.Table }
+func (s *CreateTableStmt) TableName() string { return s.Table.Name }
+func (s *CreateIndexStmt) TableName() string { return s.Table }
+
+// 型の名前はtable.ColTypeの名前と、よく使われる別名を受け付ける
+var sqlColTypeAliases = map[string]table.ColType{
+	"blob":      table.COL_TYPE_BYTES,
+	"text":      table.COL_TYPE_STRING,
+	"varchar":   table.COL_TYPE_STRING,
+	"int":       table.COL_TYPE_INT64,
+	"integer":   table.COL_TYPE_INT64,
+	"bigint":    table.COL_TYPE_INT64,
+	"double":    table.COL_TYPE_FLOAT64,
+	"float":     table.COL_TYPE_FLOAT64,
+	"real":      table.COL_TYPE_FLOAT64,
+	"boolean":   table.COL_TYPE_BOOL,
+	"datetime":  table.COL_TYPE_TIMESTAMP,
+	"timestamp": table.COL_TYPE_TIMESTAMP,
+}
+
+func ParseSql(sql string) (Statement, error) {
+	tokens, err := tokenizeSql(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{tokens: tokens}
+
+	var stmt Statement
+	switch {
+	case p.keyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case p.keyword("INSERT"):
+		stmt, err = p.parseInsert()
+	case p.keyword("UPDATE"):
+		stmt, err = p.parseUpdate()
+	case p.keyword("DELETE"):
+		stmt, err = p.parseDelete()
+	case p.keyword("CREATE"):
+		stmt, err = p.parseCreate()
+	default:
+		err = p.syntaxError()
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.symbol(";")
+	if p.peek().kind != sqlTokenEOF {
+		return nil, p.syntaxError()
+	}
+	return stmt, nil
+}
+
+// 検索するプランを構築する
+func (s *SelectStmt) Plan(tbl *table.Table) (PlanNode, error) {
+	var project *Project
+	if s.Columns != nil {
+		project = &Project{Names: s.Names}
+		for _, colName := range s.Columns {
+			col, err := sqlColIndex(tbl, colName)
+			if err != nil {
+				return nil, err
+			}
+			project.Columns = append(project.Columns, col)
+		}
+	}
+	var sortKeys []SortKey
+	for _, item := range s.OrderBy {
+		col, err := sqlColIndex(tbl, item.Column)
+		if err != nil {
+			return nil, err
+		}
+		sortKeys = append(sortKeys, SortKey{Col: col, Desc: item.Desc})
+	}
+	return planSql(tbl, s.where, project, sortKeys)
+}
+
+// 書き換えるレコードを検索するプランを構築する
+func (s *UpdateStmt) Plan(tbl *table.Table) (PlanNode, error) {
+	return planSql(tbl, s.where, nil, nil)
+}
+
+// カラム番号ごとの新しい値
+func (s *UpdateStmt) EncodedValues(tbl *table.Table) (map[int][]byte, error) {
+	values := map[int][]byte{}
+	for i, colName := range s.Columns {
+		col, err := sqlColIndex(tbl, colName)
+		if err != nil {
+			return nil, err
+		}
+		value, err := encodeSqlValue(tbl, col, s.Values[i])
+		if err != nil {
+			return nil, err
+		}
+		values[col] = value
+	}
+	return values, nil
+}
+
+// 削除するレコードを検索するプランを構築する
+func (s *DeleteStmt) Plan(tbl *table.Table) (PlanNode, error) {
+	return planSql(tbl, s.where, nil, nil)
+}
+
+// 挿入するレコード。指定しなかったカラムはNULLになる
+func (s *InsertStmt) Records(tbl *table.Table) ([][][]byte, error) {
+	cols := []int{}
+	if len(s.Columns) == 0 {
+		for col := 0; col < tbl.NumCols; col++ {
+			cols = append(cols, col)
+		}
+	}
+	for _, colName := range s.Columns {
+		col, err := sqlColIndex(tbl, colName)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+
+	records := [][][]byte{}
+	for _, row := range s.Rows {
+		if len(row) != len(cols) {
+			return nil, xerrors.New("Invalid number of columns")
+		}
+		record := make([][]byte, tbl.NumCols)
+		for i, col := range cols {
+			value, err := encodeSqlValue(tbl, col, row[i])
+			if err != nil {
+				return nil, err
+			}
+			record[col] = value
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (s *CreateIndexStmt) Kind() table.IndexKind {
+	if s.Unique {
+		return table.INDEX_KIND_UNIQUE
+	}
+	return table.INDEX_KIND_SECONDARY
+}
+
+// インデックスを作るカラムの番号
+func (s *CreateIndexStmt) SKey(tbl *table.Table) ([]int, error) {
+	skey := []int{}
+	for _, colName := range s.Columns {
+		col, err := sqlColIndex(tbl, colName)
+		if err != nil {
+			return nil, err
+		}
+		skey = append(skey, col)
+	}
+	return skey, nil
+}
+
+func sqlColIndex(tbl *table.Table, colName string) (int, error) {
+	col := funk.IndexOf(tbl.ColNames, colName)
+	if col < 0 {
+		return 0, xerrors.Errorf("%s: %w", colName, ErrUnknownColumn)
+	}
+	return col, nil
+}
+
+func encodeSqlValue(tbl *table.Table, col int, value interface{}) ([]byte, error) {
+	buf, err := table.EncodeValue(tbl.ColType(col), value)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid %s value for column %s: %w", tbl.ColType(col), tbl.ColNames[col], err)
+	}
+	return buf, nil
+}
+
+// WHEREの条件は、カラム名をキーにしたJSONの検索条件と同じ形で持つ
+// カラム名をカラム番号に置き換えてからプランを構築する
+func planSql(tbl *table.Table, where map[string]interface{}, project *Project, sortKeys []SortKey) (PlanNode, error) {
+	where, err := resolveSqlWhere(tbl, where)
+	if err != nil {
+		return nil, err
+	}
+	return NewTableParser(tbl).buildPlan("", where, project, sortKeys)
+}
+
+func resolveSqlWhere(tbl *table.Table, where map[string]interface{}) (map[string]interface{}, error) {
+	resolved := map[string]interface{}{}
+	for key, value := range where {
+		switch Op(key) {
+		case OP_AND, OP_OR:
+			values, ok := value.([]interface{})
+			if !ok {
+				return nil, ErrInvalidCondition
+			}
+			items := []interface{}{}
+			for _, item := range values {
+				itemWhere, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, ErrInvalidCondition
+				}
+				itemWhere, err := resolveSqlWhere(tbl, itemWhere)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, itemWhere)
+			}
+			resolved[key] = items
+		case OP_NOT:
+			notWhere, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, ErrInvalidCondition
+			}
+			notWhere, err := resolveSqlWhere(tbl, notWhere)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = notWhere
+		default:
+			col, err := sqlColIndex(tbl, key)
+			if err != nil {
+				return nil, err
+			}
+			resolved[strconv.Itoa(col)] = value
+		}
+	}
+	return resolved, nil
+}
+
+// 2つの条件をANDで結ぶ
+// 同じカラムの演算子は重ならなければ1つにまとめ、まとめられない条件は$andに入れる
+func andSqlWhere(where map[string]interface{}, other map[string]interface{}) map[string]interface{} {
+	and, _ := where[string(OP_AND)].([]interface{})
+	for key, value := range other {
+		if items, ok := value.([]interface{}); ok && Op(key) == OP_AND {
+			and = append(and, items...)
+			continue
+		}
+		current, ok := where[key]
+		if !ok {
+			where[key] = value
+			continue
+		}
+		currentExprs, ok1 := current.(map[string]interface{})
+		exprs, ok2 := value.(map[string]interface{})
+		if ok1 && ok2 && !Op(key).logical() {
+			overlapped := false
+			for op := range exprs {
+				if _, ok := currentExprs[op]; ok {
+					overlapped = true
+				}
+			}
+			if !overlapped {
+				for op, right := range exprs {
+					currentExprs[op] = right
+				}
+				continue
+			}
+		}
+		and = append(and, map[string]interface{}{key: value})
+	}
+	if len(and) > 0 {
+		where[string(OP_AND)] = and
+	}
+	return where
+}
+
+type sqlTokenKind int
+
+const (
+	sqlTokenEOF sqlTokenKind = iota
+	sqlTokenIdent
+	sqlTokenQuotedIdent
+	sqlTokenString
+	sqlTokenNumber
+	sqlTokenSymbol
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+}
+
+var sqlSymbols = []string{"<=", ">=", "<>", "!=", "(", ")", ",", ";", "*", "=", "<", ">", "-"}
+
+func tokenizeSql(sql string) ([]sqlToken, error) {
+	tokens := []sqlToken{}
+	runes := []rune(sql)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(runes) && (runes[i] == '_' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenIdent, string(runes[start:i])})
+
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == 'e' || runes[i] == 'E' ||
+				((runes[i] == '+' || runes[i] == '-') && (runes[i-1] == 'e' || runes[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{sqlTokenNumber, string(runes[start:i])})
+
+		case c == '\'' || c == '"' || c == '`':
+			// 文字列は'で、識別子は"か`で囲む。囲んだ文字を2つ重ねると1つになる
+			kind := sqlTokenString
+			if c != '\'' {
+				kind = sqlTokenQuotedIdent
+			}
+			text := []rune{}
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, xerrors.Errorf("unterminated quote: %w", ErrSqlSyntax)
+				}
+				if runes[i] == c {
+					if i+1 < len(runes) && runes[i+1] == c {
+						text = append(text, c)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text = append(text, runes[i])
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind, string(text)})
+
+		default:
+			matched := false
+			for _, symbol := range sqlSymbols {
+				if strings.HasPrefix(string(runes[i:]), symbol) {
+					tokens = append(tokens, sqlToken{sqlTokenSymbol, symbol})
+					i += len([]rune(symbol))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, xerrors.Errorf("near %q: %w", string(c), ErrSqlSyntax)
+			}
+		}
+	}
+	return append(tokens, sqlToken{sqlTokenEOF, ""}), nil
+}
+
+type sqlParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) syntaxError() error {
+	token := p.peek()
+	if token.kind == sqlTokenEOF {
+		return xerrors.Errorf("unexpected end: %w", ErrSqlSyntax)
+	}
+	return xerrors.Errorf("near %q: %w", token.text, ErrSqlSyntax)
+}
+
+// キーワードは大文字と小文字を区別しない。一致したら読み進める
+func (p *sqlParser) keyword(keyword string) bool {
+	token := p.peek()
+	if token.kind == sqlTokenIdent && strings.EqualFold(token.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectKeyword(keywords ...string) error {
+	for _, keyword := range keywords {
+		if !p.keyword(keyword) {
+			return p.syntaxError()
+		}
+	}
+	return nil
+}
+
+func (p *sqlParser) symbol(symbol string) bool {
+	token := p.peek()
+	if token.kind == sqlTokenSymbol && token.text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.symbol(symbol) {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *sqlParser) ident() (string, error) {
+	token := p.peek()
+	if token.kind != sqlTokenIdent && token.kind != sqlTokenQuotedIdent {
+		return "", p.syntaxError()
+	}
+	p.pos++
+	return token.text, nil
+}
+
+// (識別子, ...)
+func (p *sqlParser) identList() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	idents := []string{}
+	for {
+		ident, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		idents = append(idents, ident)
+		if p.symbol(")") {
+			return idents, nil
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// 値はJSONの検索条件と同じ型で返す
+// 数値はjson.Number、文字列はstring、TRUE/FALSEはbool、NULLはnil
+func (p *sqlParser) literal() (interface{}, error) {
+	negative := p.symbol("-")
+	token := p.peek()
+	switch {
+	case token.kind == sqlTokenNumber:
+		p.pos++
+		if negative {
+			return json.Number("-" + token.text), nil
+		}
+		return json.Number(token.text), nil
+	case negative:
+		return nil, p.syntaxError()
+	case token.kind == sqlTokenString:
+		p.pos++
+		return token.text, nil
+	case p.keyword("TRUE"):
+		return true, nil
+	case p.keyword("FALSE"):
+		return false, nil
+	case p.keyword("NULL"):
+		return nil, nil
+	}
+	return nil, p.syntaxError()
+}
+
+// [WHERE 条件]
+// 条件はOR、AND、NOTと括弧で組み合わせられる
+func (p *sqlParser) parseWhere() (map[string]interface{}, error) {
+	if !p.keyword("WHERE") {
+		return map[string]interface{}{}, nil
+	}
+	return p.parseOr()
+}
+
+func (p *sqlParser) parseOr() (map[string]interface{}, error) {
+	where, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	if !p.keyword("OR") {
+		return where, nil
+	}
+	items := []interface{}{where}
+	for {
+		where, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, where)
+		if !p.keyword("OR") {
+			return map[string]interface{}{string(OP_OR): items}, nil
+		}
+	}
+}
+
+func (p *sqlParser) parseAnd() (map[string]interface{}, error) {
+	where, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		other, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		where = andSqlWhere(where, other)
+	}
+	return where, nil
+}
+
+func (p *sqlParser) parseNot() (map[string]interface{}, error) {
+	if p.keyword("NOT") {
+		where, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{string(OP_NOT): where}, nil
+	}
+	if p.symbol("(") {
+		where, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return where, nil
+	}
+	return p.parseCond()
+}
+
+// カラム 演算子 値 | カラム IS [NOT] NULL | カラム [NOT] IN (値, ...) | カラム LIKE 'パターン'
+func (p *sqlParser) parseCond() (map[string]interface{}, error) {
+	col, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	// 検索条件では$で始まるキーを演算子として扱うので、カラム名には使えない
+	if strings.HasPrefix(col, "$") {
+		return nil, xerrors.Errorf("%s: %w", col, ErrInvalidCondition)
+	}
+	if p.keyword("IS") {
+		op := OP_IS_NULL
+		if p.keyword("NOT") {
+			op = OP_IS_NOT_NULL
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{col: map[string]interface{}{string(op): true}}, nil
+	}
+
+	op := OP_IN
+	if p.keyword("NOT") {
+		op = OP_NIN
+		if err := p.expectKeyword("IN"); err != nil {
+			return nil, err
+		}
+	}
+	if op == OP_NIN || p.keyword("IN") {
+		values, err := p.literalList()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{col: map[string]interface{}{string(op): values}}, nil
+	}
+	if p.keyword("LIKE") {
+		token := p.peek()
+		if token.kind != sqlTokenString {
+			return nil, p.syntaxError()
+		}
+		p.pos++
+		return map[string]interface{}{col: map[string]interface{}{string(OP_LIKE): token.text}}, nil
+	}
+
+	switch {
+	case p.symbol("="):
+		op = ""
+	case p.symbol("<>"), p.symbol("!="):
+		op = OP_NE
+	case p.symbol("<"):
+		op = OP_LT
+	case p.symbol("<="):
+		op = OP_LTE
+	case p.symbol(">"):
+		op = OP_GT
+	case p.symbol(">="):
+		op = OP_GTE
+	default:
+		return nil, p.syntaxError()
+	}
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	// NULLとの比較はIS NULL/IS NOT NULLを使う
+	if value == nil {
+		return nil, ErrInvalidCondition
+	}
+	if op == "" {
+		return map[string]interface{}{col: value}, nil
+	}
+	return map[string]interface{}{col: map[string]interface{}{string(op): value}}, nil
+}
+
+// (値, ...)。NULLは含められない
+func (p *sqlParser) literalList() ([]interface{}, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	values := []interface{}{}
+	for {
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, ErrInvalidCondition
+		}
+		values = append(values, value)
+		if p.symbol(")") {
+			return values, nil
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *sqlParser) parseSelect() (*SelectStmt, error) {
+	stmt := &SelectStmt{}
+	if !p.symbol("*") {
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			name := col
+			if p.keyword("AS") {
+				if name, err = p.ident(); err != nil {
+					return nil, err
+				}
+			}
+			stmt.Columns = append(stmt.Columns, col)
+			stmt.Names = append(stmt.Names, name)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if stmt.where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			item := OrderByItem{Column: col}
+			if p.keyword("DESC") {
+				item.Desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) parseInsert() (*InsertStmt, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	tableName, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	if token := p.peek(); token.kind == sqlTokenSymbol && token.text == "(" {
+		if columns, err = p.identList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+
+	rows := [][]interface{}{}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		row := []interface{}{}
+		for {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, value)
+			if p.symbol(")") {
+				break
+			}
+			if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+		}
+		rows = append(rows, row)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return &InsertStmt{Table: tableName, Columns: columns, Rows: rows}, nil
+}
+
+func (p *sqlParser) parseUpdate() (*UpdateStmt, error) {
+	tableName, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: tableName}
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = append(stmt.Columns, col)
+		stmt.Values = append(stmt.Values, value)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if stmt.where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) parseDelete() (*DeleteStmt, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	tableName, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	where, err := p.parseWhere()
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteStmt{Table: tableName, where: where}, nil
+}
+
+func (p *sqlParser) parseCreate() (Statement, error) {
+	if p.keyword("TABLE") {
+		return p.parseCreateTable()
+	}
+	unique := p.keyword("UNIQUE")
+	if err := p.expectKeyword("INDEX"); err != nil {
+		return nil, err
+	}
+	// インデックス名を省略したら、カラム名から付ける
+	stmt := &CreateIndexStmt{Unique: unique}
+	if !p.keyword("ON") {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Name = name
+		if err := p.expectKeyword("ON"); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if stmt.Columns, err = p.identList(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) parseCreateTable() (*CreateTableStmt, error) {
+	tableName, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	tbl := &table.Table{Name: tableName, MetaPageId: disk.INVALID_PAGE_ID}
+	pkey := []string{}
+	for {
+		if p.keyword("PRIMARY") {
+			if err := p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			if len(pkey) > 0 {
+				return nil, p.syntaxError()
+			}
+			if pkey, err = p.identList(); err != nil {
+				return nil, err
+			}
+		} else {
+			// カラム 型 [NOT NULL | NULL] [PRIMARY KEY]
+			colName, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			typeName, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			colType, ok := sqlColTypeAliases[strings.ToLower(typeName)]
+			if !ok {
+				if colType, err = table.ParseColType(strings.ToLower(typeName)); err != nil {
+					return nil, xerrors.Errorf("%s: %w", typeName, err)
+				}
+			}
+			nullable := true
+			for {
+				if p.keyword("NOT") {
+					if err := p.expectKeyword("NULL"); err != nil {
+						return nil, err
+					}
+					nullable = false
+				} else if p.keyword("NULL") {
+					nullable = true
+				} else if p.keyword("PRIMARY") {
+					if err := p.expectKeyword("KEY"); err != nil {
+						return nil, err
+					}
+					pkey = append(pkey, colName)
+				} else {
+					break
+				}
+			}
+			tbl.ColNames = append(tbl.ColNames, colName)
+			tbl.ColTypes = append(tbl.ColTypes, colType)
+			tbl.Nullable = append(tbl.Nullable, nullable)
+		}
+		if p.symbol(")") {
+			break
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+	}
+
+	// プライマリキーは先頭のカラムから順に並べる。指定が無ければ先頭のカラムにする
+	if len(tbl.ColNames) == 0 {
+		return nil, xerrors.Errorf("no columns: %w", ErrSqlSyntax)
+	}
+	if len(pkey) == 0 {
+		pkey = tbl.ColNames[:1]
+	}
+	for i, colName := range pkey {
+		if i >= len(tbl.ColNames) || tbl.ColNames[i] != colName {
+			return nil, xerrors.Errorf("primary key must be leading columns: %w", ErrSqlSyntax)
+		}
+		tbl.Nullable[i] = false
+	}
+	tbl.NumCols = len(tbl.ColNames)
+	tbl.NumKeyElems = len(pkey)
+	return &CreateTableStmt{Table: tbl}, nil
+}
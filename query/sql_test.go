@@ -0,0 +1,317 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+	"my-relly-go/memcmpable"
+	"my-relly-go/table"
+
+	"golang.org/x/xerrors"
+)
+
+func TestSql(t *testing.T) {
+	// プランを実行して、各レコードの先頭のカラムを返す
+	execPlan := func(bufmgr *buffer.BufferPoolManager, plan PlanNode) [][]byte {
+		exec, err := plan.Start(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		defer exec.Finish(bufmgr)
+		pkeys := [][]byte{}
+		for {
+			record, err := exec.Next(bufmgr)
+			if err == ErrEndOfIterator {
+				return pkeys
+			}
+			if err != nil {
+				panic(err)
+			}
+			pkeys = append(pkeys, record[0])
+		}
+	}
+
+	t.Run("構文", func(t *testing.T) {
+		tests := []struct {
+			sql    string
+			expect Statement
+		}{
+			{
+				"SELECT * FROM students",
+				&SelectStmt{Table: "students", where: map[string]interface{}{}},
+			},
+			{
+				"SELECT id, name AS `full name` FROM t",
+				&SelectStmt{Table: "t", Columns: []string{"id", "name"}, Names: []string{"id", "full name"}, where: map[string]interface{}{}},
+			},
+			{
+				"select * from \"order\" where id >= -1.5 and name <> 'It''s' AND age IS NOT NULL;",
+				&SelectStmt{Table: "order", where: map[string]interface{}{
+					"id":   map[string]interface{}{"$gte": json.Number("-1.5")},
+					"name": map[string]interface{}{"$ne": "It's"},
+					"age":  map[string]interface{}{"$isNotNull": true},
+				}},
+			},
+			{
+				"SELECT * FROM t WHERE a > 1 AND a < 5 AND a <> 3 AND a = 2",
+				&SelectStmt{Table: "t", where: map[string]interface{}{
+					"a": map[string]interface{}{"$gt": json.Number("1"), "$lt": json.Number("5"), "$ne": json.Number("3")},
+					"$and": []interface{}{
+						map[string]interface{}{"a": json.Number("2")},
+					},
+				}},
+			},
+			{
+				"SELECT * FROM t WHERE a = 1 OR NOT (b IN (1, 2) AND c NOT IN ('x')) OR c IS NULL",
+				&SelectStmt{Table: "t", where: map[string]interface{}{
+					"$or": []interface{}{
+						map[string]interface{}{"a": json.Number("1")},
+						map[string]interface{}{"$not": map[string]interface{}{
+							"b": map[string]interface{}{"$in": []interface{}{json.Number("1"), json.Number("2")}},
+							"c": map[string]interface{}{"$nin": []interface{}{"x"}},
+						}},
+						map[string]interface{}{"c": map[string]interface{}{"$isNull": true}},
+					},
+				}},
+			},
+			{
+				"INSERT INTO t (a, `b c`) VALUES (1, 'x'), (TRUE, NULL)",
+				&InsertStmt{Table: "t", Columns: []string{"a", "b c"}, Rows: [][]interface{}{
+					{json.Number("1"), "x"},
+					{true, nil},
+				}},
+			},
+			{
+				"UPDATE t SET a = 1, b = NULL WHERE c = FALSE",
+				&UpdateStmt{Table: "t", Columns: []string{"a", "b"}, Values: []interface{}{json.Number("1"), nil}, where: map[string]interface{}{"c": false}},
+			},
+			{
+				"DELETE FROM t WHERE a < 10",
+				&DeleteStmt{Table: "t", where: map[string]interface{}{"a": map[string]interface{}{"$lt": json.Number("10")}}},
+			},
+			{
+				"CREATE UNIQUE INDEX by_name ON t (last, first)",
+				&CreateIndexStmt{Table: "t", Name: "by_name", Unique: true, Columns: []string{"last", "first"}},
+			},
+			{
+				"CREATE INDEX ON t (a)",
+				&CreateIndexStmt{Table: "t", Columns: []string{"a"}},
+			},
+			{
+				"CREATE TABLE t (id1 INT, id2 string, name TEXT NOT NULL, score float64 NULL, PRIMARY KEY (id1, id2))",
+				&CreateTableStmt{&table.Table{
+					Name:        "t",
+					MetaPageId:  disk.INVALID_PAGE_ID,
+					NumCols:     4,
+					NumKeyElems: 2,
+					ColNames:    []string{"id1", "id2", "name", "score"},
+					ColTypes:    []table.ColType{table.COL_TYPE_INT64, table.COL_TYPE_STRING, table.COL_TYPE_STRING, table.COL_TYPE_FLOAT64},
+					Nullable:    []bool{false, false, false, true},
+				}},
+			},
+		}
+		for _, tt := range tests {
+			stmt, err := ParseSql(tt.sql)
+			if err != nil {
+				t.Fatalf("ParseSql(%q) = %v", tt.sql, err)
+			}
+			if !reflect.DeepEqual(stmt, tt.expect) {
+				t.Fatalf("ParseSql(%q) = %+v, want %+v", tt.sql, stmt, tt.expect)
+			}
+		}
+	})
+
+	t.Run("SELECT", func(t *testing.T) {
+		bufmgr, parser := openDb("../query_test1.rly")
+		tbl := parser.tbl
+		pkeys := func(ids ...string) [][]byte {
+			ret := [][]byte{}
+			for _, id := range ids {
+				ret = append(ret, []byte(id))
+			}
+			return ret
+		}
+
+		// JSONの検索条件と同じプランになる
+		tests := []struct {
+			sql         string
+			wantExplain []string
+			wantPKeys   [][]byte
+		}{
+			{"SELECT * FROM students WHERE id1 = '0010'", []string{"SeqScan"}, pkeys("0010")},
+			{"SELECT * FROM students WHERE id1 > '0010' AND id1 <= '0013'", []string{"SeqScan"}, pkeys("0011", "0012", "0013")},
+			{"SELECT * FROM students WHERE email = '0010@example.com'", []string{"IndexScan"}, pkeys("0010")},
+			{"SELECT * FROM students WHERE grade = '01' AND class = '01' AND student_no = '11'", []string{"IndexScan"}, pkeys("0010")},
+			{"SELECT * FROM students WHERE name = 'YamadaTaro010111'", []string{"Filter", "SeqScan"}, pkeys("0010")},
+			{"SELECT * FROM students WHERE id1 < '0004' AND id1 != '0001'", []string{"Filter", "SeqScan"}, pkeys("0000", "0002", "0003")},
+			{"SELECT * FROM students WHERE id1 IN ('0012', '0010')", []string{"Union", "SeqScan", "SeqScan"}, pkeys("0010", "0012")},
+			{"SELECT * FROM students WHERE id1 < '0003' OR id1 = '0500'", []string{"Filter", "SeqScan"}, pkeys("0000", "0001", "0002", "0500")},
+			{"SELECT * FROM students WHERE id1 <= '0003' AND NOT (id1 = '0001' OR id1 = '0002')", []string{"Filter", "SeqScan"}, pkeys("0000", "0003")},
+			{"SELECT * FROM students WHERE id1 = '0001' AND id1 = '0002'", []string{"Filter", "SeqScan"}, pkeys()},
+			{"SELECT * FROM students WHERE email LIKE '001%' AND id1 < '0012'", []string{"Filter", "SeqScan"}, pkeys("0010", "0011")},
+			{"SELECT id1 FROM students WHERE email IN ('0012@example.com', '0010@example.com')", []string{"Project", "Union", "IndexOnlyScan", "IndexOnlyScan"}, pkeys("0010", "0012")},
+			{"SELECT name, id1 FROM students WHERE email = '0010@example.com'", []string{"Project", "IndexScan"}, pkeys("YamadaTaro010111")},
+			{"SELECT * FROM students WHERE email LIKE '095%'", []string{"IndexScan"}, pkeys("0950", "0951", "0952", "0953", "0954", "0955", "0956", "0957", "0958", "0959")},
+			{"SELECT * FROM students WHERE id1 LIKE '095_' AND id1 > '0957'", []string{"Filter", "SeqScan"}, pkeys("0958", "0959")},
+		}
+		for _, tt := range tests {
+			stmt, err := ParseSql(tt.sql)
+			if err != nil {
+				panic(err)
+			}
+			plan, err := stmt.(*SelectStmt).Plan(tbl)
+			if err != nil {
+				t.Fatalf("%s: Plan() = %v", tt.sql, err)
+			}
+			if got := plan.Explain(); !reflect.DeepEqual(got, tt.wantExplain) {
+				t.Fatalf("%s: explain = %v, want %v", tt.sql, got, tt.wantExplain)
+			}
+			if got := execPlan(bufmgr, plan); !reflect.DeepEqual(got, tt.wantPKeys) {
+				t.Fatalf("%s = %q, want %q", tt.sql, got, tt.wantPKeys)
+			}
+		}
+	})
+
+	t.Run("書き込み", func(t *testing.T) {
+		stmt, err := ParseSql("CREATE TABLE scores (id INT64 PRIMARY KEY, name STRING NOT NULL, score FLOAT64)")
+		if err != nil {
+			panic(err)
+		}
+		tbl := stmt.(*CreateTableStmt).Table
+		bufmgr, cleanup := createTempTable(tbl)
+		defer cleanup()
+		exec := func(sql string) Statement {
+			stmt, err := ParseSql(sql)
+			if err != nil {
+				panic(err)
+			}
+			return stmt
+		}
+		selectIds := func(sql string) []int64 {
+			plan, err := exec(sql).(*SelectStmt).Plan(tbl)
+			if err != nil {
+				panic(err)
+			}
+			ids := []int64{}
+			for _, pkey := range execPlan(bufmgr, plan) {
+				ids = append(ids, memcmpable.DecodeInt64(pkey))
+			}
+			return ids
+		}
+
+		records, err := exec("INSERT INTO scores VALUES (1, 'Alice', 80.5), (2, 'Bob', NULL)").(*InsertStmt).Records(tbl)
+		if err != nil {
+			t.Fatalf("Records() = %v", err)
+		}
+		// カラムを指定しなければNULLになる
+		moreRecords, err := exec("INSERT INTO scores (name, id) VALUES ('Carol', -3)").(*InsertStmt).Records(tbl)
+		if err != nil {
+			t.Fatalf("Records() = %v", err)
+		}
+		if moreRecords[0][2] != nil {
+			t.Fatalf("score = %v, want NULL", moreRecords[0][2])
+		}
+		for _, record := range append(records, moreRecords...) {
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		if got := selectIds("SELECT * FROM scores WHERE score IS NULL"); !reflect.DeepEqual(got, []int64{-3, 2}) {
+			t.Fatalf("ids = %v, want [-3 2]", got)
+		}
+
+		update := exec("UPDATE scores SET score = 90, name = 'Bobby' WHERE id = 2").(*UpdateStmt)
+		plan, err := update.Plan(tbl)
+		if err != nil {
+			panic(err)
+		}
+		values, err := update.EncodedValues(tbl)
+		if err != nil {
+			t.Fatalf("EncodedValues() = %v", err)
+		}
+		if !bytes.Equal(values[1], []byte("Bobby")) || !bytes.Equal(values[2], memcmpable.EncodeFloat64(90)) {
+			t.Fatalf("EncodedValues() = %v", values)
+		}
+		if got := execPlan(bufmgr, plan); len(got) != 1 {
+			t.Fatalf("len(records) = %v, want 1", len(got))
+		}
+
+		index := exec("CREATE UNIQUE INDEX ON scores (name)").(*CreateIndexStmt)
+		skey, err := index.SKey(tbl)
+		if err != nil || !reflect.DeepEqual(skey, []int{1}) || index.Kind() != table.INDEX_KIND_UNIQUE {
+			t.Fatalf("SKey() = %v, %v", skey, err)
+		}
+		if err := tbl.AddIndex(bufmgr, index.Kind(), index.Name, skey); err != nil {
+			panic(err)
+		}
+		if got := selectIds("SELECT * FROM scores WHERE name >= 'B'"); !reflect.DeepEqual(got, []int64{2, -3}) {
+			t.Fatalf("ids = %v, want [2 -3]", got)
+		}
+
+		plan, err = exec("DELETE FROM scores WHERE id < 2").(*DeleteStmt).Plan(tbl)
+		if err != nil {
+			panic(err)
+		}
+		if got := execPlan(bufmgr, plan); len(got) != 2 {
+			t.Fatalf("len(records) = %v, want 2", len(got))
+		}
+	})
+
+	t.Run("異常系", func(t *testing.T) {
+		tests := []struct {
+			sql string
+			err error
+		}{
+			{"", ErrSqlSyntax},
+			{"DROP TABLE t", ErrSqlSyntax},
+			{"SELECT FROM t", ErrSqlSyntax},
+			{"SELECT id, FROM t", ErrSqlSyntax},
+			{"SELECT id AS FROM t", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a = 1 OR", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE (a = 1", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a NOT = 1", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a IN ()", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a LIKE 1", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a IN (1, NULL)", ErrInvalidCondition},
+			{"SELECT * FROM t WHERE a = 'abc", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a = 1 extra", ErrSqlSyntax},
+			{"SELECT * FROM t WHERE a = NULL", ErrInvalidCondition},
+			{`SELECT * FROM t WHERE "$or" = 1`, ErrInvalidCondition},
+			{`DELETE FROM t WHERE "$not" IS NULL`, ErrInvalidCondition},
+			{"INSERT INTO t VALUES (1, 2", ErrSqlSyntax},
+			{"UPDATE t SET a = b", ErrSqlSyntax},
+			{"CREATE TABLE t (a INT, b INT, PRIMARY KEY (b))", ErrSqlSyntax},
+			{"CREATE TABLE t (a DECIMAL)", table.ErrInvalidColType},
+			{"CREATE TABLE t ()", ErrSqlSyntax},
+		}
+		for _, tt := range tests {
+			if _, err := ParseSql(tt.sql); !xerrors.Is(err, tt.err) {
+				t.Fatalf("ParseSql(%q) = %v, want %v", tt.sql, err, tt.err)
+			}
+		}
+
+		_, parser := openDb("../query_test1.rly")
+		planTests := []struct {
+			sql string
+			err error
+		}{
+			{"SELECT * FROM students WHERE nothing = 1", ErrUnknownColumn},
+			{"SELECT id1, nothing FROM students", ErrUnknownColumn},
+			{"SELECT * FROM students WHERE id1 = '0001' OR NOT nothing IS NULL", ErrUnknownColumn},
+		}
+		for _, tt := range planTests {
+			stmt, err := ParseSql(tt.sql)
+			if err != nil {
+				panic(err)
+			}
+			if _, err := stmt.(*SelectStmt).Plan(parser.tbl); !xerrors.Is(err, tt.err) {
+				t.Fatalf("%s: Plan() = %v, want %v", tt.sql, err, tt.err)
+			}
+		}
+	})
+}
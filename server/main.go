@@ -9,21 +9,54 @@ import (
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
 	"my-relly-go/query"
+	"my-relly-go/table"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thoas/go-funk"
+	"golang.org/x/xerrors"
 )
 
 const DEFAULT_PORT int = 5646
 const DEFAULT_BUFFER_POOL_SIZE int = 100
+const DEFAULT_MAX_CONNECTIONS int = 100
+const DEFAULT_IDLE_TIMEOUT time.Duration = 2 * time.Minute
+
+// BEGINしてロックを持ったままコマンドが来なければ、この時間で切断してロールバックする
+// ロックを待つ時間の上限より短くしておき、止まったセッションのロックが、待っている書き込みが諦める前に外れるようにする
+const DEFAULT_TXN_IDLE_TIMEOUT time.Duration = 2 * time.Second
+
+// 他のセッションがロックしているページを書き換えるときに待つ時間の上限
+// BEGINしたまま止まっているセッションがあっても、他のセッションの書き込みが待ち続けないようにする
+const DEFAULT_LOCK_TIMEOUT time.Duration = 5 * time.Second
 
 var bufmgr *buffer.BufferPoolManager
-var parser *query.Parser
+var catalog *table.Catalog
+var idleTimeout time.Duration
+var txnIdleTimeout time.Duration
+var shutdown = make(chan struct{})
+
+// 接続中のクライアント
+// シャットダウン時に待ち受けを止めるため、接続を控えておく
+var clients = struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}{conns: map[net.Conn]struct{}{}}
 
 func main() {
 	port := flag.Int("p", DEFAULT_PORT, "Port no")
 	poolSize := flag.Int("l", DEFAULT_BUFFER_POOL_SIZE, "Buffer pool size")
+	maxConns := flag.Int("c", DEFAULT_MAX_CONNECTIONS, "Max connections")
+	flag.DurationVar(&idleTimeout, "t", DEFAULT_IDLE_TIMEOUT, "Idle timeout")
+	flag.DurationVar(&txnIdleTimeout, "T", DEFAULT_TXN_IDLE_TIMEOUT, "Idle timeout in a transaction holding locks")
+	lockTimeout := flag.Duration("w", DEFAULT_LOCK_TIMEOUT, "Lock wait timeout")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -31,46 +64,194 @@ func main() {
 		os.Exit(1)
 	}
 
-	bufmgr, parser = openDb(flag.Args()[0], *poolSize)
+	bufmgr, catalog = openDb(flag.Args()[0], *poolSize)
+	bufmgr.SetLockTimeout(*lockTimeout)
+	if *lockTimeout > 0 && txnIdleTimeout >= *lockTimeout {
+		log.Printf("Idle timeout in a transaction (%v) is not shorter than lock wait timeout (%v); an idle session can make other writers fail\n", txnIdleTimeout, *lockTimeout)
+	}
 
 	service := fmt.Sprintf(":%d", *port)
 	tcpAddr, err := net.ResolveTCPAddr("tcp4", service)
 	checkError(err)
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	checkError(err)
+
+	// SIGINT/SIGTERMを受けたら新しい接続を受け付けるのをやめる
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received %v, shutting down\n", sig)
+		close(shutdown)
+		listener.Close()
+	}()
+
 	log.Printf("Server start\n")
+	sem := make(chan struct{}, *maxConns)
+	// Acceptが失敗し続けても空回りしないよう、5msから1sまで倍々に待つ時間を延ばす
+	var acceptDelay time.Duration
+LOOP:
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-shutdown:
+				break LOOP
+			default:
+			}
+			acceptDelay *= 2
+			if acceptDelay == 0 {
+				acceptDelay = 5 * time.Millisecond
+			}
+			if acceptDelay > time.Second {
+				acceptDelay = time.Second
+			}
+			log.Printf("Accept: %v; retrying in %v\n", err, acceptDelay)
+			select {
+			case <-shutdown:
+				break LOOP
+			case <-time.After(acceptDelay):
+			}
+			continue
+		}
+		acceptDelay = 0
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			log.Printf("%s: Too many connections\n", conn.RemoteAddr())
+			conn.Write(errMsg("Too many connections"))
+			conn.Close()
 			continue
 		}
-		//go handleClient(conn)
-		handleClient(conn)
+		addClient(conn)
+		go func() {
+			defer func() { <-sem }()
+			defer removeClient(conn)
+			handleClient(conn)
+		}()
+	}
+
+	// 実行中のコマンドが終わったら読み込みを打ち切らせ、各接続の後始末を待つ
+	clients.Lock()
+	for conn := range clients.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	clients.Unlock()
+	clients.wg.Wait()
+
+	if err := bufmgr.Flush(); err != nil {
+		log.Printf("Flush: %v\n", err)
+		os.Exit(1)
+	}
+	log.Printf("Server stop\n")
+}
+
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
 	}
 }
 
+func addClient(conn net.Conn) {
+	clients.Lock()
+	defer clients.Unlock()
+	clients.conns[conn] = struct{}{}
+	clients.wg.Add(1)
+}
+
+func removeClient(conn net.Conn) {
+	clients.Lock()
+	defer clients.Unlock()
+	delete(clients.conns, conn)
+	clients.wg.Done()
+}
+
+// シャットダウン中でなければ読み込みの期限をtimeout後に延ばす
+func extendDeadline(conn net.Conn, timeout time.Duration) bool {
+	clients.Lock()
+	defer clients.Unlock()
+	if shuttingDown() {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	return true
+}
+
+// コマンドは1行ずつ受け付け、結果を1行で返す
+// BEGINしていなければ、書き換えるコマンドは1つずつトランザクションで実行してコミットする
+// 書き換えたページはコミットかロールバックまでロックし、同じページを書き換える他のセッションを待たせる
+// 検索はロックを取らないので、他のセッションがコミットしていない変更も見える（READ UNCOMMITTED）
 func handleClient(conn net.Conn) {
 	defer func() {
 		if err := conn.Close(); err != nil {
-			panic(err)
+			log.Printf("%s: %v\n", conn.RemoteAddr(), err)
 		}
 	}()
 
 	log.Printf("%s: Connected\n", conn.RemoteAddr())
-	//conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+	// BEGINしている間は、トランザクションに紐付いたBufferPoolManagerを使う
+	session := bufmgr
 	var executor query.Executor
+	// USEで選んだテーブル。テーブルが1つしかなければ最初から選んでおく
+	// 他のセッションがインデックスやテーブルを削除するかもしれないので、定義はコマンドごとにカタログから読み直す
+	tableName := ""
+	if names, err := catalog.ListTables(bufmgr); err == nil && len(names) == 1 {
+		tableName = names[0]
+	}
+	// 実行中のクエリのテーブルと、結果のカラム
+	var tbl *table.Table
+	var project *query.Project
+	// ロックを待つ相手とデッドロックしたら、コマンドをやり直しても相手のロックは外れないので、BEGINしたトランザクションごと取り消す
+	writeError := func(err error) {
+		if !xerrors.Is(err, buffer.ErrDeadlock) || !session.InTransaction() {
+			conn.Write(errMsg(err.Error()))
+			return
+		}
+		if executor != nil {
+			executor.Finish(session)
+			executor = nil
+		}
+		if err := session.Rollback(); err != nil {
+			log.Printf("%s: %v\n", conn.RemoteAddr(), err)
+		}
+		session = bufmgr
+		conn.Write(errMsg(err.Error() + "; transaction rolled back"))
+	}
 	defer func() {
 		if executor != nil {
-			executor.Finish(bufmgr)
+			executor.Finish(session)
+		}
+		if session.InTransaction() {
+			if err := session.Rollback(); err != nil {
+				log.Printf("%s: %v\n", conn.RemoteAddr(), err)
+			}
 		}
 	}()
 
 LOOP:
 	for {
+		// 一定時間コマンドが来なければ切断する
+		// ロックを持っていれば、他のセッションを待たせないよう短い時間で切断し、ロールバックする
+		timeout := idleTimeout
+		holdsLocks := session.HoldsLocks()
+		if holdsLocks {
+			timeout = txnIdleTimeout
+		}
+		if !extendDeadline(conn, timeout) {
+			break
+		}
 		request := make([]byte, 1024)
 		readLen, err := conn.Read(request)
 		if err != nil {
 			log.Printf("%s: %v\n", conn.RemoteAddr(), err)
+			var netErr net.Error
+			if holdsLocks && xerrors.As(err, &netErr) && netErr.Timeout() && !shuttingDown() {
+				conn.Write(errMsg("Transaction idle timeout; transaction rolled back"))
+			}
 			break
 		}
 		if readLen == 0 {
@@ -101,27 +282,89 @@ LOOP:
 			msg += "\n"
 			conn.Write([]byte(msg))
 
+		case "TABLES":
+			names, err := catalog.ListTables(session)
+			if err != nil {
+				conn.Write(errMsg(err.Error()))
+				continue
+			}
+			msg, err := json.Marshal(names)
+			if err != nil {
+				conn.Write(errMsg("JSON marshalize error"))
+				continue
+			}
+			conn.Write([]byte("OK " + string(msg) + "\n"))
+
+		case "USE":
+			if len(cmdItems) < 2 {
+				conn.Write(errMsg("Missing table name"))
+				continue
+			}
+			if _, err := catalog.OpenTable(session, cmdItems[1]); err != nil {
+				writeError(err)
+				continue
+			}
+			if executor != nil {
+				executor.Finish(session)
+				executor = nil
+			}
+			tableName = cmdItems[1]
+			conn.Write([]byte("OK\n"))
+
 		case "FIND":
+			// JSONの検索条件ならUSEで選んだテーブルを、SQLのSELECTならFROMのテーブルを検索する
 			if len(cmdItems) < 2 {
 				conn.Write(errMsg("Missing query string"))
 				continue
 			}
 
 			if executor != nil {
-				executor.Finish(bufmgr)
+				executor.Finish(session)
+				executor = nil
 			}
 
-			plan, err := parser.Parse(cmdItems[1])
+			tbl, project, executor, err = startQuery(session, tableName, cmdItems[1])
 			if err != nil {
-				conn.Write(errMsg(err.Error()))
+				writeError(err)
 				continue
 			}
-			executor, err = plan.Start(bufmgr)
+			conn.Write(columnsMsg(project))
+
+		case "SQL":
+			// SELECTはFINDと同じくNEXTで読み出す。それ以外は変更した件数を返す
+			if len(cmdItems) < 2 {
+				conn.Write(errMsg("Missing SQL statement"))
+				continue
+			}
+			stmt, err := query.ParseSql(cmdItems[1])
 			if err != nil {
 				conn.Write(errMsg(err.Error()))
 				continue
 			}
-			conn.Write([]byte("OK\n"))
+			if executor != nil {
+				executor.Finish(session)
+				executor = nil
+			}
+			if _, ok := stmt.(*query.SelectStmt); ok {
+				tbl, project, executor, err = startQuery(session, tableName, cmdItems[1])
+				if err != nil {
+					writeError(err)
+					continue
+				}
+				conn.Write(columnsMsg(project))
+				continue
+			}
+			n, err := execSql(session, stmt)
+			if err != nil {
+				writeError(err)
+				continue
+			}
+			switch stmt.(type) {
+			case *query.CreateTableStmt, *query.CreateIndexStmt:
+				conn.Write([]byte("OK\n"))
+			default:
+				conn.Write([]byte(fmt.Sprintf("OK %d\n", n)))
+			}
 
 		case "NEXT":
 			if executor == nil {
@@ -138,29 +381,38 @@ LOOP:
 				}
 			}
 
-			encodedRecords := [][]string{}
+			encodedRecords := [][]interface{}{}
 			eof := false
+			var nextErr error
 			for i := 0; i < limit; i++ {
-				record, err := executor.Next(bufmgr)
+				record, err := executor.Next(session)
+				if err == query.ErrEndOfIterator {
+					eof = true
+					break
+				}
 				if err != nil {
-					if err == query.ErrEndOfIterator {
-						eof = true
-						break
-					} else {
-						conn.Write(errMsg(err.Error()))
-						continue
-					}
+					nextErr = err
+					break
 				}
 
-				r := []string{}
-				for _, col := range record {
-					r = append(r, base64.StdEncoding.EncodeToString(col))
+				r, err := encodeRecord(tbl, project.Columns, record)
+				if err != nil {
+					nextErr = err
+					break
 				}
 				encodedRecords = append(encodedRecords, r)
 			}
+			// 失敗したら、読み出したレコードは返さずに検索を終える
+			if nextErr != nil {
+				executor.Finish(session)
+				executor = nil
+
+				conn.Write(errMsg(nextErr.Error()))
+				continue
+			}
 			if eof {
 				if len(encodedRecords) == 0 {
-					executor.Finish(bufmgr)
+					executor.Finish(session)
 					executor = nil
 
 					conn.Write([]byte("END\n"))
@@ -182,17 +434,456 @@ LOOP:
 				conn.Write(errMsg("Query doesn't running"))
 				continue
 			}
-			executor.Finish(bufmgr)
+			executor.Finish(session)
 			executor = nil
 
 			conn.Write([]byte("OK\n"))
 
+		case "INSERT":
+			if len(cmdItems) < 2 {
+				conn.Write(errMsg("Missing record"))
+				continue
+			}
+			if tableName == "" {
+				conn.Write(errMsg("No table selected"))
+				continue
+			}
+			var encodedRecord []interface{}
+			decoder := json.NewDecoder(strings.NewReader(cmdItems[1]))
+			decoder.UseNumber()
+			if err := decoder.Decode(&encodedRecord); err != nil {
+				conn.Write(errMsg(query.ErrJsonParse.Error()))
+				continue
+			}
+			_, err := insertRecords(session, tableName, func(tbl *table.Table) ([][][]byte, error) {
+				record, err := decodeRecord(tbl, encodedRecord)
+				if err != nil {
+					return nil, err
+				}
+				return [][][]byte{record}, nil
+			})
+			if err != nil {
+				writeError(err)
+				continue
+			}
+			conn.Write([]byte("OK 1\n"))
+
+		case "UPDATE":
+			if len(cmdItems) < 2 {
+				conn.Write(errMsg("Missing query string"))
+				continue
+			}
+			if tableName == "" {
+				conn.Write(errMsg("No table selected"))
+				continue
+			}
+			args := cmdItems[1]
+			n, err := updateRecords(session, tableName, func(tbl *table.Table) (query.PlanNode, map[int][]byte, error) {
+				cond, values, err := parseUpdateArgs(tbl, args)
+				if err != nil {
+					return nil, nil, err
+				}
+				plan, err := query.NewTableParser(tbl).ParseCondition(cond)
+				return plan, values, err
+			})
+			if err != nil {
+				writeError(err)
+				continue
+			}
+			conn.Write([]byte(fmt.Sprintf("OK %d\n", n)))
+
+		case "DELETE":
+			if len(cmdItems) < 2 {
+				conn.Write(errMsg("Missing query string"))
+				continue
+			}
+			if tableName == "" {
+				conn.Write(errMsg("No table selected"))
+				continue
+			}
+			cond := cmdItems[1]
+			n, err := deleteRecords(session, tableName, func(tbl *table.Table) (query.PlanNode, error) {
+				return query.NewTableParser(tbl).ParseCondition(cond)
+			})
+			if err != nil {
+				writeError(err)
+				continue
+			}
+			conn.Write([]byte(fmt.Sprintf("OK %d\n", n)))
+
+		case "DROP":
+			// DROP TABLE テーブル名 / DROP INDEX インデックス名（USEで選んだテーブルのもの）
+			args := []string{}
+			if len(cmdItems) >= 2 {
+				args = strings.Fields(cmdItems[1])
+			}
+			if len(args) != 2 || (args[0] != "TABLE" && args[0] != "INDEX") {
+				conn.Write(errMsg("Invalid argument"))
+				continue
+			}
+			if args[0] == "INDEX" && tableName == "" {
+				conn.Write(errMsg("No table selected"))
+				continue
+			}
+			if executor != nil {
+				executor.Finish(session)
+				executor = nil
+			}
+			if args[0] == "TABLE" {
+				err = catalog.DropTable(session, args[1])
+			} else {
+				err = dropIndex(session, tableName, args[1])
+			}
+			if err != nil {
+				writeError(err)
+				continue
+			}
+			if args[0] == "TABLE" && args[1] == tableName {
+				tableName = ""
+			}
+			conn.Write([]byte("OK\n"))
+
+		case "BEGIN":
+			if session.InTransaction() {
+				conn.Write(errMsg("Transaction already started"))
+				continue
+			}
+			// 書き換えたページはCOMMITかROLLBACKまでロックし、他のセッションが書き換えようとすると待たせる
+			// ロックを持ったまま一定時間コマンドが来なければ、切断してロールバックする
+			// 他のセッションの検索には、COMMITする前の変更も見える
+			tx, err := bufmgr.Begin()
+			if err != nil {
+				conn.Write(errMsg(err.Error()))
+				continue
+			}
+			session = tx
+			conn.Write([]byte("OK\n"))
+
+		case "COMMIT", "ROLLBACK":
+			if !session.InTransaction() {
+				conn.Write(errMsg("Transaction doesn't started"))
+				continue
+			}
+			if executor != nil {
+				executor.Finish(session)
+				executor = nil
+			}
+
+			if cmdItems[0] == "COMMIT" {
+				err = session.Commit()
+			} else {
+				err = session.Rollback()
+			}
+			session = bufmgr
+			if err != nil {
+				conn.Write(errMsg(err.Error()))
+				continue
+			}
+			conn.Write([]byte("OK\n"))
+
 		default:
 			conn.Write(errMsg("Unknown command"))
 		}
 	}
 }
 
+// バイト列のカラムはbase64で、それ以外のカラムはJSONの値でやりとりする
+// タイムスタンプはRFC3339の文字列、NULLはnull
+// record[i]はテーブルのcolumns[i]番目のカラム
+func encodeRecord(tbl *table.Table, columns []int, record [][]byte) ([]interface{}, error) {
+	r := []interface{}{}
+	for i, buf := range record {
+		col := columns[i]
+		if buf != nil && tbl.ColType(col) == table.COL_TYPE_BYTES {
+			r = append(r, base64.StdEncoding.EncodeToString(buf))
+			continue
+		}
+		v, err := table.DecodeValue(tbl.ColType(col), buf)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, v)
+	}
+	return r, nil
+}
+
+func decodeValue(tbl *table.Table, col int, encodedValue interface{}) ([]byte, error) {
+	if encodedValue != nil && tbl.ColType(col) == table.COL_TYPE_BYTES {
+		s, ok := encodedValue.(string)
+		if !ok {
+			return nil, xerrors.New("Invalid base64 string")
+		}
+		value, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, xerrors.New("Invalid base64 string")
+		}
+		return value, nil
+	}
+	value, err := table.EncodeValue(tbl.ColType(col), encodedValue)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid %s value for column %d", tbl.ColType(col), col)
+	}
+	return value, nil
+}
+
+func decodeRecord(tbl *table.Table, encodedRecord []interface{}) ([][]byte, error) {
+	if len(encodedRecord) != tbl.NumCols {
+		return nil, xerrors.New("Invalid number of columns")
+	}
+	record := [][]byte{}
+	for col, encodedCol := range encodedRecord {
+		value, err := decodeValue(tbl, col, encodedCol)
+		if err != nil {
+			return nil, err
+		}
+		record = append(record, value)
+	}
+	return record, nil
+}
+
+// "{検索条件} {カラム: 新しい値}" を分解する
+// 新しい値はencodeRecordと同じ形式
+func parseUpdateArgs(tbl *table.Table, args string) (string, map[int][]byte, error) {
+	decoder := json.NewDecoder(strings.NewReader(args))
+	decoder.UseNumber()
+	var cond json.RawMessage
+	var encodedValues map[string]interface{}
+	if err := decoder.Decode(&cond); err != nil {
+		return "", nil, query.ErrJsonParse
+	}
+	if err := decoder.Decode(&encodedValues); err != nil {
+		return "", nil, query.ErrJsonParse
+	}
+
+	values := map[int][]byte{}
+	for colStr, encodedValue := range encodedValues {
+		col := funk.IndexOf(tbl.ColNames, colStr)
+		if col < 0 {
+			var err error
+			col, err = strconv.Atoi(colStr)
+			if err != nil || col < 0 || tbl.NumCols <= col {
+				return "", nil, xerrors.Errorf("Unknown column: %s", colStr)
+			}
+		}
+		value, err := decodeValue(tbl, col, encodedValue)
+		if err != nil {
+			return "", nil, err
+		}
+		values[col] = value
+	}
+	return string(cond), values, nil
+}
+
+// 検索を始める。SQLのSELECTならFROMのテーブルを、JSONの検索条件ならtableNameのテーブルを検索する
+// 結果のカラムを返すため、プランの一番手前は必ずProjectにする
+func startQuery(session *buffer.BufferPoolManager, tableName string, cond string) (*table.Table, *query.Project, query.Executor, error) {
+	var plan query.PlanNode
+	var tbl *table.Table
+	var err error
+	cond = strings.TrimSpace(cond)
+	if strings.HasPrefix(cond, "{") {
+		if tableName == "" {
+			return nil, nil, nil, xerrors.New("No table selected")
+		}
+		tbl, err = catalog.OpenTable(session, tableName)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		plan, err = query.NewTableParser(tbl).Parse(cond)
+	} else {
+		var stmt query.Statement
+		stmt, err = query.ParseSql(cond)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		selectStmt, ok := stmt.(*query.SelectStmt)
+		if !ok {
+			return nil, nil, nil, xerrors.New("Not a SELECT statement")
+		}
+		tbl, err = catalog.OpenTable(session, selectStmt.Table)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		plan, err = selectStmt.Plan(tbl)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	project, ok := plan.(*query.Project)
+	if !ok {
+		project = &query.Project{InnerPlan: plan}
+		for col := 0; col < tbl.NumCols; col++ {
+			project.Columns = append(project.Columns, col)
+			name := strconv.Itoa(col)
+			if col < len(tbl.ColNames) {
+				name = tbl.ColNames[col]
+			}
+			project.Names = append(project.Names, name)
+		}
+	}
+	executor, err := project.Start(session)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return tbl, project, executor, nil
+}
+
+// 検索を始めたときの応答。結果のカラム名を付ける
+func columnsMsg(project *query.Project) []byte {
+	msg, err := json.Marshal(project.Names)
+	if err != nil {
+		return errMsg("JSON marshalize error")
+	}
+	return []byte(fmt.Sprintf("OK %s\n", msg))
+}
+
+// SELECT以外のSQLを実行し、変更したレコードの件数を返す
+func execSql(session *buffer.BufferPoolManager, stmt query.Statement) (int, error) {
+	switch stmt := stmt.(type) {
+	case *query.InsertStmt:
+		return insertRecords(session, stmt.Table, stmt.Records)
+	case *query.UpdateStmt:
+		return updateRecords(session, stmt.Table, func(tbl *table.Table) (query.PlanNode, map[int][]byte, error) {
+			values, err := stmt.EncodedValues(tbl)
+			if err != nil {
+				return nil, nil, err
+			}
+			plan, err := stmt.Plan(tbl)
+			return plan, values, err
+		})
+	case *query.DeleteStmt:
+		return deleteRecords(session, stmt.Table, stmt.Plan)
+	case *query.CreateTableStmt:
+		return 0, catalog.CreateTable(session, stmt.Table)
+	case *query.CreateIndexStmt:
+		return 0, session.Transaction(func(tx *buffer.BufferPoolManager) error {
+			tbl, err := catalog.OpenTable(tx, stmt.Table)
+			if err != nil {
+				return err
+			}
+			skey, err := stmt.SKey(tbl)
+			if err != nil {
+				return err
+			}
+			return catalog.AddIndex(tx, tbl, stmt.Kind(), stmt.Name, skey)
+		})
+	}
+	return 0, xerrors.New("Unsupported statement")
+}
+
+// 条件に合うレコードを先にすべて集めてから書き換える
+func findRecords(bufmgr *buffer.BufferPoolManager, plan query.PlanNode) ([]query.Tuple, error) {
+	executor, err := plan.Start(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	defer executor.Finish(bufmgr)
+
+	records := []query.Tuple{}
+	for {
+		record, err := executor.Next(bufmgr)
+		if err == query.ErrEndOfIterator {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// テーブルの定義の読み直しから書き込みまでを1つのトランザクションで行い、
+// その間に他のセッションがインデックスやテーブルを削除しないようにする
+// 挿入するレコードや検索するプランは、読み直した定義をもとにbuildで作る
+func insertRecords(session *buffer.BufferPoolManager, tableName string, build func(tbl *table.Table) ([][][]byte, error)) (int, error) {
+	n := 0
+	err := session.Transaction(func(tx *buffer.BufferPoolManager) error {
+		tbl, err := catalog.OpenTable(tx, tableName)
+		if err != nil {
+			return err
+		}
+		records, err := build(tbl)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := tbl.Insert(tx, record); err != nil {
+				return err
+			}
+		}
+		n = len(records)
+		return nil
+	})
+	return n, err
+}
+
+func updateRecords(session *buffer.BufferPoolManager, tableName string, build func(tbl *table.Table) (query.PlanNode, map[int][]byte, error)) (int, error) {
+	n := 0
+	err := session.Transaction(func(tx *buffer.BufferPoolManager) error {
+		tbl, err := catalog.OpenTable(tx, tableName)
+		if err != nil {
+			return err
+		}
+		plan, values, err := build(tbl)
+		if err != nil {
+			return err
+		}
+		records, err := findRecords(tx, plan)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			newRecord := make([][]byte, len(record))
+			copy(newRecord, record)
+			for col, value := range values {
+				newRecord[col] = value
+			}
+			if err := tbl.Update(tx, record, newRecord); err != nil {
+				return err
+			}
+		}
+		n = len(records)
+		return nil
+	})
+	return n, err
+}
+
+func deleteRecords(session *buffer.BufferPoolManager, tableName string, build func(tbl *table.Table) (query.PlanNode, error)) (int, error) {
+	n := 0
+	err := session.Transaction(func(tx *buffer.BufferPoolManager) error {
+		tbl, err := catalog.OpenTable(tx, tableName)
+		if err != nil {
+			return err
+		}
+		plan, err := build(tbl)
+		if err != nil {
+			return err
+		}
+		records, err := findRecords(tx, plan)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := tbl.Delete(tx, record); err != nil {
+				return err
+			}
+		}
+		n = len(records)
+		return nil
+	})
+	return n, err
+}
+
+func dropIndex(session *buffer.BufferPoolManager, tableName string, indexName string) error {
+	return session.Transaction(func(tx *buffer.BufferPoolManager) error {
+		tbl, err := catalog.OpenTable(tx, tableName)
+		if err != nil {
+			return err
+		}
+		return catalog.DropIndex(tx, tbl, indexName)
+	})
+}
+
 func errMsg(msg string) []byte {
 	return []byte("ERROR " + msg + "\n")
 }
@@ -204,18 +895,18 @@ func checkError(err error) {
 	}
 }
 
-func openDb(fileName string, poolSize int) (*buffer.BufferPoolManager, *query.Parser) {
-	diskManager, err := disk.OpenDiskManager(fileName)
+func openDb(fileName string, poolSize int) (*buffer.BufferPoolManager, *table.Catalog) {
+	diskManager, err := disk.OpenDiskManagerWithMode(fileName, disk.OPEN_MODE_READ_WRITE)
 	if err != nil {
 		panic(err)
 	}
 	pool := buffer.NewBufferPool(poolSize)
 	bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
 
-	parser, err := query.NewParser(bufmgr)
+	catalog, err := table.OpenCatalog(bufmgr)
 	if err != nil {
 		panic(err)
 	}
 
-	return bufmgr, parser
+	return bufmgr, catalog
 }
@@ -0,0 +1,293 @@
+package table
+
+import (
+	"bytes"
+	"io"
+
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+	"my-relly-go/memcmpable"
+
+	"golang.org/x/xerrors"
+)
+
+// カタログはデータベースの先頭のページに置くB+tree
+// テーブル名をキーに、テーブルの定義（Meta）を値として持つ
+const CATALOG_META_PAGE_ID = disk.PageId(0)
+
+var catalogMagic = []byte("RLYGOCAT")
+
+var (
+	ErrNoCatalog        = xerrors.New("catalog not found")
+	ErrDatabaseNotEmpty = xerrors.New("database is not empty")
+	ErrEmptyTableName   = xerrors.New("table name is empty")
+	ErrTableExists      = xerrors.New("table already exists")
+	ErrTableNotFound    = xerrors.New("table not found")
+)
+
+type Catalog struct {
+	tree *btree.BTree
+}
+
+// 空のデータベースに最初に作成する
+func CreateCatalog(bufmgr *buffer.BufferPoolManager) (*Catalog, error) {
+	var catalog *Catalog
+	err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		tree, err := btree.CreateBTree(bufmgr)
+		if err != nil {
+			return err
+		}
+		if tree.MetaPageId != CATALOG_META_PAGE_ID {
+			return ErrDatabaseNotEmpty
+		}
+		if err := tree.WriteMetaAppArea(bufmgr, catalogMagic); err != nil {
+			return err
+		}
+		catalog = &Catalog{tree}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 空のデータベースなので、古いバージョンのファイルでも移行するタプルはない
+	if bufmgr.DiskManager().Version() < disk.HEAP_FILE_VERSION_NULL {
+		if err := bufmgr.DiskManager().UpgradeVersion(); err != nil {
+			return nil, err
+		}
+	}
+	return catalog, nil
+}
+
+func OpenCatalog(bufmgr *buffer.BufferPoolManager) (*Catalog, error) {
+	tree := btree.NewBTree(CATALOG_META_PAGE_ID)
+	buf, err := tree.ReadMetaAppArea(bufmgr)
+	if err != nil {
+		if xerrors.Is(err, io.EOF) {
+			return nil, ErrNoCatalog
+		}
+		return nil, err
+	}
+	if !bytes.Equal(buf, catalogMagic) {
+		return nil, ErrNoCatalog
+	}
+	catalog := &Catalog{tree}
+	if bufmgr.DiskManager().Version() < disk.HEAP_FILE_VERSION_NULL {
+		if err := catalog.migrate(bufmgr); err != nil {
+			return nil, xerrors.Errorf("migrate tuples to the current format: %w", err)
+		}
+	}
+	return catalog, nil
+}
+
+// NULLを加える前の形式で書かれたタプルを、今の形式に書き換える
+// テーブルごとにトランザクションを分け、カタログのメタのバージョンを進捗として書き換える
+// 途中でクラッシュしても、次に開いたときに残りのテーブルから続ける
+func (c *Catalog) migrate(bufmgr *buffer.BufferPoolManager) error {
+	if bufmgr.DiskManager().Mode() == disk.OPEN_MODE_READ_ONLY {
+		return disk.ErrReadOnly
+	}
+	tables, keysMigrated, err := c.legacyTables(bufmgr)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+			// カタログのキーは、最初に移行したテーブルと一緒に書き換える
+			if !keysMigrated {
+				if err := c.tree.RewritePairs(bufmgr, memcmpable.MigrateLegacy, nil); err != nil {
+					return err
+				}
+			}
+			if err := t.migrate(bufmgr); err != nil {
+				return err
+			}
+			return c.updateTable(bufmgr, t)
+		})
+		if err != nil {
+			return err
+		}
+		keysMigrated = true
+	}
+	return bufmgr.DiskManager().UpgradeVersion()
+}
+
+// 移行していないテーブルと、カタログのキーを移行済みかどうかを返す
+// 移行したテーブルのメタは今のバージョンになっているので、1つでもあればキーは移行済み
+func (c *Catalog) legacyTables(bufmgr *buffer.BufferPoolManager) ([]*Table, bool, error) {
+	iter, err := c.tree.Search(bufmgr, &btree.SearchModeStart{})
+	if err != nil {
+		return nil, false, err
+	}
+	defer iter.Finish(bufmgr)
+
+	tables := []*Table{}
+	keysMigrated := false
+	for {
+		_, v, err := iter.Next(bufmgr)
+		if err == btree.ErrEndOfIterator {
+			return tables, keysMigrated, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		meta := NewMetaFromBytes(v)
+		if meta.Version >= META_VERSION_NULLABLE {
+			keysMigrated = true
+			continue
+		}
+		tables = append(tables, newTableFromMeta(disk.PageId(meta.MetaPageId), meta))
+	}
+}
+
+func encodeTableName(name string) []byte {
+	return EncodeTuple([][]byte{[]byte(name)})
+}
+
+// テーブルを書き換えるトランザクションと、テーブルやインデックスを作成・削除する操作が並行しないよう、カタログのmetaページをロックする
+// 前者は共有ロック、後者は排他ロックをトランザクションが終わるまで保持する
+// ラッチを保持していないときに呼ぶので、他のトランザクションがロックしていれば外れるまで待つ
+func (c *Catalog) lock(bufmgr *buffer.BufferPoolManager, exclusive bool) error {
+	for {
+		var err error
+		if exclusive {
+			err = bufmgr.LockPage(c.tree.MetaPageId)
+		} else {
+			err = bufmgr.LockPageShared(c.tree.MetaPageId)
+		}
+		var locked *buffer.PageLockedError
+		if !xerrors.As(err, &locked) {
+			return err
+		}
+		if err := bufmgr.WaitPageLock(locked); err != nil {
+			return err
+		}
+	}
+}
+
+// t.Nameの名前でテーブルを作成し、カタログに登録する
+func (c *Catalog) CreateTable(bufmgr *buffer.BufferPoolManager, t *Table) error {
+	if t.Name == "" {
+		return ErrEmptyTableName
+	}
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		if err := c.lock(bufmgr, true); err != nil {
+			return err
+		}
+		if err := t.Create(bufmgr); err != nil {
+			return err
+		}
+		err := c.tree.Insert(bufmgr, encodeTableName(t.Name), t.toMeta().ToBytes())
+		if err == btree.ErrDuplicateKey {
+			return ErrTableExists
+		}
+		return err
+	})
+}
+
+// トランザクション中に開いたテーブルは、トランザクションが終わるまで他のトランザクションに削除させない
+func (c *Catalog) OpenTable(bufmgr *buffer.BufferPoolManager, name string) (*Table, error) {
+	if err := c.lock(bufmgr, false); err != nil {
+		return nil, err
+	}
+	key := encodeTableName(name)
+	iter, err := c.tree.Search(bufmgr, &btree.SearchModeKey{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Finish(bufmgr)
+
+	k, v, err := iter.Get(bufmgr)
+	if err == btree.ErrEndOfIterator || (err == nil && !bytes.Equal(k, key)) {
+		return nil, ErrTableNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := NewMetaFromBytes(v)
+	return newTableFromMeta(disk.PageId(meta.MetaPageId), meta), nil
+}
+
+// テーブル名を昇順に返す
+func (c *Catalog) ListTables(bufmgr *buffer.BufferPoolManager) ([]string, error) {
+	iter, err := c.tree.Search(bufmgr, &btree.SearchModeStart{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Finish(bufmgr)
+
+	names := []string{}
+	for {
+		k, _, err := iter.Next(bufmgr)
+		if err == btree.ErrEndOfIterator {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, string(DecodeTuple(k, [][]byte{})[0]))
+	}
+}
+
+// カタログから登録を外し、テーブルとインデックスのページを解放する
+func (c *Catalog) DropTable(bufmgr *buffer.BufferPoolManager, name string) error {
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		if err := c.lock(bufmgr, true); err != nil {
+			return err
+		}
+		t, err := c.OpenTable(bufmgr, name)
+		if err != nil {
+			return err
+		}
+		if err := c.tree.Delete(bufmgr, encodeTableName(name)); err != nil {
+			return err
+		}
+		return t.Drop(bufmgr)
+	})
+}
+
+// テーブルにインデックスを追加し、カタログの定義も書き換える
+func (c *Catalog) AddIndex(bufmgr *buffer.BufferPoolManager, t *Table, kind IndexKind, name string, skey []int) error {
+	uniqueIndices, secondaryIndices := t.UniqueIndices, t.SecondaryIndices
+	err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		if err := c.lock(bufmgr, true); err != nil {
+			return err
+		}
+		if err := t.AddIndex(bufmgr, kind, name, skey); err != nil {
+			return err
+		}
+		return c.updateTable(bufmgr, t)
+	})
+	if err != nil {
+		t.UniqueIndices, t.SecondaryIndices = uniqueIndices, secondaryIndices
+		return err
+	}
+	return nil
+}
+
+func (c *Catalog) updateTable(bufmgr *buffer.BufferPoolManager, t *Table) error {
+	err := c.tree.Update(bufmgr, encodeTableName(t.Name), t.toMeta().ToBytes())
+	if err == btree.ErrKeyNotFound {
+		return ErrTableNotFound
+	}
+	return err
+}
+
+// インデックスのページを解放し、カタログの定義も書き換える
+func (c *Catalog) DropIndex(bufmgr *buffer.BufferPoolManager, t *Table, name string) error {
+	uniqueIndices, secondaryIndices := t.UniqueIndices, t.SecondaryIndices
+	err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		if err := c.lock(bufmgr, true); err != nil {
+			return err
+		}
+		if err := t.DropIndex(bufmgr, name); err != nil {
+			return err
+		}
+		return c.updateTable(bufmgr, t)
+	})
+	if err != nil {
+		t.UniqueIndices, t.SecondaryIndices = uniqueIndices, secondaryIndices
+		return err
+	}
+	return nil
+}
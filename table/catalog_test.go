@@ -0,0 +1,495 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+func TestCatalog(t *testing.T) {
+	createHeapFile := func() (string, func()) {
+		file, err := ioutil.TempFile("", "TestCatalog")
+		if err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+		return file.Name(), func() {
+			if err := os.Remove(file.Name()); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+				panic(err)
+			}
+		}
+	}
+	openBufferPoolManager := func(heapFilePath string, mode disk.OpenMode) (*buffer.BufferPoolManager, func()) {
+		diskManager, err := disk.OpenDiskManagerWithMode(heapFilePath, mode)
+		if err != nil {
+			panic(err)
+		}
+		pool := buffer.NewBufferPool(10)
+		bufmgr := buffer.NewBufferPoolManager(diskManager, pool)
+		return bufmgr, func() {
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+			if err := diskManager.Close(); err != nil {
+				panic(err)
+			}
+		}
+	}
+	newTable := func(name string) *Table {
+		return &Table{
+			Name:        name,
+			NumCols:     3,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "first_name", "last_name"},
+			UniqueIndices: []UniqueIndex{
+				{SKey: []int{2}},
+				{Name: "full_name", SKey: []int{1, 2}},
+			},
+		}
+	}
+
+	t.Run("正常系", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		catalog, err := CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		for _, name := range []string{"users", "accounts", "groups"} {
+			if err := catalog.CreateTable(bufmgr, newTable(name)); err != nil {
+				panic(err)
+			}
+		}
+		users, err := catalog.OpenTable(bufmgr, "users")
+		if err != nil {
+			panic(err)
+		}
+		if err := users.Insert(bufmgr, [][]byte{[]byte("z"), []byte("Alice"), []byte("Smith")}); err != nil {
+			panic(err)
+		}
+		closeDb()
+
+		// 開き直してもテーブルの定義を引ける
+		bufmgr, closeDb = openBufferPoolManager(heapFilePath, disk.OPEN_MODE_READ_WRITE)
+		defer closeDb()
+		catalog, err = OpenCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		names, err := catalog.ListTables(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if expect := []string{"accounts", "groups", "users"}; !reflect.DeepEqual(names, expect) {
+			t.Fatalf("catalog.ListTables() = %v, want %v", names, expect)
+		}
+
+		users2, err := catalog.OpenTable(bufmgr, "users")
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(users2, users) {
+			t.Fatalf("catalog.OpenTable() = %v, want %v", users2, users)
+		}
+		if index, err := users2.UniqueIndex("last_name"); err != nil || !reflect.DeepEqual(index.SKey, []int{2}) {
+			t.Fatalf("users2.UniqueIndex() = %v, %v, want SKey [2]", index, err)
+		}
+		if _, err := users2.UniqueIndex("first_name"); err != ErrIndexNotFound {
+			t.Fatalf("users2.UniqueIndex() = %v, want ErrIndexNotFound", err)
+		}
+		if err := users2.Insert(bufmgr, [][]byte{[]byte("y"), []byte("Bob"), []byte("Smith")}); err != btree.ErrDuplicateKey {
+			t.Fatalf("users2.Insert() = %v, want ErrDuplicateKey", err)
+		}
+
+		if err := catalog.DropTable(bufmgr, "groups"); err != nil {
+			panic(err)
+		}
+		if _, err := catalog.OpenTable(bufmgr, "groups"); err != ErrTableNotFound {
+			t.Fatalf("catalog.OpenTable() = %v, want ErrTableNotFound", err)
+		}
+		if err := catalog.DropTable(bufmgr, "groups"); err != ErrTableNotFound {
+			t.Fatalf("catalog.DropTable() = %v, want ErrTableNotFound", err)
+		}
+		names, err = catalog.ListTables(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if expect := []string{"accounts", "users"}; !reflect.DeepEqual(names, expect) {
+			t.Fatalf("catalog.ListTables() = %v, want %v", names, expect)
+		}
+	})
+
+	t.Run("異常系", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		defer closeDb()
+
+		// カタログのないデータベース
+		if _, err := OpenCatalog(bufmgr); err != ErrNoCatalog {
+			t.Fatalf("OpenCatalog() = %v, want ErrNoCatalog", err)
+		}
+		if err := newTable("").Create(bufmgr); err != nil {
+			panic(err)
+		}
+		if _, err := OpenCatalog(bufmgr); err != ErrNoCatalog {
+			t.Fatalf("OpenCatalog() = %v, want ErrNoCatalog", err)
+		}
+		if _, err := CreateCatalog(bufmgr); err != ErrDatabaseNotEmpty {
+			t.Fatalf("CreateCatalog() = %v, want ErrDatabaseNotEmpty", err)
+		}
+	})
+
+	t.Run("CreateTable: 作成できない", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		defer closeDb()
+		catalog, err := CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if err := catalog.CreateTable(bufmgr, newTable("users")); err != nil {
+			panic(err)
+		}
+		if err := catalog.CreateTable(bufmgr, newTable("users")); err != ErrTableExists {
+			t.Fatalf("catalog.CreateTable() = %v, want ErrTableExists", err)
+		}
+		if err := catalog.CreateTable(bufmgr, newTable("")); err != ErrEmptyTableName {
+			t.Fatalf("catalog.CreateTable() = %v, want ErrEmptyTableName", err)
+		}
+		tbl := newTable("accounts")
+		tbl.UniqueIndices[1].Name = "last_name"
+		if err := catalog.CreateTable(bufmgr, tbl); err != ErrDuplicateIndexName {
+			t.Fatalf("catalog.CreateTable() = %v, want ErrDuplicateIndexName", err)
+		}
+		names, err := catalog.ListTables(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if expect := []string{"users"}; !reflect.DeepEqual(names, expect) {
+			t.Fatalf("catalog.ListTables() = %v, want %v", names, expect)
+		}
+	})
+
+	t.Run("AddIndex", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		defer closeDb()
+		catalog, err := CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		users := newTable("users")
+		if err := catalog.CreateTable(bufmgr, users); err != nil {
+			panic(err)
+		}
+		if err := users.Insert(bufmgr, [][]byte{[]byte("z"), []byte("Alice"), []byte("Smith")}); err != nil {
+			panic(err)
+		}
+		if err := catalog.AddIndex(bufmgr, users, INDEX_KIND_SECONDARY, "", []int{1}); err != nil {
+			panic(err)
+		}
+		if err := catalog.AddIndex(bufmgr, users, INDEX_KIND_UNIQUE, "", []int{1}); err != ErrDuplicateIndexName {
+			t.Fatalf("catalog.AddIndex() = %v, want ErrDuplicateIndexName", err)
+		}
+
+		// カタログから開いたテーブルにも追加したインデックスがある
+		users2, err := catalog.OpenTable(bufmgr, "users")
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(users2, users) {
+			t.Fatalf("catalog.OpenTable() = %v, want %v", users2, users)
+		}
+		if _, err := users2.SecondaryIndex("first_name"); err != nil {
+			t.Fatalf("users2.SecondaryIndex() = %v", err)
+		}
+	})
+
+	t.Run("DropTable/DropIndex", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		defer closeDb()
+		catalog, err := CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		createTable := func(name string) *Table {
+			tbl := newTable(name)
+			if err := catalog.CreateTable(bufmgr, tbl); err != nil {
+				panic(err)
+			}
+			for i := 0; i < 500; i++ {
+				id := []byte(fmt.Sprintf("%04d", i))
+				if err := tbl.Insert(bufmgr, [][]byte{id, bytes.Repeat(id, 20), bytes.Repeat(id, 30)}); err != nil {
+					panic(err)
+				}
+			}
+			return tbl
+		}
+		fileSize := func() int64 {
+			if err := bufmgr.Flush(); err != nil {
+				panic(err)
+			}
+			stat, err := os.Stat(heapFilePath)
+			if err != nil {
+				panic(err)
+			}
+			return stat.Size()
+		}
+
+		createTable("accounts")
+		users := createTable("users")
+		size := fileSize()
+
+		// 削除したテーブルのページは、次に作るテーブルで再利用される
+		if err := catalog.DropTable(bufmgr, "accounts"); err != nil {
+			panic(err)
+		}
+		createTable("groups")
+		if size2 := fileSize(); size2 != size {
+			t.Fatalf("file size = %v, want %v", size2, size)
+		}
+
+		if err := catalog.DropIndex(bufmgr, users, "full_name"); err != nil {
+			panic(err)
+		}
+		if err := catalog.DropIndex(bufmgr, users, "full_name"); err != ErrIndexNotFound {
+			t.Fatalf("catalog.DropIndex() = %v, want ErrIndexNotFound", err)
+		}
+		users2, err := catalog.OpenTable(bufmgr, "users")
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(users2, users) || len(users2.UniqueIndices) != 1 {
+			t.Fatalf("catalog.OpenTable() = %v, want %v", users2, users)
+		}
+	})
+	t.Run("DropTable: 書き換え中のテーブル", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		defer closeDb()
+		catalog, err := CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if err := catalog.CreateTable(bufmgr, newTable("users")); err != nil {
+			panic(err)
+		}
+
+		// トランザクション中に開いたテーブルは、コミットするまで削除されない
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		users, err := catalog.OpenTable(tx, "users")
+		if err != nil {
+			panic(err)
+		}
+		if err := users.Insert(tx, [][]byte{[]byte("1"), []byte("Alice"), []byte("Smith")}); err != nil {
+			panic(err)
+		}
+		done := make(chan error)
+		go func() {
+			done <- catalog.DropTable(bufmgr, "users")
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("catalog.DropTable() = %v while another transaction writes the table", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err := tx.Commit(); err != nil {
+			panic(err)
+		}
+		if err := <-done; err != nil {
+			panic(err)
+		}
+		if _, err := catalog.OpenTable(bufmgr, "users"); err != ErrTableNotFound {
+			t.Fatalf("catalog.OpenTable() = %v, want ErrTableNotFound", err)
+		}
+
+		// 待つ時間の上限を過ぎたら諦める
+		if err := catalog.CreateTable(bufmgr, newTable("users")); err != nil {
+			panic(err)
+		}
+		tx, err = bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		if _, err := catalog.OpenTable(tx, "users"); err != nil {
+			panic(err)
+		}
+		bufmgr.SetLockTimeout(10 * time.Millisecond)
+		if err := catalog.DropTable(bufmgr, "users"); err != buffer.ErrLockTimeout {
+			t.Fatalf("catalog.DropTable() = %v, want ErrLockTimeout", err)
+		}
+		bufmgr.SetLockTimeout(0)
+		if err := tx.Rollback(); err != nil {
+			panic(err)
+		}
+	})
+
+	t.Run("古いバージョン", func(t *testing.T) {
+		heapFilePath, cleanup := createHeapFile()
+		defer cleanup()
+
+		// 複数のブロックにまたがる値と、ブランチができる数のレコードを入れる
+		bufmgr, closeDb := openBufferPoolManager(heapFilePath, disk.OPEN_MODE_CREATE)
+		catalog, err := CreateCatalog(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		for _, name := range []string{"users", "accounts"} {
+			if err := catalog.CreateTable(bufmgr, newTable(name)); err != nil {
+				panic(err)
+			}
+		}
+		users, err := catalog.OpenTable(bufmgr, "users")
+		if err != nil {
+			panic(err)
+		}
+		for i := 0; i < 300; i++ {
+			record := [][]byte{[]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("Christopher%04d", i)), []byte(fmt.Sprintf("Smith%d", i))}
+			if err := users.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		dumpTree := func(bufmgr *buffer.BufferPoolManager, metaPageId disk.PageId) [][][]byte {
+			iter, err := btree.NewBTree(metaPageId).Search(bufmgr, &btree.SearchModeStart{})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+			pairs := [][][]byte{}
+			for {
+				k, v, err := iter.Next(bufmgr)
+				if err == btree.ErrEndOfIterator {
+					return pairs
+				}
+				if err != nil {
+					panic(err)
+				}
+				pairs = append(pairs, append(DecodeTuple(k, [][]byte{}), DecodeTuple(v, [][]byte{})...))
+			}
+		}
+		metaPageIds := []disk.PageId{users.MetaPageId, users.UniqueIndices[0].MetaPageId, users.UniqueIndices[1].MetaPageId}
+		expects := [][][][]byte{}
+		for _, metaPageId := range metaPageIds {
+			expects = append(expects, dumpTree(bufmgr, metaPageId))
+		}
+
+		// NULLを加える前の形式に戻し、バージョン2のファイルにする
+		toLegacy := func(src []byte) []byte {
+			dst := append([]byte{}, src...)
+			for i := 8; i < len(dst); i += 9 {
+				dst[i]--
+			}
+			return dst
+		}
+		for _, metaPageId := range metaPageIds {
+			if err := btree.NewBTree(metaPageId).RewritePairs(bufmgr, toLegacy, toLegacy); err != nil {
+				panic(err)
+			}
+		}
+		for _, name := range []string{"users", "accounts"} {
+			tbl, err := catalog.OpenTable(bufmgr, name)
+			if err != nil {
+				panic(err)
+			}
+			meta := tbl.toMeta()
+			meta.Version = META_VERSION_CATALOG
+			if err := catalog.tree.Update(bufmgr, encodeTableName(name), meta.ToBytes()); err != nil {
+				panic(err)
+			}
+		}
+		if err := catalog.tree.RewritePairs(bufmgr, toLegacy, nil); err != nil {
+			panic(err)
+		}
+		closeDb()
+		file, err := os.OpenFile(heapFilePath, os.O_RDWR, 0)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := file.WriteAt([]byte{disk.HEAP_FILE_VERSION_FREE_LIST, 0, 0, 0}, 8); err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+
+		// 読み込み専用では書き換えられない
+		bufmgr, closeDb = openBufferPoolManager(heapFilePath, disk.OPEN_MODE_READ_ONLY)
+		if _, err := OpenCatalog(bufmgr); !xerrors.Is(err, disk.ErrReadOnly) {
+			t.Fatalf("OpenCatalog() = %v, want ErrReadOnly", err)
+		}
+		closeDb()
+
+		bufmgr, closeDb = openBufferPoolManager(heapFilePath, disk.OPEN_MODE_READ_WRITE)
+		defer closeDb()
+		// カタログを通さずに、移行していないファイルのテーブルを読み書きできない
+		if _, err := LoadTable(bufmgr, users.MetaPageId); err != ErrLegacyHeapFile {
+			t.Fatalf("LoadTable() = %v, want ErrLegacyHeapFile", err)
+		}
+		if err := newTable("groups").Create(bufmgr); err != ErrLegacyHeapFile {
+			t.Fatalf("tbl.Create() = %v, want ErrLegacyHeapFile", err)
+		}
+		catalog, err = OpenCatalog(bufmgr)
+		if err != nil {
+			t.Fatalf("OpenCatalog() = %v", err)
+		}
+		if version := bufmgr.DiskManager().Version(); version != disk.HEAP_FILE_VERSION {
+			t.Fatalf("Version() = %v, want %v", version, disk.HEAP_FILE_VERSION)
+		}
+		names, err := catalog.ListTables(bufmgr)
+		if err != nil {
+			panic(err)
+		}
+		if expect := []string{"accounts", "users"}; !reflect.DeepEqual(names, expect) {
+			t.Fatalf("catalog.ListTables() = %v, want %v", names, expect)
+		}
+		users2, err := catalog.OpenTable(bufmgr, "users")
+		if err != nil {
+			panic(err)
+		}
+		if _, err := LoadTable(bufmgr, users.MetaPageId); err != nil {
+			t.Fatalf("LoadTable() = %v after migration", err)
+		}
+		for i, metaPageId := range metaPageIds {
+			if pairs := dumpTree(bufmgr, metaPageId); !reflect.DeepEqual(pairs, expects[i]) {
+				t.Fatalf("tree %v = %q, want %q", metaPageId, pairs, expects[i])
+			}
+		}
+		if err := users2.Insert(bufmgr, [][]byte{[]byte("9999"), []byte("Bob"), []byte("Smith7")}); err != btree.ErrDuplicateKey {
+			t.Fatalf("users2.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if err := users2.Insert(bufmgr, [][]byte{[]byte("9999"), []byte("Bob"), []byte("Jones")}); err != nil {
+			t.Fatalf("users2.Insert() = %v", err)
+		}
+	})
+}
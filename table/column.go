@@ -0,0 +1,195 @@
+package table
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"my-relly-go/memcmpable"
+
+	"golang.org/x/xerrors"
+)
+
+// カラムの値は型ごとにmemcmpableで符号化したバイト列で持つ
+// バイト列のまま比較すれば値の大小と同じ順になる
+type ColType int32
+
+const (
+	COL_TYPE_BYTES ColType = iota
+	COL_TYPE_STRING
+	COL_TYPE_INT64
+	COL_TYPE_UINT64
+	COL_TYPE_FLOAT64
+	COL_TYPE_BOOL
+	COL_TYPE_TIMESTAMP // UTCのUnix時間（ナノ秒）をint64として持つ
+)
+
+var (
+	ErrInvalidColType = xerrors.New("invalid column type")
+	ErrInvalidValue   = xerrors.New("invalid value")
+)
+
+var colTypeNames = []string{"bytes", "string", "int64", "uint64", "float64", "bool", "timestamp"}
+
+func (c ColType) valid() bool {
+	return COL_TYPE_BYTES <= c && c <= COL_TYPE_TIMESTAMP
+}
+
+func (c ColType) String() string {
+	if !c.valid() {
+		return "ColType(" + strconv.Itoa(int(c)) + ")"
+	}
+	return colTypeNames[c]
+}
+
+func ParseColType(name string) (ColType, error) {
+	for i, colTypeName := range colTypeNames {
+		if colTypeName == name {
+			return ColType(i), nil
+		}
+	}
+	return COL_TYPE_BYTES, ErrInvalidColType
+}
+
+// Goの値をカラムの型で符号化する
+// JSONから来た値（文字列、json.Number、bool）もそのまま受け付ける
+// nilはNULLとしてnilを返す
+func EncodeValue(colType ColType, v interface{}) ([]byte, error) {
+	if v == nil && colType.valid() {
+		return nil, nil
+	}
+	switch colType {
+	case COL_TYPE_BYTES:
+		switch v := v.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		}
+
+	case COL_TYPE_STRING:
+		switch v := v.(type) {
+		case string:
+			if utf8.ValidString(v) {
+				return []byte(v), nil
+			}
+		case []byte:
+			if utf8.Valid(v) {
+				return v, nil
+			}
+		}
+
+	case COL_TYPE_INT64:
+		switch v := v.(type) {
+		case int:
+			return memcmpable.EncodeInt64(int64(v)), nil
+		case int64:
+			return memcmpable.EncodeInt64(v), nil
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return memcmpable.EncodeInt64(n), nil
+			}
+		}
+
+	case COL_TYPE_UINT64:
+		switch v := v.(type) {
+		case int:
+			if v >= 0 {
+				return memcmpable.EncodeUint64(uint64(v)), nil
+			}
+		case uint64:
+			return memcmpable.EncodeUint64(v), nil
+		case json.Number:
+			if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+				return memcmpable.EncodeUint64(n), nil
+			}
+		}
+
+	case COL_TYPE_FLOAT64:
+		switch v := v.(type) {
+		case int:
+			return memcmpable.EncodeFloat64(float64(v)), nil
+		case float64:
+			return memcmpable.EncodeFloat64(v), nil
+		case json.Number:
+			if n, err := v.Float64(); err == nil {
+				return memcmpable.EncodeFloat64(n), nil
+			}
+		}
+
+	case COL_TYPE_BOOL:
+		if v, ok := v.(bool); ok {
+			return memcmpable.EncodeBool(v), nil
+		}
+
+	case COL_TYPE_TIMESTAMP:
+		switch v := v.(type) {
+		case time.Time:
+			return memcmpable.EncodeInt64(v.UnixNano()), nil
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return memcmpable.EncodeInt64(t.UnixNano()), nil
+			}
+		}
+
+	default:
+		return nil, ErrInvalidColType
+	}
+	return nil, ErrInvalidValue
+}
+
+// 符号化されたカラムの値をGoの値に戻す
+// BYTESは[]byte、TIMESTAMPはUTCのtime.Timeになる
+func DecodeValue(colType ColType, buf []byte) (interface{}, error) {
+	if buf == nil && colType.valid() {
+		return nil, nil
+	}
+	if err := validateValue(colType, buf); err != nil {
+		return nil, err
+	}
+	switch colType {
+	case COL_TYPE_STRING:
+		return string(buf), nil
+	case COL_TYPE_INT64:
+		return memcmpable.DecodeInt64(buf), nil
+	case COL_TYPE_UINT64:
+		return memcmpable.DecodeUint64(buf), nil
+	case COL_TYPE_FLOAT64:
+		return memcmpable.DecodeFloat64(buf), nil
+	case COL_TYPE_BOOL:
+		return memcmpable.DecodeBool(buf), nil
+	case COL_TYPE_TIMESTAMP:
+		return time.Unix(0, memcmpable.DecodeInt64(buf)).UTC(), nil
+	}
+	return buf, nil
+}
+
+// 符号化済みのバイト列が型として正しいか
+func validateValue(colType ColType, buf []byte) error {
+	size := -1
+	switch colType {
+	case COL_TYPE_BYTES:
+	case COL_TYPE_STRING:
+		if !utf8.Valid(buf) {
+			return ErrInvalidValue
+		}
+	case COL_TYPE_INT64, COL_TYPE_TIMESTAMP:
+		size = memcmpable.INT64_SIZE
+	case COL_TYPE_UINT64:
+		size = memcmpable.UINT64_SIZE
+	case COL_TYPE_FLOAT64:
+		size = memcmpable.FLOAT64_SIZE
+	case COL_TYPE_BOOL:
+		if len(buf) == memcmpable.BOOL_SIZE && buf[0] > 1 {
+			return ErrInvalidValue
+		}
+		size = memcmpable.BOOL_SIZE
+	default:
+		return ErrInvalidColType
+	}
+	if size >= 0 && len(buf) != size {
+		return ErrInvalidValue
+	}
+	return nil
+}
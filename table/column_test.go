@@ -0,0 +1,111 @@
+package table
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+func TestColumn(t *testing.T) {
+	t.Run("EncodeValue/DecodeValue", func(t *testing.T) {
+		ts := time.Date(2021, 4, 1, 9, 30, 0, 123, time.UTC)
+		testCases := []struct {
+			colType ColType
+			value   interface{}
+			want    interface{}
+		}{
+			{COL_TYPE_BYTES, []byte{0, 1, 2}, []byte{0, 1, 2}},
+			{COL_TYPE_BYTES, "abc", []byte("abc")},
+			{COL_TYPE_STRING, "あいう", "あいう"},
+			{COL_TYPE_INT64, int64(-10), int64(-10)},
+			{COL_TYPE_INT64, 42, int64(42)},
+			{COL_TYPE_INT64, json.Number("-9223372036854775808"), int64(math.MinInt64)},
+			{COL_TYPE_UINT64, json.Number("18446744073709551615"), uint64(math.MaxUint64)},
+			{COL_TYPE_FLOAT64, json.Number("-1.5e3"), -1500.0},
+			{COL_TYPE_FLOAT64, 3, 3.0},
+			{COL_TYPE_BOOL, true, true},
+			{COL_TYPE_TIMESTAMP, ts, ts},
+			{COL_TYPE_TIMESTAMP, "2021-04-01T18:30:00.000000123+09:00", ts},
+			{COL_TYPE_INT64, nil, nil},
+			{COL_TYPE_BYTES, nil, nil},
+		}
+		for _, tc := range testCases {
+			buf, err := EncodeValue(tc.colType, tc.value)
+			if err != nil {
+				t.Fatalf("EncodeValue(%v, %v) = %v", tc.colType, tc.value, err)
+			}
+			got, err := DecodeValue(tc.colType, buf)
+			if err != nil {
+				t.Fatalf("DecodeValue(%v) = %v", tc.colType, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("DecodeValue(%v) = %#v, want %#v", tc.colType, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("数値の順序", func(t *testing.T) {
+		// バイト列のままでは"10" < "9"になるが、型で符号化すれば数値の順になる
+		nine, _ := EncodeValue(COL_TYPE_INT64, json.Number("9"))
+		ten, _ := EncodeValue(COL_TYPE_INT64, json.Number("10"))
+		minus, _ := EncodeValue(COL_TYPE_INT64, json.Number("-100"))
+		if !(bytes.Compare(minus, nine) < 0 && bytes.Compare(nine, ten) < 0) {
+			t.Fatal("EncodeValue(int64) does not preserve order")
+		}
+		a, _ := EncodeValue(COL_TYPE_FLOAT64, json.Number("-0.5"))
+		b, _ := EncodeValue(COL_TYPE_FLOAT64, json.Number("0.25"))
+		if bytes.Compare(a, b) >= 0 {
+			t.Fatal("EncodeValue(float64) does not preserve order")
+		}
+		before, _ := EncodeValue(COL_TYPE_TIMESTAMP, "1969-12-31T23:59:59Z")
+		after, _ := EncodeValue(COL_TYPE_TIMESTAMP, "1970-01-01T00:00:00Z")
+		if bytes.Compare(before, after) >= 0 {
+			t.Fatal("EncodeValue(timestamp) does not preserve order")
+		}
+	})
+
+	t.Run("不正な値", func(t *testing.T) {
+		testCases := []struct {
+			colType ColType
+			value   interface{}
+		}{
+			{COL_TYPE_INT64, "10"},
+			{COL_TYPE_INT64, json.Number("1.5")},
+			{COL_TYPE_UINT64, json.Number("-1")},
+			{COL_TYPE_UINT64, -1},
+			{COL_TYPE_BOOL, "true"},
+			{COL_TYPE_STRING, []byte{0xff}},
+			{COL_TYPE_TIMESTAMP, "2021-04-01"},
+		}
+		for _, tc := range testCases {
+			if _, err := EncodeValue(tc.colType, tc.value); err != ErrInvalidValue {
+				t.Fatalf("EncodeValue(%v, %v) = %v, want ErrInvalidValue", tc.colType, tc.value, err)
+			}
+		}
+		if _, err := EncodeValue(ColType(99), 1); err != ErrInvalidColType {
+			t.Fatalf("EncodeValue() = %v, want ErrInvalidColType", err)
+		}
+		if _, err := DecodeValue(COL_TYPE_INT64, []byte{1, 2, 3}); err != ErrInvalidValue {
+			t.Fatalf("DecodeValue() = %v, want ErrInvalidValue", err)
+		}
+		if _, err := DecodeValue(COL_TYPE_BOOL, []byte{2}); err != ErrInvalidValue {
+			t.Fatalf("DecodeValue() = %v, want ErrInvalidValue", err)
+		}
+	})
+
+	t.Run("ParseColType", func(t *testing.T) {
+		for _, colType := range []ColType{COL_TYPE_BYTES, COL_TYPE_STRING, COL_TYPE_INT64, COL_TYPE_UINT64, COL_TYPE_FLOAT64, COL_TYPE_BOOL, COL_TYPE_TIMESTAMP} {
+			if got, err := ParseColType(colType.String()); err != nil || got != colType {
+				t.Fatalf("ParseColType(%v) = %v, %v", colType, got, err)
+			}
+		}
+		if _, err := ParseColType("int"); !xerrors.Is(err, ErrInvalidColType) {
+			t.Fatalf("ParseColType() = %v, want ErrInvalidColType", err)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package table
+
+import (
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+)
+
+// 空のテーブルにレコードをまとめて読み込む
+// プライマリキーと各インデックスのペアをキーの順に並べ替え、それぞれの木をBulkLoadで作る
+// プライマリキーが重複していればbtree.ErrDuplicateKey、ユニークインデックスで重複していれば
+// *UniqueViolationErrorを返し、何も変更しない
+func (t *Table) Import(bufmgr *buffer.BufferPoolManager, records [][][]byte) error {
+	pkeys := make([][]byte, len(records))
+	for i, record := range records {
+		if err := t.validateRecord(record); err != nil {
+			return err
+		}
+		pkeys[i] = EncodeTuple(record[:t.NumKeyElems])
+	}
+
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		err := bulkLoadSorted(bufmgr, t.MetaPageId, len(records), func(i int) ([]byte, []byte) {
+			return pkeys[i], EncodeTuple(records[i][t.NumKeyElems:])
+		}, nil)
+		if err != nil {
+			return err
+		}
+		for _, uniqueIndex := range t.UniqueIndices {
+			encodeSKey := uniqueIndex.encodeSKey
+			checker := &uniqueCheckIterator{}
+			err := bulkLoadSorted(bufmgr, uniqueIndex.MetaPageId, len(records), func(i int) ([]byte, []byte) {
+				return encodeSKey(pkeys[i], records[i]), pkeys[i]
+			}, checker)
+			if err != nil {
+				return err
+			}
+			if len(checker.duplicates) > 0 {
+				return &UniqueViolationError{IndexName: uniqueIndex.Name, Keys: checker.duplicates}
+			}
+		}
+		for _, secondaryIndex := range t.SecondaryIndices {
+			encodeSKey := secondaryIndex.encodeSKey
+			err := bulkLoadSorted(bufmgr, secondaryIndex.MetaPageId, len(records), func(i int) ([]byte, []byte) {
+				return encodeSKey(pkeys[i], records[i]), pkeys[i]
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// entryで作ったn件のペアを、インデックスを追加するときと同じくbtree.Sorterで並べ替えて、空の木にBulkLoadする
+// checkerを渡すと、重複したキーのペアは飛ばしてchecker.duplicatesに集める
+func bulkLoadSorted(bufmgr *buffer.BufferPoolManager, metaPageId disk.PageId, n int, entry func(i int) ([]byte, []byte), checker *uniqueCheckIterator) error {
+	sorter := btree.NewSorter(indexSortMemoryLimit, 0)
+	defer sorter.Finish()
+	for i := 0; i < n; i++ {
+		if err := sorter.Add(entry(i)); err != nil {
+			return err
+		}
+	}
+	if err := sorter.Sort(); err != nil {
+		return err
+	}
+	var entries btree.Iterator = sorter
+	if checker != nil {
+		checker.inner = sorter
+		entries = checker
+	}
+	return btree.NewBTree(metaPageId).BulkLoad(bufmgr, entries)
+}
@@ -0,0 +1,181 @@
+package table
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+func TestImport(t *testing.T) {
+	createTable := func() (*buffer.BufferPoolManager, *Table, func()) {
+		file, err := ioutil.TempFile("", "TestImport")
+		if err != nil {
+			panic(err)
+		}
+		diskManager, err := disk.CreateDiskManager(file.Name())
+		if err != nil {
+			panic(err)
+		}
+		bufmgr := buffer.NewBufferPoolManager(diskManager, buffer.NewBufferPool(10))
+		tbl := &Table{
+			NumCols:     3,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "name", "email"},
+			Nullable:    []bool{false, false, true},
+			UniqueIndices: []UniqueIndex{
+				{MetaPageId: disk.INVALID_PAGE_ID, SKey: []int{2}},
+			},
+			SecondaryIndices: []SecondaryIndex{
+				{MetaPageId: disk.INVALID_PAGE_ID, SKey: []int{1}},
+			},
+		}
+		if err := tbl.Create(bufmgr); err != nil {
+			panic(err)
+		}
+		return bufmgr, tbl, func() {
+			if err := diskManager.Close(); err != nil {
+				panic(err)
+			}
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(file.Name()); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+				panic(err)
+			}
+		}
+	}
+	// 逆順に並べたレコード。emailは3件に1件がNULL
+	makeRecords := func(numRecords int) [][][]byte {
+		records := [][][]byte{}
+		for i := numRecords - 1; i >= 0; i-- {
+			var email []byte
+			if i%3 != 0 {
+				email = []byte(fmt.Sprintf("user%05d@example.com", i))
+			}
+			records = append(records, [][]byte{
+				[]byte(fmt.Sprintf("%05d", i)),
+				[]byte(fmt.Sprintf("name%d", i%10)),
+				email,
+			})
+		}
+		return records
+	}
+	readTree := func(bufmgr *buffer.BufferPoolManager, metaPageId disk.PageId) ([][]byte, [][]byte) {
+		iter, err := btree.NewBTree(metaPageId).Search(bufmgr, &btree.SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		keys, values := [][]byte{}, [][]byte{}
+		for {
+			key, value, err := iter.Next(bufmgr)
+			if err == btree.ErrEndOfIterator {
+				return keys, values
+			}
+			if err != nil {
+				panic(err)
+			}
+			keys, values = append(keys, key), append(values, value)
+		}
+	}
+
+	t.Run("正常系", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		// 並べ替えるペアがメモリの上限を超えても、一時ファイルに書き出して読み込める
+		defer func(limit int) { indexSortMemoryLimit = limit }(indexSortMemoryLimit)
+		indexSortMemoryLimit = 4096
+
+		const numRecords = 3000
+		records := makeRecords(numRecords)
+		if err := tbl.Import(bufmgr, records); err != nil {
+			t.Fatalf("tbl.Import() = %v", err)
+		}
+
+		// 1件ずつ挿入したテーブルと同じ内容になる
+		expectBufmgr, expectTbl, expectCleanup := createTable()
+		defer expectCleanup()
+		for _, record := range records {
+			if err := expectTbl.Insert(expectBufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		metaPageIds := [][]disk.PageId{
+			{tbl.MetaPageId, expectTbl.MetaPageId},
+			{tbl.UniqueIndices[0].MetaPageId, expectTbl.UniqueIndices[0].MetaPageId},
+			{tbl.SecondaryIndices[0].MetaPageId, expectTbl.SecondaryIndices[0].MetaPageId},
+		}
+		for _, ids := range metaPageIds {
+			keys, values := readTree(bufmgr, ids[0])
+			expectKeys, expectValues := readTree(expectBufmgr, ids[1])
+			if len(keys) != numRecords {
+				t.Fatalf("len(keys) = %v, want %v", len(keys), numRecords)
+			}
+			if !reflect.DeepEqual(keys, expectKeys) || !reflect.DeepEqual(values, expectValues) {
+				t.Fatalf("tree %v differs from inserted one", ids[0])
+			}
+		}
+
+		// 読み込んだ後は普通に更新できる
+		if err := tbl.Insert(bufmgr, records[0]); !xerrors.Is(err, btree.ErrDuplicateKey) {
+			t.Fatalf("tbl.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if err := tbl.Delete(bufmgr, records[0]); err != nil {
+			t.Fatalf("tbl.Delete() = %v", err)
+		}
+		if err := tbl.Insert(bufmgr, records[0]); err != nil {
+			t.Fatalf("tbl.Insert() = %v", err)
+		}
+	})
+
+	t.Run("異常系", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		records := makeRecords(100)
+		duplicatePKey := append(makeRecords(100), records[10])
+		duplicateEmail := append(makeRecords(100), [][]byte{[]byte("zzzzz"), []byte("name"), records[10][2]})
+		tests := []struct {
+			name    string
+			records [][][]byte
+			err     error
+		}{
+			{"プライマリキーが重複", duplicatePKey, btree.ErrDuplicateKey},
+			{"ユニークインデックスが重複", duplicateEmail, btree.ErrDuplicateKey},
+			{"NOT NULLのカラムがNULL", [][][]byte{{[]byte("a"), nil, nil}}, ErrNullValue},
+		}
+		for _, tt := range tests {
+			if err := tbl.Import(bufmgr, tt.records); !xerrors.Is(err, tt.err) {
+				t.Fatalf("%s: tbl.Import() = %v, want %v", tt.name, err, tt.err)
+			}
+			// 何も変更しない
+			if keys, _ := readTree(bufmgr, tbl.MetaPageId); len(keys) != 0 {
+				t.Fatalf("%s: len(keys) = %v, want 0", tt.name, len(keys))
+			}
+		}
+		err := tbl.Import(bufmgr, duplicateEmail)
+		var violation *UniqueViolationError
+		if !xerrors.As(err, &violation) || len(violation.Keys) != 1 {
+			t.Fatalf("tbl.Import() = %v, want UniqueViolationError", err)
+		}
+
+		if err := tbl.Import(bufmgr, records); err != nil {
+			t.Fatalf("tbl.Import() = %v", err)
+		}
+		if err := tbl.Import(bufmgr, records); err != btree.ErrTreeNotEmpty {
+			t.Fatalf("tbl.Import() = %v, want ErrTreeNotEmpty", err)
+		}
+	})
+}
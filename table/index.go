@@ -0,0 +1,207 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	ErrInvalidIndex = xerrors.New("invalid index columns")
+)
+
+// ユニークインデックスを作成できなかったときに、重複したセカンダリキーを報告する
+type UniqueViolationError struct {
+	IndexName string
+	Keys      [][][]byte // 重複していたセカンダリキー
+}
+
+const maxReportedKeys = 10
+
+func (e *UniqueViolationError) Error() string {
+	keys := e.Keys
+	more := ""
+	if len(keys) > maxReportedKeys {
+		more = fmt.Sprintf(" and %d more", len(keys)-maxReportedKeys)
+		keys = keys[:maxReportedKeys]
+	}
+	return fmt.Sprintf("index %s: duplicate keys %q%s", e.IndexName, keys, more)
+}
+
+func (e *UniqueViolationError) Unwrap() error {
+	return btree.ErrDuplicateKey
+}
+
+// データが入っているテーブルにインデックスを追加し、メタページの定義を書き換える
+// ユニークインデックスで重複があれば*UniqueViolationErrorを返し、何も変更しない
+// カタログに登録されたテーブルなら、Catalog.AddIndexを使うこと
+func (t *Table) AddIndex(bufmgr *buffer.BufferPoolManager, kind IndexKind, name string, skey []int) error {
+	if len(skey) == 0 || (kind != INDEX_KIND_UNIQUE && kind != INDEX_KIND_SECONDARY) {
+		return ErrInvalidIndex
+	}
+	for _, col := range skey {
+		if col < 0 || t.NumCols <= col {
+			return ErrInvalidIndex
+		}
+	}
+	if name == "" {
+		name = defaultIndexName(t.ColNames, skey)
+	}
+	if _, err := t.UniqueIndex(name); err == nil {
+		return ErrDuplicateIndexName
+	}
+	if _, err := t.SecondaryIndex(name); err == nil {
+		return ErrDuplicateIndexName
+	}
+
+	uniqueIndices, secondaryIndices := t.UniqueIndices, t.SecondaryIndices
+	err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		var encodeSKey func(pkey []byte, record [][]byte) []byte
+		if kind == INDEX_KIND_UNIQUE {
+			encodeSKey = (&UniqueIndex{SKey: skey}).encodeSKey
+		} else {
+			encodeSKey = (&SecondaryIndex{SKey: skey}).encodeSKey
+		}
+		sorter, err := t.sortIndexEntries(bufmgr, encodeSKey)
+		if err != nil {
+			return err
+		}
+		defer sorter.Finish()
+
+		tree, err := btree.CreateBTree(bufmgr)
+		if err != nil {
+			return err
+		}
+		var entries btree.Iterator = sorter
+		var checker *uniqueCheckIterator
+		if kind == INDEX_KIND_UNIQUE {
+			checker = &uniqueCheckIterator{inner: sorter}
+			entries = checker
+		}
+		if err := tree.BulkLoad(bufmgr, entries); err != nil {
+			return err
+		}
+		// 重複があれば、作った木はロールバックで解放される
+		if checker != nil && len(checker.duplicates) > 0 {
+			return &UniqueViolationError{IndexName: name, Keys: checker.duplicates}
+		}
+
+		if kind == INDEX_KIND_UNIQUE {
+			t.UniqueIndices = append(t.UniqueIndices, UniqueIndex{Name: name, MetaPageId: tree.MetaPageId, SKey: skey})
+		} else {
+			t.SecondaryIndices = append(t.SecondaryIndices, SecondaryIndex{Name: name, MetaPageId: tree.MetaPageId, SKey: skey})
+		}
+		return btree.NewBTree(t.MetaPageId).WriteMetaAppArea(bufmgr, t.toMeta().ToBytes())
+	})
+	if err != nil {
+		t.UniqueIndices, t.SecondaryIndices = uniqueIndices, secondaryIndices
+		return err
+	}
+	return nil
+}
+
+// インデックスを作るときに、メモリに置くペアの大きさの上限（バイト）
+// 超えた分はbtree.Sorterが一時ファイルに書き出す
+var indexSortMemoryLimit = btree.DEFAULT_SORT_MEMORY_LIMIT
+
+// テーブルを全件読んで、インデックスに入れるペアをキーの順に返すSorterを作る
+// 使い終わったらFinishを呼ぶこと
+func (t *Table) sortIndexEntries(bufmgr *buffer.BufferPoolManager, encodeSKey func(pkey []byte, record [][]byte) []byte) (*btree.Sorter, error) {
+	iter, err := btree.NewBTree(t.MetaPageId).Search(bufmgr, &btree.SearchModeStart{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Finish(bufmgr)
+
+	sorter := btree.NewSorter(indexSortMemoryLimit, 0)
+	for {
+		pkey, value, err := iter.Next(bufmgr)
+		if err == btree.ErrEndOfIterator {
+			break
+		}
+		if err != nil {
+			sorter.Finish()
+			return nil, err
+		}
+		record := DecodeTuple(pkey, [][]byte{})
+		record = DecodeTuple(value, record)
+		if err := sorter.Add(encodeSKey(pkey, record), pkey); err != nil {
+			sorter.Finish()
+			return nil, err
+		}
+	}
+	if err := sorter.Sort(); err != nil {
+		sorter.Finish()
+		return nil, err
+	}
+	return sorter, nil
+}
+
+// キーの順に並んだペアから、直前と同じキーのペアを飛ばして返す
+// 飛ばしたキーは、3件以上重複していても1回だけduplicatesに加える
+type uniqueCheckIterator struct {
+	inner      btree.Iterator
+	prevKey    []byte
+	reported   bool
+	duplicates [][][]byte
+}
+
+func (it *uniqueCheckIterator) Next(bufmgr *buffer.BufferPoolManager) ([]byte, []byte, error) {
+	for {
+		key, value, err := it.inner.Next(bufmgr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if it.prevKey == nil || !bytes.Equal(it.prevKey, key) {
+			it.prevKey = key
+			it.reported = false
+			return key, value, nil
+		}
+		if !it.reported {
+			it.duplicates = append(it.duplicates, DecodeTuple(key, [][]byte{}))
+			it.reported = true
+		}
+	}
+}
+
+// インデックスの木のページをすべて解放し、メタページの定義から外す
+// カタログに登録されたテーブルなら、Catalog.DropIndexを使うこと
+func (t *Table) DropIndex(bufmgr *buffer.BufferPoolManager, name string) error {
+	uniqueIndices, secondaryIndices := t.UniqueIndices, t.SecondaryIndices
+	var indexTree *btree.BTree
+	t.UniqueIndices, t.SecondaryIndices = nil, nil
+	for _, uniqueIndex := range uniqueIndices {
+		if uniqueIndex.Name == name {
+			indexTree = btree.NewBTree(uniqueIndex.MetaPageId)
+			continue
+		}
+		t.UniqueIndices = append(t.UniqueIndices, uniqueIndex)
+	}
+	for _, secondaryIndex := range secondaryIndices {
+		if secondaryIndex.Name == name {
+			indexTree = btree.NewBTree(secondaryIndex.MetaPageId)
+			continue
+		}
+		t.SecondaryIndices = append(t.SecondaryIndices, secondaryIndex)
+	}
+	if indexTree == nil {
+		t.UniqueIndices, t.SecondaryIndices = uniqueIndices, secondaryIndices
+		return ErrIndexNotFound
+	}
+
+	err := bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		if err := indexTree.Drop(bufmgr); err != nil {
+			return err
+		}
+		return btree.NewBTree(t.MetaPageId).WriteMetaAppArea(bufmgr, t.toMeta().ToBytes())
+	})
+	if err != nil {
+		t.UniqueIndices, t.SecondaryIndices = uniqueIndices, secondaryIndices
+		return err
+	}
+	return nil
+}
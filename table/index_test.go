@@ -0,0 +1,250 @@
+package table
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+func TestIndex(t *testing.T) {
+	createTable := func() (*buffer.BufferPoolManager, *Table, func()) {
+		file, err := ioutil.TempFile("", "TestIndex")
+		if err != nil {
+			panic(err)
+		}
+		diskManager, err := disk.CreateDiskManager(file.Name())
+		if err != nil {
+			panic(err)
+		}
+		bufmgr := buffer.NewBufferPoolManager(diskManager, buffer.NewBufferPool(10))
+		tbl := &Table{
+			NumCols:     4,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "first_name", "last_name", "email"},
+			Nullable:    []bool{false, false, false, true},
+		}
+		if err := tbl.Create(bufmgr); err != nil {
+			panic(err)
+		}
+		records := [][][]byte{
+			{[]byte("z"), []byte("Alice"), []byte("Smith"), nil},
+			{[]byte("y"), []byte("Bob"), []byte("Smith"), []byte("bob@example.com")},
+			{[]byte("x"), []byte("Charlie"), []byte("Jones"), nil},
+			{[]byte("w"), []byte("Alice"), []byte("Jones"), []byte("alice@example.com")},
+			{[]byte("v"), []byte("Alice"), []byte("Brown"), []byte("alice2@example.com")},
+		}
+		for _, record := range records {
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		return bufmgr, tbl, func() {
+			if err := diskManager.Close(); err != nil {
+				panic(err)
+			}
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(file.Name()); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+				panic(err)
+			}
+		}
+	}
+	countRecords := func(bufmgr *buffer.BufferPoolManager, metaPageId disk.PageId) int {
+		iter, err := btree.NewBTree(metaPageId).Search(bufmgr, &btree.SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+		n := 0
+		for {
+			if _, _, err := iter.Next(bufmgr); err == btree.ErrEndOfIterator {
+				return n
+			} else if err != nil {
+				panic(err)
+			}
+			n++
+		}
+	}
+
+	t.Run("正常系", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_SECONDARY, "", []int{2}); err != nil {
+			panic(err)
+		}
+		// NULLは重複してもよい
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "", []int{3}); err != nil {
+			panic(err)
+		}
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "full_name", []int{1, 2}); err != nil {
+			panic(err)
+		}
+		for _, metaPageId := range []disk.PageId{tbl.SecondaryIndices[0].MetaPageId, tbl.UniqueIndices[0].MetaPageId, tbl.UniqueIndices[1].MetaPageId} {
+			if n := countRecords(bufmgr, metaPageId); n != 5 {
+				t.Fatalf("countRecords() = %v, want 5", n)
+			}
+		}
+
+		// 追加したインデックスも更新される
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("u"), []byte("Bob"), []byte("Smith"), nil}); err != btree.ErrDuplicateKey {
+			t.Fatalf("tbl.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("u"), []byte("Dave"), []byte("Smith"), nil}); err != nil {
+			panic(err)
+		}
+		if n := countRecords(bufmgr, tbl.SecondaryIndices[0].MetaPageId); n != 6 {
+			t.Fatalf("countRecords() = %v, want 6", n)
+		}
+
+		loaded, err := LoadTable(bufmgr, tbl.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(loaded, tbl) {
+			t.Fatalf("LoadTable() = %v, want %v", loaded, tbl)
+		}
+		if _, err := loaded.UniqueIndex("email"); err != nil {
+			t.Fatalf("loaded.UniqueIndex() = %v", err)
+		}
+	})
+
+	t.Run("ユニークインデックスが重複", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "", []int{1})
+		var violation *UniqueViolationError
+		if !xerrors.As(err, &violation) || !xerrors.Is(err, btree.ErrDuplicateKey) {
+			t.Fatalf("tbl.AddIndex() = %v, want UniqueViolationError", err)
+		}
+		if expect := [][][]byte{{[]byte("Alice")}}; violation.IndexName != "first_name" || !reflect.DeepEqual(violation.Keys, expect) {
+			t.Fatalf("violation = %v, want %q", violation, expect)
+		}
+
+		// 失敗した追加は定義に残らない
+		if len(tbl.UniqueIndices) != 0 {
+			t.Fatalf("len(tbl.UniqueIndices) = %v, want 0", len(tbl.UniqueIndices))
+		}
+		loaded, err := LoadTable(bufmgr, tbl.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(loaded, tbl) {
+			t.Fatalf("LoadTable() = %v, want %v", loaded, tbl)
+		}
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("u"), []byte("Alice"), []byte("Miller"), nil}); err != nil {
+			panic(err)
+		}
+	})
+
+	t.Run("一時ファイルで並べ替え", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		// メモリに置けない分はrunとして書き出してマージする
+		defer func(limit int) { indexSortMemoryLimit = limit }(indexSortMemoryLimit)
+		indexSortMemoryLimit = 256
+		for i := 0; i < 500; i++ {
+			record := [][]byte{[]byte(fmt.Sprintf("r%03d", i)), []byte(fmt.Sprintf("First%03d", i)), []byte(fmt.Sprintf("Last%03d", i%400)), nil}
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+
+		err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "", []int{2})
+		var violation *UniqueViolationError
+		if !xerrors.As(err, &violation) {
+			t.Fatalf("tbl.AddIndex() = %v, want UniqueViolationError", err)
+		}
+		expect := [][][]byte{{[]byte("Jones")}}
+		for i := 0; i < 100; i++ {
+			expect = append(expect, [][]byte{[]byte(fmt.Sprintf("Last%03d", i))})
+		}
+		expect = append(expect, [][]byte{[]byte("Smith")})
+		if !reflect.DeepEqual(violation.Keys, expect) {
+			t.Fatalf("violation.Keys = %q, want %q", violation.Keys, expect)
+		}
+
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_SECONDARY, "", []int{2}); err != nil {
+			panic(err)
+		}
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "full_name", []int{1, 2}); err != nil {
+			panic(err)
+		}
+		for _, metaPageId := range []disk.PageId{tbl.SecondaryIndices[0].MetaPageId, tbl.UniqueIndices[0].MetaPageId} {
+			if n := countRecords(bufmgr, metaPageId); n != 505 {
+				t.Fatalf("countRecords() = %v, want 505", n)
+			}
+		}
+	})
+
+	t.Run("異常系", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_SECONDARY, "", []int{4}); err != ErrInvalidIndex {
+			t.Fatalf("tbl.AddIndex() = %v, want ErrInvalidIndex", err)
+		}
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_SECONDARY, "", []int{}); err != ErrInvalidIndex {
+			t.Fatalf("tbl.AddIndex() = %v, want ErrInvalidIndex", err)
+		}
+		if err := tbl.AddIndex(bufmgr, IndexKind(9), "", []int{1}); err != ErrInvalidIndex {
+			t.Fatalf("tbl.AddIndex() = %v, want ErrInvalidIndex", err)
+		}
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_SECONDARY, "", []int{2}); err != nil {
+			panic(err)
+		}
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "last_name", []int{1, 2}); err != ErrDuplicateIndexName {
+			t.Fatalf("tbl.AddIndex() = %v, want ErrDuplicateIndexName", err)
+		}
+	})
+
+	t.Run("DropIndex", func(t *testing.T) {
+		bufmgr, tbl, cleanup := createTable()
+		defer cleanup()
+
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_SECONDARY, "", []int{1}); err != nil {
+			panic(err)
+		}
+		if err := tbl.AddIndex(bufmgr, INDEX_KIND_UNIQUE, "", []int{3}); err != nil {
+			panic(err)
+		}
+		if err := tbl.DropIndex(bufmgr, "first_name"); err != nil {
+			panic(err)
+		}
+		if err := tbl.DropIndex(bufmgr, "first_name"); err != ErrIndexNotFound {
+			t.Fatalf("tbl.DropIndex() = %v, want ErrIndexNotFound", err)
+		}
+		if len(tbl.SecondaryIndices) != 0 || len(tbl.UniqueIndices) != 1 {
+			t.Fatalf("tbl = %v, want only email index", tbl)
+		}
+		loaded, err := LoadTable(bufmgr, tbl.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(loaded, tbl) {
+			t.Fatalf("LoadTable() = %v, want %v", loaded, tbl)
+		}
+
+		// 削除したユニークインデックスの制約はなくなる
+		if err := tbl.DropIndex(bufmgr, "email"); err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("u"), []byte("Bob"), []byte("Smith"), []byte("bob@example.com")}); err != nil {
+			panic(err)
+		}
+	})
+}
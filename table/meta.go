@@ -4,12 +4,19 @@ import (
 	"strconv"
 	"strings"
 
+	"my-relly-go/disk"
+
 	"google.golang.org/protobuf/proto"
 )
 
 const (
-	META_VERSION_UNIQUE_INDICES = 1
-	META_CURRENT_VERSION        = 1
+	META_VERSION_UNIQUE_INDICES             = 1
+	META_VERSION_UNIQUE_INDEX_META_PAGE_IDS = 2
+	META_VERSION_CATALOG                    = 3
+	META_VERSION_COL_TYPES                  = 4
+	META_VERSION_NULLABLE                   = 5
+	META_VERSION_INDEX_KINDS                = 6
+	META_CURRENT_VERSION                    = 6
 	//INVALID_SKEY                = math.MaxUint16
 )
 
@@ -23,6 +30,15 @@ type Meta struct {
 }
 */
 
+// インデックスの種類
+// UniqueIndicesStrなどには、種類によらずすべてのインデックスを並べる
+type IndexKind int32
+
+const (
+	INDEX_KIND_UNIQUE IndexKind = iota
+	INDEX_KIND_SECONDARY
+)
+
 func NewMeta() *Meta {
 	meta := &Meta{
 		Version: META_CURRENT_VERSION,
@@ -55,6 +71,28 @@ func (m *Meta) GetUniqueIndices() [][]int {
 	return indices
 }
 
+// ユニークインデックスのメタページID
+// バージョン1のメタにはないので、テーブルに続けて作成された前提で求める
+func (m *Meta) IndexMetaPageIds(tableMetaPageId disk.PageId) []disk.PageId {
+	pageIds := []disk.PageId{}
+	for i := range m.UniqueIndicesStr {
+		if m.Version >= META_VERSION_UNIQUE_INDEX_META_PAGE_IDS {
+			pageIds = append(pageIds, disk.PageId(m.UniqueIndexMetaPageIds[i]))
+		} else {
+			pageIds = append(pageIds, tableMetaPageId+disk.PageId((i+1)*2))
+		}
+	}
+	return pageIds
+}
+
+// バージョン5までのメタにはユニークインデックスしかない
+func (m *Meta) IndexKind(i int) IndexKind {
+	if m.Version < META_VERSION_INDEX_KINDS {
+		return INDEX_KIND_UNIQUE
+	}
+	return IndexKind(m.IndexKinds[i])
+}
+
 func NewMetaFromBytes(buf []byte) *Meta {
 	meta := &Meta{}
 	if err := proto.Unmarshal(buf, meta); err != nil {
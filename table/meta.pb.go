@@ -25,11 +25,18 @@ type Meta struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Version          int32    `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
-	NumCols          int32    `protobuf:"varint,2,opt,name=NumCols,proto3" json:"NumCols,omitempty"`
-	NumKeyElems      int32    `protobuf:"varint,3,opt,name=NumKeyElems,proto3" json:"NumKeyElems,omitempty"`
-	ColNames         []string `protobuf:"bytes,4,rep,name=ColNames,proto3" json:"ColNames,omitempty"`
-	UniqueIndicesStr []string `protobuf:"bytes,5,rep,name=UniqueIndicesStr,proto3" json:"UniqueIndicesStr,omitempty"`
+	Version                int32    `protobuf:"varint,1,opt,name=Version,proto3" json:"Version,omitempty"`
+	NumCols                int32    `protobuf:"varint,2,opt,name=NumCols,proto3" json:"NumCols,omitempty"`
+	NumKeyElems            int32    `protobuf:"varint,3,opt,name=NumKeyElems,proto3" json:"NumKeyElems,omitempty"`
+	ColNames               []string `protobuf:"bytes,4,rep,name=ColNames,proto3" json:"ColNames,omitempty"`
+	UniqueIndicesStr       []string `protobuf:"bytes,5,rep,name=UniqueIndicesStr,proto3" json:"UniqueIndicesStr,omitempty"`
+	UniqueIndexMetaPageIds []uint64 `protobuf:"varint,6,rep,packed,name=UniqueIndexMetaPageIds,proto3" json:"UniqueIndexMetaPageIds,omitempty"`
+	Name                   string   `protobuf:"bytes,7,opt,name=Name,proto3" json:"Name,omitempty"`
+	MetaPageId             uint64   `protobuf:"varint,8,opt,name=MetaPageId,proto3" json:"MetaPageId,omitempty"`
+	UniqueIndexNames       []string `protobuf:"bytes,9,rep,name=UniqueIndexNames,proto3" json:"UniqueIndexNames,omitempty"`
+	ColTypes               []int32  `protobuf:"varint,10,rep,packed,name=ColTypes,proto3" json:"ColTypes,omitempty"`
+	Nullable               []bool   `protobuf:"varint,11,rep,packed,name=Nullable,proto3" json:"Nullable,omitempty"`
+	IndexKinds             []int32  `protobuf:"varint,12,rep,packed,name=IndexKinds,proto3" json:"IndexKinds,omitempty"`
 }
 
 func (x *Meta) Reset() {
@@ -99,11 +106,60 @@ func (x *Meta) GetUniqueIndicesStr() []string {
 	return nil
 }
 
+func (x *Meta) GetUniqueIndexMetaPageIds() []uint64 {
+	if x != nil {
+		return x.UniqueIndexMetaPageIds
+	}
+	return nil
+}
+
+func (x *Meta) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Meta) GetMetaPageId() uint64 {
+	if x != nil {
+		return x.MetaPageId
+	}
+	return 0
+}
+
+func (x *Meta) GetUniqueIndexNames() []string {
+	if x != nil {
+		return x.UniqueIndexNames
+	}
+	return nil
+}
+
+func (x *Meta) GetColTypes() []int32 {
+	if x != nil {
+		return x.ColTypes
+	}
+	return nil
+}
+
+func (x *Meta) GetNullable() []bool {
+	if x != nil {
+		return x.Nullable
+	}
+	return nil
+}
+
+func (x *Meta) GetIndexKinds() []int32 {
+	if x != nil {
+		return x.IndexKinds
+	}
+	return nil
+}
+
 var File_meta_proto protoreflect.FileDescriptor
 
 var file_meta_proto_rawDesc = []byte{
 	0x0a, 0x0a, 0x6d, 0x65, 0x74, 0x61, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x74, 0x61,
-	0x62, 0x6c, 0x65, 0x22, 0xa4, 0x01, 0x0a, 0x04, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x18, 0x0a, 0x07,
+	0x62, 0x6c, 0x65, 0x22, 0x94, 0x03, 0x0a, 0x04, 0x4d, 0x65, 0x74, 0x61, 0x12, 0x18, 0x0a, 0x07,
 	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x56,
 	0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x18, 0x0a, 0x07, 0x4e, 0x75, 0x6d, 0x43, 0x6f, 0x6c,
 	0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x4e, 0x75, 0x6d, 0x43, 0x6f, 0x6c, 0x73,
@@ -113,7 +169,22 @@ var file_meta_proto_rawDesc = []byte{
 	0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x43, 0x6f, 0x6c, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x12, 0x2a,
 	0x0a, 0x10, 0x55, 0x6e, 0x69, 0x71, 0x75, 0x65, 0x49, 0x6e, 0x64, 0x69, 0x63, 0x65, 0x73, 0x53,
 	0x74, 0x72, 0x18, 0x05, 0x20, 0x03, 0x28, 0x09, 0x52, 0x10, 0x55, 0x6e, 0x69, 0x71, 0x75, 0x65,
-	0x49, 0x6e, 0x64, 0x69, 0x63, 0x65, 0x73, 0x53, 0x74, 0x72, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2f,
+	0x49, 0x6e, 0x64, 0x69, 0x63, 0x65, 0x73, 0x53, 0x74, 0x72, 0x12, 0x36, 0x0a, 0x16, 0x55, 0x6e,
+	0x69, 0x71, 0x75, 0x65, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x4d, 0x65, 0x74, 0x61, 0x50, 0x61, 0x67,
+	0x65, 0x49, 0x64, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x04, 0x52, 0x16, 0x55, 0x6e, 0x69, 0x71,
+	0x75, 0x65, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x4d, 0x65, 0x74, 0x61, 0x50, 0x61, 0x67, 0x65, 0x49,
+	0x64, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x4d, 0x65, 0x74, 0x61, 0x50, 0x61,
+	0x67, 0x65, 0x49, 0x64, 0x18, 0x08, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0a, 0x4d, 0x65, 0x74, 0x61,
+	0x50, 0x61, 0x67, 0x65, 0x49, 0x64, 0x12, 0x2a, 0x0a, 0x10, 0x55, 0x6e, 0x69, 0x71, 0x75, 0x65,
+	0x49, 0x6e, 0x64, 0x65, 0x78, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x10, 0x55, 0x6e, 0x69, 0x71, 0x75, 0x65, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x4e, 0x61, 0x6d,
+	0x65, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x43, 0x6f, 0x6c, 0x54, 0x79, 0x70, 0x65, 0x73, 0x18, 0x0a,
+	0x20, 0x03, 0x28, 0x05, 0x52, 0x08, 0x43, 0x6f, 0x6c, 0x54, 0x79, 0x70, 0x65, 0x73, 0x12, 0x1a,
+	0x0a, 0x08, 0x4e, 0x75, 0x6c, 0x6c, 0x61, 0x62, 0x6c, 0x65, 0x18, 0x0b, 0x20, 0x03, 0x28, 0x08,
+	0x52, 0x08, 0x4e, 0x75, 0x6c, 0x6c, 0x61, 0x62, 0x6c, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x49, 0x6e,
+	0x64, 0x65, 0x78, 0x4b, 0x69, 0x6e, 0x64, 0x73, 0x18, 0x0c, 0x20, 0x03, 0x28, 0x05, 0x52, 0x0a,
+	0x49, 0x6e, 0x64, 0x65, 0x78, 0x4b, 0x69, 0x6e, 0x64, 0x73, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2f,
 	0x3b, 0x74, 0x61, 0x62, 0x6c, 0x65, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
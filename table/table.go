@@ -1,17 +1,44 @@
 package table
 
 import (
+	"bytes"
+	"strconv"
+	"strings"
+
 	"my-relly-go/btree"
 	"my-relly-go/buffer"
 	"my-relly-go/disk"
+	"my-relly-go/memcmpable"
+
+	"golang.org/x/xerrors"
 )
 
+var (
+	ErrIndexNotFound      = xerrors.New("index not found")
+	ErrDuplicateIndexName = xerrors.New("duplicate index name")
+	ErrInvalidNullable    = xerrors.New("invalid nullable flags")
+	ErrNullableKey        = xerrors.New("primary key column cannot be nullable")
+	ErrNullValue          = xerrors.New("null value in non-nullable column")
+	ErrLegacyHeapFile     = xerrors.New("heap file has tuples in an old format; open it with OpenCatalog to migrate")
+)
+
+// NULLを加える前のバージョンのファイルは、OpenCatalogで移行するまでテーブルとして読み書きしない
+func checkHeapFileVersion(bufmgr *buffer.BufferPoolManager) error {
+	if bufmgr.DiskManager().Version() < disk.HEAP_FILE_VERSION_NULL {
+		return ErrLegacyHeapFile
+	}
+	return nil
+}
+
 type SimpleTable struct {
 	MetaPageId  disk.PageId
 	NumKeyElems int
 }
 
 func (t *SimpleTable) Create(bufmgr *buffer.BufferPoolManager) error {
+	if err := checkHeapFileVersion(bufmgr); err != nil {
+		return err
+	}
 	tree, err := btree.CreateBTree(bufmgr)
 	if err != nil {
 		return err
@@ -31,54 +58,385 @@ func (t *SimpleTable) Insert(bufmgr *buffer.BufferPoolManager, record [][]byte)
 }
 
 type Table struct {
+	Name          string
 	MetaPageId    disk.PageId
 	NumCols       int
 	NumKeyElems   int
 	ColNames      []string
+	ColTypes      []ColType // 空ならすべてCOL_TYPE_BYTES
+	Nullable      []bool    // 空ならすべてNOT NULL
 	UniqueIndices []UniqueIndex
+	// 値が重複してもよいインデックス
+	SecondaryIndices []SecondaryIndex
 }
 
 func (t *Table) Create(bufmgr *buffer.BufferPoolManager) error {
-	tree, err := btree.CreateBTree(bufmgr)
-	if err != nil {
+	if err := checkHeapFileVersion(bufmgr); err != nil {
 		return err
 	}
-	t.MetaPageId = tree.MetaPageId
+	if len(t.ColTypes) != 0 && len(t.ColTypes) != t.NumCols {
+		return ErrInvalidColType
+	}
+	for _, colType := range t.ColTypes {
+		if !colType.valid() {
+			return ErrInvalidColType
+		}
+	}
+	if len(t.Nullable) != 0 && len(t.Nullable) != t.NumCols {
+		return ErrInvalidNullable
+	}
+	for col := 0; col < t.NumKeyElems; col++ {
+		if t.IsNullable(col) {
+			return ErrNullableKey
+		}
+	}
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		tree, err := btree.CreateBTree(bufmgr)
+		if err != nil {
+			return err
+		}
+		t.MetaPageId = tree.MetaPageId
+
+		names := map[string]bool{}
+		for i := range t.UniqueIndices {
+			if t.UniqueIndices[i].Name == "" {
+				t.UniqueIndices[i].Name = defaultIndexName(t.ColNames, t.UniqueIndices[i].SKey)
+			}
+			if names[t.UniqueIndices[i].Name] {
+				return ErrDuplicateIndexName
+			}
+			names[t.UniqueIndices[i].Name] = true
+			if err := t.UniqueIndices[i].Create(bufmgr); err != nil {
+				return err
+			}
+		}
+		for i := range t.SecondaryIndices {
+			if t.SecondaryIndices[i].Name == "" {
+				t.SecondaryIndices[i].Name = defaultIndexName(t.ColNames, t.SecondaryIndices[i].SKey)
+			}
+			if names[t.SecondaryIndices[i].Name] {
+				return ErrDuplicateIndexName
+			}
+			names[t.SecondaryIndices[i].Name] = true
+			if err := t.SecondaryIndices[i].Create(bufmgr); err != nil {
+				return err
+			}
+		}
+		return tree.WriteMetaAppArea(bufmgr, t.toMeta().ToBytes())
+	})
+}
+
+// テーブルとすべてのインデックスのページを解放する
+// 解放したテーブルはもう使えない
+func (t *Table) Drop(bufmgr *buffer.BufferPoolManager) error {
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		for _, uniqueIndex := range t.UniqueIndices {
+			if err := btree.NewBTree(uniqueIndex.MetaPageId).Drop(bufmgr); err != nil {
+				return err
+			}
+		}
+		for _, secondaryIndex := range t.SecondaryIndices {
+			if err := btree.NewBTree(secondaryIndex.MetaPageId).Drop(bufmgr); err != nil {
+				return err
+			}
+		}
+		return btree.NewBTree(t.MetaPageId).Drop(bufmgr)
+	})
+}
 
+// テーブルとインデックスのキーと値を、NULLを加える前の形式から今の形式に書き換える
+func (t *Table) migrate(bufmgr *buffer.BufferPoolManager) error {
+	metaPageIds := []disk.PageId{t.MetaPageId}
+	for _, uniqueIndex := range t.UniqueIndices {
+		metaPageIds = append(metaPageIds, uniqueIndex.MetaPageId)
+	}
+	for _, secondaryIndex := range t.SecondaryIndices {
+		metaPageIds = append(metaPageIds, secondaryIndex.MetaPageId)
+	}
+	for _, metaPageId := range metaPageIds {
+		if err := btree.NewBTree(metaPageId).RewritePairs(bufmgr, memcmpable.MigrateLegacy, memcmpable.MigrateLegacy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// メタページに保存された定義からテーブルを復元する
+// 古いバージョンのファイルのタプルは移行しないので、ErrLegacyHeapFileを返す。カタログから開くこと
+func LoadTable(bufmgr *buffer.BufferPoolManager, metaPageId disk.PageId) (*Table, error) {
+	if err := checkHeapFileVersion(bufmgr); err != nil {
+		return nil, err
+	}
+	tree := btree.NewBTree(metaPageId)
+	buf, err := tree.ReadMetaAppArea(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	return newTableFromMeta(metaPageId, NewMetaFromBytes(buf)), nil
+}
+
+func newTableFromMeta(metaPageId disk.PageId, meta *Meta) *Table {
+	t := &Table{
+		Name:        meta.Name,
+		MetaPageId:  metaPageId,
+		NumCols:     int(meta.NumCols),
+		NumKeyElems: int(meta.NumKeyElems),
+		ColNames:    meta.ColNames,
+	}
+	if meta.Version >= META_VERSION_COL_TYPES {
+		for _, colType := range meta.ColTypes {
+			t.ColTypes = append(t.ColTypes, ColType(colType))
+		}
+	}
+	if meta.Version >= META_VERSION_NULLABLE {
+		t.Nullable = meta.Nullable
+	}
+	indexMetaPageIds := meta.IndexMetaPageIds(metaPageId)
+	for i, skey := range meta.GetUniqueIndices() {
+		name := defaultIndexName(t.ColNames, skey)
+		if meta.Version >= META_VERSION_CATALOG {
+			name = meta.UniqueIndexNames[i]
+		}
+		switch meta.IndexKind(i) {
+		case INDEX_KIND_SECONDARY:
+			t.SecondaryIndices = append(t.SecondaryIndices, SecondaryIndex{
+				Name:       name,
+				MetaPageId: indexMetaPageIds[i],
+				SKey:       skey,
+			})
+		default:
+			t.UniqueIndices = append(t.UniqueIndices, UniqueIndex{
+				Name:       name,
+				MetaPageId: indexMetaPageIds[i],
+				SKey:       skey,
+			})
+		}
+	}
+	return t
+}
+
+func (t *Table) toMeta() *Meta {
 	meta := NewMeta()
+	meta.Name = t.Name
+	meta.MetaPageId = uint64(t.MetaPageId)
 	meta.NumCols = int32(t.NumCols)
 	meta.NumKeyElems = int32(t.NumKeyElems)
 	meta.ColNames = t.ColNames
-	for i := range t.UniqueIndices {
-		t.UniqueIndices[i].Create(bufmgr)
-		meta.AddUniqueIndices(t.UniqueIndices[i].SKey)
+	for _, colType := range t.ColTypes {
+		meta.ColTypes = append(meta.ColTypes, int32(colType))
+	}
+	meta.Nullable = t.Nullable
+	for _, uniqueIndex := range t.UniqueIndices {
+		meta.AddUniqueIndices(uniqueIndex.SKey)
+		meta.UniqueIndexMetaPageIds = append(meta.UniqueIndexMetaPageIds, uint64(uniqueIndex.MetaPageId))
+		meta.UniqueIndexNames = append(meta.UniqueIndexNames, uniqueIndex.Name)
+		meta.IndexKinds = append(meta.IndexKinds, int32(INDEX_KIND_UNIQUE))
+	}
+	for _, secondaryIndex := range t.SecondaryIndices {
+		meta.AddUniqueIndices(secondaryIndex.SKey)
+		meta.UniqueIndexMetaPageIds = append(meta.UniqueIndexMetaPageIds, uint64(secondaryIndex.MetaPageId))
+		meta.UniqueIndexNames = append(meta.UniqueIndexNames, secondaryIndex.Name)
+		meta.IndexKinds = append(meta.IndexKinds, int32(INDEX_KIND_SECONDARY))
 	}
+	return meta
+}
 
-	buf := meta.ToBytes()
-	err = tree.WriteMetaAppArea(bufmgr, buf)
-	if err != nil {
-		return err
+// 名前のないインデックスは、カラム名をつないだ名前にする
+func defaultIndexName(colNames []string, skey []int) string {
+	names := []string{}
+	for _, col := range skey {
+		if col < len(colNames) {
+			names = append(names, colNames[col])
+		} else {
+			names = append(names, strconv.Itoa(col))
+		}
+	}
+	return strings.Join(names, "_")
+}
+
+func (t *Table) ColType(col int) ColType {
+	if col < len(t.ColTypes) {
+		return t.ColTypes[col]
+	}
+	return COL_TYPE_BYTES
+}
+
+func (t *Table) IsNullable(col int) bool {
+	return col < len(t.Nullable) && t.Nullable[col]
+}
+
+// Goの値のレコードを、カラムの型で符号化する
+// nilはNULLになる
+func (t *Table) EncodeRecord(values []interface{}) ([][]byte, error) {
+	if len(values) != t.NumCols {
+		return nil, ErrInvalidValue
+	}
+	record := make([][]byte, len(values))
+	for col, v := range values {
+		buf, err := EncodeValue(t.ColType(col), v)
+		if err != nil {
+			return nil, xerrors.Errorf("column %d: %w", col, err)
+		}
+		record[col] = buf
+	}
+	return record, nil
+}
+
+func (t *Table) DecodeRecord(record [][]byte) ([]interface{}, error) {
+	values := make([]interface{}, len(record))
+	for col, buf := range record {
+		v, err := DecodeValue(t.ColType(col), buf)
+		if err != nil {
+			return nil, xerrors.Errorf("column %d: %w", col, err)
+		}
+		values[col] = v
+	}
+	return values, nil
+}
+
+// NOT NULLのカラムにNULLが、型のあるカラムにその型として正しくない値が入らないようにする
+func (t *Table) validateRecord(record [][]byte) error {
+	for col := 0; col < len(record); col++ {
+		if record[col] == nil {
+			if !t.IsNullable(col) {
+				return xerrors.Errorf("column %d: %w", col, ErrNullValue)
+			}
+			continue
+		}
+		if err := validateValue(t.ColType(col), record[col]); err != nil {
+			return xerrors.Errorf("column %d: %w", col, err)
+		}
 	}
 	return nil
 }
 
+func (t *Table) UniqueIndex(name string) (*UniqueIndex, error) {
+	for i := range t.UniqueIndices {
+		if t.UniqueIndices[i].Name == name {
+			return &t.UniqueIndices[i], nil
+		}
+	}
+	return nil, ErrIndexNotFound
+}
+
+func (t *Table) SecondaryIndex(name string) (*SecondaryIndex, error) {
+	for i := range t.SecondaryIndices {
+		if t.SecondaryIndices[i].Name == name {
+			return &t.SecondaryIndices[i], nil
+		}
+	}
+	return nil, ErrIndexNotFound
+}
+
+// プライマリキーとすべてのインデックスへの挿入を1つのトランザクションで行う
+// いずれかが失敗した場合は、それまでの挿入も取り消す
 func (t *Table) Insert(bufmgr *buffer.BufferPoolManager, record [][]byte) error {
-	tree := btree.NewBTree(t.MetaPageId)
-	key := EncodeTuple(record[:t.NumKeyElems])
-	value := EncodeTuple(record[t.NumKeyElems:])
-	if err := tree.Insert(bufmgr, key, value); err != nil {
+	if err := t.validateRecord(record); err != nil {
 		return err
 	}
-	for _, uniqueIndex := range t.UniqueIndices {
-		err := uniqueIndex.Insert(bufmgr, key, record)
-		if err != nil {
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		tree := btree.NewBTree(t.MetaPageId)
+		key := EncodeTuple(record[:t.NumKeyElems])
+		value := EncodeTuple(record[t.NumKeyElems:])
+		if err := tree.Insert(bufmgr, key, value); err != nil {
+			return err
+		}
+		for _, uniqueIndex := range t.UniqueIndices {
+			err := uniqueIndex.Insert(bufmgr, key, record)
+			if err != nil {
+				return err
+			}
+		}
+		for _, secondaryIndex := range t.SecondaryIndices {
+			if err := secondaryIndex.Insert(bufmgr, key, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (t *Table) Delete(bufmgr *buffer.BufferPoolManager, record [][]byte) error {
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		tree := btree.NewBTree(t.MetaPageId)
+		key := EncodeTuple(record[:t.NumKeyElems])
+		if err := tree.Delete(bufmgr, key); err != nil {
 			return err
 		}
+		for _, uniqueIndex := range t.UniqueIndices {
+			if err := uniqueIndex.Delete(bufmgr, key, record); err != nil {
+				return err
+			}
+		}
+		for _, secondaryIndex := range t.SecondaryIndices {
+			if err := secondaryIndex.Delete(bufmgr, key, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// oldRecordをnewRecordに書き換える
+// プライマリキーやセカンダリキーが変わる場合は、削除してから挿入し直す
+func (t *Table) Update(bufmgr *buffer.BufferPoolManager, oldRecord [][]byte, newRecord [][]byte) error {
+	if err := t.validateRecord(newRecord); err != nil {
+		return err
 	}
-	return nil
+	return bufmgr.Transaction(func(bufmgr *buffer.BufferPoolManager) error {
+		tree := btree.NewBTree(t.MetaPageId)
+		oldKey := EncodeTuple(oldRecord[:t.NumKeyElems])
+		newKey := EncodeTuple(newRecord[:t.NumKeyElems])
+		value := EncodeTuple(newRecord[t.NumKeyElems:])
+		if bytes.Equal(oldKey, newKey) {
+			if err := tree.Update(bufmgr, newKey, value); err != nil {
+				return err
+			}
+		} else {
+			if err := tree.Delete(bufmgr, oldKey); err != nil {
+				return err
+			}
+			if err := tree.Insert(bufmgr, newKey, value); err != nil {
+				return err
+			}
+		}
+
+		for _, uniqueIndex := range t.UniqueIndices {
+			if bytes.Equal(uniqueIndex.encodeSKey(oldKey, oldRecord), uniqueIndex.encodeSKey(newKey, newRecord)) {
+				if bytes.Equal(oldKey, newKey) {
+					continue
+				}
+				if err := uniqueIndex.update(bufmgr, newKey, newRecord); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := uniqueIndex.Delete(bufmgr, oldKey, oldRecord); err != nil {
+				return err
+			}
+			if err := uniqueIndex.Insert(bufmgr, newKey, newRecord); err != nil {
+				return err
+			}
+		}
+
+		// キーにプライマリキーを含むので、どちらかが変わったら入れ直す
+		for _, secondaryIndex := range t.SecondaryIndices {
+			if bytes.Equal(secondaryIndex.encodeSKey(oldKey, oldRecord), secondaryIndex.encodeSKey(newKey, newRecord)) {
+				continue
+			}
+			if err := secondaryIndex.Delete(bufmgr, oldKey, oldRecord); err != nil {
+				return err
+			}
+			if err := secondaryIndex.Insert(bufmgr, newKey, newRecord); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 type UniqueIndex struct {
+	Name       string
 	MetaPageId disk.PageId
 	SKey       []int
 }
@@ -94,15 +452,85 @@ func (idx *UniqueIndex) Create(bufmgr *buffer.BufferPoolManager) error {
 
 func (idx *UniqueIndex) Insert(bufmgr *buffer.BufferPoolManager, pkey []byte, record [][]byte) error {
 	tree := btree.NewBTree(idx.MetaPageId)
+	skey := idx.encodeSKey(pkey, record)
+	if err := tree.Insert(bufmgr, skey, pkey); err != nil {
+		return err
+	}
+	return nil
+}
 
+func (idx *UniqueIndex) Delete(bufmgr *buffer.BufferPoolManager, pkey []byte, record [][]byte) error {
+	tree := btree.NewBTree(idx.MetaPageId)
+	skey := idx.encodeSKey(pkey, record)
+	if err := tree.Delete(bufmgr, skey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// セカンダリキーはそのままで、指す先のプライマリキーを書き換える
+func (idx *UniqueIndex) update(bufmgr *buffer.BufferPoolManager, pkey []byte, record [][]byte) error {
+	tree := btree.NewBTree(idx.MetaPageId)
+	skey := idx.encodeSKey(pkey, record)
+	if err := tree.Update(bufmgr, skey, pkey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SQLと同じく、NULLを含むセカンダリキーは重複してもよい
+// NULLを含む場合はプライマリキーを後ろに付けて、別のキーにする
+func (idx *UniqueIndex) encodeSKey(pkey []byte, record [][]byte) []byte {
 	skeyElems := [][]byte{}
 	for _, k := range idx.SKey {
 		skeyElems = append(skeyElems, record[k])
 	}
 	skey := EncodeTuple(skeyElems)
+	if hasNull(skeyElems) {
+		skey = append(skey, pkey...)
+	}
+	return skey
+}
+
+// 値が重複してもよいインデックス
+// セカンダリキーの後ろにプライマリキーを付けてキーを一意にし、値にもプライマリキーを持つ
+type SecondaryIndex struct {
+	Name       string
+	MetaPageId disk.PageId
+	SKey       []int
+}
 
+func (idx *SecondaryIndex) Create(bufmgr *buffer.BufferPoolManager) error {
+	tree, err := btree.CreateBTree(bufmgr)
+	if err != nil {
+		return err
+	}
+	idx.MetaPageId = tree.MetaPageId
+	return nil
+}
+
+func (idx *SecondaryIndex) Insert(bufmgr *buffer.BufferPoolManager, pkey []byte, record [][]byte) error {
+	tree := btree.NewBTree(idx.MetaPageId)
+	skey := idx.encodeSKey(pkey, record)
 	if err := tree.Insert(bufmgr, skey, pkey); err != nil {
 		return err
 	}
 	return nil
 }
+
+func (idx *SecondaryIndex) Delete(bufmgr *buffer.BufferPoolManager, pkey []byte, record [][]byte) error {
+	tree := btree.NewBTree(idx.MetaPageId)
+	skey := idx.encodeSKey(pkey, record)
+	if err := tree.Delete(bufmgr, skey); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (idx *SecondaryIndex) encodeSKey(pkey []byte, record [][]byte) []byte {
+	skeyElems := [][]byte{}
+	for _, k := range idx.SKey {
+		skeyElems = append(skeyElems, record[k])
+	}
+	return append(EncodeTuple(skeyElems), pkey...)
+}
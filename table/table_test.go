@@ -0,0 +1,398 @@
+package table
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"my-relly-go/btree"
+	"my-relly-go/buffer"
+	"my-relly-go/disk"
+
+	"golang.org/x/xerrors"
+)
+
+func TestTable(t *testing.T) {
+	createBufferPoolManager := func() (*buffer.BufferPoolManager, func()) {
+		file, err := ioutil.TempFile("", "TestTable")
+		if err != nil {
+			panic(err)
+		}
+		diskManager, err := disk.CreateDiskManager(file.Name())
+		if err != nil {
+			panic(err)
+		}
+		pool := buffer.NewBufferPool(10)
+		return buffer.NewBufferPoolManager(diskManager, pool), func() {
+			if err := diskManager.Close(); err != nil {
+				panic(err)
+			}
+			if err := file.Close(); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(file.Name()); err != nil {
+				panic(err)
+			}
+			if err := os.Remove(disk.WalFilePath(file.Name())); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	countRecords := func(bufmgr *buffer.BufferPoolManager, metaPageId disk.PageId) int {
+		iter, err := btree.NewBTree(metaPageId).Search(bufmgr, &btree.SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		defer iter.Finish(bufmgr)
+
+		n := 0
+		for {
+			_, _, err := iter.Next(bufmgr)
+			if err == btree.ErrEndOfIterator {
+				return n
+			}
+			if err != nil {
+				panic(err)
+			}
+			n++
+		}
+	}
+
+	createTable := func(bufmgr *buffer.BufferPoolManager) *Table {
+		tbl := &Table{
+			NumCols:     3,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "first_name", "last_name"},
+			UniqueIndices: []UniqueIndex{
+				{SKey: []int{2}},
+			},
+		}
+		if err := tbl.Create(bufmgr); err != nil {
+			panic(err)
+		}
+		return tbl
+	}
+
+	t.Run("Insert: ユニークインデックスが重複", func(t *testing.T) {
+		bufmgr, cleanup := createBufferPoolManager()
+		defer cleanup()
+		tbl := createTable(bufmgr)
+
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("z"), []byte("Alice"), []byte("Smith")}); err != nil {
+			panic(err)
+		}
+		// プライマリキーへの挿入も取り消される
+		err := tbl.Insert(bufmgr, [][]byte{[]byte("x"), []byte("Bob"), []byte("Smith")})
+		if err != btree.ErrDuplicateKey {
+			t.Fatalf("tbl.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if n := countRecords(bufmgr, tbl.MetaPageId); n != 1 {
+			t.Fatalf("countRecords() = %v, want 1", n)
+		}
+		if n := countRecords(bufmgr, tbl.UniqueIndices[0].MetaPageId); n != 1 {
+			t.Fatalf("countRecords() = %v, want 1", n)
+		}
+	})
+
+	t.Run("Begin/Rollback", func(t *testing.T) {
+		bufmgr, cleanup := createBufferPoolManager()
+		defer cleanup()
+		tbl := createTable(bufmgr)
+
+		tx, err := bufmgr.Begin()
+		if err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(tx, [][]byte{[]byte("z"), []byte("Alice"), []byte("Smith")}); err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(tx, [][]byte{[]byte("y"), []byte("Bob"), []byte("Johnson")}); err != nil {
+			panic(err)
+		}
+		// 失敗した挿入だけが取り消され、トランザクションは続けられる
+		if err := tbl.Insert(tx, [][]byte{[]byte("x"), []byte("Charlie"), []byte("Smith")}); err != btree.ErrDuplicateKey {
+			t.Fatalf("tbl.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if n := countRecords(tx, tbl.MetaPageId); n != 2 {
+			t.Fatalf("countRecords() = %v, want 2", n)
+		}
+		if err := tx.Rollback(); err != nil {
+			panic(err)
+		}
+		if n := countRecords(bufmgr, tbl.MetaPageId); n != 0 {
+			t.Fatalf("countRecords() = %v, want 0", n)
+		}
+		if n := countRecords(bufmgr, tbl.UniqueIndices[0].MetaPageId); n != 0 {
+			t.Fatalf("countRecords() = %v, want 0", n)
+		}
+	})
+	t.Run("Update/Delete", func(t *testing.T) {
+		bufmgr, cleanup := createBufferPoolManager()
+		defer cleanup()
+		created := createTable(bufmgr)
+
+		tbl, err := LoadTable(bufmgr, created.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if tbl.UniqueIndices[0].MetaPageId != created.UniqueIndices[0].MetaPageId {
+			t.Fatalf("LoadTable() index = %v, want %v", tbl.UniqueIndices[0].MetaPageId, created.UniqueIndices[0].MetaPageId)
+		}
+
+		alice := [][]byte{[]byte("z"), []byte("Alice"), []byte("Smith")}
+		bob := [][]byte{[]byte("y"), []byte("Bob"), []byte("Johnson")}
+		for _, record := range [][][]byte{alice, bob} {
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		findByLastName := func(lastName string) []byte {
+			iter, err := btree.NewBTree(tbl.UniqueIndices[0].MetaPageId).Search(bufmgr, &btree.SearchModeKey{Key: EncodeTuple([][]byte{[]byte(lastName)})})
+			if err != nil {
+				panic(err)
+			}
+			defer iter.Finish(bufmgr)
+			skey, pkey, err := iter.Get(bufmgr)
+			if err != nil || !bytes.Equal(skey, EncodeTuple([][]byte{[]byte(lastName)})) {
+				return nil
+			}
+			return pkey
+		}
+
+		// セカンダリキーが重複する更新は取り消される
+		if err := tbl.Update(bufmgr, bob, [][]byte{[]byte("y"), []byte("Bob"), []byte("Smith")}); err != btree.ErrDuplicateKey {
+			t.Fatalf("tbl.Update() = %v, want ErrDuplicateKey", err)
+		}
+		if pkey := findByLastName("Johnson"); !bytes.Equal(pkey, EncodeTuple(bob[:1])) {
+			t.Fatalf("findByLastName() = %v, want %v", pkey, EncodeTuple(bob[:1]))
+		}
+
+		// プライマリキーとセカンダリキーを変更する
+		bob2 := [][]byte{[]byte("x"), []byte("Bob"), []byte("Jones")}
+		if err := tbl.Update(bufmgr, bob, bob2); err != nil {
+			panic(err)
+		}
+		if pkey := findByLastName("Johnson"); pkey != nil {
+			t.Fatalf("findByLastName() = %v, want nil", pkey)
+		}
+		if pkey := findByLastName("Jones"); !bytes.Equal(pkey, EncodeTuple(bob2[:1])) {
+			t.Fatalf("findByLastName() = %v, want %v", pkey, EncodeTuple(bob2[:1]))
+		}
+
+		// プライマリキーだけを変更すると、インデックスの指す先も変わる
+		alice2 := [][]byte{[]byte("w"), []byte("Alice"), []byte("Smith")}
+		if err := tbl.Update(bufmgr, alice, alice2); err != nil {
+			panic(err)
+		}
+		if pkey := findByLastName("Smith"); !bytes.Equal(pkey, EncodeTuple(alice2[:1])) {
+			t.Fatalf("findByLastName() = %v, want %v", pkey, EncodeTuple(alice2[:1]))
+		}
+
+		if err := tbl.Delete(bufmgr, alice2); err != nil {
+			panic(err)
+		}
+		if err := tbl.Delete(bufmgr, alice2); err != btree.ErrKeyNotFound {
+			t.Fatalf("tbl.Delete() = %v, want ErrKeyNotFound", err)
+		}
+		if n := countRecords(bufmgr, tbl.MetaPageId); n != 1 {
+			t.Fatalf("countRecords() = %v, want 1", n)
+		}
+		if n := countRecords(bufmgr, tbl.UniqueIndices[0].MetaPageId); n != 1 {
+			t.Fatalf("countRecords() = %v, want 1", n)
+		}
+	})
+
+	t.Run("型のあるカラム", func(t *testing.T) {
+		bufmgr, cleanup := createBufferPoolManager()
+		defer cleanup()
+
+		tbl := &Table{
+			NumCols:     3,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "name", "score"},
+			ColTypes:    []ColType{COL_TYPE_INT64, COL_TYPE_STRING},
+		}
+		if err := tbl.Create(bufmgr); err != ErrInvalidColType {
+			t.Fatalf("tbl.Create() = %v, want ErrInvalidColType", err)
+		}
+		tbl.ColTypes = []ColType{COL_TYPE_INT64, COL_TYPE_STRING, COL_TYPE_FLOAT64}
+		if err := tbl.Create(bufmgr); err != nil {
+			panic(err)
+		}
+
+		record, err := tbl.EncodeRecord([]interface{}{-1, "Alice", 72.5})
+		if err != nil {
+			panic(err)
+		}
+		if err := tbl.Insert(bufmgr, record); err != nil {
+			panic(err)
+		}
+		if _, err := tbl.EncodeRecord([]interface{}{"x", "Bob", 80.0}); !xerrors.Is(err, ErrInvalidValue) {
+			t.Fatalf("tbl.EncodeRecord() = %v, want ErrInvalidValue", err)
+		}
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("x"), []byte("Bob"), record[2]}); !xerrors.Is(err, ErrInvalidValue) {
+			t.Fatalf("tbl.Insert() = %v, want ErrInvalidValue", err)
+		}
+
+		loaded, err := LoadTable(bufmgr, tbl.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(loaded.ColTypes, tbl.ColTypes) {
+			t.Fatalf("LoadTable() ColTypes = %v, want %v", loaded.ColTypes, tbl.ColTypes)
+		}
+		values, err := loaded.DecodeRecord(record)
+		if err != nil {
+			panic(err)
+		}
+		if expect := []interface{}{int64(-1), "Alice", 72.5}; !reflect.DeepEqual(values, expect) {
+			t.Fatalf("loaded.DecodeRecord() = %v, want %v", values, expect)
+		}
+	})
+
+	t.Run("NULL", func(t *testing.T) {
+		bufmgr, cleanup := createBufferPoolManager()
+		defer cleanup()
+
+		tbl := &Table{
+			NumCols:     3,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "first_name", "email"},
+			Nullable:    []bool{true, false, true},
+			UniqueIndices: []UniqueIndex{
+				{SKey: []int{2}},
+			},
+		}
+		if err := tbl.Create(bufmgr); err != ErrNullableKey {
+			t.Fatalf("tbl.Create() = %v, want ErrNullableKey", err)
+		}
+		tbl.Nullable = []bool{false, false}
+		if err := tbl.Create(bufmgr); err != ErrInvalidNullable {
+			t.Fatalf("tbl.Create() = %v, want ErrInvalidNullable", err)
+		}
+		tbl.Nullable = []bool{false, false, true}
+		if err := tbl.Create(bufmgr); err != nil {
+			panic(err)
+		}
+
+		alice := [][]byte{[]byte("z"), []byte("Alice"), nil}
+		bob := [][]byte{[]byte("y"), []byte("Bob"), nil}
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("x"), nil, nil}); !xerrors.Is(err, ErrNullValue) {
+			t.Fatalf("tbl.Insert() = %v, want ErrNullValue", err)
+		}
+		// NULLはユニークインデックスで重複してもよいが、空文字列は重複できない
+		for _, record := range [][][]byte{alice, bob, {[]byte("x"), []byte("Charlie"), {}}} {
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		if err := tbl.Insert(bufmgr, [][]byte{[]byte("w"), []byte("Dave"), {}}); err != btree.ErrDuplicateKey {
+			t.Fatalf("tbl.Insert() = %v, want ErrDuplicateKey", err)
+		}
+		if n := countRecords(bufmgr, tbl.UniqueIndices[0].MetaPageId); n != 3 {
+			t.Fatalf("countRecords() = %v, want 3", n)
+		}
+
+		// NULLのままプライマリキーを変える、NULLから値にする
+		bob2 := [][]byte{[]byte("v"), []byte("Bob"), nil}
+		if err := tbl.Update(bufmgr, bob, bob2); err != nil {
+			panic(err)
+		}
+		alice2 := [][]byte{[]byte("z"), []byte("Alice"), []byte("alice@example.com")}
+		if err := tbl.Update(bufmgr, alice, alice2); err != nil {
+			panic(err)
+		}
+		if err := tbl.Delete(bufmgr, bob2); err != nil {
+			panic(err)
+		}
+		if n := countRecords(bufmgr, tbl.UniqueIndices[0].MetaPageId); n != 2 {
+			t.Fatalf("countRecords() = %v, want 2", n)
+		}
+
+		loaded, err := LoadTable(bufmgr, tbl.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(loaded.Nullable, tbl.Nullable) {
+			t.Fatalf("LoadTable() Nullable = %v, want %v", loaded.Nullable, tbl.Nullable)
+		}
+	})
+
+	t.Run("SecondaryIndex", func(t *testing.T) {
+		bufmgr, cleanup := createBufferPoolManager()
+		defer cleanup()
+
+		tbl := &Table{
+			NumCols:     3,
+			NumKeyElems: 1,
+			ColNames:    []string{"id", "first_name", "last_name"},
+			UniqueIndices: []UniqueIndex{
+				{SKey: []int{1}},
+			},
+			SecondaryIndices: []SecondaryIndex{
+				{SKey: []int{2}},
+			},
+		}
+		if err := tbl.Create(bufmgr); err != nil {
+			panic(err)
+		}
+
+		// 同じ姓の行を何件でも挿入できる
+		alice := [][]byte{[]byte("z"), []byte("Alice"), []byte("Smith")}
+		bob := [][]byte{[]byte("y"), []byte("Bob"), []byte("Smith")}
+		charlie := [][]byte{[]byte("x"), []byte("Charlie"), []byte("Smith")}
+		for _, record := range [][][]byte{alice, bob, charlie} {
+			if err := tbl.Insert(bufmgr, record); err != nil {
+				panic(err)
+			}
+		}
+		if n := countRecords(bufmgr, tbl.SecondaryIndices[0].MetaPageId); n != 3 {
+			t.Fatalf("countRecords() = %v, want 3", n)
+		}
+
+		// プライマリキーだけ変えても、インデックスが指す先が変わる
+		bob2 := [][]byte{[]byte("w"), []byte("Bob"), []byte("Smith")}
+		if err := tbl.Update(bufmgr, bob, bob2); err != nil {
+			panic(err)
+		}
+		if err := tbl.Delete(bufmgr, charlie); err != nil {
+			panic(err)
+		}
+		iter, err := btree.NewBTree(tbl.SecondaryIndices[0].MetaPageId).Search(bufmgr, &btree.SearchModeStart{})
+		if err != nil {
+			panic(err)
+		}
+		pkeys := [][]byte{}
+		for {
+			_, pkey, err := iter.Next(bufmgr)
+			if err == btree.ErrEndOfIterator {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			pkeys = append(pkeys, DecodeTuple(pkey, [][]byte{})[0])
+		}
+		iter.Finish(bufmgr)
+		if expect := [][]byte{[]byte("w"), []byte("z")}; !reflect.DeepEqual(pkeys, expect) {
+			t.Fatalf("pkeys = %q, want %q", pkeys, expect)
+		}
+
+		loaded, err := LoadTable(bufmgr, tbl.MetaPageId)
+		if err != nil {
+			panic(err)
+		}
+		if !reflect.DeepEqual(loaded, tbl) {
+			t.Fatalf("LoadTable() = %v, want %v", loaded, tbl)
+		}
+		if _, err := loaded.SecondaryIndex("last_name"); err != nil {
+			t.Fatalf("loaded.SecondaryIndex() = %v", err)
+		}
+		if _, err := loaded.UniqueIndex("last_name"); err != ErrIndexNotFound {
+			t.Fatalf("loaded.UniqueIndex() = %v, want ErrIndexNotFound", err)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package table
 
 import "my-relly-go/memcmpable"
 
+// nilの要素はNULLとして符号化する
 func EncodeTuple(elems [][]byte) []byte {
 	encSize := 0
 	for _, elem := range elems {
@@ -9,6 +10,10 @@ func EncodeTuple(elems [][]byte) []byte {
 	}
 	bytes := make([]byte, 0, encSize)
 	for _, elem := range elems {
+		if elem == nil {
+			bytes = memcmpable.EncodeNull(bytes)
+			continue
+		}
 		bytes = memcmpable.Encode(elem, bytes)
 	}
 	return bytes
@@ -23,3 +28,12 @@ func DecodeTuple(bytes []byte, elems [][]byte) [][]byte {
 	}
 	return elems
 }
+
+func hasNull(elems [][]byte) bool {
+	for _, elem := range elems {
+		if elem == nil {
+			return true
+		}
+	}
+	return false
+}
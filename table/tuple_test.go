@@ -19,4 +19,11 @@ func TestTuple(t *testing.T) {
 			t.Fatalf("Decode() = %v, want %v", r, org)
 		}
 	}
+
+	// NULLと空のバイト列は区別される
+	withNull := [][]byte{[]byte("a"), nil, {}}
+	elems = DecodeTuple(EncodeTuple(withNull), [][]byte{})
+	if len(elems) != 3 || elems[1] != nil || elems[2] == nil || len(elems[2]) != 0 {
+		t.Fatalf("DecodeTuple() = %#v, want %#v", elems, withNull)
+	}
 }